@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	errCancelled      = errors.New("command cancelled")
+	errCancelledEarly = errors.New("command cancelled before it started")
+)
+
+// earlyCancelTTL is how long a cancel for a command that has not started is
+// kept. A command the agent never got, or already finished, would otherwise
+// be remembered forever.
+const earlyCancelTTL = time.Hour
+
+// cancellations lets a CMD_CANCEL reach the command it targets. Commands run
+// one at a time, so there is at most one to stop; a command cancelled before
+// it starts is remembered for earlyCancelTTL and refused when its turn comes.
+type cancellations struct {
+	mu      sync.Mutex
+	running string
+	cancel  context.CancelCauseFunc
+	early   map[string]time.Time
+}
+
+func newCancellations() *cancellations {
+	return &cancellations{early: make(map[string]time.Time)}
+}
+
+// Start returns the context a command runs under, bounded by its timeout in
+// seconds if it has one, and the func to call once it has finished. It
+// fails with errCancelledEarly if the command was cancelled while queued.
+func (c *cancellations) Start(parent context.Context, id string, timeout int) (context.Context, func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(time.Now())
+	if _, ok := c.early[id]; ok {
+		delete(c.early, id)
+		return nil, nil, errCancelledEarly
+	}
+
+	ctx, cancel := context.WithCancelCause(parent)
+	runCtx, stopTimeout := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		limit := time.Duration(timeout) * time.Second
+		runCtx, stopTimeout = context.WithTimeoutCause(ctx, limit, fmt.Errorf("command timed out after %v", limit))
+	}
+	c.running, c.cancel = id, cancel
+
+	return runCtx, func() {
+		c.mu.Lock()
+		c.running, c.cancel = "", nil
+		c.mu.Unlock()
+		stopTimeout()
+		cancel(nil)
+	}, nil
+}
+
+// Cancel stops the command if it is running, or marks it to be refused if
+// it has not started, and reports whether it was running
+func (c *cancellations) Cancel(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running == id {
+		c.cancel(errCancelled)
+		return true
+	}
+	now := time.Now()
+	c.prune(now)
+	c.early[id] = now
+	return false
+}
+
+// prune forgets early cancels older than earlyCancelTTL; c.mu must be held
+func (c *cancellations) prune(now time.Time) {
+	for id, at := range c.early {
+		if now.Sub(at) > earlyCancelTTL {
+			delete(c.early, id)
+		}
+	}
+}
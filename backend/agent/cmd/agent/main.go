@@ -1,26 +1,46 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"math/rand/v2"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/netly/agent/config"
 	"github.com/netly/agent/internal/communicator"
 	"github.com/netly/agent/internal/executor"
+	"github.com/netly/agent/internal/identity"
+	"github.com/netly/agent/internal/journal"
+	"github.com/netly/agent/internal/manifest"
+	"github.com/netly/agent/internal/metrics"
+	"github.com/netly/agent/internal/network"
+	"github.com/netly/agent/internal/probe"
+	"github.com/netly/agent/internal/revisions"
+	"github.com/netly/agent/internal/singbox"
+	"github.com/netly/agent/internal/spool"
 	"github.com/netly/agent/internal/stats"
+	"github.com/netly/protocol"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-const (
-	Version = "0.1.0"
-)
+// Version is overridden at build time with -ldflags "-X main.Version=..."
+var Version = "0.1.0"
+
+const certCheckInterval = 6 * time.Hour
 
 func main() {
 	configPath := flag.String("config", "", "Path to config file")
+	dryRun := flag.Bool("dry-run", false, "Record what commands would change instead of changing anything")
+	dryRunJournal := flag.String("dry-run-journal", "netly-dry-run.jsonl", "Where --dry-run records planned actions")
 	flag.Parse()
 
 	// Load configuration
@@ -29,15 +49,40 @@ func main() {
 		panic("failed to load config: " + err.Error())
 	}
 
-	// Initialize logger
-	logger := initLogger(cfg.LogPath)
+	// Initialize logger; its level follows the live settings
+	level := zap.NewAtomicLevel()
+	logger := initLogger(cfg.LogPath, level)
 	defer logger.Sync()
+	live := newLiveSettings(cfg, level, probe.NewScheduler(logger), logger)
 
 	logger.Info("starting netly agent",
 		zap.String("version", Version),
 		zap.String("backend", cfg.BackendURL),
 	)
 
+	// The certificate is authoritative for who this node is; without one the
+	// token names the node
+	nodeID, _ := protocol.NodeIDFromToken(cfg.NodeToken)
+	var ident *identity.Identity
+	var clientTLS *tls.Config
+	if cfg.MTLSEnabled() {
+		ident, err = identity.Load(cfg.CAFile, cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			logger.Fatal("failed to load mTLS identity", zap.Error(err))
+		}
+		if ident.Recovered() {
+			logger.Warn("mTLS identity was half renewed, restored the previous certificate")
+		}
+		clientTLS = ident.ClientTLSConfig()
+		nodeID, _ = ident.NodeID()
+		logger.Info("mTLS identity loaded", zap.Uint("node_id", nodeID), zap.Time("not_after", ident.NotAfter()))
+	}
+
+	verifier, err := executor.NewVerifier(cfg.SigningPublicKey, nodeID)
+	if err != nil {
+		logger.Error("command verification unavailable, all commands will be refused", zap.Error(err))
+	}
+
 	// Initialize components
 	collector := stats.NewCollector()
     client := communicator.NewClient(communicator.ClientConfig{
@@ -45,42 +90,319 @@ func main() {
         NodeToken:  cfg.NodeToken,
         Version:    Version,
         Logger:     logger,
+        TLSConfig:  clientTLS,
     })
 	processor := executor.NewProcessor(logger)
+	var netRunner network.Runner = network.SudoRunner{}
+	registryPath, networkPath, journalPath, spoolPath, listenPort := cfg.SingBoxRegistryPath, cfg.NetworkStatePath, cfg.JournalPath, cfg.SpoolPath, cfg.ListenPort
+	manifestPath, revisionsDir := cfg.ManagedFilesPath, cfg.RevisionsDir
+	if *dryRun {
+		// A simulating agent keeps no state on disk besides its dry-run
+		// journal, never replaces itself and serves no control API
+		simulation := executor.NewDryRun(*dryRunJournal)
+		processor = executor.NewDryRunProcessor(logger, simulation)
+		netRunner = simulation.Commands()
+		registryPath, networkPath, journalPath, spoolPath, listenPort = "", "", "", "", 0
+		manifestPath, revisionsDir = "", ""
+		logger.Warn("dry run: commands are recorded, not applied", zap.String("journal", *dryRunJournal))
+	}
+
+	updater, err := executor.NewUpdater(executor.UpdaterConfig{
+		PublicKey:      cfg.SigningPublicKey,
+		CurrentVersion: Version,
+		GracePeriod:    cfg.UpdateGracePeriod,
+		Logger:         logger,
+	})
+	if err != nil {
+		logger.Warn("self-update key rejected, updates will be refused", zap.Error(err))
+	}
+	if !*dryRun {
+		processor.SetUpdater(updater)
+	}
+
+	// Composing from an empty registry would drop every fragment the node
+	// serves, so without it sing-box commands are refused
+	sbRegistry, err := singbox.Open(registryPath)
+	if err != nil {
+		logger.Error("sing-box registry unavailable, sing-box commands will be refused", zap.String("path", registryPath), zap.Error(err))
+	} else {
+		processor.SetSingBox(sbRegistry)
+	}
+
+	// Firewall and ip rules do not survive a reboot; put back what the
+	// interfaces on this node declared. Starting empty would hand out tables
+	// and rewrite chains that other interfaces still use, so without the
+	// state firewall syncs and routing changes are refused.
+	netManager, err := network.Open(networkPath, netRunner)
+	if err != nil {
+		logger.Error("network state unavailable, firewall and routing changes will be refused", zap.String("path", networkPath), zap.Error(err))
+	} else {
+		if netManager.Len() > 0 {
+			if err := netManager.Reconcile(); err != nil {
+				logger.Error("failed to restore network rules", zap.Error(err))
+			} else if backend, err := netManager.Backend(); err == nil {
+				logger.Info("network rules restored", zap.String("firewall", backend), zap.Int("owners", netManager.Len()))
+			}
+		}
+		processor.SetNetwork(netManager)
+	}
+
+	managed, err := manifest.Open(manifestPath)
+	if err != nil {
+		logger.Warn("managed file list unavailable, starting empty", zap.String("path", manifestPath), zap.Error(err))
+	}
+	processor.SetManifest(managed)
+
+	configRevisions, err := revisions.Open(revisionsDir, cfg.ConfigRevisions)
+	if err != nil {
+		logger.Warn("config revisions unavailable, starting empty", zap.String("dir", revisionsDir), zap.Error(err))
+	}
+	processor.SetRevisions(configRevisions)
+
+	// A broken journal must not stop the agent; it just loses replay protection
+	// for commands run before this start
+	cmdJournal, err := journal.Open(journalPath)
+	if err != nil {
+		logger.Warn("command journal unavailable, starting empty", zap.String("path", journalPath), zap.Error(err))
+	}
+
+	// Reports the backend could not take wait here until it is reachable
+	reportSpool, err := spool.Open(spoolPath, cfg.SpoolMaxEntries)
+	if err != nil {
+		logger.Warn("report spool unavailable, starting empty", zap.String("path", spoolPath), zap.Error(err))
+	}
+	if n := reportSpool.Len(); n > 0 {
+		logger.Info("undelivered reports found", zap.Int("count", n))
+	}
+
+	// Filled by heartbeats and commands, served on metrics_address
+	recorder := metrics.NewRecorder()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Commands from the push stream and from heartbeats share one queue so
+	// they always run one at a time, in arrival order. Cancellations skip
+	// the queue; they cannot wait behind the command they stop.
+	incoming := make(chan protocol.Command, 64)
+	commands := make(chan protocol.Command, 64)
+	cancels := newCancellations()
+	go routeCommands(ctx, logger, client, verifier, cmdJournal, reportSpool, live, cancels, incoming, commands)
+	go runCommands(ctx, logger, client, processor, verifier, cmdJournal, reportSpool, live, cancels, recorder, commands)
+
+	stream := client.NewStream()
+	go stream.Run(ctx, func(cmd protocol.Command) {
+		incoming <- cmd
+	})
+
+	if ident != nil {
+		go renewCertificate(ctx, logger, client, ident)
+	}
+	startedAt := time.Now()
+	var lastHeartbeat atomic.Int64
+	if listenPort != 0 || cfg.MetricsAddress != "" {
+		serverCfg := communicator.AgentServerConfig{
+			Address:  cfg.ListenAddress,
+			Port:     listenPort,
+			Verifier: verifier,
+			Status: func() protocol.AgentStatus {
+				hostname, _ := os.Hostname()
+				return protocol.AgentStatus{
+					NodeID:          nodeID,
+					Version:         Version,
+					ProtocolVersion: protocol.Version,
+					Hostname:        hostname,
+					StartedAt:       startedAt.Unix(),
+					LastHeartbeat:   lastHeartbeat.Load(),
+					CertNotAfter:    ident.NotAfter().Unix(),
+				}
+			},
+			Diagnostics: func() []protocol.DiagnosticCheck {
+				checks := []protocol.DiagnosticCheck{
+					heartbeatCheck(lastHeartbeat.Load(), live.HeartbeatInterval()),
+					certificateCheck(ident),
+				}
+				return append(checks, processor.Diagnostics()...)
+			},
+			Client:         client,
+			MetricsAddress: cfg.MetricsAddress,
+			MetricsToken:   cfg.MetricsToken,
+			Metrics:        recorder,
+			Logger:         logger,
+		}
+		// The control API needs the mTLS identity, the metrics listener does not
+		if listenPort != 0 {
+			serverCfg.TLSConfig = ident.ServerTLSConfig()
+		}
+		server := communicator.NewAgentServer(serverCfg)
+		if listenPort != 0 {
+			go func() {
+				if err := server.Start(); err != nil {
+					logger.Error("agent server stopped", zap.Error(err))
+				}
+			}()
+		}
+		if cfg.MetricsAddress != "" {
+			go func() {
+				if err := server.StartMetrics(); err != nil {
+					logger.Error("metrics listener stopped", zap.Error(err))
+				}
+			}()
+		}
+	}
 
-	// Setup graceful shutdown
+	// Setup graceful shutdown; SIGHUP reloads agent.yaml
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-
-	// Start heartbeat loop
-	ticker := time.NewTicker(cfg.HeartbeatInterval)
-	defer ticker.Stop()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
 	logger.Info("heartbeat loop started",
-		zap.Duration("interval", cfg.HeartbeatInterval),
+		zap.Duration("interval", live.HeartbeatInterval()),
+		zap.Duration("max_backoff", live.HeartbeatMaxBackoff()),
 	)
 
+	// Heartbeats back off exponentially while the backend is unreachable and
+	// the spool is flushed as soon as one gets through
+	confirmed := false
+	failures := 0
+	var lastDrift time.Time
+	heartbeat := func() {
+		// Digests only go up every drift interval; hashing is cheap, but the
+		// backend compares every file it is sent
+		var files []protocol.ManagedFile
+		if time.Since(lastDrift) >= live.DriftInterval() {
+			files = processor.ManagedFiles()
+		}
+		if !sendHeartbeat(logger, collector, processor, client, incoming, reportSpool, live, recorder, files, &lastHeartbeat) {
+			failures++
+			return
+		}
+		if files != nil {
+			lastDrift = time.Now()
+		}
+		if failures > 0 {
+			logger.Info("backend reachable again", zap.Int("failed_heartbeats", failures))
+		}
+		failures = 0
+		flushSpool(logger, client, reportSpool)
+		if !confirmed {
+			confirmed = confirmUpdate(logger, updater)
+		}
+	}
+
 	// Initial heartbeat
-	sendHeartbeat(logger, collector, client, processor)
+	heartbeat()
+	// The delay is recomputed every time, so an interval pushed by the
+	// backend or reloaded from agent.yaml applies from the next heartbeat
+	nextDelay := func() time.Duration {
+		return heartbeatDelay(live.HeartbeatInterval(), live.HeartbeatMaxBackoff(), failures)
+	}
+	timer := time.NewTimer(nextDelay())
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			sendHeartbeat(logger, collector, client, processor)
+		case <-timer.C:
+			heartbeat()
+			timer.Reset(nextDelay())
+
+		case <-reload:
+			if err := live.Reload(); err != nil {
+				logger.Error("config reload failed, keeping current settings", zap.Error(err))
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(nextDelay())
 
 		case sig := <-quit:
 			logger.Info("received shutdown signal", zap.String("signal", sig.String()))
 			logger.Info("agent stopped gracefully")
+			live.probes.Stop()
+			return
+		}
+	}
+}
+
+// renewCertificate keeps the mTLS certificate fresh, renewing it once a third
+// of its lifetime is left
+func renewCertificate(ctx context.Context, logger *zap.Logger, client *communicator.Client, ident *identity.Identity) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if ident.NeedsRenewal(time.Now()) {
+			if err := renewOnce(client, ident); err != nil {
+				logger.Warn("certificate renewal failed", zap.Error(err), zap.Time("not_after", ident.NotAfter()))
+			} else {
+				logger.Info("certificate renewed", zap.Time("not_after", ident.NotAfter()))
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func sendHeartbeat(logger *zap.Logger, collector *stats.Collector, client *communicator.Client, processor *executor.Processor) {
+func renewOnce(client *communicator.Client, ident *identity.Identity) error {
+	csr, key, err := ident.CreateCSR()
+	if err != nil {
+		return err
+	}
+	resp, err := client.RenewCertificate(csr)
+	if err != nil {
+		return err
+	}
+	return ident.Install(resp.Certificate, resp.CA, key)
+}
+
+// confirmUpdate commits a pending self-update once this binary has proven it
+// can reach the backend. It reports whether the check is done.
+func confirmUpdate(logger *zap.Logger, updater *executor.Updater) bool {
+	committed, err := updater.Confirm()
+	if err != nil {
+		logger.Error("failed to confirm agent update", zap.Error(err))
+		return false
+	}
+	if committed {
+		logger.Info("agent update confirmed", zap.String("version", Version))
+	}
+	return true
+}
+
+// heartbeatDelay is the wait before the next heartbeat. After failures it
+// doubles per failure up to maxBackoff; every delay is jittered so agents
+// that lost the backend together do not come back in lockstep.
+func heartbeatDelay(interval, maxBackoff time.Duration, failures int) time.Duration {
+	if failures == 0 {
+		// ±10% around the configured interval
+		return interval - interval/10 + rand.N(interval/5+1)
+	}
+
+	delay := maxBackoff
+	if failures < 16 && interval<<failures < maxBackoff {
+		delay = interval << failures
+	}
+	// Equal jitter: half fixed, half random
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// sendHeartbeat reports stats, probe results and the health of managed
+// components, applies the config the backend returns, queues any returned
+// commands and reports whether the backend accepted the heartbeat. The time of the last accepted
+// heartbeat is kept in lastHeartbeat; a sample the backend did not take is
+// spooled so the node's history has no gap. The sample, health and round
+// trip are recorded for /metrics. files, when not nil, is the drift report.
+func sendHeartbeat(logger *zap.Logger, collector *stats.Collector, processor *executor.Processor, client *communicator.Client, commands chan<- protocol.Command, reportSpool *spool.Spool, live *liveSettings, recorder *metrics.Recorder, files []protocol.ManagedFile, lastHeartbeat *atomic.Int64) bool {
 	systemStats, err := collector.Collect()
 	if err != nil {
 		logger.Warn("failed to collect stats", zap.Error(err))
-		return
+		return false
 	}
 
 	logger.Debug("collected stats",
@@ -88,46 +410,277 @@ func sendHeartbeat(logger *zap.Logger, collector *stats.Collector, client *commu
 		zap.Float64("ram", systemStats.RAMUsage),
 		zap.Uint64("uptime", systemStats.Uptime),
 	)
+	if results := live.probes.Results(); len(results) > 0 {
+		systemStats.Probes = results
+	}
+
+	health := processor.Health()
+	recorder.ObserveStats(systemStats)
+	recorder.ObserveComponents(health)
 
-	resp, err := client.SendHeartbeat(systemStats)
+	sentAt := time.Now()
+	resp, err := client.SendHeartbeat(systemStats, health, files)
+	recorder.ObserveHeartbeat(time.Since(sentAt), err == nil)
 	if err != nil {
-		// Don't crash - just log and retry next tick
+		// Don't crash - keep the sample and retry after the backoff
 		logger.Warn("heartbeat failed", zap.Error(err))
-		return
+		if err := reportSpool.PushStats(systemStats); err != nil {
+			logger.Warn("failed to spool stats sample", zap.Error(err))
+		}
+		return false
 	}
 
 	logger.Debug("heartbeat sent successfully")
+	lastHeartbeat.Store(time.Now().Unix())
+	live.ApplyRemote(resp.Config)
 
 	if len(resp.Commands) > 0 {
 		logger.Info("received commands from backend",
 			zap.Int("count", len(resp.Commands)),
 		)
 
-		// Process each command
 		for _, cmd := range resp.Commands {
-			// Convert communicator.Command to executor.Command
-			execCmd := executor.Command{
-				ID:        cmd.ID,
-				Type:      cmd.Type,
-				Payload:   cmd.Payload,
-				Priority:  cmd.Priority,
-				CreatedAt: cmd.CreatedAt,
+			commands <- cmd
+		}
+	}
+	return true
+}
+
+// reportResult sends a command result to the backend. If it cannot be
+// delivered, or older reports are still waiting, it is spooled behind them so
+// results arrive in the order the commands ran.
+func reportResult(logger *zap.Logger, client *communicator.Client, reportSpool *spool.Spool, result *executor.ExecutionResult) {
+	payload := protocol.CommandResult{
+		Success:   result.Success,
+		Output:    result.Output,
+		Error:     result.Error,
+		DryRun:    result.DryRun,
+		Files:     result.Files,
+		Timestamp: time.Now().Unix(),
+	}
+
+	if reportSpool.Len() == 0 {
+		err := client.SendCommandResult(result.CommandID, payload)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, communicator.ErrRejected) {
+			logger.Warn("backend rejected command result", zap.String("command_id", result.CommandID), zap.Error(err))
+			return
+		}
+		logger.Warn("failed to report command result, spooling it",
+			zap.String("command_id", result.CommandID),
+			zap.Error(err),
+		)
+	}
+	if err := reportSpool.PushResult(result.CommandID, payload); err != nil {
+		logger.Error("failed to spool command result", zap.String("command_id", result.CommandID), zap.Error(err))
+	}
+}
+
+// flushSpool delivers spooled reports oldest first. Consecutive stats samples
+// go up in one request. It stops at the first report that fails for a reason
+// worth retrying and leaves it, and everything after it, for the next time.
+func flushSpool(logger *zap.Logger, client *communicator.Client, reportSpool *spool.Spool) {
+	const batchSize = 100
+
+	for {
+		entries := reportSpool.Peek(batchSize)
+		if len(entries) == 0 {
+			return
+		}
+
+		var n int
+		var err error
+		if entries[0].Kind == spool.KindResult {
+			n = 1
+			err = client.SendCommandResult(entries[0].CommandID, *entries[0].Result)
+		} else {
+			var samples []protocol.SystemStats
+			for _, e := range entries {
+				if e.Kind != spool.KindStats {
+					break
+				}
+				samples = append(samples, *e.Stats)
+			}
+			n = len(samples)
+			err = client.SendStatsBacklog(samples)
+		}
+
+		if err != nil && !errors.Is(err, communicator.ErrRejected) {
+			logger.Warn("spool flush interrupted", zap.Int("remaining", reportSpool.Len()), zap.Error(err))
+			return
+		}
+		if err != nil {
+			logger.Warn("backend rejected spooled report, dropping it", zap.String("kind", entries[0].Kind), zap.Int("count", n), zap.Error(err))
+		}
+		if dropErr := reportSpool.DropThrough(entries[n-1].Seq); dropErr != nil {
+			logger.Warn("failed to update spool", zap.Error(dropErr))
+		}
+		if err == nil {
+			logger.Info("spooled reports delivered", zap.String("kind", entries[0].Kind), zap.Int("count", n), zap.Int("remaining", reportSpool.Len()))
+		}
+	}
+}
+
+// admitCommand decides whether a delivered command may run. Only commands
+// signed by the pinned backend key for this node are run, and the journal
+// makes execution at-most-once: a duplicate delivery is only re-reported,
+// never run again. Command types the settings disable are
+// refused. It returns nil if the command may run, or the result to report
+// in its place.
+func admitCommand(logger *zap.Logger, verifier *executor.Verifier, cmdJournal *journal.Journal, live *liveSettings, cmd protocol.Command) *executor.ExecutionResult {
+	if entry, run := cmdJournal.ShouldRun(cmd.ID); !run {
+		logger.Info("skipping already executed command",
+			zap.String("command_id", cmd.ID),
+			zap.String("state", entry.State),
+		)
+		return journaledResult(entry)
+	}
+	if err := verifier.Verify(cmd); errors.Is(err, protocol.ErrCommandExpired) {
+		logger.Warn("dropping expired command",
+			zap.String("command_id", cmd.ID),
+			zap.String("type", cmd.Type),
+			zap.Int64("expires_at", cmd.ExpiresAt),
+		)
+		return &executor.ExecutionResult{CommandID: cmd.ID, Error: "command expired before execution"}
+	} else if err != nil {
+		logger.Warn("rejecting unverified command",
+			zap.String("command_id", cmd.ID),
+			zap.String("type", cmd.Type),
+			zap.Error(err),
+		)
+		return &executor.ExecutionResult{CommandID: cmd.ID, Error: "command rejected: " + err.Error()}
+	}
+	if !live.CommandEnabled(cmd.Type) {
+		logger.Warn("refusing disabled command type",
+			zap.String("command_id", cmd.ID),
+			zap.String("type", cmd.Type),
+		)
+		return &executor.ExecutionResult{CommandID: cmd.ID, Error: fmt.Sprintf("command type %s is disabled on this agent", cmd.Type)}
+	}
+	return nil
+}
+
+// runCommands executes queued commands one at a time and reports each
+// result back. Output is streamed to the backend while a command runs, and
+// a command is stopped when its timeout passes or it is cancelled.
+func runCommands(ctx context.Context, logger *zap.Logger, client *communicator.Client, processor *executor.Processor, verifier *executor.Verifier, cmdJournal *journal.Journal, reportSpool *spool.Spool, live *liveSettings, cancels *cancellations, recorder *metrics.Recorder, commands <-chan protocol.Command) {
+	for {
+		select {
+		case cmd := <-commands:
+			result := admitCommand(logger, verifier, cmdJournal, live, cmd)
+			if result == nil {
+				result = runCommand(ctx, logger, client, processor, cmdJournal, cancels, recorder, cmd)
 			}
+			reportResult(logger, client, reportSpool, result)
 
-			result := processor.Execute(execCmd)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func runCommand(ctx context.Context, logger *zap.Logger, client *communicator.Client, processor *executor.Processor, cmdJournal *journal.Journal, cancels *cancellations, recorder *metrics.Recorder, cmd protocol.Command) *executor.ExecutionResult {
+	runCtx, finish, err := cancels.Start(ctx, cmd.ID, cmd.Timeout)
+	if err != nil {
+		logger.Info("skipping cancelled command", zap.String("command_id", cmd.ID), zap.String("type", cmd.Type))
+		if err := cmdJournal.Finish(cmd.ID, cmd.Attempt, false, err.Error()); err != nil {
+			logger.Warn("failed to journal command result", zap.String("command_id", cmd.ID), zap.Error(err))
+		}
+		return &executor.ExecutionResult{CommandID: cmd.ID, Error: err.Error()}
+	}
+
+	if err := cmdJournal.Begin(cmd.ID, cmd.Attempt); err != nil {
+		logger.Warn("failed to journal command", zap.String("command_id", cmd.ID), zap.Error(err))
+	}
+	output := client.NewOutputStream(cmd.ID)
+	startedAt := time.Now()
+	result := processor.Execute(runCtx, cmd, output.Write)
+	recorder.ObserveCommand(cmd.Type, result.Success, time.Since(startedAt))
+	finish()
+	output.Close()
+	if err := cmdJournal.Finish(cmd.ID, cmd.Attempt, result.Success, result.Error); err != nil {
+		logger.Warn("failed to journal command result", zap.String("command_id", cmd.ID), zap.Error(err))
+	}
+	return result
+}
 
-			// Report result back to backend (best effort)
-			if err := client.ReportCommandResult(result.CommandID, result.Success, result.Output); err != nil {
-				logger.Warn("failed to report command result",
-					zap.Uint("command_id", result.CommandID),
-					zap.Error(err),
-				)
+// routeCommands moves delivered commands into the run queue, except
+// CMD_CANCEL, which is carried out on arrival
+func routeCommands(ctx context.Context, logger *zap.Logger, client *communicator.Client, verifier *executor.Verifier, cmdJournal *journal.Journal, reportSpool *spool.Spool, live *liveSettings, cancels *cancellations, incoming <-chan protocol.Command, commands chan<- protocol.Command) {
+	for {
+		select {
+		case cmd := <-incoming:
+			if cmd.Type != executor.CmdCancel {
+				commands <- cmd
+				continue
+			}
+			result := admitCommand(logger, verifier, cmdJournal, live, cmd)
+			if result == nil {
+				result = cancelCommand(logger, cmdJournal, cancels, cmd)
 			}
+			reportResult(logger, client, reportSpool, result)
+
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func initLogger(logPath string) *zap.Logger {
+// cancelCommand stops the command a CMD_CANCEL targets. Cancelling a command
+// that already finished is not an error; there is nothing left to stop.
+func cancelCommand(logger *zap.Logger, cmdJournal *journal.Journal, cancels *cancellations, cmd protocol.Command) *executor.ExecutionResult {
+	if err := cmdJournal.Begin(cmd.ID, cmd.Attempt); err != nil {
+		logger.Warn("failed to journal command", zap.String("command_id", cmd.ID), zap.Error(err))
+	}
+
+	result := &executor.ExecutionResult{CommandID: cmd.ID, Success: true}
+	var payload protocol.CancelPayload
+	if err := json.Unmarshal(cmd.Payload, &payload); err != nil || payload.CommandID == "" {
+		result.Success = false
+		result.Error = "invalid payload: command_id is required"
+	} else if entry, ok := cmdJournal.Lookup(payload.CommandID); ok && entry.State != journal.StateRunning {
+		result.Output = fmt.Sprintf("command %s already %s", payload.CommandID, entry.State)
+	} else if cancels.Cancel(payload.CommandID) {
+		logger.Info("cancelling running command", zap.String("command_id", payload.CommandID))
+		result.Output = fmt.Sprintf("command %s is being stopped", payload.CommandID)
+	} else {
+		logger.Info("cancelling queued command", zap.String("command_id", payload.CommandID))
+		result.Output = fmt.Sprintf("command %s will not run", payload.CommandID)
+	}
+
+	if err := cmdJournal.Finish(cmd.ID, cmd.Attempt, result.Success, result.Error); err != nil {
+		logger.Warn("failed to journal command result", zap.String("command_id", cmd.ID), zap.Error(err))
+	}
+	return result
+}
+
+// heartbeatCheck fails once three heartbeats in a row did not reach the
+// backend
+func heartbeatCheck(last int64, interval time.Duration) protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "backend"}
+	if last == 0 {
+		check.Detail = "no heartbeat accepted since start"
+		return check
+	}
+	age := time.Since(time.Unix(last, 0)).Round(time.Second)
+	check.OK = age <= 3*interval
+	check.Detail = fmt.Sprintf("last heartbeat %s ago", age)
+	return check
+}
+
+// certificateCheck fails when the mTLS certificate has been due for renewal
+// for longer than one renewal check, which means renewing it is not working
+func certificateCheck(ident *identity.Identity) protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "certificate"}
+	notAfter := ident.NotAfter()
+	check.OK = !ident.NeedsRenewal(time.Now().Add(-certCheckInterval))
+	check.Detail = fmt.Sprintf("expires %s", notAfter.UTC().Format(time.RFC3339))
+	return check
+}
+
+func initLogger(logPath string, level zap.AtomicLevel) *zap.Logger {
 	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "timestamp",
 		LevelKey:       "level",
@@ -147,7 +700,7 @@ func initLogger(logPath string) *zap.Logger {
 	consoleCore := zapcore.NewCore(
 		consoleEncoder,
 		zapcore.AddSync(os.Stdout),
-		zapcore.DebugLevel,
+		level,
 	)
 
 	cores := []zapcore.Core{consoleCore}
@@ -159,7 +712,7 @@ func initLogger(logPath string) *zap.Logger {
 			fileCore := zapcore.NewCore(
 				jsonEncoder,
 				zapcore.AddSync(file),
-				zapcore.InfoLevel,
+				level,
 			)
 			cores = append(cores, fileCore)
 		}
@@ -168,3 +721,17 @@ func initLogger(logPath string) *zap.Logger {
 	core := zapcore.NewTee(cores...)
 	return zap.New(core, zap.AddCaller())
 }
+
+// journaledResult rebuilds the result of a command that already ran
+func journaledResult(entry journal.Entry) *executor.ExecutionResult {
+	result := &executor.ExecutionResult{
+		CommandID: entry.ID,
+		Success:   entry.State == journal.StateSucceeded,
+		Output:    "duplicate delivery; command already executed",
+		Error:     entry.Error,
+	}
+	if entry.State == journal.StateRunning {
+		result.Error = "agent restarted while the command was running; not retried"
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/netly/agent/config"
+	"github.com/netly/agent/internal/probe"
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// minRemoteHeartbeat keeps a bad push from turning heartbeats into a flood
+const minRemoteHeartbeat = time.Second
+
+// liveSettings is what the agent runs with right now: agent.yaml, reread on
+// SIGHUP, overridden field by field by the last config the backend pushed.
+// Only heartbeat timing, drift interval, log level, enabled commands and
+// probes change live; everything else in agent.yaml needs a restart.
+type liveSettings struct {
+	mu     sync.RWMutex
+	local  *config.Config
+	remote *protocol.RemoteConfig
+
+	level  zap.AtomicLevel
+	probes *probe.Scheduler
+	logger *zap.Logger
+}
+
+func newLiveSettings(local *config.Config, level zap.AtomicLevel, probes *probe.Scheduler, logger *zap.Logger) *liveSettings {
+	s := &liveSettings{local: local, level: level, probes: probes, logger: logger}
+	s.apply()
+	return s
+}
+
+func (s *liveSettings) HeartbeatInterval() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.remote != nil && s.remote.HeartbeatInterval > 0 {
+		return max(time.Duration(s.remote.HeartbeatInterval)*time.Second, minRemoteHeartbeat)
+	}
+	return s.local.HeartbeatInterval
+}
+
+func (s *liveSettings) HeartbeatMaxBackoff() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.local.HeartbeatMaxBackoff
+}
+
+// DriftInterval is how often heartbeats carry the managed files' digests
+func (s *liveSettings) DriftInterval() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.local.DriftInterval
+}
+
+// CommandEnabled reports whether the command type may run. An empty list
+// allows every type.
+func (s *liveSettings) CommandEnabled(cmdType string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	enabled := s.local.EnabledCommands
+	if s.remote != nil && len(s.remote.EnabledCommands) > 0 {
+		enabled = s.remote.EnabledCommands
+	}
+	return len(enabled) == 0 || slices.Contains(enabled, cmdType)
+}
+
+// ApplyRemote takes the config from a heartbeat response. nil drops the
+// overrides, so settings removed on the backend fall back to agent.yaml.
+func (s *liveSettings) ApplyRemote(remote *protocol.RemoteConfig) {
+	s.mu.Lock()
+	if reflect.DeepEqual(s.remote, remote) {
+		s.mu.Unlock()
+		return
+	}
+	s.remote = remote
+	s.mu.Unlock()
+
+	s.apply()
+	s.logger.Info("remote config applied",
+		zap.Duration("heartbeat_interval", s.HeartbeatInterval()),
+		zap.String("log_level", s.level.Level().String()),
+	)
+}
+
+// Reload rereads agent.yaml. A file that fails to load or validate leaves
+// the running settings untouched.
+func (s *liveSettings) Reload() error {
+	s.mu.RLock()
+	path := s.local.Path
+	s.mu.RUnlock()
+
+	next, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	restart := s.local.RestartRequired(next)
+	s.local = next
+	s.mu.Unlock()
+
+	s.apply()
+	s.logger.Info("config reloaded",
+		zap.String("path", path),
+		zap.Duration("heartbeat_interval", s.HeartbeatInterval()),
+		zap.String("log_level", s.level.Level().String()),
+	)
+	if len(restart) > 0 {
+		s.logger.Warn("changed settings take effect after a restart", zap.Strings("settings", restart))
+	}
+	return nil
+}
+
+// apply pushes the log level and probe schedules to the components that
+// hold them
+func (s *liveSettings) apply() {
+	s.mu.RLock()
+	levelName := s.local.LogLevel
+	var schedules []protocol.ProbeSchedule
+	if s.remote != nil {
+		if s.remote.LogLevel != "" {
+			levelName = s.remote.LogLevel
+		}
+		schedules = s.remote.Probes
+	}
+	s.mu.RUnlock()
+
+	if level, err := zapcore.ParseLevel(levelName); err != nil {
+		s.logger.Warn("ignoring invalid log level", zap.String("log_level", levelName))
+	} else {
+		s.level.SetLevel(level)
+	}
+	s.probes.SetSchedules(schedules)
+}
@@ -2,9 +2,11 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"time"
 
+	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v3"
 )
 
@@ -14,10 +16,74 @@ var defaultConfigPaths = []string{
 }
 
 type Config struct {
+	// Path is the file the config was loaded from, reread on SIGHUP
+	Path string `yaml:"-"`
+
 	BackendURL        string        `yaml:"backend_url"`
 	NodeToken         string        `yaml:"node_token"`
 	LogPath           string        `yaml:"log_path"`
+	LogLevel          string        `yaml:"log_level"`
 	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	// HeartbeatMaxBackoff caps the exponential backoff between heartbeats
+	// while the backend is unreachable
+	HeartbeatMaxBackoff time.Duration `yaml:"heartbeat_max_backoff"`
+	JournalPath         string        `yaml:"journal_path"`
+	// SpoolPath buffers stats samples and command results the backend did
+	// not accept, up to SpoolMaxEntries, until it is reachable again
+	SpoolPath       string `yaml:"spool_path"`
+	SpoolMaxEntries int    `yaml:"spool_max_entries"`
+	// SingBoxRegistryPath keeps the sing-box fragments the config is
+	// composed from
+	SingBoxRegistryPath string `yaml:"singbox_registry_path"`
+	// NetworkStatePath keeps the forwarding, NAT and policy rules the agent
+	// maintains, restored on start
+	NetworkStatePath string `yaml:"network_state_path"`
+	// ManagedFilesPath lists the files the agent wrote for the backend.
+	// Every DriftInterval their digests and unit states go up with a
+	// heartbeat so the backend can spot hand edits.
+	ManagedFilesPath string        `yaml:"managed_files_path"`
+	DriftInterval    time.Duration `yaml:"drift_interval"`
+	// RevisionsDir keeps the last ConfigRevisions versions of every managed
+	// file, for CMD_ROLLBACK_CONFIG to restore
+	RevisionsDir    string `yaml:"revisions_dir"`
+	ConfigRevisions int    `yaml:"config_revisions"`
+
+	// SigningPublicKey is the backend's base64 Ed25519 key, pinned at install
+	// time. Commands and update artifacts must be signed with it. It is
+	// required: an agent without it could not verify the command that would
+	// deliver it, so the key can only arrive with the install.
+	SigningPublicKey string `yaml:"signing_public_key"`
+
+	// UpdateGracePeriod is how long a new binary has to heartbeat before it
+	// is rolled back
+	UpdateGracePeriod time.Duration `yaml:"update_grace_period"`
+
+	// mTLS identity issued by the backend's CA. When cert_file is set every
+	// connection to the backend presents it.
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// ListenPort enables the AgentServer; it requires the mTLS identity and
+	// the signing key. It binds ListenAddress, which defaults to loopback so
+	// exposing the control API is a deliberate choice.
+	ListenPort    int    `yaml:"listen_port"`
+	ListenAddress string `yaml:"listen_address"`
+
+	// MetricsAddress enables the Prometheus /metrics listener on host:port.
+	// Off loopback it requires MetricsToken, which scrapers send as a bearer
+	// token.
+	MetricsAddress string `yaml:"metrics_address"`
+	MetricsToken   string `yaml:"metrics_token"`
+
+	// EnabledCommands restricts the command types the agent runs; empty
+	// allows every type. The backend can override it remotely.
+	EnabledCommands []string `yaml:"enabled_commands"`
+}
+
+// MTLSEnabled reports whether the agent has a client certificate configured
+func (c *Config) MTLSEnabled() bool {
+	return c.CertFile != ""
 }
 
 func Load(path string) (*Config, error) {
@@ -47,6 +113,7 @@ func Load(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
+	cfg.Path = configPath
 
 	// Set defaults
 	if cfg.HeartbeatInterval == 0 {
@@ -55,6 +122,45 @@ func Load(path string) (*Config, error) {
 	if cfg.LogPath == "" {
 		cfg.LogPath = "/var/log/netly-agent.log"
 	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if cfg.UpdateGracePeriod == 0 {
+		cfg.UpdateGracePeriod = 2 * time.Minute
+	}
+	if cfg.HeartbeatMaxBackoff == 0 {
+		cfg.HeartbeatMaxBackoff = 5 * time.Minute
+	}
+	if cfg.JournalPath == "" {
+		cfg.JournalPath = "/var/lib/netly/journal.json"
+	}
+	if cfg.SpoolPath == "" {
+		cfg.SpoolPath = "/var/lib/netly/spool.json"
+	}
+	if cfg.SpoolMaxEntries == 0 {
+		cfg.SpoolMaxEntries = 1000
+	}
+	if cfg.ListenAddress == "" {
+		cfg.ListenAddress = "127.0.0.1"
+	}
+	if cfg.SingBoxRegistryPath == "" {
+		cfg.SingBoxRegistryPath = "/var/lib/netly/singbox.json"
+	}
+	if cfg.NetworkStatePath == "" {
+		cfg.NetworkStatePath = "/var/lib/netly/network.json"
+	}
+	if cfg.ManagedFilesPath == "" {
+		cfg.ManagedFilesPath = "/var/lib/netly/managed.json"
+	}
+	if cfg.DriftInterval == 0 {
+		cfg.DriftInterval = 5 * time.Minute
+	}
+	if cfg.RevisionsDir == "" {
+		cfg.RevisionsDir = "/var/lib/netly/revisions"
+	}
+	if cfg.ConfigRevisions == 0 {
+		cfg.ConfigRevisions = 10
+	}
 
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -70,5 +176,62 @@ func (c *Config) Validate() error {
 	if c.NodeToken == "" {
 		return fmt.Errorf("node_token is required")
 	}
+	if c.SigningPublicKey == "" {
+		return fmt.Errorf("signing_public_key is required; reinstall the agent to provision it")
+	}
+	if c.MTLSEnabled() && (c.CAFile == "" || c.KeyFile == "") {
+		return fmt.Errorf("cert_file requires ca_file and key_file")
+	}
+	if c.ListenPort != 0 && !c.MTLSEnabled() {
+		return fmt.Errorf("listen_port requires the mTLS identity (ca_file, cert_file, key_file)")
+	}
+	if c.MetricsAddress != "" {
+		host, _, err := net.SplitHostPort(c.MetricsAddress)
+		if err != nil {
+			return fmt.Errorf("invalid metrics_address: %w", err)
+		}
+		if ip := net.ParseIP(host); c.MetricsToken == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("metrics_address off loopback requires metrics_token")
+		}
+	}
+	if c.ConfigRevisions < 0 {
+		return fmt.Errorf("config_revisions must not be negative")
+	}
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("invalid log_level: %w", err)
+	}
 	return nil
 }
+
+// RestartRequired lists the settings that differ from next but only take
+// effect after a restart. Heartbeat timing, drift interval, log level and
+// enabled commands are applied live.
+func (c *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("backend_url", c.BackendURL != next.BackendURL)
+	check("node_token", c.NodeToken != next.NodeToken)
+	check("log_path", c.LogPath != next.LogPath)
+	check("journal_path", c.JournalPath != next.JournalPath)
+	check("spool_path", c.SpoolPath != next.SpoolPath)
+	check("spool_max_entries", c.SpoolMaxEntries != next.SpoolMaxEntries)
+	check("singbox_registry_path", c.SingBoxRegistryPath != next.SingBoxRegistryPath)
+	check("network_state_path", c.NetworkStatePath != next.NetworkStatePath)
+	check("managed_files_path", c.ManagedFilesPath != next.ManagedFilesPath)
+	check("revisions_dir", c.RevisionsDir != next.RevisionsDir)
+	check("config_revisions", c.ConfigRevisions != next.ConfigRevisions)
+	check("signing_public_key", c.SigningPublicKey != next.SigningPublicKey)
+	check("update_grace_period", c.UpdateGracePeriod != next.UpdateGracePeriod)
+	check("ca_file", c.CAFile != next.CAFile)
+	check("cert_file", c.CertFile != next.CertFile)
+	check("key_file", c.KeyFile != next.KeyFile)
+	check("listen_port", c.ListenPort != next.ListenPort)
+	check("listen_address", c.ListenAddress != next.ListenAddress)
+	check("metrics_address", c.MetricsAddress != next.MetricsAddress)
+	check("metrics_token", c.MetricsToken != next.MetricsToken)
+	return changed
+}
@@ -3,6 +3,8 @@ module github.com/netly/agent
 go 1.22
 
 require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/netly/protocol v0.0.0
 	github.com/shirou/gopsutil/v3 v3.24.5
 	go.uber.org/zap v1.27.0
 	gopkg.in/yaml.v3 v3.0.1
@@ -19,3 +21,5 @@ require (
 	go.uber.org/multierr v1.10.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
 )
+
+replace github.com/netly/protocol => ../protocol
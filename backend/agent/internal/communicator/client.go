@@ -2,45 +2,28 @@ package communicator
 
 import (
     "bytes"
+    "crypto/tls"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "net/http"
     "time"
 
     "github.com/netly/agent/internal/stats"
+    "github.com/netly/protocol"
     "go.uber.org/zap"
 )
 
-type Command struct {
-	ID        uint   `json:"id"`
-	Type      string `json:"type"`
-	Payload   string `json:"payload"`
-	Priority  int    `json:"priority"`
-	CreatedAt int64  `json:"created_at"`
-}
-
-type HeartbeatRequest struct {
-	Stats     *stats.SystemStats `json:"stats"`
-	AgentVersion string          `json:"agent_version"`
-	Timestamp    int64           `json:"timestamp"`
-}
-
-type HeartbeatResponse struct {
-	Success  bool      `json:"success"`
-	Message  string    `json:"message,omitempty"`
-	Commands []Command `json:"commands,omitempty"`
-	Config   *RemoteConfig `json:"config,omitempty"`
-}
-
-type RemoteConfig struct {
-	HeartbeatInterval int `json:"heartbeat_interval,omitempty"`
-}
+// ErrRejected marks a report the backend refused outright. Sending it again
+// would not help, so it is not kept for a retry.
+var ErrRejected = errors.New("backend rejected the request")
 
 type Client struct {
     backendURL string
     nodeToken  string
     httpClient *http.Client
+    tlsConfig  *tls.Config
     version    string
     logger     *zap.Logger
 }
@@ -51,6 +34,8 @@ type ClientConfig struct {
     Timeout    time.Duration
     Version    string
     Logger     *zap.Logger
+    // TLSConfig enables mTLS with the agent's client certificate
+    TLSConfig  *tls.Config
 }
 
 func NewClient(cfg ClientConfig) *Client {
@@ -59,23 +44,32 @@ func NewClient(cfg ClientConfig) *Client {
 		timeout = 30 * time.Second
 	}
 
+	httpClient := &http.Client{Timeout: timeout}
+	if cfg.TLSConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg.TLSConfig
+		httpClient.Transport = transport
+	}
+
     return &Client{
         backendURL: cfg.BackendURL,
         nodeToken:  cfg.NodeToken,
         version:    cfg.Version,
-        httpClient: &http.Client{
-            Timeout: timeout,
-        },
+        httpClient: httpClient,
+        tlsConfig:  cfg.TLSConfig,
         logger:     cfg.Logger,
     }
 }
 
-func (c *Client) SendHeartbeat(systemStats *stats.SystemStats) (*HeartbeatResponse, error) {
+func (c *Client) SendHeartbeat(systemStats *stats.SystemStats, components []protocol.ComponentHealth, files []protocol.ManagedFile) (*protocol.HeartbeatResponse, error) {
     start := time.Now()
-    req := HeartbeatRequest{
-        Stats:        systemStats,
-        AgentVersion: c.version,
-        Timestamp:    time.Now().Unix(),
+    req := protocol.HeartbeatRequest{
+        ProtocolVersion: protocol.Version,
+        Stats:           systemStats,
+        Components:      components,
+        Files:           files,
+        AgentVersion:    c.version,
+        Timestamp:       time.Now().Unix(),
     }
 
 	body, err := json.Marshal(req)
@@ -121,6 +115,12 @@ func (c *Client) SendHeartbeat(systemStats *stats.SystemStats) (*HeartbeatRespon
             zap.Int("resp_bytes", len(respBody)),
         )
     }
+    if resp.StatusCode == http.StatusUpgradeRequired {
+        if c.logger != nil {
+            c.logger.Error("agent_heartbeat_protocol_rejected", zap.Int("protocol_version", protocol.Version), zap.String("body", string(respBody)))
+        }
+        return nil, fmt.Errorf("%w: backend rejected agent protocol v%d", protocol.ErrUnsupportedVersion, protocol.Version)
+    }
     if resp.StatusCode != http.StatusOK {
         if c.logger != nil {
             c.logger.Warn("agent_heartbeat_bad_status", zap.Int("status", resp.StatusCode))
@@ -128,13 +128,19 @@ func (c *Client) SendHeartbeat(systemStats *stats.SystemStats) (*HeartbeatRespon
         return nil, fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(respBody))
     }
 
-	var heartbeatResp HeartbeatResponse
+	var heartbeatResp protocol.HeartbeatResponse
     if err := json.Unmarshal(respBody, &heartbeatResp); err != nil {
         if c.logger != nil {
             c.logger.Warn("agent_heartbeat_parse_error", zap.Error(err))
         }
         return nil, fmt.Errorf("failed to parse response: %w", err)
     }
+    if _, err := protocol.Negotiate(heartbeatResp.ProtocolVersion); err != nil {
+        if c.logger != nil {
+            c.logger.Error("agent_heartbeat_backend_protocol_unsupported", zap.Int("backend_protocol_version", heartbeatResp.ProtocolVersion))
+        }
+        return nil, err
+    }
     if c.logger != nil {
         c.logger.Info("agent_heartbeat_parsed", zap.Int("commands", len(heartbeatResp.Commands)))
     }
@@ -143,21 +149,26 @@ func (c *Client) SendHeartbeat(systemStats *stats.SystemStats) (*HeartbeatRespon
 }
 
 // ReportCommandResult reports the result of a command execution back to the backend
-func (c *Client) ReportCommandResult(commandID uint, success bool, output string) error {
+func (c *Client) ReportCommandResult(commandID string, success bool, output string, errMsg string) error {
+    return c.SendCommandResult(commandID, protocol.CommandResult{
+        Success:   success,
+        Output:    output,
+        Error:     errMsg,
+        Timestamp: time.Now().Unix(),
+    })
+}
+
+// SendCommandResult reports a result that may have been recorded earlier,
+// keeping its original timestamp
+func (c *Client) SendCommandResult(commandID string, payload protocol.CommandResult) error {
     start := time.Now()
-    payload := map[string]interface{}{
-        "command_id": commandID,
-        "success":    success,
-        "output":     output,
-        "timestamp":  time.Now().Unix(),
-    }
 
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/api/v1/agent/command/result", c.backendURL)
+	url := fmt.Sprintf("%s/api/v1/agent/commands/%s/result", c.backendURL, commandID)
 	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
@@ -169,14 +180,14 @@ func (c *Client) ReportCommandResult(commandID uint, success bool, output string
     if c.logger != nil {
         c.logger.Info("agent_command_report_request",
             zap.String("url", url),
-            zap.Uint("command_id", commandID),
+            zap.String("command_id", commandID),
             zap.Int("payload_bytes", len(body)),
         )
     }
     resp, err := c.httpClient.Do(httpReq)
     if err != nil {
         if c.logger != nil {
-            c.logger.Warn("agent_command_report_network_error", zap.Error(err), zap.Uint("command_id", commandID))
+            c.logger.Warn("agent_command_report_network_error", zap.Error(err), zap.String("command_id", commandID))
         }
         return fmt.Errorf("request failed: %w", err)
     }
@@ -186,15 +197,120 @@ func (c *Client) ReportCommandResult(commandID uint, success bool, output string
         c.logger.Info("agent_command_report_response",
             zap.Int("status", resp.StatusCode),
             zap.Int64("duration_ms", time.Since(start).Milliseconds()),
-            zap.Uint("command_id", commandID),
+            zap.String("command_id", commandID),
         )
     }
     if resp.StatusCode != http.StatusOK {
         if c.logger != nil {
-            c.logger.Warn("agent_command_report_bad_status", zap.Int("status", resp.StatusCode), zap.Uint("command_id", commandID))
+            c.logger.Warn("agent_command_report_bad_status", zap.Int("status", resp.StatusCode), zap.String("command_id", commandID))
         }
-        return fmt.Errorf("server returned status %d", resp.StatusCode)
+        return statusError(resp.StatusCode)
     }
 
 	return nil
 }
+
+// RenewCertificate asks the backend to sign a CSR for a new client
+// certificate. It must be called over mTLS with the current certificate.
+func (c *Client) RenewCertificate(csrPEM []byte) (*protocol.CertificateResponse, error) {
+	body, err := json.Marshal(protocol.CertificateRequest{CSR: string(csrPEM)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := c.backendURL + protocol.CertificatePath
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", fmt.Sprintf("NetlyAgent/%s", c.version))
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var certResp protocol.CertificateResponse
+	if err := json.Unmarshal(respBody, &certResp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &certResp, nil
+}
+
+// ReportDestructProgress tells the backend a self-destruct stage finished.
+// It is best effort: the files holding the token may already be gone, but
+// the client keeps what it loaded at start.
+func (c *Client) ReportDestructProgress(stage string, stageErr error) error {
+	progress := protocol.DestructProgress{Stage: stage, Timestamp: time.Now().Unix()}
+	if stageErr != nil {
+		progress.Error = stageErr.Error()
+	}
+	body, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("failed to marshal progress: %w", err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, c.backendURL+protocol.DestructProgressPath, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.nodeToken))
+	httpReq.Header.Set("User-Agent", fmt.Sprintf("NetlyAgent/%s", c.version))
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SendStatsBacklog uploads stats samples that were buffered while the
+// backend was unreachable
+func (c *Client) SendStatsBacklog(samples []protocol.SystemStats) error {
+	body, err := json.Marshal(protocol.StatsBacklog{Samples: samples})
+	if err != nil {
+		return fmt.Errorf("failed to marshal backlog: %w", err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, c.backendURL+protocol.StatsBacklogPath, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.nodeToken))
+	httpReq.Header.Set("User-Agent", fmt.Sprintf("NetlyAgent/%s", c.version))
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// statusError wraps ErrRejected for client errors other than a failed login,
+// which may clear up once the token or certificate is fixed
+func statusError(status int) error {
+	if status >= 400 && status < 500 && status != http.StatusUnauthorized {
+		return fmt.Errorf("%w: server returned status %d", ErrRejected, status)
+	}
+	return fmt.Errorf("server returned status %d", status)
+}
@@ -0,0 +1,165 @@
+package communicator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	outputFlushInterval = time.Second
+	// maxChunkBytes splits large writes so one chunk never dominates a request
+	maxChunkBytes = 16 << 10
+	// maxPendingBytes bounds what is held while the backend is unreachable;
+	// past it new output is dropped, leaving a gap in the sequence
+	maxPendingBytes = 1 << 20
+)
+
+// OutputStream sends a running command's output to the backend in numbered
+// chunks. Writes never wait on the network: chunks are batched and sent once
+// a second, and whatever a send loses is retried on the next one.
+type OutputStream struct {
+	client    *Client
+	commandID string
+	logger    *zap.Logger
+
+	mu           sync.Mutex
+	seq          int
+	pending      []protocol.OutputChunk
+	pendingBytes int
+	dropped      int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOutputStream starts streaming output for a command. Close it once the
+// command has finished.
+func (c *Client) NewOutputStream(commandID string) *OutputStream {
+	s := &OutputStream{
+		client:    c,
+		commandID: commandID,
+		logger:    c.logger,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if s.logger == nil {
+		s.logger = zap.NewNop()
+	}
+	go s.run()
+	return s
+}
+
+// Write queues output from one stream. It has the signature of
+// executor.Output.
+func (s *OutputStream) Write(stream string, data []byte) {
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(data) > 0 {
+		n := min(len(data), maxChunkBytes)
+		s.seq++
+		if s.pendingBytes+n > maxPendingBytes {
+			s.dropped++
+		} else {
+			s.pending = append(s.pending, protocol.OutputChunk{Seq: s.seq, Stream: stream, Data: string(data[:n]), Timestamp: now})
+			s.pendingBytes += n
+		}
+		data = data[n:]
+	}
+}
+
+// Close sends what is left and stops the stream. Output the backend still
+// cannot take is given up; the command result carries the full output.
+func (s *OutputStream) Close() {
+	close(s.stop)
+	<-s.done
+	s.flush()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped > 0 || len(s.pending) > 0 {
+		s.logger.Warn("command output incomplete",
+			zap.String("command_id", s.commandID),
+			zap.Int("dropped_chunks", s.dropped),
+			zap.Int("undelivered_chunks", len(s.pending)),
+		)
+	}
+}
+
+func (s *OutputStream) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// flush sends the pending chunks and forgets the ones the backend took
+func (s *OutputStream) flush() {
+	s.mu.Lock()
+	chunks := s.pending
+	s.mu.Unlock()
+	if len(chunks) == 0 {
+		return
+	}
+
+	err := s.client.SendCommandOutput(s.commandID, chunks)
+	if err != nil && !errors.Is(err, ErrRejected) {
+		s.logger.Debug("command output not delivered", zap.String("command_id", s.commandID), zap.Int("chunks", len(chunks)), zap.Error(err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// Sending the same chunks again would be refused again
+		s.logger.Warn("backend rejected command output", zap.String("command_id", s.commandID), zap.Error(err))
+		s.dropped += len(chunks)
+	}
+	for _, c := range s.pending[:len(chunks)] {
+		s.pendingBytes -= len(c.Data)
+	}
+	s.pending = s.pending[len(chunks):]
+}
+
+// SendCommandOutput uploads output chunks of a running command
+func (c *Client) SendCommandOutput(commandID string, chunks []protocol.OutputChunk) error {
+	body, err := json.Marshal(protocol.CommandOutput{Chunks: chunks})
+	if err != nil {
+		return fmt.Errorf("failed to marshal output: %w", err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, c.backendURL+protocol.CommandOutputPath(commandID), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.nodeToken))
+	httpReq.Header.Set("User-Agent", fmt.Sprintf("NetlyAgent/%s", c.version))
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+	return nil
+}
@@ -1,42 +1,252 @@
 package communicator
 
 import (
+    "crypto/subtle"
+    "crypto/tls"
     "encoding/json"
-    "fmt"
+    "errors"
+    "io"
+    "net"
     "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
 
     "github.com/netly/agent/internal/executor"
+    "github.com/netly/protocol"
+    "go.uber.org/zap"
 )
 
+const maxControlBody = 64 << 10
+
+// AgentServer is the local control API the backend calls. It only serves
+// over mTLS to a client holding the backend's certificate, and every request
+// must also carry a fresh signature from the pinned backend key, so neither
+// a stolen backend certificate nor a captured request is enough on its own.
 type AgentServer struct {
-	port int
+	address     string
+	port        int
+	tlsConfig   *tls.Config
+	verifier    *executor.Verifier
+	status      func() protocol.AgentStatus
+	diagnostics func() []protocol.DiagnosticCheck
+	client      *Client
+	logger      *zap.Logger
+
+	metricsAddress string
+	metricsToken   string
+	metrics        http.Handler
+
+	nonceMu sync.Mutex
+	nonces  map[string]time.Time
+
+	destructing atomic.Bool
 }
 
-func NewAgentServer(port int) *AgentServer {
-	return &AgentServer{port: port}
+type AgentServerConfig struct {
+	// Address and Port to bind; Address defaults to loopback
+	Address   string
+	Port      int
+	TLSConfig *tls.Config
+	// Verifier checks request signatures; without one every request is refused
+	Verifier *executor.Verifier
+	// Status and Diagnostics build the responses of the matching endpoints
+	Status      func() protocol.AgentStatus
+	Diagnostics func() []protocol.DiagnosticCheck
+	// Client reports self-destruct progress to the backend
+	Client *Client
+	// MetricsAddress is the host:port StartMetrics serves Metrics on, in
+	// plain HTTP. With MetricsToken set scrapers must send it as a bearer
+	// token.
+	MetricsAddress string
+	MetricsToken   string
+	Metrics        http.Handler
+	Logger         *zap.Logger
+}
+
+func NewAgentServer(cfg AgentServerConfig) *AgentServer {
+	address := cfg.Address
+	if address == "" {
+		address = "127.0.0.1"
+	}
+	return &AgentServer{
+		address:     address,
+		port:        cfg.Port,
+		tlsConfig:   cfg.TLSConfig,
+		verifier:    cfg.Verifier,
+		status:      cfg.Status,
+		diagnostics: cfg.Diagnostics,
+		client:      cfg.Client,
+		logger:      cfg.Logger,
+		nonces:      make(map[string]time.Time),
+
+		metricsAddress: cfg.MetricsAddress,
+		metricsToken:   cfg.MetricsToken,
+		metrics:        cfg.Metrics,
+	}
 }
 
 func (s *AgentServer) Start() error {
-	http.HandleFunc("/api/v1/agent/self", s.handleSelfDestruct)
-	
-	// Listen on 0.0.0.0 to allow backend connection
-	addr := fmt.Sprintf(":%d", s.port)
-	return http.ListenAndServe(addr, nil)
+	if s.tlsConfig == nil || s.tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		return errors.New("agent server requires mTLS; configure ca_file, cert_file and key_file")
+	}
+	if s.verifier == nil {
+		return errors.New("agent server requires signing_public_key to verify requests")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(protocol.ControlStatusPath, s.authenticated(http.MethodGet, s.handleStatus))
+	mux.HandleFunc(protocol.ControlDiagnosticsPath, s.authenticated(http.MethodGet, s.handleDiagnostics))
+	mux.HandleFunc(protocol.ControlSelfPath, s.authenticated(http.MethodDelete, s.handleSelfDestruct))
+
+	addr := net.JoinHostPort(s.address, strconv.Itoa(s.port))
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         s.tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.logger.Info("agent server listening", zap.String("addr", addr))
+	return server.ListenAndServeTLS("", "")
+}
+
+// StartMetrics serves the Prometheus /metrics endpoint on its own listener.
+// It does not need the mTLS identity, so monitoring works on nodes without
+// the control API.
+func (s *AgentServer) StartMetrics() error {
+	if s.metrics == nil || s.metricsAddress == "" {
+		return errors.New("metrics listener requires an address and a handler")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if s.metricsToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.metricsToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="netly-agent"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		s.metrics.ServeHTTP(w, r)
+	})
+
+	server := &http.Server{
+		Addr:              s.metricsAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.logger.Info("metrics listening", zap.String("addr", s.metricsAddress), zap.Bool("auth", s.metricsToken != ""))
+	return server.ListenAndServe()
+}
+
+// authenticated wraps a handler with the method check, signature check and
+// replay protection every control endpoint shares
+func (s *AgentServer) authenticated(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxControlBody))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "failed to read body"})
+			return
+		}
+		timestamp, _ := strconv.ParseInt(r.Header.Get(protocol.ControlTimestampHeader), 10, 64)
+		req := protocol.ControlRequest{
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Timestamp: timestamp,
+			Nonce:     r.Header.Get(protocol.ControlNonceHeader),
+			Body:      body,
+		}
+
+		if err := s.verifier.VerifyControl(req, r.Header.Get(protocol.ControlSignatureHeader)); err != nil {
+			s.logger.Warn("control request rejected", zap.String("path", r.URL.Path), zap.String("remote", r.RemoteAddr), zap.Error(err))
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
+		if !s.useNonce(req.Nonce) {
+			s.logger.Warn("control request replayed", zap.String("path", r.URL.Path), zap.String("remote", r.RemoteAddr))
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "request already used"})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// useNonce records a nonce and reports whether it was new. A nonce only has
+// to be remembered while its timestamp would still pass verification.
+func (s *AgentServer) useNonce(nonce string) bool {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+
+	now := time.Now()
+	for n, seen := range s.nonces {
+		if now.Sub(seen) > 2*protocol.ControlMaxSkew {
+			delete(s.nonces, n)
+		}
+	}
+	if _, ok := s.nonces[nonce]; ok {
+		return false
+	}
+	s.nonces[nonce] = now
+	return true
 }
 
+func (s *AgentServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.status()
+	status.Destructing = s.destructing.Load()
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *AgentServer) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, protocol.AgentDiagnostics{
+		Timestamp: time.Now().Unix(),
+		Checks:    s.diagnostics(),
+	})
+}
+
+// handleSelfDestruct answers right away and runs the destruct in the
+// background, reporting each stage to the backend as it goes
 func (s *AgentServer) handleSelfDestruct(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if !s.destructing.CompareAndSwap(false, true) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "self-destruct already running"})
 		return
 	}
 
-	// Trigger self-destruct asynchronously
+	s.logger.Warn("self-destruct requested by backend", zap.String("remote", r.RemoteAddr))
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": protocol.DestructAccepted})
+
 	go func() {
-		if err := executor.PerformSelfDestruct(); err != nil {
-			fmt.Println("Self destruct failed:", err)
+		s.report(protocol.DestructAccepted, nil)
+		if err := executor.PerformSelfDestruct(s.report); err != nil {
+			s.logger.Error("self-destruct incomplete", zap.Error(err))
 		}
 	}()
+}
+
+func (s *AgentServer) report(stage string, stageErr error) {
+	if stageErr != nil {
+		s.logger.Error("self-destruct stage failed", zap.String("stage", stage), zap.Error(stageErr))
+	} else {
+		s.logger.Info("self-destruct stage done", zap.String("stage", stage))
+	}
+	if s.client == nil {
+		return
+	}
+	if err := s.client.ReportDestructProgress(stage, stageErr); err != nil {
+		s.logger.Warn("failed to report self-destruct progress", zap.String("stage", stage), zap.Error(err))
+	}
+}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "self-destruct initiated"})
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
@@ -0,0 +1,158 @@
+package communicator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	streamWriteWait  = 10 * time.Second
+	streamReadWait   = 90 * time.Second
+	streamMinBackoff = 1 * time.Second
+	streamMaxBackoff = 60 * time.Second
+)
+
+// Stream holds the push connection to the backend. While it is up commands
+// arrive immediately; while it is down the heartbeat loop keeps polling.
+type Stream struct {
+	url       string
+	nodeToken string
+	version   string
+	logger    *zap.Logger
+	dialer    *websocket.Dialer
+	connected atomic.Bool
+	writeMu   sync.Mutex
+}
+
+// NewStream creates a push stream using the client's backend and credentials
+func (c *Client) NewStream() *Stream {
+	url := c.backendURL
+	switch {
+	case strings.HasPrefix(url, "https://"):
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	case strings.HasPrefix(url, "http://"):
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	}
+
+	return &Stream{
+		url:       strings.TrimSuffix(url, "/") + protocol.StreamPath,
+		nodeToken: c.nodeToken,
+		version:   c.version,
+		logger:    c.logger,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 15 * time.Second,
+			TLSClientConfig:  c.tlsConfig,
+		},
+	}
+}
+
+// Connected reports whether commands are currently being pushed
+func (s *Stream) Connected() bool {
+	return s.connected.Load()
+}
+
+// Run keeps the stream connected until ctx is cancelled, handing every pushed
+// command to handle. It reconnects with exponential backoff.
+func (s *Stream) Run(ctx context.Context, handle func(protocol.Command)) {
+	backoff := streamMinBackoff
+	for {
+		start := time.Now()
+		err := s.session(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A session that stayed up for a while was healthy; retry quickly
+		if time.Since(start) > streamMaxBackoff {
+			backoff = streamMinBackoff
+		}
+		if s.logger != nil {
+			s.logger.Warn("agent_stream_down_polling_fallback", zap.Error(err), zap.Duration("retry_in", backoff))
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+func (s *Stream) session(ctx context.Context, handle func(protocol.Command)) error {
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", s.nodeToken))
+	header.Set("User-Agent", fmt.Sprintf("NetlyAgent/%s", s.version))
+	header.Set(protocol.ProtocolVersionHeader, strconv.Itoa(protocol.Version))
+
+	conn, resp, err := s.dialer.DialContext(ctx, s.url, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("dial failed with status %d: %w", resp.StatusCode, err)
+		}
+		return fmt.Errorf("dial failed: %w", err)
+	}
+	defer conn.Close()
+
+	s.connected.Store(true)
+	defer s.connected.Store(false)
+	if s.logger != nil {
+		s.logger.Info("agent_stream_connected", zap.String("url", s.url))
+	}
+
+	// Unblock ReadJSON when the agent shuts down
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	conn.SetReadDeadline(time.Now().Add(streamReadWait))
+	conn.SetPingHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(streamReadWait))
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(streamWriteWait))
+	})
+
+	for {
+		var msg protocol.StreamMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("read failed: %w", err)
+		}
+
+		switch msg.Type {
+		case protocol.MessageCommand:
+			if msg.Command == nil {
+				continue
+			}
+			if err := s.write(conn, protocol.StreamMessage{Type: protocol.MessageAck, CommandID: msg.Command.ID}); err != nil {
+				return fmt.Errorf("ack failed: %w", err)
+			}
+			if s.logger != nil {
+				s.logger.Info("agent_stream_command_received", zap.String("command_id", msg.Command.ID), zap.String("type", msg.Command.Type))
+			}
+			handle(*msg.Command)
+		default:
+			if s.logger != nil {
+				s.logger.Warn("agent_stream_unknown_message", zap.String("type", msg.Type))
+			}
+		}
+	}
+}
+
+func (s *Stream) write(conn *websocket.Conn, msg protocol.StreamMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+	return conn.WriteJSON(msg)
+}
@@ -0,0 +1,307 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+// batchTx remembers the state of every file and service a batch touches so a
+// failed batch can put the node back the way it found it
+type batchTx struct {
+	p            *Processor
+	ctx          context.Context
+	out          Output
+	snapshotDir  string
+	files        []fileSnapshot
+	services     []serviceSnapshot
+	seenFiles    map[string]bool
+	seenServices map[string]bool
+}
+
+type fileSnapshot struct {
+	path    string
+	existed bool
+}
+
+type serviceSnapshot struct {
+	name    string
+	active  bool
+	enabled bool
+}
+
+// handleBatch runs CMD_BATCH steps in order. If a step fails, everything the
+// batch touched is restored and the batch reports one failed result. Files
+// are snapshotted into a directory of the batch's own, keyed by its command
+// ID, which is removed once the batch has committed or rolled back.
+func (p *Processor) handleBatch(ctx context.Context, out Output, commandID string, payload json.RawMessage) (string, error) {
+	var batch protocol.BatchPayload
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+
+	if len(batch.Steps) == 0 {
+		return "", fmt.Errorf("batch has no steps")
+	}
+	for i, step := range batch.Steps {
+		if step.Type == CmdBatch {
+			return "", fmt.Errorf("step %d: nested batches are not allowed", i+1)
+		}
+		if step.Type == CmdUpdateAgent {
+			return "", fmt.Errorf("step %d: agent updates cannot run inside a batch", i+1)
+		}
+		if step.Type == CmdSingBoxApply || step.Type == CmdSingBoxRemove {
+			// The registry lives outside what a batch can snapshot
+			return "", fmt.Errorf("step %d: sing-box fragments cannot change inside a batch", i+1)
+		}
+		if step.Type == CmdFirewallSync {
+			return "", fmt.Errorf("step %d: firewall openings cannot change inside a batch", i+1)
+		}
+		if step.Type == CmdRollbackConfig {
+			var req protocol.RollbackConfigPayload
+			if err := json.Unmarshal(step.Payload, &req); err == nil && req.Path == SingBoxConfigPath {
+				return "", fmt.Errorf("step %d: sing-box fragments cannot change inside a batch", i+1)
+			}
+		}
+	}
+
+	if commandID == "" || strings.ContainsAny(commandID, "/\\.") {
+		return "", fmt.Errorf("invalid command id for batch snapshots")
+	}
+
+	tx := &batchTx{
+		p:            p,
+		ctx:          ctx,
+		out:          out,
+		snapshotDir:  filepath.Join(os.TempDir(), "netly-batch-"+commandID),
+		seenFiles:    make(map[string]bool),
+		seenServices: make(map[string]bool),
+	}
+	defer tx.discard()
+	total := len(batch.Steps)
+	outputs := make([]string, 0, total)
+
+	for i, step := range batch.Steps {
+		p.logger.Info("batch_step_start", zap.Int("step", i+1), zap.Int("total", total), zap.String("type", step.Type))
+
+		output, err := tx.run(step)
+		if err != nil {
+			p.logger.Error("batch_step_failed", zap.Int("step", i+1), zap.String("type", step.Type), zap.Error(err))
+			outputs = append(outputs, fmt.Sprintf("[%d/%d] %s: %s", i+1, total, step.Type, output))
+
+			msg := fmt.Sprintf("step %d/%d (%s) failed: %v", i+1, total, step.Type, err)
+			if rbErr := tx.rollback(); rbErr != nil {
+				p.logger.Error("batch_rollback_incomplete", zap.Error(rbErr))
+				return strings.Join(outputs, "\n"), fmt.Errorf("%s; rollback incomplete: %v", msg, rbErr)
+			}
+			p.logger.Info("batch_rollback_done", zap.Int("files", len(tx.files)), zap.Int("services", len(tx.services)))
+			return strings.Join(outputs, "\n"), fmt.Errorf("%s; rolled back", msg)
+		}
+
+		outputs = append(outputs, fmt.Sprintf("[%d/%d] %s: %s", i+1, total, step.Type, output))
+		p.logger.Info("batch_step_done", zap.Int("step", i+1), zap.Int("total", total), zap.String("type", step.Type))
+	}
+
+	return strings.Join(outputs, "\n"), nil
+}
+
+// run snapshots what a step is about to change and then executes it. A
+// stopped batch fails at the next step, so it is rolled back.
+func (tx *batchTx) run(step protocol.BatchStep) (string, error) {
+	if err := context.Cause(tx.ctx); err != nil {
+		return "", err
+	}
+	files, services, err := touchedBy(step)
+	if err != nil {
+		return "", err
+	}
+	for _, path := range files {
+		if err := tx.snapshotFile(path); err != nil {
+			return "", err
+		}
+	}
+	for _, name := range services {
+		if err := tx.snapshotService(name); err != nil {
+			return "", err
+		}
+	}
+	return tx.p.dispatch(tx.ctx, tx.out, step.Type, step.Payload)
+}
+
+func (tx *batchTx) snapshotFile(path string) error {
+	if tx.seenFiles[path] {
+		return nil
+	}
+
+	existed := tx.p.fileOps.FileExists(path)
+	if existed {
+		if err := tx.p.fileOps.SnapshotConfig(path, tx.snapshotDir); err != nil {
+			return fmt.Errorf("snapshot failed: %w", err)
+		}
+	}
+
+	tx.seenFiles[path] = true
+	tx.files = append(tx.files, fileSnapshot{path: path, existed: existed})
+	return nil
+}
+
+func (tx *batchTx) snapshotService(name string) error {
+	if tx.seenServices[name] {
+		return nil
+	}
+
+	active, err := tx.p.systemd.IsActive(name)
+	if err != nil {
+		return fmt.Errorf("snapshot failed: %w", err)
+	}
+	enabled, err := tx.p.systemd.IsEnabled(name)
+	if err != nil {
+		return fmt.Errorf("snapshot failed: %w", err)
+	}
+
+	tx.seenServices[name] = true
+	tx.services = append(tx.services, serviceSnapshot{name: name, active: active, enabled: enabled})
+	return nil
+}
+
+// rollback restores files first and then services, newest first, so that
+// restarted services come back up with their original configuration
+func (tx *batchTx) rollback() error {
+	var errs []error
+	unitsChanged := false
+
+	for i := len(tx.files) - 1; i >= 0; i-- {
+		f := tx.files[i]
+		var err error
+		if f.existed {
+			err = tx.p.fileOps.RestoreSnapshot(f.path, tx.snapshotDir)
+		} else {
+			err = tx.p.fileOps.DeleteConfig(f.path)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if strings.HasPrefix(f.path, "/etc/systemd/system/") {
+			unitsChanged = true
+		}
+		tx.p.logger.Info("batch_rollback_file", zap.String("path", f.path), zap.Bool("existed", f.existed))
+	}
+
+	if unitsChanged {
+		if err := tx.p.systemd.DaemonReload(); err != nil {
+			errs = append(errs, fmt.Errorf("daemon-reload: %w", err))
+		}
+	}
+
+	for i := len(tx.services) - 1; i >= 0; i-- {
+		svc := tx.services[i]
+		if svc.enabled {
+			if err := tx.p.systemd.Enable(svc.name); err != nil {
+				errs = append(errs, fmt.Errorf("enable %s: %w", svc.name, err))
+			}
+		} else {
+			_ = tx.p.systemd.Disable(svc.name)
+		}
+
+		if svc.active {
+			if err := tx.p.systemd.Restart(svc.name); err != nil {
+				errs = append(errs, fmt.Errorf("restart %s: %w", svc.name, err))
+			}
+		} else {
+			_ = tx.p.systemd.Stop(svc.name)
+		}
+		tx.p.logger.Info("batch_rollback_service", zap.String("service", svc.name), zap.Bool("active", svc.active), zap.Bool("enabled", svc.enabled))
+	}
+
+	return errors.Join(errs...)
+}
+
+// discard removes the batch's snapshots once they are no longer needed
+func (tx *batchTx) discard() {
+	if len(tx.files) == 0 {
+		return
+	}
+	if err := tx.p.fileOps.DiscardSnapshots(tx.snapshotDir); err != nil {
+		tx.p.logger.Warn("batch_snapshot_cleanup_failed", zap.String("dir", tx.snapshotDir), zap.Error(err))
+	}
+}
+
+// touchedBy lists the files and services a step may change
+func touchedBy(step protocol.BatchStep) (files []string, services []string, err error) {
+	switch step.Type {
+	case CmdApplyConfig:
+		var cfg ApplyConfigPayload
+		if err := json.Unmarshal(step.Payload, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		if cfg.TargetPath != "" {
+			files = append(files, cfg.TargetPath)
+		}
+		if cfg.ServiceName != "" {
+			services = append(services, cfg.ServiceName)
+		}
+
+	case CmdInstallService, CmdRemoveService:
+		var svc ServicePayload
+		if err := json.Unmarshal(step.Payload, &svc); err != nil {
+			return nil, nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		if svc.ServiceName != "" {
+			files = append(files, fmt.Sprintf("/etc/systemd/system/%s.service", svc.ServiceName))
+			services = append(services, svc.ServiceName)
+		}
+
+	case CmdRestart, CmdStop, CmdStart:
+		var svc ServicePayload
+		if err := json.Unmarshal(step.Payload, &svc); err != nil {
+			return nil, nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		if svc.ServiceName != "" {
+			services = append(services, svc.ServiceName)
+		}
+
+	case CmdWGApplyInterface, CmdWGRemoveInterface:
+		var wg protocol.WireGuardRemovePayload
+		if err := json.Unmarshal(step.Payload, &wg); err != nil {
+			return nil, nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		if wgInterfaceName.MatchString(wg.Interface) {
+			files = append(files, wgConfigPath(wg.Interface))
+			services = append(services, wgUnit(wg.Interface))
+		}
+
+	case CmdSingBoxApply, CmdSingBoxRemove:
+		files = append(files, SingBoxConfigPath)
+		services = append(services, singBoxService)
+
+	case CmdRollbackConfig:
+		var req protocol.RollbackConfigPayload
+		if err := json.Unmarshal(step.Payload, &req); err != nil {
+			return nil, nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		if req.Path != "" {
+			files = append(files, req.Path)
+		}
+		if req.Service != "" {
+			services = append(services, req.Service)
+		}
+
+	case CmdExecuteScript:
+		var script ScriptPayload
+		if err := json.Unmarshal(step.Payload, &script); err != nil {
+			return nil, nil, fmt.Errorf("invalid payload: %w", err)
+		}
+		files = append(files, script.Files...)
+		services = append(services, script.Services...)
+	}
+
+	return files, services, nil
+}
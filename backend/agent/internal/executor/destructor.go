@@ -4,60 +4,95 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-)
-
-// PerformSelfDestruct executes the self-destruction sequence.
-// It creates a temporary shell script to handle the cleanup asynchronously
-// to ensure the agent can respond 200 OK before dying.
-func PerformSelfDestruct() error {
-	// Define the cleanup script
-	scriptContent := `#!/bin/bash
-# Wait for agent to respond to API
-sleep 2
+	"strings"
 
-echo "Stopping services..."
-sudo systemctl stop netly-agent || true
-sudo systemctl stop sing-box || true
-# Stop all wireguard interfaces managed by us
-sudo systemctl stop wg-quick@wg0 || true
+	"github.com/netly/protocol"
+)
 
-echo "Cleaning network..."
-sudo ip link delete tun-core || true
-sudo ip link delete tun-users || true
+// destructSteps remove what Netly put on the node, in order. Every command
+// tolerates what is already gone, so a destruct that was interrupted can be
+// repeated.
+var destructSteps = []struct {
+	stage  string
+	script string
+}{
+	{protocol.DestructStoppingService, `
+sudo systemctl disable --now sing-box || true
+for unit in $(systemctl list-units --all --plain --no-legend 'wg-quick@*' | awk '{print $1}'); do
+	sudo systemctl disable --now "$unit" || true
+done
+`},
+	{protocol.DestructCleaningNetwork, `
+sudo ip link delete tun-core 2>/dev/null || true
+sudo ip link delete tun-users 2>/dev/null || true
 sudo ip route flush table 100 || true
-# Flush Netly chains if they exist
-sudo iptables -D FORWARD -j NETLY_FORWARD || true
-sudo iptables -F NETLY_FORWARD || true
-sudo iptables -X NETLY_FORWARD || true
-
-echo "Wiping files..."
-sudo rm -rf /etc/netly
-sudo rm -rf /usr/local/bin/netly-agent
+sudo iptables -D INPUT -j NETLY_INPUT 2>/dev/null || true
+sudo iptables -F NETLY_INPUT 2>/dev/null || true
+sudo iptables -X NETLY_INPUT 2>/dev/null || true
+sudo iptables -D FORWARD -j NETLY_FORWARD 2>/dev/null || true
+sudo iptables -F NETLY_FORWARD 2>/dev/null || true
+sudo iptables -X NETLY_FORWARD 2>/dev/null || true
+sudo iptables -t nat -D POSTROUTING -j NETLY_POSTROUTING 2>/dev/null || true
+sudo iptables -t nat -F NETLY_POSTROUTING 2>/dev/null || true
+sudo iptables -t nat -X NETLY_POSTROUTING 2>/dev/null || true
+sudo nft delete table inet netly 2>/dev/null || true
+if [ -f /etc/firewalld/services/netly.xml ]; then
+	sudo firewall-cmd --permanent --remove-service=netly 2>/dev/null || true
+	sudo rm -f /etc/firewalld/services/netly.xml
+	sudo firewall-cmd --reload 2>/dev/null || true
+fi
+while sudo ip -4 rule del priority 5200 2>/dev/null; do :; done
+while sudo ip -6 rule del priority 5200 2>/dev/null; do :; done
+`},
+	{protocol.DestructWipingFiles, `
+sudo rm -rf /etc/sing-box/config.json /etc/wireguard/*.conf
+sudo rm -rf /etc/netly /var/lib/netly
+`},
+}
 
-echo "Removing service..."
-sudo systemctl disable netly-agent || true
-sudo rm /etc/systemd/system/netly-agent.service
+// removeAgentScript runs detached once everything else is gone. It waits so
+// the last progress report can leave before the agent is stopped.
+const removeAgentScript = `#!/bin/bash
+sleep 2
+sudo systemctl disable --now netly-agent || true
+sudo rm -f /etc/systemd/system/netly-agent.service
 sudo systemctl daemon-reload
-
-echo "Self-destruct complete. Goodbye."
+sudo rm -f /usr/local/bin/netly-agent /usr/local/bin/netly-agent.prev
+rm -f "$0"
 `
 
-	// Write script to /tmp
-	scriptPath := "/tmp/netly_self_destruct.sh"
-	if err := os.WriteFile(scriptPath, []byte(scriptContent), 0755); err != nil {
-		return fmt.Errorf("failed to create destruct script: %w", err)
+// PerformSelfDestruct removes managed services, network state and files, then
+// hands removing the agent itself to a detached script. progress is called as
+// each stage finishes, with the error it hit if any; a failed stage does not
+// stop the ones after it.
+func PerformSelfDestruct(progress func(stage string, err error)) error {
+	var failed []string
+	for _, step := range destructSteps {
+		output, err := exec.Command("/bin/bash", "-c", step.script).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+			failed = append(failed, step.stage)
+		}
+		progress(step.stage, err)
 	}
 
-	// Execute script in background (nohup)
-	// We use "nohup" to ensure it survives when the agent process dies
-	cmd := exec.Command("nohup", "/bin/bash", scriptPath)
-	// Redirect output to /dev/null
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-	
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start destruct script: %w", err)
+	scriptPath := "/tmp/netly_self_destruct.sh"
+	if err := os.WriteFile(scriptPath, []byte(removeAgentScript), 0755); err != nil {
+		err = fmt.Errorf("failed to create destruct script: %w", err)
+		progress(protocol.DestructRemovingAgent, err)
+		return err
+	}
+	// A transient unit keeps the script alive when systemd stops the agent
+	cmd := exec.Command("sudo", "systemd-run", "--unit=netly-agent-destruct", "--collect", "/bin/bash", scriptPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		err = fmt.Errorf("failed to start destruct script: %s: %w", strings.TrimSpace(string(output)), err)
+		progress(protocol.DestructRemovingAgent, err)
+		return err
 	}
+	progress(protocol.DestructRemovingAgent, nil)
 
+	if len(failed) > 0 {
+		return fmt.Errorf("stages failed: %s", strings.Join(failed, ", "))
+	}
 	return nil
 }
@@ -0,0 +1,110 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/netly/agent/internal/stats"
+	"github.com/netly/protocol"
+)
+
+// wgStaleHandshake is how old a peer's last handshake may be before the
+// diagnostics call it down. WireGuard re-handshakes every two minutes.
+const wgStaleHandshake = 3 * time.Minute
+
+// Diagnostics checks the node-level state the agent manages: forwarding, the
+// sing-box service and every WireGuard interface with a config file. It only
+// reads, so it is safe to run while a command executes.
+func (p *Processor) Diagnostics() []protocol.DiagnosticCheck {
+	checks := []protocol.DiagnosticCheck{ipForwardCheck()}
+
+	if p.fileOps.FileExists(SingBoxConfigPath) {
+		check := p.serviceCheck(singBoxService)
+		if p.singbox != nil {
+			check.Detail = fmt.Sprintf("%s, %d fragments", check.Detail, p.singbox.Len())
+		}
+		checks = append(checks, check)
+	}
+
+	for _, iface := range managedWireGuardInterfaces() {
+		check := p.serviceCheck(wgUnit(iface))
+		if check.OK {
+			check = wireguardPeersCheck(iface, check)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// managedWireGuardInterfaces lists the interfaces with a config file the
+// agent could have written
+func managedWireGuardInterfaces() []string {
+	confs, _ := filepath.Glob(filepath.Join(wireguardDir, "*.conf"))
+	var ifaces []string
+	for _, conf := range confs {
+		iface := strings.TrimSuffix(filepath.Base(conf), ".conf")
+		if wgInterfaceName.MatchString(iface) {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces
+}
+
+func ipForwardCheck() protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "ip_forward"}
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK = strings.TrimSpace(string(data)) == "1"
+	if !check.OK {
+		check.Detail = "net.ipv4.ip_forward is off"
+	}
+	return check
+}
+
+func (p *Processor) serviceCheck(name string) protocol.DiagnosticCheck {
+	check := protocol.DiagnosticCheck{Name: "service:" + name}
+	active, err := p.systemd.IsActive(name)
+	switch {
+	case err != nil:
+		check.Detail = err.Error()
+	case active:
+		check.OK, check.Detail = true, "active"
+	default:
+		check.Detail = "inactive"
+	}
+	return check
+}
+
+// wireguardPeersCheck fails the interface's check when a peer it dials has
+// not completed a recent handshake
+func wireguardPeersCheck(iface string, check protocol.DiagnosticCheck) protocol.DiagnosticCheck {
+	peers, err := stats.WireGuardPeers(iface)
+	if err != nil {
+		check.OK, check.Detail = false, err.Error()
+		return check
+	}
+
+	now := time.Now()
+	var stale []string
+	for _, peer := range peers {
+		if peer.Endpoint == "" {
+			continue
+		}
+		if peer.LatestHandshake == 0 || now.Sub(time.Unix(peer.LatestHandshake, 0)) > wgStaleHandshake {
+			stale = append(stale, peer.Endpoint)
+		}
+	}
+	if len(stale) > 0 {
+		check.OK = false
+		check.Detail = fmt.Sprintf("no recent handshake with %s", strings.Join(stale, ", "))
+		return check
+	}
+	check.Detail = fmt.Sprintf("active, %d peers", len(peers))
+	return check
+}
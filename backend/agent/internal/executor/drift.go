@@ -0,0 +1,172 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/netly/agent/internal/manifest"
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+// writesManagedFiles are the commands whose files become managed. Other
+// commands, scripts included, only refresh files that are managed already.
+var writesManagedFiles = map[string]bool{
+	CmdApplyConfig:      true,
+	CmdInstallService:   true,
+	CmdWGApplyInterface: true,
+	CmdSingBoxApply:     true,
+	CmdRollbackConfig:   true,
+}
+
+// SetManifest enables drift reports. An empty manifest is seeded with the
+// sing-box and WireGuard configs already on the node, written before the
+// agent kept one.
+func (p *Processor) SetManifest(m *manifest.Manifest) {
+	p.manifest = m
+	if m.Len() > 0 {
+		return
+	}
+	if p.fileOps.FileExists(SingBoxConfigPath) {
+		_ = m.Set(SingBoxConfigPath, singBoxService)
+	}
+	for _, iface := range managedWireGuardInterfaces() {
+		_ = m.Set(wgConfigPath(iface), wgUnit(iface))
+	}
+}
+
+// ManagedFiles hashes every managed file and reads the state of its unit.
+// It only reads, and returns nil without a manifest.
+func (p *Processor) ManagedFiles() []protocol.ManagedFile {
+	if p.manifest == nil {
+		return nil
+	}
+	entries := p.manifest.Entries()
+	files := make([]protocol.ManagedFile, 0, len(entries))
+	for _, e := range entries {
+		files = append(files, p.managedFile(e.Path, e.Unit))
+	}
+	return files
+}
+
+// recordManaged updates the manifest after a command succeeded and returns
+// the managed files it touched, as it left them, for the backend to take as
+// intended
+func (p *Processor) recordManaged(cmdType string, payload json.RawMessage) []protocol.ManagedFile {
+	if p.manifest == nil {
+		return nil
+	}
+
+	steps := []protocol.BatchStep{{Type: cmdType, Payload: payload}}
+	if cmdType == CmdBatch {
+		var batch protocol.BatchPayload
+		if err := json.Unmarshal(payload, &batch); err != nil {
+			return nil
+		}
+		steps = batch.Steps
+	}
+
+	var files []protocol.ManagedFile
+	seen := make(map[string]bool)
+	report := func(path, unit string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		f := p.managedFile(path, unit)
+		if f.Digest != "" && p.revisions != nil {
+			f.Revision, f.Content = p.keepRevision(path)
+		}
+		if !p.fileOps.FileExists(path) {
+			if err := p.manifest.Remove(path); err != nil {
+				p.logger.Warn("failed to update manifest", zap.String("path", path), zap.Error(err))
+			}
+		}
+		files = append(files, f)
+	}
+
+	for _, step := range steps {
+		paths, services, err := touchedBy(step)
+		if err != nil {
+			continue
+		}
+		unit := ""
+		if len(services) == 1 {
+			unit = services[0]
+		}
+		for _, path := range paths {
+			if !p.manifest.Has(path) {
+				if !writesManagedFiles[step.Type] || !p.fileOps.FileExists(path) {
+					continue
+				}
+				if err := p.manifest.Set(path, unit); err != nil {
+					p.logger.Warn("failed to update manifest", zap.String("path", path), zap.Error(err))
+					continue
+				}
+			}
+			report(path, unit)
+		}
+		// Starting or stopping a unit changes the intended state of the files
+		// it serves
+		for _, e := range p.manifest.Entries() {
+			for _, svc := range services {
+				if e.Unit == svc {
+					report(e.Path, e.Unit)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// keepRevision stores the file's current content as a revision, unless the
+// newest one already has it, and returns that revision and content
+func (p *Processor) keepRevision(path string) (string, string) {
+	content, err := p.fileOps.ReadConfig(path)
+	if err != nil {
+		return "", ""
+	}
+	rev, err := p.revisions.Record(path, content)
+	if err != nil {
+		p.logger.Warn("failed to keep config revision", zap.String("path", path), zap.Error(err))
+		return "", ""
+	}
+	if path == SingBoxConfigPath {
+		p.keepSingBoxFragments()
+	}
+	return rev.ID, content
+}
+
+// keepSingBoxFragments keeps the registry next to each sing-box config
+// revision, so a rollback can put back the fragments that composed it
+func (p *Processor) keepSingBoxFragments() {
+	if p.singbox == nil {
+		return
+	}
+	snapshot, err := p.singbox.Snapshot()
+	if err == nil {
+		_, err = p.revisions.Record(singBoxFragmentsRevisions, snapshot)
+	}
+	if err != nil {
+		p.logger.Warn("failed to keep sing-box fragments", zap.Error(err))
+	}
+}
+
+func (p *Processor) managedFile(path, unit string) protocol.ManagedFile {
+	f := protocol.ManagedFile{Path: path, Unit: unit}
+	if p.fileOps.FileExists(path) {
+		if content, err := p.fileOps.ReadConfig(path); err == nil {
+			sum := sha256.Sum256([]byte(content))
+			f.Digest = hex.EncodeToString(sum[:])
+		}
+	}
+	if unit != "" {
+		if state, err := p.systemd.State(unit); err == nil {
+			f.UnitState = state
+		} else {
+			f.UnitState = "unknown"
+		}
+	}
+	return f
+}
@@ -0,0 +1,356 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netly/agent/internal/network"
+	"github.com/netly/protocol"
+)
+
+// DryRun stands in for all three backends and records what a command would
+// do instead of doing it. Reads see the node as it is, overlaid with the
+// changes recorded so far, so a later command in the same run builds on an
+// earlier one the way it would for real. Nothing needs root.
+type DryRun struct {
+	journalPath string
+
+	mu      sync.Mutex
+	actions []protocol.PlannedAction
+	// Simulated node state: file contents (nil when deleted) and unit states
+	files   map[string]*string
+	active  map[string]bool
+	enabled map[string]bool
+}
+
+// dryRunEntry is one line of the dry-run journal
+type dryRunEntry struct {
+	CommandID string                   `json:"command_id"`
+	Type      string                   `json:"type"`
+	Timestamp int64                    `json:"timestamp"`
+	Error     string                   `json:"error,omitempty"`
+	Actions   []protocol.PlannedAction `json:"actions"`
+}
+
+// NewDryRun records into journalPath, a JSON-lines file; an empty path keeps
+// the record in the command results only
+func NewDryRun(journalPath string) *DryRun {
+	return &DryRun{
+		journalPath: journalPath,
+		files:       make(map[string]*string),
+		active:      make(map[string]bool),
+		enabled:     make(map[string]bool),
+	}
+}
+
+func (d *DryRun) Backends() Backends {
+	return Backends{
+		Systemd: dryRunSystemd{d},
+		Files:   dryRunFiles{d},
+		Scripts: dryRunScripts{d},
+	}
+}
+
+// Begin starts recording a command
+func (d *DryRun) Begin() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.actions = nil
+}
+
+// End stops recording, appends the command to the journal and returns the
+// report that replaces the command's output
+func (d *DryRun) End(cmd Command, output string, cmdErr error) string {
+	d.mu.Lock()
+	actions := d.actions
+	d.actions = nil
+	d.mu.Unlock()
+
+	if actions == nil {
+		actions = []protocol.PlannedAction{}
+	}
+	entry := dryRunEntry{CommandID: cmd.ID, Type: cmd.Type, Timestamp: time.Now().Unix(), Actions: actions}
+	if cmdErr != nil {
+		entry.Error = cmdErr.Error()
+	}
+	if err := d.appendJournal(entry); err != nil {
+		output = fmt.Sprintf("%s (dry-run journal not written: %v)", output, err)
+	}
+
+	report, _ := json.Marshal(protocol.DryRunReport{Actions: actions, Output: output})
+	return string(report)
+}
+
+func (d *DryRun) appendJournal(entry dryRunEntry) error {
+	if d.journalPath == "" {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.journalPath), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func (d *DryRun) record(action protocol.PlannedAction) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.actions = append(d.actions, action)
+}
+
+// readFile returns the simulated content of path, falling back to the real
+// file when the run has not touched it
+func (d *DryRun) readFile(path string) (string, bool) {
+	d.mu.Lock()
+	content, touched := d.files[path]
+	d.mu.Unlock()
+	if touched {
+		if content == nil {
+			return "", false
+		}
+		return *content, true
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func (d *DryRun) setFile(path string, content *string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files[path] = content
+}
+
+// dryRunFiles records file changes; paths are validated like FileOps does
+type dryRunFiles struct{ d *DryRun }
+
+func (f dryRunFiles) WriteConfig(path string, content string) error {
+	return f.WriteConfigWithPerms(path, content, 0600)
+}
+
+func (f dryRunFiles) WriteConfigWithPerms(path string, content string, perm os.FileMode) error {
+	if err := (&FileOps{}).validatePath(path); err != nil {
+		return err
+	}
+	f.d.record(protocol.PlannedAction{Kind: protocol.ActionWriteFile, Target: path, Detail: fmt.Sprintf("%04o", perm), Content: content})
+	f.d.setFile(path, &content)
+	return nil
+}
+
+func (f dryRunFiles) ReadConfig(path string) (string, error) {
+	if err := (&FileOps{}).validatePath(path); err != nil {
+		return "", err
+	}
+	content, ok := f.d.readFile(path)
+	if !ok {
+		return "", fmt.Errorf("failed to read file %s: not found", path)
+	}
+	return content, nil
+}
+
+func (f dryRunFiles) DeleteConfig(path string) error {
+	if err := (&FileOps{}).validatePath(path); err != nil {
+		return err
+	}
+	f.d.record(protocol.PlannedAction{Kind: protocol.ActionDeleteFile, Target: path})
+	f.d.setFile(path, nil)
+	return nil
+}
+
+func (f dryRunFiles) FileExists(path string) bool {
+	_, ok := f.d.readFile(path)
+	return ok
+}
+
+func (f dryRunFiles) BackupConfig(path string) error {
+	if err := (&FileOps{}).validatePath(path); err != nil {
+		return err
+	}
+	content, ok := f.d.readFile(path)
+	if !ok {
+		return nil
+	}
+	f.d.record(protocol.PlannedAction{Kind: protocol.ActionBackupFile, Target: path})
+	f.d.setFile(path+".bak", &content)
+	return nil
+}
+
+func (f dryRunFiles) SnapshotConfig(path string, dir string) error {
+	if err := (&FileOps{}).validatePath(path); err != nil {
+		return err
+	}
+	content, ok := f.d.readFile(path)
+	if !ok {
+		return fmt.Errorf("failed to snapshot file %s: not found", path)
+	}
+	f.d.record(protocol.PlannedAction{Kind: protocol.ActionBackupFile, Target: path})
+	f.d.setFile(snapshotPath(dir, path), &content)
+	return nil
+}
+
+func (f dryRunFiles) RestoreSnapshot(path string, dir string) error {
+	if err := (&FileOps{}).validatePath(path); err != nil {
+		return err
+	}
+	content, ok := f.d.readFile(snapshotPath(dir, path))
+	if !ok {
+		return fmt.Errorf("no snapshot found for %s", path)
+	}
+	f.d.record(protocol.PlannedAction{Kind: protocol.ActionRestoreFile, Target: path})
+	f.d.setFile(path, &content)
+	return nil
+}
+
+// DiscardSnapshots forgets the simulated snapshots; removing scratch files
+// is not worth a planned action
+func (f dryRunFiles) DiscardSnapshots(dir string) error {
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	for path := range f.d.files {
+		if strings.HasPrefix(path, prefix) {
+			delete(f.d.files, path)
+		}
+	}
+	return nil
+}
+
+func (f dryRunFiles) CreateServiceFile(serviceName, content string) (string, error) {
+	if serviceName == "" {
+		return "", fmt.Errorf("service name cannot be empty")
+	}
+	if strings.ContainsAny(serviceName, "/\\") {
+		return "", fmt.Errorf("invalid service name")
+	}
+	path := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
+	return path, f.WriteConfigWithPerms(path, content, 0644)
+}
+
+// dryRunSystemd records unit changes. Queries answer from the simulated
+// state, or ask systemd without sudo for units the run has not touched.
+type dryRunSystemd struct{ d *DryRun }
+
+func (s dryRunSystemd) action(verb, name string, active, enabled *bool) error {
+	if err := (&SystemdManager{}).validateServiceName(name); err != nil {
+		return err
+	}
+	s.d.record(protocol.PlannedAction{Kind: protocol.ActionSystemctl, Target: name, Detail: verb})
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if active != nil {
+		s.d.active[name] = *active
+	}
+	if enabled != nil {
+		s.d.enabled[name] = *enabled
+	}
+	return nil
+}
+
+var dryRunOn, dryRunOff = true, false
+
+func (s dryRunSystemd) EnableAndStart(name string) error {
+	return s.action("enable --now", name, &dryRunOn, &dryRunOn)
+}
+func (s dryRunSystemd) Start(name string) error   { return s.action("start", name, &dryRunOn, nil) }
+func (s dryRunSystemd) Stop(name string) error    { return s.action("stop", name, &dryRunOff, nil) }
+func (s dryRunSystemd) Restart(name string) error { return s.action("restart", name, &dryRunOn, nil) }
+func (s dryRunSystemd) Reload(name string) error  { return s.action("reload", name, nil, nil) }
+func (s dryRunSystemd) Enable(name string) error  { return s.action("enable", name, nil, &dryRunOn) }
+func (s dryRunSystemd) Disable(name string) error { return s.action("disable", name, nil, &dryRunOff) }
+
+func (s dryRunSystemd) DaemonReload() error {
+	s.d.record(protocol.PlannedAction{Kind: protocol.ActionSystemctl, Detail: "daemon-reload"})
+	return nil
+}
+
+func (s dryRunSystemd) IsActive(name string) (bool, error) {
+	s.d.mu.Lock()
+	active, touched := s.d.active[name]
+	s.d.mu.Unlock()
+	if touched {
+		return active, nil
+	}
+	return exec.Command("systemctl", "is-active", "--quiet", name).Run() == nil, nil
+}
+
+func (s dryRunSystemd) IsEnabled(name string) (bool, error) {
+	s.d.mu.Lock()
+	enabled, touched := s.d.enabled[name]
+	s.d.mu.Unlock()
+	if touched {
+		return enabled, nil
+	}
+	return exec.Command("systemctl", "is-enabled", "--quiet", name).Run() == nil, nil
+}
+
+func (s dryRunSystemd) State(name string) (string, error) {
+	s.d.mu.Lock()
+	active, touched := s.d.active[name]
+	s.d.mu.Unlock()
+	switch {
+	case touched && active:
+		return "active/running", nil
+	case touched:
+		return "inactive/dead", nil
+	}
+	return (&SystemdManager{}).State(name)
+}
+
+func (s dryRunSystemd) Status(name string) (string, error) {
+	state, err := s.State(name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s: %s (dry run)", name, state), nil
+}
+
+// Commands is the network.Runner of a dry run: queries run without sudo,
+// which is enough to read ip rules, and changes are recorded
+func (d *DryRun) Commands() network.Runner {
+	return dryRunCommands{d}
+}
+
+type dryRunCommands struct{ d *DryRun }
+
+func (c dryRunCommands) Query(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+func (c dryRunCommands) Run(stdin string, name string, args ...string) error {
+	c.d.record(protocol.PlannedAction{Kind: protocol.ActionCommand, Target: name, Detail: strings.Join(args, " "), Content: stdin})
+	return nil
+}
+
+// dryRunScripts records scripts and reports them as run
+type dryRunScripts struct{ d *DryRun }
+
+func (r dryRunScripts) Execute(command string) (*CommandResult, error) {
+	r.d.record(protocol.PlannedAction{Kind: protocol.ActionScript, Target: "sh", Content: command})
+	return &CommandResult{Success: true}, nil
+}
+
+func (r dryRunScripts) ExecuteScript(ctx context.Context, script string, interpreter string, out Output) (*CommandResult, error) {
+	if interpreter == "" {
+		interpreter = "bash"
+	}
+	r.d.record(protocol.PlannedAction{Kind: protocol.ActionScript, Target: interpreter, Content: script})
+	return &CommandResult{Success: true}, nil
+}
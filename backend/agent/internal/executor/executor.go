@@ -5,8 +5,13 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os/exec"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/netly/protocol"
 )
 
 type CommandResult struct {
@@ -68,21 +73,53 @@ func (e *Executor) Execute(command string) (*CommandResult, error) {
 	return result, nil
 }
 
-// ExecuteScript writes a script to a temp file and executes it
-func (e *Executor) ExecuteScript(script string, interpreter string) (*CommandResult, error) {
+const (
+	// stopGracePeriod is how long a stopped script gets to exit after
+	// SIGTERM before its process group is killed
+	stopGracePeriod = 10 * time.Second
+
+	// stopKillWait is how long the killed group gets to release the
+	// script's output before the agent stops waiting for it
+	stopKillWait = 2 * time.Second
+)
+
+// Output receives a running command's output as it is produced. stream is
+// protocol.StreamStdout or protocol.StreamStderr; data is only valid for the
+// duration of the call.
+type Output func(stream string, data []byte)
+
+// outputWriter feeds one stream of a process into an Output
+type outputWriter struct {
+	stream string
+	out    Output
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.out(w.stream, p)
+	return len(p), nil
+}
+
+// ExecuteScript runs a script, passing its output to out as it arrives when
+// out is set. The script is stopped once ctx is done; a ctx without a
+// deadline gets the executor's timeout.
+func (e *Executor) ExecuteScript(ctx context.Context, script string, interpreter string, out Output) (*CommandResult, error) {
 	if interpreter == "" {
 		interpreter = "bash"
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
-	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, e.timeout, fmt.Errorf("script timed out after %v", e.timeout))
+		defer cancel()
+	}
 
 	start := time.Now()
 
 	var cmd *exec.Cmd
 	// Use sudo sh -c for shell interpreters to ensure complex commands (pipes, redirects) work with permissions
 	// We use base64 encoding to avoid any issues with quoting or special characters
-	if interpreter == "sh" || interpreter == "bash" {
+	viaSudo := interpreter == "sh" || interpreter == "bash"
+	if viaSudo {
 		encodedScript := base64.StdEncoding.EncodeToString([]byte(script))
 		// echo 'ENCODED' | base64 -d | interpreter
 		command := fmt.Sprintf("echo '%s' | base64 -d | %s", encodedScript, interpreter)
@@ -91,10 +128,16 @@ func (e *Executor) ExecuteScript(script string, interpreter string) (*CommandRes
 		cmd = exec.CommandContext(ctx, interpreter)
 		cmd.Stdin = bytes.NewBufferString(script)
 	}
+	finished := stopProcessGroup(cmd, viaSudo)
+	defer finished()
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	if out != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, outputWriter{stream: protocol.StreamStdout, out: out})
+		cmd.Stderr = io.MultiWriter(&stderr, outputWriter{stream: protocol.StreamStderr, out: out})
+	}
 
 	err := cmd.Run()
 	duration := time.Since(start)
@@ -109,9 +152,59 @@ func (e *Executor) ExecuteScript(script string, interpreter string) (*CommandRes
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			result.ExitCode = exitErr.ExitCode()
 		}
+		// Report why the script was stopped rather than the signal it died of
+		if ctx.Err() != nil {
+			return result, context.Cause(ctx)
+		}
 		return result, err
 	}
 
 	result.Success = true
 	return result, nil
 }
+
+// stopProcessGroup makes a stopped command take its whole process group
+// down, so a pipeline or a child like apt-get does not outlive it. The group
+// gets SIGTERM, and SIGKILL if it is still there after stopGracePeriod.
+// Scripts run through sudo belong to root, so their group is signalled
+// through sudo. The returned func must be called once the command has
+// finished, so a group that exited in time is not signalled again.
+func stopProcessGroup(cmd *exec.Cmd, viaSudo bool) func() {
+	signal := func(sig syscall.Signal) error {
+		pgid := cmd.Process.Pid
+		if viaSudo {
+			return exec.Command("sudo", "-n", "kill", fmt.Sprintf("-%d", sig), "--", fmt.Sprintf("-%d", pgid)).Run()
+		}
+		return syscall.Kill(-pgid, sig)
+	}
+
+	var mu sync.Mutex
+	var kill *time.Timer
+	done := false
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		kill = time.AfterFunc(stopGracePeriod, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !done {
+				_ = signal(syscall.SIGKILL)
+			}
+		})
+		return signal(syscall.SIGTERM)
+	}
+	// Wait only kills the direct child, sudo, once WaitDelay passes; the
+	// group is killed before that
+	cmd.WaitDelay = stopGracePeriod + stopKillWait
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
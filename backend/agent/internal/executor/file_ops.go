@@ -65,15 +65,9 @@ func (f *FileOps) WriteConfigWithPerms(path string, content string, perm os.File
 
 	// Since we moved a file created by the current user, it might be owned by current user.
 	// Usually system files should be owned by root.
-<<<<<<< HEAD
-	// We should probably chown to root:root? 
-	// The prompt implies we are restricted user 'amin', so we probably want root ownership for /etc files.
-	// But let's check if 'chown' is allowed or needed. 
-=======
 	// We should probably chown to root:root?
 	// The prompt implies we are restricted user 'amin', so we probably want root ownership for /etc files.
 	// But let's check if 'chown' is allowed or needed.
->>>>>>> 4fdbfb934651dda52648026c4d1efc336b1e46c1
 	// If the file is readable by the service (if needed), root owner is safer.
 	// 'systemd' needs root owned unit files? Usually yes.
 	// Let's add chown root:root just in case.
@@ -131,13 +125,69 @@ func (f *FileOps) BackupConfig(path string) error {
 
 	backupPath := path + ".bak"
 	// Use sudo cp
-	if err := exec.Command("sudo", "cp", path, backupPath).Run(); err != nil {
+	if err := exec.Command("sudo", "cp", "-p", path, backupPath).Run(); err != nil {
 		return fmt.Errorf("failed to backup file %s: %w", path, err)
 	}
 	
 	return nil
 }
 
+// SnapshotConfig copies a config file into dir, under its own path, so that
+// RestoreSnapshot can put it back
+func (f *FileOps) SnapshotConfig(path string, dir string) error {
+	if err := f.validatePath(path); err != nil {
+		return err
+	}
+
+	snapPath := snapshotPath(dir, path)
+	if err := exec.Command("sudo", "mkdir", "-p", filepath.Dir(snapPath)).Run(); err != nil {
+		return fmt.Errorf("failed to create snapshot directory for %s: %w", path, err)
+	}
+	// Use sudo cp -p to keep the original mode and owner
+	if err := exec.Command("sudo", "cp", "-p", path, snapPath).Run(); err != nil {
+		return fmt.Errorf("failed to snapshot file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// RestoreSnapshot puts back the copy of path saved in dir by SnapshotConfig
+func (f *FileOps) RestoreSnapshot(path string, dir string) error {
+	if err := f.validatePath(path); err != nil {
+		return err
+	}
+
+	snapPath := snapshotPath(dir, path)
+	if !f.FileExists(snapPath) {
+		return fmt.Errorf("no snapshot found for %s", path)
+	}
+
+	if err := exec.Command("sudo", "cp", "-p", snapPath, path).Run(); err != nil {
+		return fmt.Errorf("failed to restore file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// DiscardSnapshots removes dir and every snapshot saved in it
+func (f *FileOps) DiscardSnapshots(dir string) error {
+	clean := filepath.Clean(dir)
+	if !filepath.IsAbs(clean) || clean == "/" {
+		return fmt.Errorf("invalid snapshot directory: %s", dir)
+	}
+
+	if err := exec.Command("sudo", "rm", "-rf", clean).Run(); err != nil {
+		return fmt.Errorf("failed to remove snapshots in %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// snapshotPath is where SnapshotConfig keeps path inside dir
+func snapshotPath(dir string, path string) string {
+	return filepath.Join(dir, filepath.Clean(path))
+}
+
 // validatePath ensures the path is within allowed directories
 func (f *FileOps) validatePath(path string) error {
 	if path == "" {
@@ -0,0 +1,50 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/netly/agent/internal/network"
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+// portsNetworkOwner owns the inbound openings in the network manager. The
+// backend always sends the full set, so one owner holds all of them.
+const portsNetworkOwner = "ports"
+
+// handleFirewallSync makes the node's inbound openings match the payload
+// exactly; ports no longer listed are closed again
+func (p *Processor) handleFirewallSync(payload json.RawMessage) (string, error) {
+	var req protocol.FirewallSyncPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if p.network == nil {
+		return "", fmt.Errorf("network manager is not available on this agent")
+	}
+
+	var rules network.Rules
+	opened := make([]string, 0, len(req.Openings))
+	for _, o := range req.Openings {
+		rules.Input = append(rules.Input, network.Input{Port: o.Port, Protocol: o.Protocol})
+		opened = append(opened, fmt.Sprintf("%d/%s", o.Port, o.Protocol))
+	}
+
+	p.logger.Info("firewall_sync_start", zap.Int("openings", len(rules.Input)))
+	if len(rules.Input) == 0 {
+		if err := p.network.Remove(portsNetworkOwner); err != nil {
+			return "", fmt.Errorf("failed to close ports: %w", err)
+		}
+	} else if err := p.network.Apply(portsNetworkOwner, rules); err != nil {
+		return "", fmt.Errorf("failed to open ports: %w", err)
+	}
+	p.logger.Info("firewall_sync_done", zap.Strings("ports", opened))
+
+	backend, _ := p.network.Backend()
+	if len(opened) == 0 {
+		return fmt.Sprintf("no ports open (%s)", backend), nil
+	}
+	return fmt.Sprintf("open ports (%s): %s", backend, strings.Join(opened, ", ")), nil
+}
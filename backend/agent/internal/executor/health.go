@@ -0,0 +1,119 @@
+package executor
+
+import (
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/netly/protocol"
+)
+
+// statusTailLines is how much of `systemctl status` a down unit reports; the
+// last journal lines usually say why it stopped
+const statusTailLines = 3
+
+// Health reports every unit the agent manages: sing-box when it has a config
+// and wg-quick for each WireGuard interface with a config file. It is sent with
+// every heartbeat, so it only reads and never returns nil.
+func (p *Processor) Health() []protocol.ComponentHealth {
+	components := []protocol.ComponentHealth{}
+
+	if p.fileOps.FileExists(SingBoxConfigPath) {
+		c := p.componentHealth(singBoxService, protocol.ComponentService)
+		if c.Active {
+			c.ListenPorts = processListenPorts(singBoxService)
+		}
+		components = append(components, c)
+	}
+
+	for _, iface := range managedWireGuardInterfaces() {
+		c := p.componentHealth(wgUnit(iface), protocol.ComponentWireGuard)
+		c.Interface = iface
+		c.InterfaceUp = interfaceUp(iface)
+		if c.InterfaceUp {
+			if port := wireguardListenPort(iface); port != 0 {
+				c.ListenPorts = []int{port}
+			}
+		}
+		components = append(components, c)
+	}
+	return components
+}
+
+func (p *Processor) componentHealth(unit, kind string) protocol.ComponentHealth {
+	c := protocol.ComponentHealth{Name: unit, Kind: kind}
+	state, err := p.systemd.State(unit)
+	if err != nil {
+		c.State, c.Detail = "unknown", err.Error()
+		return c
+	}
+	c.State = state
+	c.Active = strings.HasPrefix(state, "active/")
+	if !c.Active {
+		status, _ := p.systemd.Status(unit)
+		c.Detail = tailLines(status, statusTailLines)
+	}
+	return c
+}
+
+func interfaceUp(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	return iface.Flags&net.FlagUp != 0
+}
+
+func wireguardListenPort(iface string) int {
+	output, err := exec.Command("sudo", "-n", "wg", "show", iface, "listen-port").Output()
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(strings.TrimSpace(string(output)))
+	return port
+}
+
+// processListenPorts returns the TCP and UDP ports a process is bound to,
+// read from `ss`, whose users column names the owning process:
+//
+//	tcp LISTEN 0 4096 *:443 *:* users:(("sing-box",pid=812,fd=9))
+func processListenPorts(process string) []int {
+	output, err := exec.Command("sudo", "-n", "ss", "-Hlntup").Output()
+	if err != nil {
+		return nil
+	}
+
+	owner := `(("` + process + `",`
+	seen := make(map[int]bool)
+	var ports []int
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 7 || !strings.Contains(fields[6], owner) {
+			continue
+		}
+		local := fields[4]
+		port, err := strconv.Atoi(local[strings.LastIndex(local, ":")+1:])
+		if err != nil || seen[port] {
+			continue
+		}
+		seen[port] = true
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func tailLines(s string, n int) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,60 @@
+package executor
+
+import (
+	"context"
+	"os"
+)
+
+// ServiceManager controls the systemd units the agent manages.
+// SystemdManager is the real one.
+type ServiceManager interface {
+	EnableAndStart(serviceName string) error
+	Start(serviceName string) error
+	Stop(serviceName string) error
+	Restart(serviceName string) error
+	Reload(serviceName string) error
+	Enable(serviceName string) error
+	Disable(serviceName string) error
+	DaemonReload() error
+	IsActive(serviceName string) (bool, error)
+	IsEnabled(serviceName string) (bool, error)
+	State(serviceName string) (string, error)
+	Status(serviceName string) (string, error)
+}
+
+// ConfigFiles reads and writes the files the agent manages. FileOps is the
+// real one.
+type ConfigFiles interface {
+	WriteConfig(path string, content string) error
+	WriteConfigWithPerms(path string, content string, perm os.FileMode) error
+	ReadConfig(path string) (string, error)
+	DeleteConfig(path string) error
+	FileExists(path string) bool
+	BackupConfig(path string) error
+	SnapshotConfig(path string, dir string) error
+	RestoreSnapshot(path string, dir string) error
+	DiscardSnapshots(dir string) error
+	CreateServiceFile(serviceName, content string) (string, error)
+}
+
+// ScriptRunner runs shell commands and scripts. Executor is the real one.
+type ScriptRunner interface {
+	Execute(command string) (*CommandResult, error)
+	ExecuteScript(ctx context.Context, script string, interpreter string, out Output) (*CommandResult, error)
+}
+
+// Backends are what a Processor changes the node through
+type Backends struct {
+	Systemd ServiceManager
+	Files   ConfigFiles
+	Scripts ScriptRunner
+}
+
+// SystemBackends returns the backends that act on the node itself
+func SystemBackends() Backends {
+	return Backends{
+		Systemd: NewSystemdManager(),
+		Files:   NewFileOps(),
+		Scripts: NewExecutor(0),
+	}
+}
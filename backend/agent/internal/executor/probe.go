@@ -0,0 +1,82 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/netly/agent/internal/probe"
+	"github.com/netly/agent/internal/stats"
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+// maxProbes caps the probes of one CMD_PROBE
+const maxProbes = 32
+
+// handleProbe runs the payload's probes side by side and reports each
+// result, failed ones included. Probes only measure, so a dry run runs them
+// too.
+func (p *Processor) handleProbe(ctx context.Context, payload json.RawMessage) (string, error) {
+	var req protocol.ProbePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if len(req.Probes) == 0 || len(req.Probes) > maxProbes {
+		return "", fmt.Errorf("between 1 and %d probes are required", maxProbes)
+	}
+
+	p.logger.Info("probe_start", zap.Int("probes", len(req.Probes)))
+	report := protocol.ProbeReport{Results: make([]protocol.ProbeResult, len(req.Probes))}
+	var wg sync.WaitGroup
+	for i, spec := range req.Probes {
+		wg.Add(1)
+		go func(i int, spec protocol.ProbeSpec) {
+			defer wg.Done()
+			result := probe.Measure(ctx, spec)
+			if spec.Type == protocol.ProbeWireGuard && wgInterfaceName.MatchString(spec.Interface) {
+				result.HandshakeAge = handshakeAge(spec.Interface)
+			}
+			report.Results[i] = result
+		}(i, spec)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	failed := 0
+	for _, r := range report.Results {
+		if !r.OK {
+			failed++
+		}
+	}
+	p.logger.Info("probe_done", zap.Int("probes", len(report.Results)), zap.Int("failed", failed))
+
+	out, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// handshakeAge returns how many seconds ago iface last completed a handshake
+// with any peer, -1 if never and 0 if it cannot tell
+func handshakeAge(iface string) int64 {
+	peers, err := stats.WireGuardPeers(iface)
+	if err != nil {
+		return 0
+	}
+	var latest int64
+	for _, peer := range peers {
+		if peer.LatestHandshake > latest {
+			latest = peer.LatestHandshake
+		}
+	}
+	if latest == 0 {
+		return -1
+	}
+	return time.Now().Unix() - latest
+}
@@ -1,9 +1,15 @@
 package executor
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
+	"github.com/netly/agent/internal/manifest"
+	"github.com/netly/agent/internal/network"
+	"github.com/netly/agent/internal/revisions"
+	"github.com/netly/agent/internal/singbox"
+	"github.com/netly/protocol"
 	"go.uber.org/zap"
 )
 
@@ -17,16 +23,27 @@ const (
 	CmdStart          = "CMD_START"
 	CmdExecuteScript  = "CMD_EXECUTE_SCRIPT"
 	CmdUpdateAgent    = "CMD_UPDATE_AGENT"
+	CmdBatch          = "CMD_BATCH"
+
+	CmdWGApplyInterface  = "CMD_WG_APPLY_INTERFACE"
+	CmdWGRemoveInterface = "CMD_WG_REMOVE_INTERFACE"
+
+	CmdSingBoxApply  = "CMD_SINGBOX_APPLY"
+	CmdSingBoxRemove = "CMD_SINGBOX_REMOVE"
+
+	CmdFirewallSync = "CMD_FIREWALL_SYNC"
+
+	CmdRollbackConfig = "CMD_ROLLBACK_CONFIG"
+
+	CmdProbe = "CMD_PROBE"
+
+	// CmdCancel is carried out by the agent's command loop as it arrives,
+	// never by the Processor
+	CmdCancel = "CMD_CANCEL"
 )
 
 // Command represents a command from the backend
-type Command struct {
-	ID        uint   `json:"id"`
-	Type      string `json:"type"`
-	Payload   string `json:"payload"`
-	Priority  int    `json:"priority"`
-	CreatedAt int64  `json:"created_at"`
-}
+type Command = protocol.Command
 
 // ApplyConfigPayload for CMD_APPLY_CONFIG
 type ApplyConfigPayload struct {
@@ -53,86 +70,121 @@ type ServicePayload struct {
 type ScriptPayload struct {
 	Script      string `json:"script"`
 	Interpreter string `json:"interpreter,omitempty"`
+
+	// Files and services the script changes, snapshotted when it runs in a batch
+	Files    []string `json:"files,omitempty"`
+	Services []string `json:"services,omitempty"`
 }
 
 // ExecutionResult holds the result of command execution
 type ExecutionResult struct {
-	CommandID uint   `json:"command_id"`
+	CommandID string `json:"command_id"`
 	Success   bool   `json:"success"`
 	Output    string `json:"output,omitempty"`
 	Error     string `json:"error,omitempty"`
+	DryRun    bool   `json:"dry_run,omitempty"`
+	// Files are the managed files the command touched, as it left them
+	Files []protocol.ManagedFile `json:"files,omitempty"`
 }
 
 // Processor handles command execution
 type Processor struct {
-	systemd  *SystemdManager
-	fileOps  *FileOps
-	executor *Executor
-	logger   *zap.Logger
+	systemd   ServiceManager
+	fileOps   ConfigFiles
+	executor  ScriptRunner
+	updater   *Updater
+	singbox   *singbox.Registry
+	network   *network.Manager
+	manifest  *manifest.Manifest
+	revisions *revisions.Store
+	dryRun    *DryRun
+	logger    *zap.Logger
 }
 
 func NewProcessor(logger *zap.Logger) *Processor {
+	return NewProcessorWithBackends(logger, SystemBackends())
+}
+
+// NewProcessorWithBackends builds a processor that changes the node through
+// the given backends
+func NewProcessorWithBackends(logger *zap.Logger, b Backends) *Processor {
 	return &Processor{
-		systemd:  NewSystemdManager(),
-		fileOps:  NewFileOps(),
-		executor: NewExecutor(0),
+		systemd:  b.Systemd,
+		fileOps:  b.Files,
+		executor: b.Scripts,
 		logger:   logger,
 	}
 }
 
-// Execute processes a command and returns the result
-func (p *Processor) Execute(cmd Command) *ExecutionResult {
+// NewDryRunProcessor builds a processor that only records what each command
+// would do. See DryRun.
+func NewDryRunProcessor(logger *zap.Logger, dryRun *DryRun) *Processor {
+	p := NewProcessorWithBackends(logger, dryRun.Backends())
+	p.dryRun = dryRun
+	return p
+}
+
+// SetUpdater enables CMD_UPDATE_AGENT
+func (p *Processor) SetUpdater(u *Updater) {
+	p.updater = u
+}
+
+// SetSingBox enables CMD_SINGBOX_APPLY and CMD_SINGBOX_REMOVE
+func (p *Processor) SetSingBox(r *singbox.Registry) {
+	p.singbox = r
+}
+
+// SetNetwork hands forwarding, NAT and policy routing of WireGuard
+// interfaces to m and enables CMD_FIREWALL_SYNC
+func (p *Processor) SetNetwork(m *network.Manager) {
+	p.network = m
+}
+
+// Execute processes a command and returns the result. Scripts stream their
+// output to out, which may be nil, and are stopped once ctx is done.
+func (p *Processor) Execute(ctx context.Context, cmd Command, out Output) *ExecutionResult {
 	result := &ExecutionResult{
 		CommandID: cmd.ID,
 	}
 
 	p.logger.Info("executing command",
-		zap.Uint("id", cmd.ID),
+		zap.String("id", cmd.ID),
 		zap.String("type", cmd.Type),
 	)
 
-	var err error
-	var output string
-
-	switch cmd.Type {
-	case CmdApplyConfig:
-		output, err = p.handleApplyConfig(cmd.Payload)
-
-	case CmdInstallService:
-		output, err = p.handleInstallService(cmd.Payload)
-
-	case CmdRemoveService:
-		output, err = p.handleRemoveService(cmd.Payload)
-
-	case CmdRestart:
-		output, err = p.handleServiceAction(cmd.Payload, "restart")
-
-	case CmdStop:
-		output, err = p.handleServiceAction(cmd.Payload, "stop")
-
-	case CmdStart:
-		output, err = p.handleServiceAction(cmd.Payload, "start")
+	if p.dryRun != nil {
+		p.dryRun.Begin()
+	}
 
-	case CmdExecuteScript:
-		output, err = p.handleExecuteScript(cmd.Payload)
+	var output string
+	var err error
+	if cmd.Type == CmdBatch {
+		output, err = p.handleBatch(ctx, out, cmd.ID, cmd.Payload)
+	} else {
+		output, err = p.dispatch(ctx, out, cmd.Type, cmd.Payload)
+	}
 
-	default:
-		err = fmt.Errorf("unknown command type: %s", cmd.Type)
+	if p.dryRun != nil {
+		output = p.dryRun.End(cmd, output, err)
+		result.DryRun = true
 	}
 
 	if err != nil {
 		result.Success = false
 		result.Error = err.Error()
 		p.logger.Error("command execution failed",
-			zap.Uint("id", cmd.ID),
+			zap.String("id", cmd.ID),
 			zap.String("type", cmd.Type),
 			zap.Error(err),
 		)
 	} else {
 		result.Success = true
 		result.Output = output
+		if p.dryRun == nil {
+			result.Files = p.recordManaged(cmd.Type, cmd.Payload)
+		}
 		p.logger.Info("command executed successfully",
-			zap.Uint("id", cmd.ID),
+			zap.String("id", cmd.ID),
 			zap.String("type", cmd.Type),
 		)
 	}
@@ -140,9 +192,65 @@ func (p *Processor) Execute(cmd Command) *ExecutionResult {
 	return result
 }
 
-func (p *Processor) handleApplyConfig(payload string) (string, error) {
+// dispatch runs a single, non-batch command
+func (p *Processor) dispatch(ctx context.Context, out Output, cmdType string, payload json.RawMessage) (string, error) {
+	switch cmdType {
+	case CmdApplyConfig:
+		return p.handleApplyConfig(payload)
+
+	case CmdInstallService:
+		return p.handleInstallService(payload)
+
+	case CmdRemoveService:
+		return p.handleRemoveService(payload)
+
+	case CmdRestart:
+		return p.handleServiceAction(payload, "restart")
+
+	case CmdStop:
+		return p.handleServiceAction(payload, "stop")
+
+	case CmdStart:
+		return p.handleServiceAction(payload, "start")
+
+	case CmdExecuteScript:
+		return p.handleExecuteScript(ctx, out, payload)
+
+	case CmdWGApplyInterface:
+		return p.handleWGApplyInterface(payload)
+
+	case CmdWGRemoveInterface:
+		return p.handleWGRemoveInterface(payload)
+
+	case CmdSingBoxApply:
+		return p.handleSingBoxApply(payload)
+
+	case CmdSingBoxRemove:
+		return p.handleSingBoxRemove(payload)
+
+	case CmdFirewallSync:
+		return p.handleFirewallSync(payload)
+
+	case CmdRollbackConfig:
+		return p.handleRollbackConfig(payload)
+
+	case CmdProbe:
+		return p.handleProbe(ctx, payload)
+
+	case CmdUpdateAgent:
+		if p.updater == nil {
+			return "", fmt.Errorf("self-update is not enabled on this agent")
+		}
+		return p.updater.Apply(payload)
+
+	default:
+		return "", fmt.Errorf("unknown command type: %s", cmdType)
+	}
+}
+
+func (p *Processor) handleApplyConfig(payload json.RawMessage) (string, error) {
 	var cfg ApplyConfigPayload
-	if err := json.Unmarshal([]byte(payload), &cfg); err != nil {
+	if err := json.Unmarshal(payload, &cfg); err != nil {
 		return "", fmt.Errorf("invalid payload: %w", err)
 	}
 
@@ -191,9 +299,9 @@ func (p *Processor) handleApplyConfig(payload string) (string, error) {
 	return fmt.Sprintf("config written to %s", cfg.TargetPath), nil
 }
 
-func (p *Processor) handleInstallService(payload string) (string, error) {
+func (p *Processor) handleInstallService(payload json.RawMessage) (string, error) {
 	var svc InstallServicePayload
-	if err := json.Unmarshal([]byte(payload), &svc); err != nil {
+	if err := json.Unmarshal(payload, &svc); err != nil {
 		return "", fmt.Errorf("invalid payload: %w", err)
 	}
 
@@ -231,9 +339,9 @@ func (p *Processor) handleInstallService(payload string) (string, error) {
 	return fmt.Sprintf("service %s installed at %s", svc.ServiceName, path), nil
 }
 
-func (p *Processor) handleRemoveService(payload string) (string, error) {
+func (p *Processor) handleRemoveService(payload json.RawMessage) (string, error) {
 	var svc ServicePayload
-	if err := json.Unmarshal([]byte(payload), &svc); err != nil {
+	if err := json.Unmarshal(payload, &svc); err != nil {
 		return "", fmt.Errorf("invalid payload: %w", err)
 	}
 
@@ -267,9 +375,9 @@ func (p *Processor) handleRemoveService(payload string) (string, error) {
 	return fmt.Sprintf("service %s removed", svc.ServiceName), nil
 }
 
-func (p *Processor) handleServiceAction(payload string, action string) (string, error) {
+func (p *Processor) handleServiceAction(payload json.RawMessage, action string) (string, error) {
 	var svc ServicePayload
-	if err := json.Unmarshal([]byte(payload), &svc); err != nil {
+	if err := json.Unmarshal(payload, &svc); err != nil {
 		return "", fmt.Errorf("invalid payload: %w", err)
 	}
 
@@ -298,9 +406,9 @@ func (p *Processor) handleServiceAction(payload string, action string) (string,
 	return fmt.Sprintf("service %s %sed", svc.ServiceName, action), nil
 }
 
-func (p *Processor) handleExecuteScript(payload string) (string, error) {
+func (p *Processor) handleExecuteScript(ctx context.Context, out Output, payload json.RawMessage) (string, error) {
 	var script ScriptPayload
-	if err := json.Unmarshal([]byte(payload), &script); err != nil {
+	if err := json.Unmarshal(payload, &script); err != nil {
 		return "", fmt.Errorf("invalid payload: %w", err)
 	}
 
@@ -308,7 +416,7 @@ func (p *Processor) handleExecuteScript(payload string) (string, error) {
 		return "", fmt.Errorf("script is required")
 	}
 
-	result, err := p.executor.ExecuteScript(script.Script, script.Interpreter)
+	result, err := p.executor.ExecuteScript(ctx, script.Script, script.Interpreter, out)
 	if err != nil {
 		return result.Output, err
 	}
@@ -0,0 +1,216 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+// brokenSystemd fails every restart of one unit and passes the rest on
+type brokenSystemd struct {
+	ServiceManager
+	unit string
+}
+
+func (s brokenSystemd) Restart(name string) error {
+	if name == s.unit {
+		return fmt.Errorf("unit %s failed", name)
+	}
+	return s.ServiceManager.Restart(name)
+}
+
+// newTestProcessor runs against a dry run, so commands change only its
+// simulated node
+func newTestProcessor(brokenUnit string) (*Processor, *DryRun) {
+	d := NewDryRun("")
+	b := d.Backends()
+	if brokenUnit != "" {
+		b.Systemd = brokenSystemd{ServiceManager: b.Systemd, unit: brokenUnit}
+	}
+	return NewProcessorWithBackends(zap.NewNop(), b), d
+}
+
+func command(t *testing.T, id, cmdType string, payload interface{}) Command {
+	t.Helper()
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Command{ID: id, Type: cmdType, Payload: raw}
+}
+
+func step(t *testing.T, cmdType string, payload interface{}) protocol.BatchStep {
+	t.Helper()
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protocol.BatchStep{Type: cmdType, Payload: raw}
+}
+
+func readFile(t *testing.T, p *Processor, path string) string {
+	t.Helper()
+	content, err := p.fileOps.ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig(%s): %v", path, err)
+	}
+	return content
+}
+
+func TestExecuteUnknownCommand(t *testing.T) {
+	p, _ := newTestProcessor("")
+	result := p.Execute(context.Background(), Command{ID: "c1", Type: "CMD_NOPE"}, nil)
+	if result.Success || !strings.Contains(result.Error, "unknown command type") {
+		t.Fatalf("result = %+v, want unknown command type", result)
+	}
+}
+
+func TestExecuteDryRunReportsActions(t *testing.T) {
+	d := NewDryRun("")
+	p := NewDryRunProcessor(zap.NewNop(), d)
+
+	cmd := command(t, "c1", CmdApplyConfig, ApplyConfigPayload{
+		TargetPath:  "/etc/netly/app.conf",
+		Content:     "listen 8080\n",
+		ServiceName: "app",
+	})
+	result := p.Execute(context.Background(), cmd, nil)
+	if !result.Success || !result.DryRun {
+		t.Fatalf("result = %+v, want a successful dry run", result)
+	}
+
+	var report protocol.DryRunReport
+	if err := json.Unmarshal([]byte(result.Output), &report); err != nil {
+		t.Fatalf("output is not a dry-run report: %v", err)
+	}
+	want := []protocol.PlannedAction{
+		{Kind: protocol.ActionWriteFile, Target: "/etc/netly/app.conf", Detail: "0600", Content: "listen 8080\n"},
+		{Kind: protocol.ActionSystemctl, Target: "app", Detail: "restart"},
+	}
+	if len(report.Actions) != len(want) {
+		t.Fatalf("actions = %+v, want %+v", report.Actions, want)
+	}
+	for i := range want {
+		if report.Actions[i] != want[i] {
+			t.Fatalf("action %d = %+v, want %+v", i, report.Actions[i], want[i])
+		}
+	}
+}
+
+func TestBatchRollsBackOnFailure(t *testing.T) {
+	p, d := newTestProcessor("broken")
+	files := d.Backends().Files
+	if err := files.WriteConfig("/etc/netly/app.conf", "old\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := command(t, "batch-1", CmdBatch, protocol.BatchPayload{Steps: []protocol.BatchStep{
+		step(t, CmdApplyConfig, ApplyConfigPayload{TargetPath: "/etc/netly/app.conf", Content: "new\n"}),
+		step(t, CmdApplyConfig, ApplyConfigPayload{TargetPath: "/etc/netly/extra.conf", Content: "extra\n"}),
+		step(t, CmdRestart, ServicePayload{ServiceName: "broken"}),
+	}})
+	result := p.Execute(context.Background(), cmd, nil)
+	if result.Success || !strings.Contains(result.Error, "step 3/3") || !strings.Contains(result.Error, "rolled back") {
+		t.Fatalf("result = %+v, want step 3 rolled back", result)
+	}
+
+	if got := readFile(t, p, "/etc/netly/app.conf"); got != "old\n" {
+		t.Fatalf("app.conf = %q, want the original content", got)
+	}
+	if files.FileExists("/etc/netly/extra.conf") {
+		t.Fatal("extra.conf was created by the batch and should be gone")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for path := range d.files {
+		if strings.Contains(path, "netly-batch-batch-1") {
+			t.Fatalf("snapshot %s left behind", path)
+		}
+	}
+}
+
+func TestBatchCommits(t *testing.T) {
+	p, _ := newTestProcessor("")
+	cmd := command(t, "batch-2", CmdBatch, protocol.BatchPayload{Steps: []protocol.BatchStep{
+		step(t, CmdApplyConfig, ApplyConfigPayload{TargetPath: "/etc/netly/a.conf", Content: "a\n"}),
+		step(t, CmdApplyConfig, ApplyConfigPayload{TargetPath: "/etc/netly/b.conf", Content: "b\n"}),
+	}})
+	result := p.Execute(context.Background(), cmd, nil)
+	if !result.Success {
+		t.Fatalf("result = %+v, want success", result)
+	}
+	if got := readFile(t, p, "/etc/netly/b.conf"); got != "b\n" {
+		t.Fatalf("b.conf = %q", got)
+	}
+}
+
+func TestBatchRejectsBeforeRunning(t *testing.T) {
+	apply := ApplyConfigPayload{TargetPath: "/etc/netly/a.conf", Content: "a\n"}
+	tests := []struct {
+		name  string
+		id    string
+		steps []protocol.BatchStep
+		want  string
+	}{
+		{"empty", "b1", nil, "no steps"},
+		{"nested", "b2", []protocol.BatchStep{step(t, CmdBatch, protocol.BatchPayload{})}, "nested batches"},
+		{"sing-box", "b3", []protocol.BatchStep{step(t, CmdSingBoxApply, protocol.SingBoxApplyPayload{Key: "k"})}, "sing-box"},
+		{"firewall", "b4", []protocol.BatchStep{step(t, CmdFirewallSync, struct{}{})}, "firewall"},
+		{"command id", "../b5", []protocol.BatchStep{step(t, CmdApplyConfig, apply)}, "invalid command id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, d := newTestProcessor("")
+			result := p.Execute(context.Background(), command(t, tt.id, CmdBatch, protocol.BatchPayload{Steps: tt.steps}), nil)
+			if result.Success || !strings.Contains(result.Error, tt.want) {
+				t.Fatalf("result = %+v, want error containing %q", result, tt.want)
+			}
+			if len(d.actions) != 0 {
+				t.Fatalf("rejected batch changed the node: %+v", d.actions)
+			}
+		})
+	}
+}
+
+const testWireGuardConf = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.0.0.1/30
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.0.0.2/32
+`
+
+func TestRemoveWireGuardKeepsOtherInterfaces(t *testing.T) {
+	p, d := newTestProcessor("")
+	b := d.Backends()
+	for _, iface := range []string{"wg1", "wg2"} {
+		if err := b.Files.WriteConfig(wgConfigPath(iface), testWireGuardConf); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Systemd.Start(wgUnit(iface)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := p.Execute(context.Background(), command(t, "c1", CmdWGRemoveInterface,
+		protocol.WireGuardRemovePayload{Interface: "wg1"}), nil)
+	if !result.Success {
+		t.Fatalf("result = %+v, want success", result)
+	}
+
+	if active, _ := b.Systemd.IsActive(wgUnit("wg1")); active || p.fileOps.FileExists(wgConfigPath("wg1")) {
+		t.Fatal("removed interface is still there")
+	}
+	if active, _ := b.Systemd.IsActive(wgUnit("wg2")); !active {
+		t.Fatal("the other tunnel's interface was taken down")
+	}
+	if got := readFile(t, p, wgConfigPath("wg2")); got != testWireGuardConf {
+		t.Fatalf("wg2.conf after removal:\n%s", got)
+	}
+}
@@ -0,0 +1,128 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/netly/agent/internal/revisions"
+	"github.com/netly/agent/internal/singbox"
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+// systemdUnitDir holds unit files, which systemd must be able to read
+const systemdUnitDir = "/etc/systemd/system/"
+
+// SetRevisions keeps a revision of every managed file a command leaves behind
+// and enables CMD_ROLLBACK_CONFIG
+func (p *Processor) SetRevisions(s *revisions.Store) {
+	p.revisions = s
+}
+
+// handleRollbackConfig writes back a kept revision of a managed file and
+// restarts the unit serving it. If the unit does not come back, the file is
+// put back as it was. Rolling back the sing-box config also puts back the
+// fragments that composed it, so the next sing-box apply builds on the
+// rolled back config rather than undoing it.
+func (p *Processor) handleRollbackConfig(payload json.RawMessage) (string, error) {
+	var req protocol.RollbackConfigPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if req.Path == "" || req.Revision == "" {
+		return "", fmt.Errorf("path and revision are required")
+	}
+	if p.revisions == nil {
+		return "", fmt.Errorf("config revisions are not kept on this agent")
+	}
+
+	content, err := p.revisions.Read(req.Path, req.Revision)
+	if err != nil {
+		return "", err
+	}
+	var fragments string
+	if req.Path == SingBoxConfigPath {
+		if fragments, err = p.singBoxFragmentsFor(content); err != nil {
+			return "", err
+		}
+	}
+	unit := req.Service
+	if unit == "" && p.manifest != nil {
+		unit, _ = p.manifest.Unit(req.Path)
+	}
+
+	existed := p.fileOps.FileExists(req.Path)
+	var previous string
+	if existed {
+		if previous, err = p.fileOps.ReadConfig(req.Path); err != nil {
+			return "", err
+		}
+	}
+
+	p.logger.Info("rollback_config_start", zap.String("path", req.Path), zap.String("revision", req.Revision))
+	if err := p.writeRevision(req.Path, content, unit); err != nil {
+		p.logger.Error("rollback_config_failed", zap.String("path", req.Path), zap.Error(err))
+		if existed {
+			_ = p.writeRevision(req.Path, previous, unit)
+		} else {
+			_ = p.fileOps.DeleteConfig(req.Path)
+		}
+		return "", err
+	}
+	if fragments != "" {
+		if err := p.singbox.Restore(fragments); err != nil {
+			p.logger.Warn("singbox_registry_save_failed", zap.Error(err))
+		}
+	}
+	p.logger.Info("rollback_config_done", zap.String("path", req.Path), zap.String("revision", req.Revision))
+
+	if unit == "" {
+		return fmt.Sprintf("%s rolled back to revision %s", req.Path, req.Revision), nil
+	}
+	return fmt.Sprintf("%s rolled back to revision %s, %s restarted", req.Path, req.Revision, unit), nil
+}
+
+// writeRevision writes content to path and restarts unit, reloading systemd
+// first when path is a unit file
+func (p *Processor) writeRevision(path, content, unit string) error {
+	perm := os.FileMode(0600)
+	if strings.HasPrefix(path, systemdUnitDir) {
+		perm = 0644
+	}
+	if err := p.fileOps.WriteConfigWithPerms(path, content, perm); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if perm == 0644 {
+		if err := p.systemd.DaemonReload(); err != nil {
+			return fmt.Errorf("daemon-reload failed: %w", err)
+		}
+	}
+	if unit != "" {
+		if err := p.systemd.Restart(unit); err != nil {
+			return fmt.Errorf("restart %s failed: %w", unit, err)
+		}
+	}
+	return nil
+}
+
+// singBoxFragmentsFor finds the kept registry snapshot that composes config.
+// Without one the registry would disagree with the rolled back file, so the
+// rollback is refused.
+func (p *Processor) singBoxFragmentsFor(config string) (string, error) {
+	if p.singbox == nil {
+		return "", fmt.Errorf("sing-box registry is not available on this agent")
+	}
+	for _, rev := range p.revisions.List(singBoxFragmentsRevisions) {
+		snapshot, err := p.revisions.Read(singBoxFragmentsRevisions, rev.ID)
+		if err != nil {
+			continue
+		}
+		composed, err := singbox.ComposeSnapshot(snapshot)
+		if err == nil && string(composed) == config {
+			return snapshot, nil
+		}
+	}
+	return "", fmt.Errorf("no kept sing-box fragments compose this revision; apply the tunnels again instead")
+}
@@ -0,0 +1,95 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/netly/agent/internal/revisions"
+	"github.com/netly/agent/internal/singbox"
+	"github.com/netly/protocol"
+)
+
+// applyFragment does what a sing-box apply leaves behind: the fragment in
+// the registry, the composed config on disk and a revision of both
+func applyFragment(t *testing.T, p *Processor, key, tag string) string {
+	t.Helper()
+	fragment := &protocol.SingBoxFragment{Inbounds: []json.RawMessage{json.RawMessage(`{"type":"vless","tag":"` + tag + `"}`)}}
+	config, err := p.singbox.Compose(key, fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.singbox.Commit(key, fragment); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.fileOps.WriteConfig(SingBoxConfigPath, string(config)); err != nil {
+		t.Fatal(err)
+	}
+	rev, _ := p.keepRevision(SingBoxConfigPath)
+	if rev == "" {
+		t.Fatal("no revision kept")
+	}
+	return rev
+}
+
+func newRollbackProcessor(t *testing.T) *Processor {
+	t.Helper()
+	p, _ := newTestProcessor("")
+	store, err := revisions.Open("", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := singbox.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetRevisions(store)
+	p.SetSingBox(registry)
+	return p
+}
+
+func TestRollbackSingBoxRestoresFragments(t *testing.T) {
+	p := newRollbackProcessor(t)
+	first := applyFragment(t, p, "tunnel-1", "tunnel-1-in")
+	applyFragment(t, p, "tunnel-2", "tunnel-2-in")
+
+	result := p.Execute(context.Background(), command(t, "c1", CmdRollbackConfig,
+		protocol.RollbackConfigPayload{Path: SingBoxConfigPath, Revision: first}), nil)
+	if !result.Success {
+		t.Fatalf("result = %+v, want success", result)
+	}
+	if p.singbox.Has("tunnel-2") || !p.singbox.Has("tunnel-1") {
+		t.Fatal("registry does not match the rolled back config")
+	}
+
+	// The next apply builds on the rolled back config
+	config, err := p.singbox.Compose("tunnel-3", &protocol.SingBoxFragment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(config), "tunnel-2-in") {
+		t.Fatal("next apply would bring back the rolled back fragment")
+	}
+}
+
+func TestRollbackSingBoxWithoutFragmentsRefused(t *testing.T) {
+	p := newRollbackProcessor(t)
+	first := applyFragment(t, p, "tunnel-1", "tunnel-1-in")
+	applyFragment(t, p, "tunnel-2", "tunnel-2-in")
+
+	// A revision kept before fragments were kept alongside
+	store, _ := revisions.Open("", 5)
+	content, _ := p.revisions.Read(SingBoxConfigPath, first)
+	rev, _ := store.Record(SingBoxConfigPath, content)
+	p.SetRevisions(store)
+
+	result := p.Execute(context.Background(), command(t, "c1", CmdRollbackConfig,
+		protocol.RollbackConfigPayload{Path: SingBoxConfigPath, Revision: rev.ID}), nil)
+	if result.Success || !strings.Contains(result.Error, "no kept sing-box fragments") {
+		t.Fatalf("result = %+v, want a refusal", result)
+	}
+	if !p.singbox.Has("tunnel-2") {
+		t.Fatal("refused rollback changed the registry")
+	}
+}
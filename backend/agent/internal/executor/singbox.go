@@ -0,0 +1,158 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	SingBoxConfigPath = "/etc/sing-box/config.json"
+	singBoxService    = "sing-box"
+
+	// singBoxFragmentsRevisions is where registry snapshots are kept among
+	// the config revisions; it is not a file on the node
+	singBoxFragmentsRevisions = SingBoxConfigPath + "#fragments"
+)
+
+// handleSingBoxApply replaces one fragment of the sing-box config
+func (p *Processor) handleSingBoxApply(payload json.RawMessage) (string, error) {
+	var req protocol.SingBoxApplyPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if req.Key == "" {
+		return "", fmt.Errorf("key is required")
+	}
+	return p.applySingBox(req.Key, &req.SingBoxFragment)
+}
+
+// handleSingBoxRemove drops one fragment; removing an unknown key succeeds
+func (p *Processor) handleSingBoxRemove(payload json.RawMessage) (string, error) {
+	var req protocol.SingBoxRemovePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if req.Key == "" {
+		return "", fmt.Errorf("key is required")
+	}
+	if p.singbox == nil {
+		return "", fmt.Errorf("sing-box registry is not available on this agent")
+	}
+	if !p.singbox.Has(req.Key) {
+		return fmt.Sprintf("sing-box fragment %s not present", req.Key), nil
+	}
+	return p.applySingBox(req.Key, nil)
+}
+
+// applySingBox composes the config with the change, has sing-box check it,
+// swaps it in and reloads. The registry only records the change once the
+// new config is live.
+func (p *Processor) applySingBox(key string, fragment *protocol.SingBoxFragment) (string, error) {
+	if p.singbox == nil {
+		return "", fmt.Errorf("sing-box registry is not available on this agent")
+	}
+
+	config, err := p.singbox.Compose(key, fragment)
+	if err != nil {
+		return "", err
+	}
+	// A dry run may simulate a node without sing-box installed
+	if _, lookErr := exec.LookPath("sing-box"); p.dryRun == nil || lookErr == nil {
+		if err := checkSingBox(config); err != nil {
+			return "", err
+		}
+	}
+
+	existed := p.fileOps.FileExists(SingBoxConfigPath)
+	var previous string
+	if existed {
+		if previous, err = p.fileOps.ReadConfig(SingBoxConfigPath); err != nil {
+			return "", err
+		}
+	}
+	wasActive, _ := p.systemd.IsActive(singBoxService)
+
+	// The last fragment gone means nothing left to serve
+	empty := fragment == nil && p.singbox.Len() == 1
+
+	p.logger.Info("singbox_apply_start", zap.String("key", key), zap.Bool("remove", fragment == nil))
+	if err := p.fileOps.WriteConfig(SingBoxConfigPath, string(config)); err != nil {
+		return "", fmt.Errorf("failed to write config: %w", err)
+	}
+
+	var action string
+	switch {
+	case empty:
+		action, err = "stopped", p.systemd.Stop(singBoxService)
+	case wasActive:
+		action, err = "reloaded", p.reloadSingBox()
+	default:
+		action, err = "started", p.systemd.EnableAndStart(singBoxService)
+	}
+	if err != nil {
+		p.restoreSingBox(existed, previous, wasActive)
+		return "", fmt.Errorf("sing-box %s failed: %w", strings.TrimSuffix(action, "ed"), err)
+	}
+
+	if err := p.singbox.Commit(key, fragment); err != nil {
+		p.logger.Warn("singbox_registry_save_failed", zap.Error(err))
+	}
+	p.logger.Info("singbox_apply_done", zap.String("key", key), zap.String("action", action))
+	return fmt.Sprintf("sing-box config updated for %s (%d fragments), service %s", key, p.singbox.Len(), action), nil
+}
+
+// reloadSingBox sends SIGHUP through the unit. That spares a process
+// restart, but sing-box still rebuilds its whole instance, so every tunnel's
+// listeners and connections are dropped and reopened. Units without a reload
+// action get a restart.
+func (p *Processor) reloadSingBox() error {
+	if err := p.systemd.Reload(singBoxService); err != nil {
+		p.logger.Warn("singbox_reload_failed_restarting", zap.Error(err))
+		return p.systemd.Restart(singBoxService)
+	}
+	return nil
+}
+
+func (p *Processor) restoreSingBox(existed bool, previous string, wasActive bool) {
+	var err error
+	if existed {
+		err = p.fileOps.WriteConfig(SingBoxConfigPath, previous)
+	} else {
+		err = p.fileOps.DeleteConfig(SingBoxConfigPath)
+	}
+	if err == nil && wasActive {
+		err = p.systemd.Restart(singBoxService)
+	}
+	if err != nil {
+		p.logger.Error("singbox_restore_failed", zap.Error(err))
+		return
+	}
+	p.logger.Info("singbox_restore_done", zap.Bool("existed", existed))
+}
+
+// checkSingBox runs `sing-box check` on a candidate config
+func checkSingBox(config []byte) error {
+	tmp, err := os.CreateTemp("", "netly-singbox-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(config); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	tmp.Close()
+
+	output, err := exec.Command("sing-box", "check", "-c", tmp.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sing-box check rejected the config: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
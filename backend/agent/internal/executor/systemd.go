@@ -101,6 +101,21 @@ func (s *SystemdManager) IsActive(serviceName string) (bool, error) {
 	return true, nil
 }
 
+// State returns the unit's ActiveState and SubState joined by a slash, e.g.
+// "active/running" or "failed/failed"
+func (s *SystemdManager) State(serviceName string) (string, error) {
+	if err := s.validateServiceName(serviceName); err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("systemctl", "show", "-p", "ActiveState", "-p", "SubState", "--value", serviceName)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("systemctl show failed: %w", err)
+	}
+	return strings.Join(strings.Fields(string(output)), "/"), nil
+}
+
 func (s *SystemdManager) IsEnabled(serviceName string) (bool, error) {
 	if err := s.validateServiceName(serviceName); err != nil {
 		return false, err
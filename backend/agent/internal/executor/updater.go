@@ -0,0 +1,233 @@
+package executor
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	AgentBinaryPath  = "/usr/local/bin/netly-agent"
+	agentServiceName = "netly-agent"
+
+	// updateMarkerPath exists while a freshly installed binary is on trial.
+	// The new agent removes it after its first successful heartbeat; if it is
+	// still there when the grace window ends, the watchdog rolls back.
+	updateMarkerPath = "/var/lib/netly/update-pending.json"
+
+	maxAgentBinarySize = 200 << 20
+	restartDelay       = 5 * time.Second
+)
+
+type UpdaterConfig struct {
+	PublicKey      string // base64 Ed25519 key pinned by the installer
+	CurrentVersion string
+	GracePeriod    time.Duration
+	Logger         *zap.Logger
+}
+
+// Updater implements CMD_UPDATE_AGENT
+type Updater struct {
+	publicKey  ed25519.PublicKey
+	current    string
+	grace      time.Duration
+	fileOps    *FileOps
+	httpClient *http.Client
+	logger     *zap.Logger
+}
+
+type updateMarker struct {
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	Deadline    int64  `json:"deadline"`
+}
+
+func NewUpdater(cfg UpdaterConfig) (*Updater, error) {
+	u := &Updater{
+		current:    cfg.CurrentVersion,
+		grace:      cfg.GracePeriod,
+		fileOps:    NewFileOps(),
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		logger:     cfg.Logger,
+	}
+	if u.grace == 0 {
+		u.grace = 2 * time.Minute
+	}
+
+	if cfg.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cfg.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return u, fmt.Errorf("invalid signing public key")
+		}
+		u.publicKey = ed25519.PublicKey(key)
+	}
+	return u, nil
+}
+
+// Apply verifies and installs a new agent binary, then schedules a restart
+// and a rollback watchdog through systemd so both outlive this process
+func (u *Updater) Apply(payload json.RawMessage) (string, error) {
+	var update protocol.UpdateAgentPayload
+	if err := json.Unmarshal(payload, &update); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if update.Version == "" {
+		return "", fmt.Errorf("version is required")
+	}
+	if update.Version == u.current {
+		return fmt.Sprintf("agent already running version %s", u.current), nil
+	}
+
+	artifact, ok := update.Artifacts[runtime.GOARCH]
+	if !ok {
+		return "", fmt.Errorf("no artifact for architecture %s", runtime.GOARCH)
+	}
+
+	// Check the signature before downloading anything
+	if len(u.publicKey) == 0 {
+		return "", fmt.Errorf("signing_public_key is not configured; refusing unsigned update")
+	}
+	sum := strings.ToLower(artifact.SHA256)
+	signature, err := base64.StdEncoding.DecodeString(artifact.Signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(u.publicKey, protocol.UpdateSigningMessage(update.Version, runtime.GOARCH, sum), signature) {
+		return "", fmt.Errorf("signature verification failed")
+	}
+
+	u.logger.Info("agent_update_download_start", zap.String("version", update.Version), zap.String("url", artifact.URL))
+	tmpPath, err := u.download(artifact.URL, sum)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+	u.logger.Info("agent_update_download_done", zap.String("version", update.Version))
+
+	if err := u.install(tmpPath); err != nil {
+		return "", err
+	}
+
+	marker, _ := json.Marshal(updateMarker{
+		FromVersion: u.current,
+		ToVersion:   update.Version,
+		Deadline:    time.Now().Add(u.grace).Unix(),
+	})
+	if err := u.fileOps.WriteConfig(updateMarkerPath, string(marker)); err != nil {
+		u.restorePrevious()
+		return "", fmt.Errorf("failed to write update marker: %w", err)
+	}
+
+	if err := u.schedule(); err != nil {
+		u.restorePrevious()
+		_ = u.fileOps.DeleteConfig(updateMarkerPath)
+		return "", err
+	}
+
+	u.logger.Info("agent_update_installed", zap.String("from", u.current), zap.String("to", update.Version), zap.Duration("grace", u.grace))
+	return fmt.Sprintf("agent %s installed, restarting; rolls back to %s unless it heartbeats within %s", update.Version, u.current, u.grace), nil
+}
+
+// Confirm commits a pending update. It is called after the first successful
+// heartbeat and reports whether there was anything to commit.
+func (u *Updater) Confirm() (bool, error) {
+	if !u.fileOps.FileExists(updateMarkerPath) {
+		return false, nil
+	}
+	if err := u.fileOps.DeleteConfig(updateMarkerPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// download fetches url into a temp file and checks its SHA-256
+func (u *Updater) download(url, wantSum string) (string, error) {
+	resp, err := u.httpClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: server returned status %d", resp.StatusCode)
+	}
+
+	tmpFile, err := os.CreateTemp("", "netly-agent-update-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, h), io.LimitReader(resp.Body, maxAgentBinarySize))
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("download failed: %w", err)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != wantSum {
+		os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", wantSum, got)
+	}
+	return tmpFile.Name(), nil
+}
+
+// install keeps the running binary as .prev and swaps the new one in with a
+// rename, so the path never points at a partially written file
+func (u *Updater) install(tmpPath string) error {
+	if err := exec.Command("sudo", "cp", "-p", AgentBinaryPath, AgentBinaryPath+".prev").Run(); err != nil {
+		return fmt.Errorf("failed to keep previous binary: %w", err)
+	}
+	if err := exec.Command("sudo", "install", "-m", "0755", tmpPath, AgentBinaryPath+".new").Run(); err != nil {
+		return fmt.Errorf("failed to stage new binary: %w", err)
+	}
+	if err := exec.Command("sudo", "mv", "-f", AgentBinaryPath+".new", AgentBinaryPath).Run(); err != nil {
+		return fmt.Errorf("failed to swap binary: %w", err)
+	}
+	return nil
+}
+
+func (u *Updater) restorePrevious() {
+	if err := exec.Command("sudo", "mv", "-f", AgentBinaryPath+".prev", AgentBinaryPath).Run(); err != nil {
+		u.logger.Error("agent_update_restore_failed", zap.Error(err))
+	}
+}
+
+// schedule arms the rollback watchdog and then the restart as transient
+// systemd timers
+func (u *Updater) schedule() error {
+	stamp := time.Now().Unix()
+
+	rollback := fmt.Sprintf("if [ -f %[1]s ]; then mv -f %[2]s.prev %[2]s && rm -f %[1]s && systemctl restart %[3]s; fi",
+		updateMarkerPath, AgentBinaryPath, agentServiceName)
+	watchdog := exec.Command("sudo", "systemd-run",
+		fmt.Sprintf("--unit=netly-agent-rollback-%d", stamp),
+		fmt.Sprintf("--on-active=%d", int(u.grace.Seconds())),
+		"/bin/sh", "-c", rollback)
+	if output, err := watchdog.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to schedule rollback watchdog: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+
+	// Delay the restart so the result of this command can be reported first
+	restart := exec.Command("sudo", "systemd-run",
+		fmt.Sprintf("--unit=netly-agent-restart-%d", stamp),
+		fmt.Sprintf("--on-active=%d", int(restartDelay.Seconds())),
+		"systemctl", "restart", agentServiceName)
+	if output, err := restart.CombinedOutput(); err != nil {
+		_ = exec.Command("sudo", "systemctl", "stop", fmt.Sprintf("netly-agent-rollback-%d.timer", stamp)).Run()
+		return fmt.Errorf("failed to schedule restart: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
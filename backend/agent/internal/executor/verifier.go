@@ -0,0 +1,55 @@
+package executor
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/netly/protocol"
+)
+
+var errNoSigningKey = errors.New("signing_public_key is not configured; refusing unsigned commands")
+
+// Verifier checks that a command was signed by the backend the agent was
+// installed from and is meant for this node
+type Verifier struct {
+	publicKey ed25519.PublicKey
+	nodeID    uint
+}
+
+// NewVerifier decodes the base64 Ed25519 key pinned at install time
+func NewVerifier(publicKey string, nodeID uint) (*Verifier, error) {
+	if publicKey == "" {
+		return nil, errNoSigningKey
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signing public key")
+	}
+	if nodeID == 0 {
+		return nil, fmt.Errorf("node ID is unknown; neither the certificate nor the token names one")
+	}
+	return &Verifier{publicKey: key, nodeID: nodeID}, nil
+}
+
+// Verify returns an error unless cmd may be executed. A nil Verifier refuses
+// everything.
+func (v *Verifier) Verify(cmd protocol.Command) error {
+	if v == nil {
+		return errNoSigningKey
+	}
+	return protocol.VerifyCommand(v.publicKey, cmd, v.nodeID, time.Now())
+}
+
+// VerifyControl checks a backend-signed call to the local control API. The
+// request is verified as addressed to this node; replays within the allowed
+// clock skew are left to the caller's nonce cache.
+func (v *Verifier) VerifyControl(req protocol.ControlRequest, signature string) error {
+	if v == nil {
+		return errNoSigningKey
+	}
+	req.NodeID = v.nodeID
+	return protocol.VerifyControlRequest(v.publicKey, req, signature, time.Now())
+}
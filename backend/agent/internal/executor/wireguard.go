@@ -0,0 +1,413 @@
+package executor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netly/agent/internal/network"
+	"github.com/netly/agent/internal/stats"
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	wireguardDir = "/etc/wireguard"
+
+	// wgHandshakeWait is how long a freshly applied interface gets to reach
+	// its peers before the status is reported
+	wgHandshakeWait = 10 * time.Second
+)
+
+var (
+	wgInterfaceName = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+	wgHostname      = regexp.MustCompile(`^[a-zA-Z0-9.-]{1,253}$`)
+)
+
+func wgConfigPath(iface string) string {
+	return fmt.Sprintf("%s/%s.conf", wireguardDir, iface)
+}
+
+func wgUnit(iface string) string {
+	return "wg-quick@" + iface
+}
+
+// wgNetworkOwner is the name an interface's rules are kept under in the
+// network manager
+func wgNetworkOwner(iface string) string {
+	return "wg:" + iface
+}
+
+// handleWGApplyInterface renders the interface's wg-quick file and brings it
+// up, then reconciles its forwarding, NAT and policy rules. An interface
+// that already runs the same file is left alone, so the command can be
+// repeated safely.
+func (p *Processor) handleWGApplyInterface(payload json.RawMessage) (string, error) {
+	var req protocol.WireGuardApplyPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if !wgInterfaceName.MatchString(req.Interface) {
+		return "", fmt.Errorf("invalid interface name %q", req.Interface)
+	}
+	if err := validateWireGuard(req.Config); err != nil {
+		return "", err
+	}
+
+	rules, table, err := p.wireguardRules(req.Interface, req.Config.Interface)
+	if err != nil {
+		return "", err
+	}
+	content := renderWireGuard(req.Config, table)
+
+	path, unit := wgConfigPath(req.Interface), wgUnit(req.Interface)
+	existed := p.fileOps.FileExists(path)
+	var previous string
+	if existed {
+		if previous, err = p.fileOps.ReadConfig(path); err != nil {
+			return "", err
+		}
+	}
+	wasActive, _ := p.systemd.IsActive(unit)
+
+	status := protocol.WireGuardStatus{Interface: req.Interface}
+	if existed && wasActive && previous == content {
+		p.logger.Info("wg_apply_unchanged", zap.String("interface", req.Interface))
+	} else {
+		p.logger.Info("wg_apply_start", zap.String("interface", req.Interface), zap.Bool("existed", existed))
+		if err := p.bringUpWireGuard(path, unit, content); err != nil {
+			p.restoreWireGuard(path, unit, existed, previous, wasActive)
+			return "", err
+		}
+		status.Changed = true
+		p.logger.Info("wg_apply_done", zap.String("interface", req.Interface))
+	}
+
+	if p.network != nil {
+		if err := p.network.Apply(wgNetworkOwner(req.Interface), rules); err != nil {
+			if status.Changed {
+				p.restoreWireGuard(path, unit, existed, previous, wasActive)
+			}
+			return "", fmt.Errorf("failed to apply network rules: %w", err)
+		}
+	}
+
+	status.Active, _ = p.systemd.IsActive(unit)
+	// A dry run changed nothing, so there is no handshake to read
+	if p.dryRun == nil {
+		status.Peers = p.wireguardPeers(req.Interface, status.Changed)
+	}
+	return marshalStatus(status)
+}
+
+func (p *Processor) bringUpWireGuard(path, unit, content string) error {
+	if err := p.fileOps.WriteConfig(path, content); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := p.systemd.Enable(unit); err != nil {
+		return fmt.Errorf("enable %s failed: %w", unit, err)
+	}
+	if err := p.systemd.Restart(unit); err != nil {
+		return fmt.Errorf("restart %s failed: %w", unit, err)
+	}
+	return nil
+}
+
+// restoreWireGuard puts back the interface as it was before a failed apply
+func (p *Processor) restoreWireGuard(path, unit string, existed bool, previous string, wasActive bool) {
+	var err error
+	if existed {
+		err = p.fileOps.WriteConfig(path, previous)
+		if err == nil && wasActive {
+			err = p.systemd.Restart(unit)
+		} else if err == nil {
+			_ = p.systemd.Stop(unit)
+		}
+	} else {
+		_ = p.systemd.Stop(unit)
+		_ = p.systemd.Disable(unit)
+		err = p.fileOps.DeleteConfig(path)
+	}
+	if err != nil {
+		p.logger.Error("wg_restore_failed", zap.String("path", path), zap.Error(err))
+		return
+	}
+	p.logger.Info("wg_restore_done", zap.String("path", path), zap.Bool("existed", existed))
+}
+
+// handleWGRemoveInterface takes an interface down and deletes its config.
+// Removing an interface that is already gone succeeds.
+func (p *Processor) handleWGRemoveInterface(payload json.RawMessage) (string, error) {
+	var req protocol.WireGuardRemovePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if !wgInterfaceName.MatchString(req.Interface) {
+		return "", fmt.Errorf("invalid interface name %q", req.Interface)
+	}
+
+	path, unit := wgConfigPath(req.Interface), wgUnit(req.Interface)
+	existed := p.fileOps.FileExists(path)
+	active, _ := p.systemd.IsActive(unit)
+
+	status := protocol.WireGuardStatus{Interface: req.Interface}
+	if !existed && !active {
+		p.logger.Info("wg_remove_absent", zap.String("interface", req.Interface))
+		if err := p.removeWireGuardRules(req.Interface); err != nil {
+			return "", err
+		}
+		return marshalStatus(status)
+	}
+
+	p.logger.Info("wg_remove_start", zap.String("interface", req.Interface))
+	if active {
+		if err := p.systemd.Stop(unit); err != nil {
+			return "", fmt.Errorf("stop %s failed: %w", unit, err)
+		}
+	}
+	_ = p.systemd.Disable(unit)
+	if err := p.fileOps.DeleteConfig(path); err != nil {
+		return "", err
+	}
+	if err := p.removeWireGuardRules(req.Interface); err != nil {
+		return "", err
+	}
+	status.Changed = true
+	p.logger.Info("wg_remove_done", zap.String("interface", req.Interface))
+	return marshalStatus(status)
+}
+
+func (p *Processor) removeWireGuardRules(iface string) error {
+	if p.network == nil {
+		return nil
+	}
+	if err := p.network.Remove(wgNetworkOwner(iface)); err != nil {
+		return fmt.Errorf("failed to remove network rules: %w", err)
+	}
+	return nil
+}
+
+// wireguardPeers reads the handshake state of the interface's peers. After a
+// change it waits up to wgHandshakeWait for the peers it dials to answer.
+func (p *Processor) wireguardPeers(iface string, wait bool) []protocol.WireGuardPeerStatus {
+	deadline := time.Now().Add(wgHandshakeWait)
+	for {
+		peers, err := stats.WireGuardPeers(iface)
+		if err != nil {
+			p.logger.Warn("wg_status_failed", zap.String("interface", iface), zap.Error(err))
+			return nil
+		}
+		if !wait || allHandshaked(peers) || time.Now().After(deadline) {
+			return peers
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func allHandshaked(peers []protocol.WireGuardPeerStatus) bool {
+	for _, peer := range peers {
+		if peer.Endpoint != "" && peer.LatestHandshake == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func marshalStatus(status protocol.WireGuardStatus) (string, error) {
+	out, err := json.Marshal(status)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// renderWireGuard turns a typed config into a wg-quick file. The config must
+// have passed validateWireGuard, so nothing in the payload ends up in a
+// shell. The only hook left is the default route of a source-routed
+// interface in table, which has to come and go with the device.
+func renderWireGuard(cfg protocol.WireGuardConfig, table int) string {
+	iface := cfg.Interface
+
+	var b strings.Builder
+	b.WriteString("# Managed by netly-agent; local changes are overwritten\n")
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", iface.PrivateKey)
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(iface.Address, ", "))
+	if iface.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", iface.ListenPort)
+	}
+	if iface.MTU != 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", iface.MTU)
+	}
+	if len(iface.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(iface.DNS, ", "))
+	}
+	if iface.Table != "" {
+		fmt.Fprintf(&b, "Table = %s\n", iface.Table)
+	}
+
+	if iface.SourceRoute != nil {
+		fmt.Fprintf(&b, "PostUp = ip route replace default dev %%i table %d\n", table)
+	}
+
+	for _, peer := range cfg.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", peer.PublicKey)
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(&b, "PresharedKey = %s\n", peer.PresharedKey)
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return b.String()
+}
+
+// wireguardRules describes what the interface needs from the network
+// manager, and the routing table a source-routed interface uses
+func (p *Processor) wireguardRules(name string, iface protocol.WireGuardInterface) (network.Rules, int, error) {
+	var rules network.Rules
+	if !iface.Forward && !iface.Masquerade && iface.SourceRoute == nil {
+		return rules, 0, nil
+	}
+	if p.network == nil {
+		return rules, 0, fmt.Errorf("network manager is not available on this agent")
+	}
+
+	if iface.Forward {
+		rules.Forward = append(rules.Forward, network.Forward{In: name})
+	}
+	if iface.Masquerade {
+		wan, err := defaultRouteInterface()
+		if err != nil {
+			return rules, 0, err
+		}
+		rules.NAT = append(rules.NAT, network.NAT{Out: wan})
+	}
+	table := 0
+	if route := iface.SourceRoute; route != nil {
+		var err error
+		if table, err = p.network.Table(wgNetworkOwner(name)); err != nil {
+			return rules, 0, err
+		}
+		for _, from := range route.From {
+			rules.Policy = append(rules.Policy, network.Policy{From: from, Table: table})
+		}
+	}
+	return rules, table, nil
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route,
+// which masqueraded traffic leaves through
+func defaultRouteInterface() (string, error) {
+	output, err := exec.Command("ip", "-o", "-4", "route", "show", "default").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read default route: %w", err)
+	}
+	fields := strings.Fields(string(output))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" && wgInterfaceName.MatchString(fields[i+1]) {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no default route; cannot masquerade")
+}
+
+func validateWireGuard(cfg protocol.WireGuardConfig) error {
+	iface := cfg.Interface
+	if err := validateWGKey("private_key", iface.PrivateKey); err != nil {
+		return err
+	}
+	if len(iface.Address) == 0 {
+		return fmt.Errorf("interface needs at least one address")
+	}
+	if err := validatePrefixes("address", iface.Address); err != nil {
+		return err
+	}
+	if iface.ListenPort < 0 || iface.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen_port %d", iface.ListenPort)
+	}
+	if iface.MTU != 0 && (iface.MTU < 1280 || iface.MTU > 9000) {
+		return fmt.Errorf("invalid mtu %d", iface.MTU)
+	}
+	for _, dns := range iface.DNS {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			return fmt.Errorf("invalid dns %q", dns)
+		}
+	}
+	if iface.Table != "" && iface.Table != "off" && iface.Table != "auto" {
+		if _, err := strconv.ParseUint(iface.Table, 10, 32); err != nil {
+			return fmt.Errorf("invalid table %q", iface.Table)
+		}
+	}
+	if route := iface.SourceRoute; route != nil {
+		if err := validatePrefixes("source_route.from", route.From); err != nil {
+			return err
+		}
+	}
+
+	for i, peer := range cfg.Peers {
+		if err := validateWGKey(fmt.Sprintf("peers[%d].public_key", i), peer.PublicKey); err != nil {
+			return err
+		}
+		if peer.PresharedKey != "" {
+			if err := validateWGKey(fmt.Sprintf("peers[%d].preshared_key", i), peer.PresharedKey); err != nil {
+				return err
+			}
+		}
+		if peer.Endpoint != "" {
+			if err := validateEndpoint(peer.Endpoint); err != nil {
+				return fmt.Errorf("peers[%d]: %w", i, err)
+			}
+		}
+		if err := validatePrefixes(fmt.Sprintf("peers[%d].allowed_ips", i), peer.AllowedIPs); err != nil {
+			return err
+		}
+		if peer.PersistentKeepalive < 0 || peer.PersistentKeepalive > 65535 {
+			return fmt.Errorf("peers[%d]: invalid persistent_keepalive", i)
+		}
+	}
+	return nil
+}
+
+func validateWGKey(field, key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return fmt.Errorf("invalid %s", field)
+	}
+	return nil
+}
+
+func validatePrefixes(field string, prefixes []string) error {
+	for _, prefix := range prefixes {
+		if _, err := netip.ParsePrefix(prefix); err != nil {
+			return fmt.Errorf("invalid %s %q", field, prefix)
+		}
+	}
+	return nil
+}
+
+func validateEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid endpoint port %q", endpoint)
+	}
+	if _, err := netip.ParseAddr(host); err != nil && !wgHostname.MatchString(host) {
+		return fmt.Errorf("invalid endpoint host %q", endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/netly/protocol"
+)
+
+// Identity is the agent's mTLS client certificate issued by the backend's
+// internal CA. The certificate is read through callbacks, so a renewed one
+// takes effect on the next handshake without restarting the agent.
+type Identity struct {
+	caFile   string
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	leaf *x509.Certificate
+	ca   *x509.CertPool
+	// recovered is set when the pair on disk was unusable and the one Install
+	// kept from before was put back
+	recovered bool
+}
+
+// Load reads the CA, certificate and key from disk
+func Load(caFile, certFile, keyFile string) (*Identity, error) {
+	id := &Identity{caFile: caFile, certFile: certFile, keyFile: keyFile}
+	if err := id.reload(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func (id *Identity) reload() error {
+	caPEM, err := os.ReadFile(id.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates in %s", id.caFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(id.certFile, id.keyFile)
+	if err != nil {
+		// Install died between writing the key and the certificate
+		prev, prevErr := tls.LoadX509KeyPair(previous(id.certFile), previous(id.keyFile))
+		if prevErr != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		if err := id.restorePrevious(); err != nil {
+			return err
+		}
+		cert = prev
+		id.mu.Lock()
+		id.recovered = true
+		id.mu.Unlock()
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse client certificate: %w", err)
+	}
+
+	id.mu.Lock()
+	id.cert, id.leaf, id.ca = &cert, leaf, pool
+	id.mu.Unlock()
+	return nil
+}
+
+// Recovered reports whether loading fell back to the pair that was in place
+// before the last renewal
+func (id *Identity) Recovered() bool {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	return id.recovered
+}
+
+// NodeID returns the node ID the certificate was issued to
+func (id *Identity) NodeID() (uint, bool) {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	return protocol.NodeIDFromCertificate(id.leaf)
+}
+
+// NotAfter returns when the current certificate expires
+func (id *Identity) NotAfter() time.Time {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	return id.leaf.NotAfter
+}
+
+// NeedsRenewal reports whether less than a third of the certificate's
+// lifetime is left
+func (id *Identity) NeedsRenewal(now time.Time) bool {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	lifetime := id.leaf.NotAfter.Sub(id.leaf.NotBefore)
+	return id.leaf.NotAfter.Sub(now) < lifetime/3
+}
+
+// ClientTLSConfig presents the client certificate and trusts the internal CA
+// in addition to the system roots, so the backend may sit behind either
+func (id *Identity) ClientTLSConfig() *tls.Config {
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	id.mu.RLock()
+	caPEM, _ := os.ReadFile(id.caFile)
+	id.mu.RUnlock()
+	roots.AppendCertsFromPEM(caPEM)
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			id.mu.RLock()
+			defer id.mu.RUnlock()
+			return id.cert, nil
+		},
+	}
+}
+
+// ServerTLSConfig serves with the node certificate and only accepts clients
+// holding the backend's certificate from the same CA
+func (id *Identity) ServerTLSConfig() *tls.Config {
+	id.mu.RLock()
+	pool := id.ca
+	id.mu.RUnlock()
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			id.mu.RLock()
+			defer id.mu.RUnlock()
+			return id.cert, nil
+		},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return errors.New("no verified client certificate")
+			}
+			if !protocol.IsBackendCertificate(chains[0][0]) {
+				return errors.New("client certificate does not identify the backend")
+			}
+			return nil
+		},
+	}
+}
+
+// CreateCSR generates a fresh key pair and a CSR for it. The key is only
+// written to disk by Install once the backend has signed the CSR.
+func (id *Identity) CreateCSR() (csrPEM []byte, key *ecdsa.PrivateKey, err error) {
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id.mu.RLock()
+	subject := id.leaf.Subject
+	id.mu.RUnlock()
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), key, nil
+}
+
+// Install writes a renewed certificate, its key and the CA, then reloads them.
+// The key and certificate cannot be replaced in one step, so the pair in use
+// is kept next to them first; if the agent dies in between, Load goes back to
+// it instead of failing on a key that does not match its certificate.
+func (id *Identity) Install(certPEM, caPEM string, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	// Make sure the pair is usable before replacing anything
+	if _, err := tls.X509KeyPair([]byte(certPEM), keyPEM); err != nil {
+		return fmt.Errorf("renewed certificate does not match key: %w", err)
+	}
+
+	if err := id.keepCurrent(); err != nil {
+		return err
+	}
+	if caPEM != "" {
+		if err := writeAtomic(id.caFile, []byte(caPEM), 0644); err != nil {
+			return err
+		}
+	}
+	if err := writeAtomic(id.keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeAtomic(id.certFile, []byte(certPEM), 0644); err != nil {
+		return err
+	}
+	return id.reload()
+}
+
+// previous is where Install keeps the file it is about to replace
+func previous(path string) string {
+	return path + ".prev"
+}
+
+// keepCurrent copies the pair in use to its .prev files. A pair that does
+// not load is not worth keeping, and would replace a good one.
+func (id *Identity) keepCurrent() error {
+	certPEM, certErr := os.ReadFile(id.certFile)
+	keyPEM, keyErr := os.ReadFile(id.keyFile)
+	if certErr != nil || keyErr != nil {
+		return nil
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil
+	}
+
+	if err := writeAtomic(previous(id.keyFile), keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeAtomic(previous(id.certFile), certPEM, 0644)
+}
+
+// restorePrevious puts the kept pair back in place. If this is interrupted
+// too, the .prev files are still there for the next start.
+func (id *Identity) restorePrevious() error {
+	keyPEM, err := os.ReadFile(previous(id.keyFile))
+	if err != nil {
+		return fmt.Errorf("failed to read previous key: %w", err)
+	}
+	certPEM, err := os.ReadFile(previous(id.certFile))
+	if err != nil {
+		return fmt.Errorf("failed to read previous certificate: %w", err)
+	}
+	if err := writeAtomic(id.keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeAtomic(id.certFile, certPEM, 0644)
+}
+
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Entry states
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+const defaultMaxEntries = 1000
+
+// Entry records what happened to one command
+type Entry struct {
+	ID        string `json:"id"`
+	Attempt   int    `json:"attempt"`
+	State     string `json:"state"`
+	Error     string `json:"error,omitempty"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// Journal is a small on-disk record of the commands this agent has run, so a
+// duplicate delivery or a restart never executes the same command twice.
+type Journal struct {
+	path    string
+	max     int
+	mu      sync.Mutex
+	entries []Entry
+	index   map[string]int
+}
+
+// Open loads the journal at path. An empty path keeps the journal in memory
+// only. A missing or unreadable file starts an empty journal.
+func Open(path string) (*Journal, error) {
+	j := &Journal{
+		path:  path,
+		max:   defaultMaxEntries,
+		index: make(map[string]int),
+	}
+	if path == "" {
+		return j, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return j, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return j, fmt.Errorf("failed to read journal: %w", err)
+	}
+	if err := json.Unmarshal(data, &j.entries); err != nil {
+		j.entries = nil
+		return j, fmt.Errorf("failed to parse journal: %w", err)
+	}
+	j.reindex()
+	return j, nil
+}
+
+// Lookup returns the recorded entry for a command, if any
+func (j *Journal) Lookup(id string) (Entry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	i, ok := j.index[id]
+	if !ok {
+		return Entry{}, false
+	}
+	return j.entries[i], true
+}
+
+// ShouldRun reports whether a delivery of the command should execute. A
+// command runs at most once, even if it failed: the backend only redelivers
+// when a result went missing, and scripts are not safe to repeat.
+func (j *Journal) ShouldRun(id string) (Entry, bool) {
+	e, ok := j.Lookup(id)
+	return e, !ok
+}
+
+// Begin marks a command as running. It is persisted before execution so an
+// agent that dies mid-command knows not to start it again.
+func (j *Journal) Begin(id string, attempt int) error {
+	return j.put(Entry{ID: id, Attempt: attempt, State: StateRunning})
+}
+
+// Finish records the outcome of a command
+func (j *Journal) Finish(id string, attempt int, success bool, errMsg string) error {
+	state := StateSucceeded
+	if !success {
+		state = StateFailed
+	}
+	return j.put(Entry{ID: id, Attempt: attempt, State: state, Error: errMsg})
+}
+
+func (j *Journal) put(e Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.UpdatedAt = time.Now().Unix()
+	if i, ok := j.index[e.ID]; ok {
+		j.entries[i] = e
+	} else {
+		j.entries = append(j.entries, e)
+		if len(j.entries) > j.max {
+			j.entries = j.entries[len(j.entries)-j.max:]
+		}
+		j.reindex()
+	}
+	return j.save()
+}
+
+func (j *Journal) reindex() {
+	j.index = make(map[string]int, len(j.entries))
+	for i, e := range j.entries {
+		j.index[e.ID] = i
+	}
+}
+
+// save writes the journal atomically via a temp file and rename
+func (j *Journal) save() error {
+	if j.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(j.entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal: %w", err)
+	}
+
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to replace journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func reopen(t *testing.T, path string) *Journal {
+	t.Helper()
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return j
+}
+
+func TestReplayAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j := reopen(t, path)
+	if _, run := j.ShouldRun("c1"); !run {
+		t.Fatal("a new command should run")
+	}
+	if err := j.Begin("c1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Begin("c2", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Finish("c2", 1, false, "exit status 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent dies with c1 running and a save of c3 half written
+	if err := os.WriteFile(path+".tmp", []byte(`[{"id":"c3"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j = reopen(t, path)
+
+	tests := []struct {
+		id    string
+		run   bool
+		state string
+		err   string
+	}{
+		{"c1", false, StateRunning, ""},
+		{"c2", false, StateFailed, "exit status 1"},
+		{"c3", true, "", ""},
+	}
+	for _, tt := range tests {
+		e, run := j.ShouldRun(tt.id)
+		if run != tt.run || e.State != tt.state || e.Error != tt.err {
+			t.Fatalf("%s: run=%v entry=%+v, want run=%v state=%q error=%q", tt.id, run, e, tt.run, tt.state, tt.err)
+		}
+	}
+
+	// A redelivery after the restart is answered from the journal
+	if err := j.Finish("c1", 2, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := reopen(t, path).Lookup("c1"); e.State != StateSucceeded || e.Attempt != 2 {
+		t.Fatalf("c1 = %+v, want succeeded on attempt 2", e)
+	}
+}
+
+func TestOpenCorruptJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	if err := os.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := Open(path)
+	if err == nil {
+		t.Fatal("corrupt journal opened without an error")
+	}
+	if _, run := j.ShouldRun("c1"); !run {
+		t.Fatal("a corrupt journal should start empty")
+	}
+}
+
+func TestJournalKeepsNewest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j := reopen(t, path)
+	j.max = 2
+	for _, id := range []string{"c1", "c2", "c3"} {
+		if err := j.Begin(id, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Updating a kept entry does not push another one out
+	if err := j.Finish("c2", 1, true, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	j = reopen(t, path)
+	if _, ok := j.Lookup("c1"); ok {
+		t.Fatal("oldest entry was kept past the limit")
+	}
+	for _, id := range []string{"c2", "c3"} {
+		if _, ok := j.Lookup(id); !ok {
+			t.Fatalf("%s was dropped", id)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Entry is a managed file and the systemd unit serving it, if any
+type Entry struct {
+	Path string `json:"path"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// Manifest lists the files the agent wrote on the backend's behalf. Drift
+// reports hash exactly these, so a file stays listed until a command removes
+// it, even when someone deleted it by hand.
+type Manifest struct {
+	path  string
+	mu    sync.Mutex
+	files map[string]string
+}
+
+// Open loads the manifest at path. An empty path keeps it in memory only.
+func Open(path string) (*Manifest, error) {
+	m := &Manifest{path: path, files: make(map[string]string)}
+	if path == "" {
+		return m, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return m, fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.files); err != nil {
+		m.files = make(map[string]string)
+		return m, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return m, nil
+}
+
+// Len returns the number of managed files
+func (m *Manifest) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.files)
+}
+
+// Has reports whether file is managed
+func (m *Manifest) Has(file string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.files[file]
+	return ok
+}
+
+// Unit returns the unit serving file, if file is managed
+func (m *Manifest) Unit(file string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	unit, ok := m.files[file]
+	return unit, ok
+}
+
+// Set records file as managed, served by unit, and persists the manifest
+func (m *Manifest) Set(file, unit string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if current, ok := m.files[file]; ok && current == unit {
+		return nil
+	}
+	m.files[file] = unit
+	return m.save()
+}
+
+// Remove stops managing file; removing an unknown file succeeds
+func (m *Manifest) Remove(file string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[file]; !ok {
+		return nil
+	}
+	delete(m.files, file)
+	return m.save()
+}
+
+// Entries returns the managed files sorted by path
+func (m *Manifest) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]Entry, 0, len(m.files))
+	for path, unit := range m.files {
+		entries = append(entries, Entry{Path: path, Unit: unit})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// save writes the manifest atomically via a temp file and rename
+func (m *Manifest) save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(m.files)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("failed to replace manifest: %w", err)
+	}
+	return nil
+}
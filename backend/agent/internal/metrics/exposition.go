@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// exposition writes the Prometheus text format. Each family is announced
+// once with family and followed by its samples.
+type exposition struct {
+	bytes.Buffer
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func (e *exposition) family(name, kind, help string) {
+	e.WriteString("# HELP " + name + " " + helpEscaper.Replace(help) + "\n")
+	e.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// sample writes one value; labels are name, value pairs
+func (e *exposition) sample(name string, value float64, labels ...string) {
+	e.WriteString(name)
+	if len(labels) > 0 {
+		e.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				e.WriteByte(',')
+			}
+			e.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		e.WriteByte('}')
+	}
+	e.WriteByte(' ')
+	e.WriteString(formatValue(value))
+	e.WriteByte('\n')
+}
+
+func (e *exposition) gauge(name, help string, value float64) {
+	e.family(name, "gauge", help)
+	e.sample(name, value)
+}
+
+func (e *exposition) counter(name, help string, value float64) {
+	e.family(name, "counter", help)
+	e.sample(name, value)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(e *exposition, name string, labels ...string) {
+	for i, b := range h.bounds {
+		e.sample(name+"_bucket", float64(h.counts[i]), append(labels, "le", formatValue(b))...)
+	}
+	e.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	e.sample(name+"_sum", h.sum, labels...)
+	e.sample(name+"_count", float64(h.count), labels...)
+}
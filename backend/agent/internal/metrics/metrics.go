@@ -0,0 +1,264 @@
+package metrics
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netly/protocol"
+)
+
+var (
+	heartbeatBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	commandBuckets   = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+)
+
+// Recorder keeps what the agent observed for the Prometheus /metrics
+// endpoint. Stats and component health are the samples the last heartbeat
+// sent rather than collected on scrape, so a scrape never shifts the
+// collector's rate window and costs nothing on the node.
+type Recorder struct {
+	mu         sync.Mutex
+	stats      *protocol.SystemStats
+	components []protocol.ComponentHealth
+
+	heartbeats        uint64
+	heartbeatFailures uint64
+	lastHeartbeat     time.Time
+	heartbeatDuration *histogram
+
+	// commands counts finished commands by type and outcome; durations are
+	// kept per type
+	commands         map[commandKey]uint64
+	commandDurations map[string]*histogram
+}
+
+type commandKey struct {
+	Type   string
+	Result string
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		heartbeatDuration: newHistogram(heartbeatBuckets),
+		commands:          make(map[commandKey]uint64),
+		commandDurations:  make(map[string]*histogram),
+	}
+}
+
+// ObserveStats keeps the sample of the last heartbeat
+func (r *Recorder) ObserveStats(stats *protocol.SystemStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = stats
+}
+
+// ObserveComponents keeps the health of the managed units
+func (r *Recorder) ObserveComponents(components []protocol.ComponentHealth) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.components = components
+}
+
+// ObserveHeartbeat records one heartbeat round trip and whether the backend
+// accepted it
+func (r *Recorder) ObserveHeartbeat(duration time.Duration, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.heartbeats++
+	if !ok {
+		r.heartbeatFailures++
+		return
+	}
+	r.lastHeartbeat = time.Now()
+	r.heartbeatDuration.observe(duration.Seconds())
+}
+
+// ObserveCommand records a command the agent ran
+func (r *Recorder) ObserveCommand(cmdType string, success bool, duration time.Duration) {
+	result := "succeeded"
+	if !success {
+		result = "failed"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands[commandKey{Type: cmdType, Result: result}]++
+	h, ok := r.commandDurations[cmdType]
+	if !ok {
+		h = newHistogram(commandBuckets)
+		r.commandDurations[cmdType] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// ServeHTTP writes every metric in the Prometheus text format
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var e exposition
+	r.mu.Lock()
+	r.writeStats(&e)
+	r.writeComponents(&e)
+	r.writeHeartbeats(&e)
+	r.writeCommands(&e)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(e.Bytes())
+}
+
+func (r *Recorder) writeStats(e *exposition) {
+	s := r.stats
+	if s == nil {
+		return
+	}
+
+	e.gauge("netly_agent_cpu_usage_percent", "CPU usage over the last sample interval.", s.CPUUsage)
+	e.gauge("netly_agent_memory_usage_percent", "Share of memory in use.", s.RAMUsage)
+	e.gauge("netly_agent_memory_total_bytes", "Total memory.", float64(s.RAMTotal))
+	e.gauge("netly_agent_memory_used_bytes", "Memory in use.", float64(s.RAMUsed))
+	e.gauge("netly_agent_uptime_seconds", "Time since the node booted.", float64(s.Uptime))
+	e.gauge("netly_agent_stats_collected_timestamp_seconds", "When the stats below were sampled.", float64(s.CollectedAt))
+	if s.Load != nil {
+		e.gauge("netly_agent_load1", "1 minute load average.", s.Load.Load1)
+		e.gauge("netly_agent_load5", "5 minute load average.", s.Load.Load5)
+		e.gauge("netly_agent_load15", "15 minute load average.", s.Load.Load15)
+	}
+	if s.SingBoxRSS > 0 {
+		e.gauge("netly_agent_singbox_resident_memory_bytes", "Resident memory of the sing-box process.", float64(s.SingBoxRSS))
+	}
+
+	if len(s.Disks) > 0 {
+		e.family("netly_agent_disk_total_bytes", "gauge", "Size of the filesystem.")
+		for _, d := range s.Disks {
+			e.sample("netly_agent_disk_total_bytes", float64(d.Total), "mount", d.Mount)
+		}
+		e.family("netly_agent_disk_used_bytes", "gauge", "Space used on the filesystem.")
+		for _, d := range s.Disks {
+			e.sample("netly_agent_disk_used_bytes", float64(d.Used), "mount", d.Mount)
+		}
+	}
+
+	if len(s.Interfaces) > 0 {
+		e.family("netly_agent_network_receive_bytes_total", "counter", "Bytes received on the interface.")
+		for _, i := range s.Interfaces {
+			e.sample("netly_agent_network_receive_bytes_total", float64(i.RxBytes), "interface", i.Name)
+		}
+		e.family("netly_agent_network_transmit_bytes_total", "counter", "Bytes sent on the interface.")
+		for _, i := range s.Interfaces {
+			e.sample("netly_agent_network_transmit_bytes_total", float64(i.TxBytes), "interface", i.Name)
+		}
+	}
+
+	if s.TCP != nil {
+		e.family("netly_agent_tcp_connections", "gauge", "TCP connections by state.")
+		e.sample("netly_agent_tcp_connections", float64(s.TCP.Established), "state", "established")
+		e.sample("netly_agent_tcp_connections", float64(s.TCP.TimeWait), "state", "time_wait")
+		e.gauge("netly_agent_tcp_sockets_in_use", "TCP sockets in use.", float64(s.TCP.InUse))
+	}
+
+	if len(s.WireGuard) > 0 {
+		e.family("netly_agent_wireguard_interface_up", "gauge", "Whether the WireGuard interface is up.")
+		for _, wg := range s.WireGuard {
+			e.sample("netly_agent_wireguard_interface_up", boolValue(wg.Active), "interface", wg.Interface)
+		}
+		e.family("netly_agent_wireguard_peer_receive_bytes_total", "counter", "Bytes received from the peer.")
+		for _, wg := range s.WireGuard {
+			for _, p := range wg.Peers {
+				e.sample("netly_agent_wireguard_peer_receive_bytes_total", float64(p.RxBytes), "interface", wg.Interface, "public_key", p.PublicKey)
+			}
+		}
+		e.family("netly_agent_wireguard_peer_transmit_bytes_total", "counter", "Bytes sent to the peer.")
+		for _, wg := range s.WireGuard {
+			for _, p := range wg.Peers {
+				e.sample("netly_agent_wireguard_peer_transmit_bytes_total", float64(p.TxBytes), "interface", wg.Interface, "public_key", p.PublicKey)
+			}
+		}
+		e.family("netly_agent_wireguard_peer_latest_handshake_seconds", "gauge", "Unix time of the peer's latest handshake, 0 if it never completed one.")
+		for _, wg := range s.WireGuard {
+			for _, p := range wg.Peers {
+				e.sample("netly_agent_wireguard_peer_latest_handshake_seconds", float64(p.LatestHandshake), "interface", wg.Interface, "public_key", p.PublicKey)
+			}
+		}
+	}
+
+	if len(s.Probes) > 0 {
+		e.family("netly_agent_probe_success", "gauge", "Whether the latest run of the probe succeeded.")
+		for _, p := range s.Probes {
+			e.sample("netly_agent_probe_success", boolValue(p.OK), "name", p.Name, "type", p.Type, "target", p.Target)
+		}
+		e.family("netly_agent_probe_latency_seconds", "gauge", "Latency of the latest successful run of the probe.")
+		for _, p := range s.Probes {
+			if p.OK {
+				e.sample("netly_agent_probe_latency_seconds", p.LatencyMs/1000, "name", p.Name, "type", p.Type, "target", p.Target)
+			}
+		}
+	}
+}
+
+func (r *Recorder) writeComponents(e *exposition) {
+	if len(r.components) == 0 {
+		return
+	}
+	e.family("netly_agent_component_up", "gauge", "Whether the managed unit is active and its interface, if it has one, is up.")
+	for _, c := range r.components {
+		e.sample("netly_agent_component_up", boolValue(c.Healthy()), "name", c.Name, "kind", c.Kind)
+	}
+	e.family("netly_agent_component_state", "gauge", "The systemd state of the managed unit, always 1.")
+	for _, c := range r.components {
+		e.sample("netly_agent_component_state", 1, "name", c.Name, "kind", c.Kind, "state", c.State)
+	}
+}
+
+func (r *Recorder) writeHeartbeats(e *exposition) {
+	e.counter("netly_agent_heartbeats_total", "Heartbeats sent to the backend.", float64(r.heartbeats))
+	e.counter("netly_agent_heartbeat_failures_total", "Heartbeats the backend did not accept.", float64(r.heartbeatFailures))
+	if !r.lastHeartbeat.IsZero() {
+		e.gauge("netly_agent_last_heartbeat_timestamp_seconds", "When the backend last accepted a heartbeat.", float64(r.lastHeartbeat.Unix()))
+	}
+	e.family("netly_agent_heartbeat_duration_seconds", "histogram", "Round trip of accepted heartbeats.")
+	r.heartbeatDuration.write(e, "netly_agent_heartbeat_duration_seconds")
+}
+
+func (r *Recorder) writeCommands(e *exposition) {
+	if len(r.commands) == 0 {
+		return
+	}
+
+	keys := make([]commandKey, 0, len(r.commands))
+	for k := range r.commands {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Type != keys[j].Type {
+			return keys[i].Type < keys[j].Type
+		}
+		return keys[i].Result < keys[j].Result
+	})
+	e.family("netly_agent_commands_total", "counter", "Commands run, by type and result.")
+	for _, k := range keys {
+		e.sample("netly_agent_commands_total", float64(r.commands[k]), "type", k.Type, "result", k.Result)
+	}
+
+	types := make([]string, 0, len(r.commandDurations))
+	for t := range r.commandDurations {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	e.family("netly_agent_command_duration_seconds", "histogram", "How long commands took to run, by type.")
+	for _, t := range types {
+		r.commandDurations[t].write(e, "netly_agent_command_duration_seconds", "type", t)
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"bytes"
+	"flag"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netly/protocol"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden file (run with -update): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("exposition drifted from %s\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+func TestExpositionEscaping(t *testing.T) {
+	var e exposition
+	e.family("netly_test", "gauge", "Help with a \\ backslash\nand a newline.")
+	e.sample("netly_test", 1, "path", `C:\dir`, "quote", `say "hi"`, "multi", "a\nb")
+	e.sample("netly_test", math.Inf(1), "value", "inf")
+	e.sample("netly_test", math.NaN(), "value", "nan")
+	e.sample("netly_test", 1e21, "value", "large")
+	e.sample("netly_test", 0.25)
+	golden(t, "escaping.txt", e.Bytes())
+}
+
+func TestHistogramAccumulates(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1, 10})
+	for _, v := range []float64{0.05, 0.1, 0.5, 10, 42} {
+		h.observe(v)
+	}
+
+	// Buckets are cumulative and a value on a bound counts toward it
+	want := []uint64{2, 3, 4}
+	for i, n := range want {
+		if h.counts[i] != n {
+			t.Fatalf("bucket le=%v = %d, want %d", h.bounds[i], h.counts[i], n)
+		}
+	}
+	if h.count != 5 || h.sum != 52.65 {
+		t.Fatalf("count, sum = %d, %v, want 5, 52.65", h.count, h.sum)
+	}
+
+	var e exposition
+	h.write(&e, "netly_test_seconds", "type", "CMD_X")
+	golden(t, "histogram.txt", e.Bytes())
+}
+
+func TestRecorderServe(t *testing.T) {
+	r := NewRecorder()
+	r.ObserveStats(&protocol.SystemStats{
+		CPUUsage:    12.5,
+		RAMUsage:    50,
+		RAMTotal:    4 << 30,
+		RAMUsed:     2 << 30,
+		Uptime:      3600,
+		CollectedAt: 1700000000,
+		Load:        &protocol.LoadAverage{Load1: 0.5, Load5: 0.25, Load15: 0.125},
+		Disks:       []protocol.DiskUsage{{Mount: "/", Total: 100, Used: 40}},
+		Interfaces:  []protocol.InterfaceStats{{Name: "eth0", RxBytes: 1000, TxBytes: 2000}},
+		TCP:         &protocol.TCPStats{Established: 3, TimeWait: 1, InUse: 5},
+		WireGuard: []protocol.WireGuardStatus{{
+			Interface: "wg0",
+			Active:    true,
+			Peers: []protocol.WireGuardPeerStatus{{
+				PublicKey:       "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+				RxBytes:         10,
+				TxBytes:         20,
+				LatestHandshake: 1699999990,
+			}},
+		}},
+		Probes: []protocol.ProbeResult{
+			{Name: "exit", Type: "tcp", Target: "10.0.0.1:443", OK: true, LatencyMs: 12},
+			{Name: "dns", Type: "dns", Target: "example.com", OK: false},
+		},
+	})
+	r.ObserveComponents([]protocol.ComponentHealth{
+		{Name: "wg-quick@wg0", Kind: "wireguard", State: "active/exited", Active: true, Interface: "wg0", InterfaceUp: true},
+		{Name: "sing-box", Kind: "singbox", State: "failed/failed"},
+	})
+	r.ObserveHeartbeat(200*time.Millisecond, true)
+	r.ObserveHeartbeat(0, false)
+	r.lastHeartbeat = time.Unix(1700000000, 0)
+	r.ObserveCommand("CMD_WG_APPLY_INTERFACE", true, 2*time.Second)
+	r.ObserveCommand("CMD_WG_APPLY_INTERFACE", false, 45*time.Second)
+	r.ObserveCommand("CMD_BATCH", true, 500*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	golden(t, "metrics.txt", rec.Body.Bytes())
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// firewall rebuilds Netly's input, forward and NAT chains as a whole
+type firewall interface {
+	Name() string
+	Apply(input []Input, forward []Forward, nat []NAT) error
+	Teardown() error
+}
+
+// detectFirewall picks iptables when the node runs iptables-legacy, whose
+// rules nftables cannot see past, or ufw, whose drops an accept in another
+// nftables table would not get past; nftables otherwise. Nodes with neither
+// nft nor a legacy iptables fall back to whatever iptables they have.
+func detectFirewall(runner Runner) (firewall, error) {
+	version, err := runner.Query("iptables", "-V")
+	legacy := err == nil && strings.Contains(string(version), "legacy")
+	ufw, err := runner.Query("ufw", "status")
+	ufwActive := err == nil && strings.Contains(string(ufw), "Status: active")
+	if !legacy && !ufwActive {
+		if _, err := exec.LookPath("nft"); err == nil {
+			return nftables{runner}, nil
+		}
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return nil, fmt.Errorf("neither nft nor iptables is installed")
+	}
+	return iptables{runner}, nil
+}
+
+// iptables keeps the chains in the filter and nat tables. Both are rebuilt
+// in one iptables-restore, which replaces a chain atomically when it is
+// declared even with --noflush; the built-in chains only ever get one jump.
+// It covers IPv4.
+type iptables struct{ runner Runner }
+
+func (iptables) Name() string { return "iptables" }
+
+func (f iptables) Apply(input []Input, forward []Forward, nat []NAT) error {
+	var b strings.Builder
+	b.WriteString("*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", InputChain)
+	for _, r := range input {
+		fmt.Fprintf(&b, "-A %s -p %s --dport %d -j ACCEPT\n", InputChain, r.Protocol, r.Port)
+	}
+	fmt.Fprintf(&b, ":%s - [0:0]\n", ForwardChain)
+	if len(forward) > 0 {
+		fmt.Fprintf(&b, "-A %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n", ForwardChain)
+	}
+	for _, r := range forward {
+		fmt.Fprintf(&b, "-A %s -i %s", ForwardChain, r.In)
+		if r.Out != "" {
+			fmt.Fprintf(&b, " -o %s", r.Out)
+		}
+		b.WriteString(" -j ACCEPT\n")
+	}
+	b.WriteString("COMMIT\n*nat\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", NATChain)
+	for _, r := range nat {
+		if isIPv6(r.Source) {
+			continue
+		}
+		fmt.Fprintf(&b, "-A %s", NATChain)
+		if r.Source != "" {
+			fmt.Fprintf(&b, " -s %s", r.Source)
+		}
+		fmt.Fprintf(&b, " -o %s -j MASQUERADE\n", r.Out)
+	}
+	b.WriteString("COMMIT\n")
+
+	if err := f.runner.Run(b.String(), "iptables-restore", "--noflush"); err != nil {
+		return err
+	}
+	if err := f.ensureJump("filter", "INPUT", InputChain); err != nil {
+		return err
+	}
+	if err := f.ensureJump("filter", "FORWARD", ForwardChain); err != nil {
+		return err
+	}
+	return f.ensureJump("nat", "POSTROUTING", NATChain)
+}
+
+func (f iptables) ensureJump(table, from, to string) error {
+	if _, err := f.runner.Query("iptables", "-t", table, "-C", from, "-j", to); err == nil {
+		return nil
+	}
+	return f.runner.Run("", "iptables", "-t", table, "-I", from, "1", "-j", to)
+}
+
+func (f iptables) Teardown() error {
+	for _, c := range []struct{ table, from, chain string }{
+		{"filter", "INPUT", InputChain},
+		{"filter", "FORWARD", ForwardChain},
+		{"nat", "POSTROUTING", NATChain},
+	} {
+		for {
+			if _, err := f.runner.Query("iptables", "-t", c.table, "-C", c.from, "-j", c.chain); err != nil {
+				break
+			}
+			if err := f.runner.Run("", "iptables", "-t", c.table, "-D", c.from, "-j", c.chain); err != nil {
+				return err
+			}
+		}
+		if _, err := f.runner.Query("iptables", "-t", c.table, "-S", c.chain); err != nil {
+			continue
+		}
+		if err := f.runner.Run("", "iptables", "-t", c.table, "-F", c.chain); err != nil {
+			return err
+		}
+		if err := f.runner.Run("", "iptables", "-t", c.table, "-X", c.chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nftables keeps the chains in an inet table of their own, replaced in a
+// single transaction. An accept here does not override a drop in another
+// table's hook, such as a FORWARD policy set through iptables-nft; firewalld
+// gets its own service for that reason.
+type nftables struct{ runner Runner }
+
+func (nftables) Name() string { return "nftables" }
+
+func (f nftables) Apply(input []Input, forward []Forward, nat []NAT) error {
+	var b strings.Builder
+	// Declaring the table first makes the delete succeed on a clean node
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", NFTable, NFTable)
+	fmt.Fprintf(&b, "table inet %s {\n", NFTable)
+
+	fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook input priority 0; policy accept;\n", InputChain)
+	for _, r := range input {
+		fmt.Fprintf(&b, "\t\t%s dport %d accept\n", r.Protocol, r.Port)
+	}
+	b.WriteString("\t}\n")
+
+	fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook forward priority 0; policy accept;\n", ForwardChain)
+	if len(forward) > 0 {
+		b.WriteString("\t\tct state established,related accept\n")
+	}
+	for _, r := range forward {
+		fmt.Fprintf(&b, "\t\tiifname %q", r.In)
+		if r.Out != "" {
+			fmt.Fprintf(&b, " oifname %q", r.Out)
+		}
+		b.WriteString(" accept\n")
+	}
+	b.WriteString("\t}\n")
+
+	fmt.Fprintf(&b, "\tchain %s {\n\t\ttype nat hook postrouting priority 100; policy accept;\n", NATChain)
+	for _, r := range nat {
+		b.WriteString("\t\t")
+		if r.Source != "" {
+			family := "ip"
+			if isIPv6(r.Source) {
+				family = "ip6"
+			}
+			fmt.Fprintf(&b, "%s saddr %s ", family, r.Source)
+		}
+		fmt.Fprintf(&b, "oifname %q masquerade\n", r.Out)
+	}
+	b.WriteString("\t}\n}\n")
+
+	return f.runner.Run(b.String(), "nft", "-f", "-")
+}
+
+func (f nftables) Teardown() error {
+	if _, err := f.runner.Query("nft", "list", "table", "inet", NFTable); err != nil {
+		return nil
+	}
+	return f.runner.Run("", "nft", "delete", "table", "inet", NFTable)
+}
+
+func isIPv6(prefix string) bool {
+	p, err := netip.ParsePrefix(prefix)
+	return err == nil && p.Addr().Is6()
+}
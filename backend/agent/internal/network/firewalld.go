@@ -0,0 +1,83 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+)
+
+// firewalldServicePath is where the Netly service definition lives
+var firewalldServicePath = "/etc/firewalld/services/" + FirewalldService + ".xml"
+
+// applyFirewalld mirrors the inbound ports into a firewalld service when
+// firewalld runs the host firewall. Its zones drop anything they do not
+// allow, whatever Netly's own chain accepts, so the ports have to be allowed
+// there as well. Nothing happens on nodes without firewalld. A change ends
+// in a reload, which on the iptables backend flushes Netly's chains too, so
+// callers rebuild the chains afterwards.
+func (m *Manager) applyFirewalld(input []Input) error {
+	if _, err := m.runner.Query("firewall-cmd", "--state"); err != nil {
+		return nil
+	}
+
+	current, err := m.runner.Query("cat", firewalldServicePath)
+	exists := err == nil
+	if !exists && len(input) == 0 {
+		return nil
+	}
+
+	changed := false
+	desired := renderFirewalldService(input)
+	if !exists || string(current) != desired {
+		if err := m.runner.Run(desired, "tee", firewalldServicePath); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if _, err := m.runner.Query("firewall-cmd", "--permanent", "--query-service="+FirewalldService); err != nil {
+		// firewalld only sees a new service file after a reload
+		if !exists {
+			if err := m.runner.Run("", "firewall-cmd", "--reload"); err != nil {
+				return err
+			}
+		}
+		if err := m.runner.Run("", "firewall-cmd", "--permanent", "--add-service="+FirewalldService); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return m.runner.Run("", "firewall-cmd", "--reload")
+}
+
+// teardownFirewalld removes the Netly service from firewalld, if it is there
+func (m *Manager) teardownFirewalld() error {
+	if _, err := m.runner.Query("firewall-cmd", "--state"); err != nil {
+		return nil
+	}
+	if _, err := m.runner.Query("cat", firewalldServicePath); err != nil {
+		return nil
+	}
+	if _, err := m.runner.Query("firewall-cmd", "--permanent", "--query-service="+FirewalldService); err == nil {
+		if err := m.runner.Run("", "firewall-cmd", "--permanent", "--remove-service="+FirewalldService); err != nil {
+			return err
+		}
+	}
+	if err := m.runner.Run("", "rm", "-f", firewalldServicePath); err != nil {
+		return err
+	}
+	return m.runner.Run("", "firewall-cmd", "--reload")
+}
+
+func renderFirewalldService(input []Input) string {
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<service>\n")
+	b.WriteString("  <short>Netly</short>\n")
+	b.WriteString("  <description>Ports opened by the Netly agent; managed automatically.</description>\n")
+	for _, r := range input {
+		fmt.Fprintf(&b, "  <port protocol=%q port=\"%d\"/>\n", r.Protocol, r.Port)
+	}
+	b.WriteString("</service>\n")
+	return b.String()
+}
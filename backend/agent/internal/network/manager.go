@@ -0,0 +1,391 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Everything Netly puts into the node's firewall and routing lives under
+// these names, so it can be rebuilt or removed without touching anyone
+// else's rules
+const (
+	// InputChain, ForwardChain and NATChain are the chains Netly owns; the
+	// built-in INPUT, FORWARD and POSTROUTING chains only get a jump to them
+	InputChain   = "NETLY_INPUT"
+	ForwardChain = "NETLY_FORWARD"
+	NATChain     = "NETLY_POSTROUTING"
+	// NFTable is the nftables table holding the chains
+	NFTable = "netly"
+	// FirewalldService is the firewalld service holding the inbound ports
+	// where firewalld manages the host firewall
+	FirewalldService = "netly"
+
+	// RulePriority marks the ip rules Netly owns
+	RulePriority = 5200
+	// Routing tables are handed out from TableMin to TableMax
+	TableMin = 5201
+	TableMax = 5299
+)
+
+var ifaceName = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+// Rules describe what one owner, such as a WireGuard interface, needs from
+// the node's firewall and routing
+type Rules struct {
+	Input   []Input   `json:"input,omitempty"`
+	Forward []Forward `json:"forward,omitempty"`
+	NAT     []NAT     `json:"nat,omitempty"`
+	Policy  []Policy  `json:"policy,omitempty"`
+}
+
+// Input accepts inbound traffic to Port over Protocol, tcp or udp
+type Input struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// Forward accepts forwarded traffic arriving on In, and only when it leaves
+// through Out if that is set. Replies to accepted traffic are accepted too.
+type Forward struct {
+	In  string `json:"in"`
+	Out string `json:"out,omitempty"`
+}
+
+// NAT masquerades traffic leaving through Out, only from Source if that is
+// set
+type NAT struct {
+	Out    string `json:"out"`
+	Source string `json:"source,omitempty"`
+}
+
+// Policy routes traffic from the From prefix through Table
+type Policy struct {
+	From  string `json:"from"`
+	Table int    `json:"table"`
+}
+
+// state is what the manager persists: the rules of every owner and the
+// routing tables handed out to them
+type state struct {
+	Owners map[string]Rules `json:"owners"`
+	Tables map[string]int   `json:"tables"`
+}
+
+// Manager owns Netly's chains, ip rules and routing tables. Owners declare
+// their rules and the manager reconciles the node to the union of them: the
+// chains are rebuilt as a whole and ip rules are added or deleted to match,
+// so applying the same rules again changes nothing and leaves no duplicates.
+type Manager struct {
+	path   string
+	runner Runner
+
+	mu       sync.Mutex
+	state    state
+	firewall firewall
+}
+
+// Open loads the manager's state at path. An empty path keeps it in memory
+// only. Nothing on the node changes until Reconcile or Apply.
+func Open(path string, runner Runner) (*Manager, error) {
+	m := &Manager{path: path, runner: runner, state: emptyState()}
+	if path == "" {
+		return m, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return m, fmt.Errorf("failed to create network state directory: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to read network state: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.state); err != nil {
+		m.state = emptyState()
+		return m, fmt.Errorf("failed to parse network state: %w", err)
+	}
+	if m.state.Owners == nil {
+		m.state.Owners = make(map[string]Rules)
+	}
+	if m.state.Tables == nil {
+		m.state.Tables = make(map[string]int)
+	}
+	return m, nil
+}
+
+func emptyState() state {
+	return state{Owners: make(map[string]Rules), Tables: make(map[string]int)}
+}
+
+// Len returns the number of owners with declared rules
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.state.Owners)
+}
+
+// Table returns the routing table of owner, handing out a free one the
+// first time
+func (m *Manager) Table(owner string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if table, ok := m.state.Tables[owner]; ok {
+		return table, nil
+	}
+	used := make(map[int]bool, len(m.state.Tables))
+	for _, t := range m.state.Tables {
+		used[t] = true
+	}
+	for t := TableMin; t <= TableMax; t++ {
+		if !used[t] {
+			m.state.Tables[owner] = t
+			if err := m.save(); err != nil {
+				delete(m.state.Tables, owner)
+				return 0, err
+			}
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("no free routing table between %d and %d", TableMin, TableMax)
+}
+
+// Apply sets the rules of owner and reconciles the node. If that fails the
+// owner's previous rules are put back.
+func (m *Manager) Apply(owner string, rules Rules) error {
+	if err := rules.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, existed := m.state.Owners[owner]
+	m.state.Owners[owner] = rules
+	if err := m.reconcile(); err != nil {
+		if existed {
+			m.state.Owners[owner] = previous
+		} else {
+			delete(m.state.Owners, owner)
+		}
+		_ = m.reconcile()
+		return err
+	}
+	return m.save()
+}
+
+// Remove drops the rules and routing table of owner and reconciles the node.
+// Removing an unknown owner succeeds.
+func (m *Manager) Remove(owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	table, hadTable := m.state.Tables[owner]
+	delete(m.state.Owners, owner)
+	delete(m.state.Tables, owner)
+	if err := m.reconcile(); err != nil {
+		return err
+	}
+	if hadTable {
+		_ = m.runner.Run("", "ip", "route", "flush", "table", fmt.Sprint(table))
+	}
+	return m.save()
+}
+
+// Reconcile brings the node back to the declared rules, e.g. after a reboot
+// or when someone flushed the firewall
+func (m *Manager) Reconcile() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reconcile()
+}
+
+// Teardown removes everything Netly put into the firewall and routing. The
+// declared rules are kept, so a later Reconcile restores them.
+func (m *Manager) Teardown() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fw, err := m.detect()
+	if err != nil {
+		return err
+	}
+	if err := fw.Teardown(); err != nil {
+		return err
+	}
+	if err := m.teardownFirewalld(); err != nil {
+		return err
+	}
+	if err := m.applyPolicy(nil); err != nil {
+		return err
+	}
+	for _, table := range m.state.Tables {
+		_ = m.runner.Run("", "ip", "route", "flush", "table", fmt.Sprint(table))
+	}
+	return nil
+}
+
+// Backend names the firewall the manager drives, detecting it if needed
+func (m *Manager) Backend() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fw, err := m.detect()
+	if err != nil {
+		return "", err
+	}
+	return fw.Name(), nil
+}
+
+func (m *Manager) reconcile() error {
+	input, forward, nat, policy := m.union()
+
+	if len(forward) > 0 {
+		if err := m.runner.Run("", "sysctl", "-q", "-w", "net.ipv4.ip_forward=1"); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %w", err)
+		}
+		// Best effort; IPv6 may be disabled on the node
+		_ = m.runner.Run("", "sysctl", "-q", "-w", "net.ipv6.conf.all.forwarding=1")
+	}
+
+	fw, err := m.detect()
+	if err != nil {
+		return err
+	}
+	// firewalld goes first: its reload flushes every chain on the iptables
+	// backend, Netly's included, so the chains are built after it
+	if err := m.applyFirewalld(input); err != nil {
+		return fmt.Errorf("failed to apply firewalld service: %w", err)
+	}
+	if err := fw.Apply(input, forward, nat); err != nil {
+		return fmt.Errorf("failed to apply %s rules: %w", fw.Name(), err)
+	}
+	if err := m.applyPolicy(policy); err != nil {
+		return fmt.Errorf("failed to apply ip rules: %w", err)
+	}
+	return nil
+}
+
+// union merges the rules of every owner, dropping duplicates, in a stable
+// order so the rebuilt chains come out the same every time
+func (m *Manager) union() ([]Input, []Forward, []NAT, []Policy) {
+	owners := make([]string, 0, len(m.state.Owners))
+	for owner := range m.state.Owners {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	var (
+		input     []Input
+		forward   []Forward
+		nat       []NAT
+		policy    []Policy
+		seenInput = make(map[Input]bool)
+		seenFwd   = make(map[Forward]bool)
+		seenNAT   = make(map[NAT]bool)
+		seenRoute = make(map[Policy]bool)
+	)
+	for _, owner := range owners {
+		rules := m.state.Owners[owner]
+		for _, r := range rules.Input {
+			if !seenInput[r] {
+				seenInput[r] = true
+				input = append(input, r)
+			}
+		}
+		for _, r := range rules.Forward {
+			if !seenFwd[r] {
+				seenFwd[r] = true
+				forward = append(forward, r)
+			}
+		}
+		for _, r := range rules.NAT {
+			if !seenNAT[r] {
+				seenNAT[r] = true
+				nat = append(nat, r)
+			}
+		}
+		for _, r := range rules.Policy {
+			r.From = normalizePrefix(r.From)
+			if !seenRoute[r] {
+				seenRoute[r] = true
+				policy = append(policy, r)
+			}
+		}
+	}
+	return input, forward, nat, policy
+}
+
+func (m *Manager) detect() (firewall, error) {
+	if m.firewall == nil {
+		fw, err := detectFirewall(m.runner)
+		if err != nil {
+			return nil, err
+		}
+		m.firewall = fw
+	}
+	return m.firewall, nil
+}
+
+// save writes the state atomically via a temp file and rename
+func (m *Manager) save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(m.state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal network state: %w", err)
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write network state: %w", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("failed to replace network state: %w", err)
+	}
+	return nil
+}
+
+// validate keeps anything that is not an interface name or a prefix out of
+// the commands the rules turn into
+func (r Rules) validate() error {
+	for _, in := range r.Input {
+		if in.Port < 1 || in.Port > 65535 || (in.Protocol != "tcp" && in.Protocol != "udp") {
+			return fmt.Errorf("invalid input rule %d/%s", in.Port, in.Protocol)
+		}
+	}
+	for _, f := range r.Forward {
+		if !ifaceName.MatchString(f.In) || (f.Out != "" && !ifaceName.MatchString(f.Out)) {
+			return fmt.Errorf("invalid forward rule %s -> %s", f.In, f.Out)
+		}
+	}
+	for _, n := range r.NAT {
+		if !ifaceName.MatchString(n.Out) {
+			return fmt.Errorf("invalid nat interface %q", n.Out)
+		}
+		if n.Source != "" {
+			if _, err := netip.ParsePrefix(n.Source); err != nil {
+				return fmt.Errorf("invalid nat source %q", n.Source)
+			}
+		}
+	}
+	for _, p := range r.Policy {
+		if _, err := netip.ParsePrefix(p.From); err != nil {
+			return fmt.Errorf("invalid policy source %q", p.From)
+		}
+		if p.Table < TableMin || p.Table > TableMax {
+			return fmt.Errorf("routing table %d is outside %d-%d", p.Table, TableMin, TableMax)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// applyPolicy makes the ip rules at RulePriority match policy exactly:
+// missing ones are added, ones no owner declares any more are deleted
+func (m *Manager) applyPolicy(policy []Policy) error {
+	current, err := m.listPolicy()
+	if err != nil {
+		return err
+	}
+
+	desired := make(map[Policy]bool, len(policy))
+	for _, p := range policy {
+		desired[p] = true
+	}
+	for p := range current {
+		if !desired[p] {
+			if err := m.runner.Run("", "ip", familyFlag(p.From), "rule", "del", "from", p.From, "table", strconv.Itoa(p.Table), "priority", strconv.Itoa(RulePriority)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range policy {
+		if !current[p] {
+			if err := m.runner.Run("", "ip", familyFlag(p.From), "rule", "add", "from", p.From, "table", strconv.Itoa(p.Table), "priority", strconv.Itoa(RulePriority)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listPolicy parses `ip rule show` for both families, keeping the rules at
+// RulePriority, e.g. "5200:	from 10.10.0.1 lookup 5201"
+func (m *Manager) listPolicy() (map[Policy]bool, error) {
+	rules := make(map[Policy]bool)
+	prefix := strconv.Itoa(RulePriority) + ":"
+	for _, family := range []string{"-4", "-6"} {
+		output, err := m.runner.Query("ip", family, "rule", "show")
+		if err != nil {
+			if family == "-6" {
+				// IPv6 may be disabled on the node
+				continue
+			}
+			return nil, fmt.Errorf("failed to list ip rules: %w", err)
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 5 || fields[0] != prefix || fields[1] != "from" || fields[3] != "lookup" {
+				continue
+			}
+			table, err := strconv.Atoi(fields[4])
+			if err != nil {
+				continue
+			}
+			rules[Policy{From: normalizePrefix(fields[2]), Table: table}] = true
+		}
+	}
+	return rules, nil
+}
+
+// normalizePrefix writes a prefix the way `ip rule show` does: masked, and
+// without the length for a single address
+func normalizePrefix(s string) string {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			return addr.String()
+		}
+		return s
+	}
+	p = p.Masked()
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+func familyFlag(prefix string) string {
+	if strings.Contains(prefix, ":") {
+		return "-6"
+	}
+	return "-4"
+}
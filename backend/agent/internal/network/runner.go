@@ -0,0 +1,32 @@
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Runner runs the tools the manager drives. Query only reads the node's
+// state; Run changes it, feeding stdin to the command when it is not empty.
+type Runner interface {
+	Query(name string, args ...string) ([]byte, error)
+	Run(stdin string, name string, args ...string) error
+}
+
+// SudoRunner runs everything through sudo, like the rest of the agent
+type SudoRunner struct{}
+
+func (SudoRunner) Query(name string, args ...string) ([]byte, error) {
+	return exec.Command("sudo", append([]string{"-n", name}, args...)...).Output()
+}
+
+func (SudoRunner) Run(stdin string, name string, args ...string) error {
+	cmd := exec.Command("sudo", append([]string{"-n", name}, args...)...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %s: %w", name, strings.Join(args, " "), strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/netly/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	// minInterval keeps a misconfigured schedule from hammering its target
+	minInterval = 10 * time.Second
+
+	// defaultCount and maxCount bound the attempts of an on-demand probe
+	defaultCount = 5
+	maxCount     = 20
+	// attemptGap spaces attempts so they are not one burst
+	attemptGap = 200 * time.Millisecond
+	// udpReplyWait is how long a udp attempt waits for an answer or a refusal
+	udpReplyWait = time.Second
+)
+
+var (
+	pingTime = regexp.MustCompile(`time=([0-9.]+) ms`)
+	pingSent = regexp.MustCompile(`([0-9]+) packets transmitted`)
+	// hostName and ifaceName keep targets from reaching ping as flags
+	hostName  = regexp.MustCompile(`^[a-zA-Z0-9.:-]{1,253}$`)
+	ifaceName = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+)
+
+// Run performs one attempt of a scheduled probe
+func Run(ctx context.Context, schedule protocol.ProbeSchedule) protocol.ProbeResult {
+	return Measure(ctx, protocol.ProbeSpec{
+		Name:   schedule.Name,
+		Type:   schedule.Type,
+		Target: schedule.Target,
+		Count:  1,
+	})
+}
+
+// Measure runs a probe's attempts one after another and sums them up: loss,
+// mean round trip and jitter
+func Measure(ctx context.Context, spec protocol.ProbeSpec) protocol.ProbeResult {
+	result := protocol.ProbeResult{
+		Name:   spec.Name,
+		Type:   spec.Type,
+		Target: spec.Target,
+	}
+	count := spec.Count
+	if count <= 0 {
+		count = defaultCount
+	}
+	if count > maxCount {
+		count = maxCount
+	}
+
+	switch spec.Type {
+	case protocol.ProbeICMP:
+		ping(ctx, &result, spec.Target, "", count)
+	case protocol.ProbeWireGuard:
+		if !ifaceName.MatchString(spec.Interface) {
+			result.Error = fmt.Sprintf("invalid interface %q", spec.Interface)
+			break
+		}
+		ping(ctx, &result, spec.Target, spec.Interface, count)
+	case protocol.ProbeTCP:
+		var rtts []time.Duration
+		var lastErr error
+		for i := 0; i < count; i++ {
+			if i > 0 && !pause(ctx) {
+				break
+			}
+			dialer := net.Dialer{Timeout: dialTimeout}
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, "tcp", spec.Target)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			rtts = append(rtts, time.Since(start))
+			conn.Close()
+		}
+		summarize(&result, count, rtts, lastErr)
+	case protocol.ProbeUDP:
+		udp(ctx, &result, spec.Target, count)
+	default:
+		result.Error = fmt.Sprintf("unsupported probe type %q", spec.Type)
+	}
+
+	result.CheckedAt = time.Now().Unix()
+	return result
+}
+
+// ping runs the system ping, through iface if set, and reads the round trips
+// from its output. ping exits non-zero when replies are lost, so only a run
+// that sent nothing counts as an error.
+func ping(ctx context.Context, result *protocol.ProbeResult, target, iface string, count int) {
+	if !hostName.MatchString(target) || strings.HasPrefix(target, "-") {
+		result.Error = fmt.Sprintf("invalid target %q", target)
+		return
+	}
+	args := []string{"-n", "-c", strconv.Itoa(count), "-i", "0.2", "-W", "1"}
+	if iface != "" {
+		args = append(args, "-I", iface)
+	}
+	args = append(args, target)
+
+	output, err := exec.CommandContext(ctx, "ping", args...).Output()
+	sent := count
+	if m := pingSent.FindSubmatch(output); m != nil {
+		sent, _ = strconv.Atoi(string(m[1]))
+	} else if err != nil {
+		result.Error = fmt.Sprintf("ping failed: %v", err)
+		return
+	}
+
+	var rtts []time.Duration
+	for _, m := range pingTime.FindAllSubmatch(output, -1) {
+		ms, err := strconv.ParseFloat(string(m[1]), 64)
+		if err == nil {
+			rtts = append(rtts, time.Duration(ms*float64(time.Millisecond)))
+		}
+	}
+	summarize(result, sent, rtts, nil)
+}
+
+// udp sends datagrams to target. A refusal means nothing listens there; no
+// answer at all is what a WireGuard port or a firewall that drops gives, so
+// it still counts as reachable.
+func udp(ctx context.Context, result *protocol.ProbeResult, target string, count int) {
+	conn, err := (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, "udp", target)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer conn.Close()
+
+	var rtts []time.Duration
+	buf := make([]byte, 1500)
+	sent := 0
+	for i := 0; i < count; i++ {
+		if i > 0 && !pause(ctx) {
+			break
+		}
+		start := time.Now()
+		if _, err := conn.Write([]byte("netly-probe")); err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				result.Sent = sent
+				result.Error = "port unreachable (connection refused)"
+				return
+			}
+			continue
+		}
+		sent++
+		_ = conn.SetReadDeadline(time.Now().Add(udpReplyWait))
+		if _, err := conn.Read(buf); err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				result.Sent = sent
+				result.Error = "port unreachable (connection refused)"
+				return
+			}
+			continue
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+
+	if len(rtts) > 0 {
+		summarize(result, sent, rtts, nil)
+		return
+	}
+	result.OK = sent > 0
+	result.Sent = sent
+	result.Detail = "no reply; open or filtered"
+}
+
+// summarize fills in the outcome of sent attempts, rtts holding the answered
+// ones
+func summarize(result *protocol.ProbeResult, sent int, rtts []time.Duration, lastErr error) {
+	result.Sent, result.Received = sent, len(rtts)
+	if sent > 0 {
+		result.LossPercent = math.Round(float64(sent-len(rtts))*1000/float64(sent)) / 10
+	}
+	if len(rtts) == 0 {
+		result.Error = "no reply"
+		if lastErr != nil {
+			result.Error = lastErr.Error()
+		}
+		return
+	}
+
+	result.OK = true
+	var total, jitter time.Duration
+	for i, rtt := range rtts {
+		total += rtt
+		if i > 0 {
+			d := rtt - rtts[i-1]
+			if d < 0 {
+				d = -d
+			}
+			jitter += d
+		}
+	}
+	result.LatencyMs = millis(total / time.Duration(len(rtts)))
+	if len(rtts) > 1 {
+		result.JitterMs = millis(jitter / time.Duration(len(rtts)-1))
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// pause waits between attempts; false once ctx is done
+func pause(ctx context.Context) bool {
+	select {
+	case <-time.After(attemptGap):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Scheduler runs the probes the backend scheduled and keeps the latest
+// result of each
+type Scheduler struct {
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	schedules []protocol.ProbeSchedule
+	results   map[string]protocol.ProbeResult
+	cancel    context.CancelFunc
+}
+
+func NewScheduler(logger *zap.Logger) *Scheduler {
+	return &Scheduler{
+		logger:  logger,
+		results: make(map[string]protocol.ProbeResult),
+	}
+}
+
+// SetSchedules replaces the running probes. An unchanged set is left running
+// so results and timing carry over.
+func (s *Scheduler) SetSchedules(schedules []protocol.ProbeSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if reflect.DeepEqual(s.schedules, schedules) {
+		return
+	}
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.schedules = schedules
+	s.results = make(map[string]protocol.ProbeResult)
+	if len(schedules) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, schedule := range schedules {
+		go s.loop(ctx, schedule)
+	}
+	s.logger.Info("probe schedules applied", zap.Int("count", len(schedules)))
+}
+
+// Results returns the latest result of every probe, ordered by name
+func (s *Scheduler) Results() []protocol.ProbeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]protocol.ProbeResult, 0, len(s.results))
+	for _, r := range s.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+// Stop ends every running probe
+func (s *Scheduler) Stop() {
+	s.SetSchedules(nil)
+}
+
+func (s *Scheduler) loop(ctx context.Context, schedule protocol.ProbeSchedule) {
+	interval := time.Duration(schedule.Interval) * time.Second
+	if interval < minInterval {
+		interval = minInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result := Run(ctx, schedule)
+		// Schedules are replaced under the lock, so a cancelled loop cannot
+		// write into its successor's results
+		s.mu.Lock()
+		if ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.results[schedule.Name] = result
+		s.mu.Unlock()
+		if !result.OK {
+			s.logger.Debug("probe failed", zap.String("name", schedule.Name), zap.String("target", schedule.Target), zap.String("error", result.Error))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
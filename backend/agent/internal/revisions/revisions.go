@@ -0,0 +1,190 @@
+package revisions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idLayout is the timestamp part of a revision ID; IDs sort by time
+const idLayout = "20060102T150405.000Z"
+
+// Revision is one version of a managed file the agent kept
+type Revision struct {
+	ID        string    `json:"id"`
+	Digest    string    `json:"digest"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store keeps the last few versions of every managed file, one directory per
+// file named after its escaped path and one file per revision
+type Store struct {
+	dir  string
+	keep int
+
+	mu        sync.Mutex
+	revisions map[string][]Revision // oldest first
+	content   map[string]string     // by path and ID, for memory-only stores
+}
+
+// Open loads the revisions kept under dir, keeping up to keep per file. An
+// empty dir keeps them in memory only.
+func Open(dir string, keep int) (*Store, error) {
+	if keep < 1 {
+		keep = 1
+	}
+	s := &Store{
+		dir:       dir,
+		keep:      keep,
+		revisions: make(map[string][]Revision),
+		content:   make(map[string]string),
+	}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return s, fmt.Errorf("failed to create revisions directory: %w", err)
+	}
+	dirs, err := os.ReadDir(dir)
+	if err != nil {
+		return s, fmt.Errorf("failed to read revisions directory: %w", err)
+	}
+	for _, d := range dirs {
+		path, err := url.PathUnescape(d.Name())
+		if !d.IsDir() || err != nil {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, d.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			created, ok := parseID(f.Name())
+			if !ok {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, d.Name(), f.Name()))
+			if err != nil {
+				continue
+			}
+			s.revisions[path] = append(s.revisions[path], Revision{ID: f.Name(), Digest: digest(string(data)), CreatedAt: created})
+		}
+		sort.Slice(s.revisions[path], func(i, j int) bool { return s.revisions[path][i].ID < s.revisions[path][j].ID })
+	}
+	return s, nil
+}
+
+// Record keeps content as the newest revision of path and drops the oldest
+// beyond the limit. Content equal to the newest revision is not kept twice;
+// that revision is returned instead.
+func (s *Store) Record(path, content string) (Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sum := digest(content)
+	revs := s.revisions[path]
+	if n := len(revs); n > 0 && revs[n-1].Digest == sum {
+		return revs[n-1], nil
+	}
+
+	now := time.Now().UTC()
+	rev := Revision{ID: now.Format(idLayout) + "-" + sum[:8], Digest: sum, CreatedAt: now}
+	if err := s.write(path, rev.ID, content); err != nil {
+		return Revision{}, err
+	}
+	revs = append(revs, rev)
+
+	for len(revs) > s.keep {
+		s.remove(path, revs[0].ID)
+		revs = revs[1:]
+	}
+	s.revisions[path] = revs
+	return rev, nil
+}
+
+// List returns the revisions kept of path, newest first
+func (s *Store) List(path string) []Revision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revs := s.revisions[path]
+	list := make([]Revision, len(revs))
+	for i, rev := range revs {
+		list[len(revs)-1-i] = rev
+	}
+	return list
+}
+
+// Read returns the content of a kept revision
+func (s *Store) Read(path, id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rev := range s.revisions[path] {
+		if rev.ID != id {
+			continue
+		}
+		if s.dir == "" {
+			return s.content[path+"\x00"+id], nil
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, url.PathEscape(path), id))
+		if err != nil {
+			return "", fmt.Errorf("failed to read revision: %w", err)
+		}
+		return string(data), nil
+	}
+	return "", fmt.Errorf("revision %s of %s is not kept on this node", id, path)
+}
+
+// write stores a revision atomically via a temp file and rename
+func (s *Store) write(path, id, content string) error {
+	if s.dir == "" {
+		s.content[path+"\x00"+id] = content
+		return nil
+	}
+
+	dir := filepath.Join(s.dir, url.PathEscape(path))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create revisions directory: %w", err)
+	}
+	tmp := filepath.Join(dir, "."+id+".tmp")
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to write revision: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, id)); err != nil {
+		return fmt.Errorf("failed to store revision: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) remove(path, id string) {
+	if s.dir == "" {
+		delete(s.content, path+"\x00"+id)
+		return
+	}
+	_ = os.Remove(filepath.Join(s.dir, url.PathEscape(path), id))
+}
+
+// parseID reads the time a revision was kept from its ID; temp files and
+// anything else in the directory do not parse
+func parseID(id string) (time.Time, bool) {
+	ts, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	created, err := time.Parse(idLayout, ts)
+	return created, err == nil
+}
+
+func digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,228 @@
+package singbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/netly/protocol"
+)
+
+// Registry holds the sing-box fragments this node runs, keyed by the tunnel
+// or service they belong to. The live config is always composed from it, so
+// applying one tunnel never drops another's inbounds.
+type Registry struct {
+	path      string
+	mu        sync.Mutex
+	fragments map[string]protocol.SingBoxFragment
+}
+
+// Open loads the registry at path. An empty path keeps it in memory only.
+func Open(path string) (*Registry, error) {
+	r := &Registry{path: path, fragments: make(map[string]protocol.SingBoxFragment)}
+	if path == "" {
+		return r, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return r, fmt.Errorf("failed to create registry directory: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return r, fmt.Errorf("failed to read registry: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.fragments); err != nil {
+		r.fragments = make(map[string]protocol.SingBoxFragment)
+		return r, fmt.Errorf("failed to parse registry: %w", err)
+	}
+	return r, nil
+}
+
+// Len returns the number of fragments held
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.fragments)
+}
+
+// Has reports whether a fragment is held under key
+func (r *Registry) Has(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.fragments[key]
+	return ok
+}
+
+// Compose builds the full config the registry would produce with key set to
+// fragment, or removed if fragment is nil. The registry itself is unchanged.
+func (r *Registry) Compose(key string, fragment *protocol.SingBoxFragment) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return compose(r.with(key, fragment))
+}
+
+// Commit records fragment under key, or removes key if fragment is nil, and
+// persists the registry
+func (r *Registry) Commit(key string, fragment *protocol.SingBoxFragment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fragments = r.with(key, fragment)
+	return r.save()
+}
+
+// Snapshot returns the fragments as they are saved, for Restore or
+// ComposeSnapshot later
+func (r *Registry) Snapshot() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := json.Marshal(r.fragments)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal registry: %w", err)
+	}
+	return string(data), nil
+}
+
+// Restore replaces every fragment with those of a snapshot and persists the
+// registry
+func (r *Registry) Restore(snapshot string) error {
+	fragments, err := parseSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fragments = fragments
+	return r.save()
+}
+
+// ComposeSnapshot builds the full config a snapshot's fragments produce
+func ComposeSnapshot(snapshot string) ([]byte, error) {
+	fragments, err := parseSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return compose(fragments)
+}
+
+func parseSnapshot(snapshot string) (map[string]protocol.SingBoxFragment, error) {
+	fragments := make(map[string]protocol.SingBoxFragment)
+	if err := json.Unmarshal([]byte(snapshot), &fragments); err != nil {
+		return nil, fmt.Errorf("invalid registry snapshot: %w", err)
+	}
+	if fragments == nil {
+		fragments = make(map[string]protocol.SingBoxFragment)
+	}
+	return fragments, nil
+}
+
+func (r *Registry) with(key string, fragment *protocol.SingBoxFragment) map[string]protocol.SingBoxFragment {
+	out := make(map[string]protocol.SingBoxFragment, len(r.fragments)+1)
+	for k, v := range r.fragments {
+		out[k] = v
+	}
+	if fragment == nil {
+		delete(out, key)
+	} else {
+		out[key] = *fragment
+	}
+	return out
+}
+
+// save writes the registry atomically via a temp file and rename
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(r.fragments)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registry: %w", err)
+	}
+
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to replace registry: %w", err)
+	}
+	return nil
+}
+
+// directTag is the outbound traffic leaves through unless a rule says
+// otherwise
+const directTag = "direct"
+
+type rootConfig struct {
+	Log       map[string]interface{} `json:"log"`
+	Inbounds  []json.RawMessage      `json:"inbounds"`
+	Outbounds []json.RawMessage      `json:"outbounds"`
+	Route     *routeConfig           `json:"route,omitempty"`
+}
+
+type routeConfig struct {
+	Rules []json.RawMessage `json:"rules,omitempty"`
+	Final string            `json:"final"`
+}
+
+// compose merges fragments in key order into one root config. Tags must be
+// unique across fragments, since rules and sing-box itself refer to them.
+func compose(fragments map[string]protocol.SingBoxFragment) ([]byte, error) {
+	keys := make([]string, 0, len(fragments))
+	for k := range fragments {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	root := rootConfig{
+		Log:       map[string]interface{}{"level": "warn", "timestamp": true},
+		Inbounds:  []json.RawMessage{},
+		Outbounds: []json.RawMessage{json.RawMessage(`{"type":"direct","tag":"direct"}`)},
+		Route:     &routeConfig{Final: directTag},
+	}
+	owners := map[string]string{directTag: "netly"}
+
+	claim := func(key, kind string, raw json.RawMessage) error {
+		var obj struct {
+			Tag string `json:"tag"`
+		}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return fmt.Errorf("%s: invalid %s: %w", key, kind, err)
+		}
+		if obj.Tag == "" {
+			return fmt.Errorf("%s: %s has no tag", key, kind)
+		}
+		if owner, taken := owners[obj.Tag]; taken {
+			return fmt.Errorf("%s: %s tag %q is already used by %s", key, kind, obj.Tag, owner)
+		}
+		owners[obj.Tag] = key
+		return nil
+	}
+
+	for _, key := range keys {
+		f := fragments[key]
+		for _, in := range f.Inbounds {
+			if err := claim(key, "inbound", in); err != nil {
+				return nil, err
+			}
+			root.Inbounds = append(root.Inbounds, in)
+		}
+		for _, out := range f.Outbounds {
+			if err := claim(key, "outbound", out); err != nil {
+				return nil, err
+			}
+			root.Outbounds = append(root.Outbounds, out)
+		}
+		root.Route.Rules = append(root.Route.Rules, f.Rules...)
+	}
+
+	return json.MarshalIndent(root, "", "  ")
+}
@@ -0,0 +1,167 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/netly/protocol"
+)
+
+// Entry kinds
+const (
+	KindStats  = "stats"
+	KindResult = "result"
+)
+
+const defaultMaxEntries = 1000
+
+// Entry is one report the backend has not accepted yet. Seq numbers entries
+// in the order they were queued.
+type Entry struct {
+	Seq       uint64                  `json:"seq"`
+	Kind      string                  `json:"kind"`
+	Stats     *protocol.SystemStats   `json:"stats,omitempty"`
+	CommandID string                  `json:"command_id,omitempty"`
+	Result    *protocol.CommandResult `json:"result,omitempty"`
+	QueuedAt  int64                   `json:"queued_at"`
+}
+
+// Spool is a bounded on-disk queue of stats samples and command results the
+// agent could not deliver. It is flushed in order once the backend answers
+// again. When full, the oldest stats sample is dropped first: a gap in the
+// history is cheaper than a lost command outcome.
+type Spool struct {
+	path    string
+	max     int
+	mu      sync.Mutex
+	entries []Entry
+	next    uint64
+}
+
+// Open loads the spool at path. An empty path keeps the spool in memory only.
+// A missing or unreadable file starts an empty spool.
+func Open(path string, maxEntries int) (*Spool, error) {
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxEntries
+	}
+	s := &Spool{path: path, max: maxEntries}
+	if path == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return s, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to read spool: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		s.entries = nil
+		return s, fmt.Errorf("failed to parse spool: %w", err)
+	}
+	// Renumber so entries from a spool written before Seq existed stay in
+	// order too
+	for i := range s.entries {
+		s.entries[i].Seq = uint64(i + 1)
+	}
+	s.next = uint64(len(s.entries))
+	return s, nil
+}
+
+// Len returns the number of queued entries
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// PushStats queues a stats sample
+func (s *Spool) PushStats(stats *protocol.SystemStats) error {
+	return s.push(Entry{Kind: KindStats, Stats: stats})
+}
+
+// PushResult queues a command result
+func (s *Spool) PushResult(commandID string, result protocol.CommandResult) error {
+	return s.push(Entry{Kind: KindResult, CommandID: commandID, Result: &result})
+}
+
+// Peek returns up to n entries from the front of the queue without removing
+// them
+func (s *Spool) Peek(n int) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > len(s.entries) {
+		n = len(s.entries)
+	}
+	return append([]Entry(nil), s.entries[:n]...)
+}
+
+// DropThrough removes the delivered entries, every entry up to and including
+// seq. Entries are matched by Seq rather than position, as pushes may evict
+// entries while a flush is in flight.
+func (s *Spool) DropThrough(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for n < len(s.entries) && s.entries[n].Seq <= seq {
+		n++
+	}
+	s.entries = s.entries[n:]
+	return s.save()
+}
+
+func (s *Spool) push(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next++
+	e.Seq = s.next
+	e.QueuedAt = time.Now().Unix()
+	s.entries = append(s.entries, e)
+	for len(s.entries) > s.max {
+		s.evict()
+	}
+	return s.save()
+}
+
+// evict drops the oldest stats sample, or the oldest entry if only results
+// are left
+func (s *Spool) evict() {
+	for i, e := range s.entries {
+		if e.Kind == KindStats {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return
+		}
+	}
+	s.entries = s.entries[1:]
+}
+
+// save writes the spool atomically via a temp file and rename
+func (s *Spool) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spool: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace spool: %w", err)
+	}
+	return nil
+}
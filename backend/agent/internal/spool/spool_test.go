@@ -0,0 +1,115 @@
+package spool
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/netly/protocol"
+)
+
+func stats(at int64) *protocol.SystemStats {
+	return &protocol.SystemStats{CollectedAt: at}
+}
+
+func result(id string) protocol.CommandResult {
+	return protocol.CommandResult{Success: true, Output: id}
+}
+
+// describe names each entry by kind and payload, e.g. "s1" or "r:c1"
+func describe(entries []Entry) []string {
+	var out []string
+	for _, e := range entries {
+		if e.Kind == KindStats {
+			out = append(out, "s"+string(rune('0'+e.Stats.CollectedAt)))
+		} else {
+			out = append(out, "r:"+e.CommandID)
+		}
+	}
+	return out
+}
+
+func assertEntries(t *testing.T, s *Spool, want ...string) {
+	t.Helper()
+	got := describe(s.Peek(s.Len()))
+	if len(got) != len(want) {
+		t.Fatalf("entries = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("entries = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSpoolKeepsOrder(t *testing.T) {
+	s, _ := Open("", 10)
+	s.PushStats(stats(1))
+	s.PushResult("c1", result("c1"))
+	s.PushStats(stats(2))
+	assertEntries(t, s, "s1", "r:c1", "s2")
+
+	front := s.Peek(2)
+	if err := s.DropThrough(front[1].Seq); err != nil {
+		t.Fatal(err)
+	}
+	assertEntries(t, s, "s2")
+}
+
+func TestSpoolEvictsStatsFirst(t *testing.T) {
+	s, _ := Open("", 3)
+	s.PushResult("c1", result("c1"))
+	s.PushStats(stats(1))
+	s.PushResult("c2", result("c2"))
+	s.PushStats(stats(2))
+	assertEntries(t, s, "r:c1", "r:c2", "s2")
+
+	s.PushResult("c3", result("c3"))
+	assertEntries(t, s, "r:c1", "r:c2", "r:c3")
+
+	// With only results left the oldest goes
+	s.PushResult("c4", result("c4"))
+	assertEntries(t, s, "r:c2", "r:c3", "r:c4")
+}
+
+func TestSpoolEvictionDuringFlush(t *testing.T) {
+	s, _ := Open("", 3)
+	s.PushStats(stats(1))
+	s.PushStats(stats(2))
+	s.PushResult("c1", result("c1"))
+
+	// Both stats samples are in flight when a result arrives and evicts the
+	// first of them
+	sent := s.Peek(2)
+	s.PushResult("c2", result("c2"))
+	if err := s.DropThrough(sent[len(sent)-1].Seq); err != nil {
+		t.Fatal(err)
+	}
+	assertEntries(t, s, "r:c1", "r:c2")
+}
+
+func TestSpoolPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.json")
+	s, err := Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PushStats(stats(1))
+	s.PushResult("c1", result("c1"))
+	s.PushStats(stats(2))
+	s.DropThrough(s.Peek(1)[0].Seq)
+
+	s, err = Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEntries(t, s, "r:c1", "s2")
+	if e := s.Peek(1)[0]; e.Result == nil || e.Result.Output != "c1" {
+		t.Fatalf("result after reopen = %+v", e.Result)
+	}
+
+	// Entries queued after a restart still sort after the reloaded ones
+	s.PushResult("c2", result("c2"))
+	front := s.Peek(2)
+	s.DropThrough(front[1].Seq)
+	assertEntries(t, s, "r:c2")
+}
@@ -1,31 +1,32 @@
 package stats
 
 import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/netly/protocol"
 	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
 	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
 )
 
-type SystemStats struct {
-	CPUUsage    float64 `json:"cpu_usage"`
-	RAMUsage    float64 `json:"ram_usage"`
-	RAMTotal    uint64  `json:"ram_total"`
-	RAMUsed     uint64  `json:"ram_used"`
-	Uptime      uint64  `json:"uptime"`
-	NetworkRx   uint64  `json:"network_rx"`
-	NetworkTx   uint64  `json:"network_tx"`
-	Hostname    string  `json:"hostname"`
-	OS          string  `json:"os"`
-	Platform    string  `json:"platform"`
-	CollectedAt int64   `json:"collected_at"`
-}
+// SystemStats is the heartbeat telemetry sample defined by the wire protocol
+type SystemStats = protocol.SystemStats
 
+// Collector samples the node. Rates and deltas are computed against the
+// previous sample, so the first sample after a start reports none.
 type Collector struct {
-	lastNetRx uint64
-	lastNetTx uint64
+	lastAt  time.Time
+	lastNet map[string]net.IOCountersStat
 }
 
 func NewCollector() *Collector {
@@ -33,8 +34,9 @@ func NewCollector() *Collector {
 }
 
 func (c *Collector) Collect() (*SystemStats, error) {
+	now := time.Now()
 	stats := &SystemStats{
-		CollectedAt: time.Now().Unix(),
+		CollectedAt: now.Unix(),
 	}
 
 	// CPU Usage
@@ -60,18 +62,201 @@ func (c *Collector) Collect() (*SystemStats, error) {
 		stats.Platform = hostInfo.Platform
 	}
 
-	// Network I/O
-	netIO, err := net.IOCounters(false)
-	if err == nil && len(netIO) > 0 {
-		stats.NetworkRx = netIO[0].BytesRecv - c.lastNetRx
-		stats.NetworkTx = netIO[0].BytesSent - c.lastNetTx
-		c.lastNetRx = netIO[0].BytesRecv
-		c.lastNetTx = netIO[0].BytesSent
+	if avg, err := load.Avg(); err == nil {
+		stats.Load = &protocol.LoadAverage{Load1: avg.Load1, Load5: avg.Load5, Load15: avg.Load15}
 	}
 
+	stats.Disks = collectDisks()
+	c.collectNetwork(stats, now)
+	stats.WireGuard = collectWireGuard()
+	stats.TCP = collectTCP()
+	stats.SingBoxRSS = singBoxRSS()
+
 	return stats, nil
 }
 
+// collectNetwork fills the per-interface counters and rates and the summed
+// deltas. A counter that went backwards was reset, so no delta is reported
+// for it.
+func (c *Collector) collectNetwork(stats *SystemStats, now time.Time) {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		return
+	}
+
+	elapsed := now.Sub(c.lastAt).Seconds()
+	current := make(map[string]net.IOCountersStat, len(counters))
+	for _, nic := range counters {
+		if nic.Name == "lo" {
+			continue
+		}
+		current[nic.Name] = nic
+		iface := protocol.InterfaceStats{Name: nic.Name, RxBytes: nic.BytesRecv, TxBytes: nic.BytesSent}
+
+		if prev, ok := c.lastNet[nic.Name]; ok && elapsed > 0 {
+			if nic.BytesRecv >= prev.BytesRecv {
+				delta := nic.BytesRecv - prev.BytesRecv
+				stats.NetworkRx += delta
+				iface.RxRate = uint64(float64(delta) / elapsed)
+			}
+			if nic.BytesSent >= prev.BytesSent {
+				delta := nic.BytesSent - prev.BytesSent
+				stats.NetworkTx += delta
+				iface.TxRate = uint64(float64(delta) / elapsed)
+			}
+		}
+		stats.Interfaces = append(stats.Interfaces, iface)
+	}
+
+	c.lastNet = current
+	c.lastAt = now
+}
+
+// collectDisks reports every mounted physical filesystem once
+func collectDisks() []protocol.DiskUsage {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return nil
+	}
+
+	var disks []protocol.DiskUsage
+	seen := make(map[string]bool)
+	for _, part := range partitions {
+		if seen[part.Device] {
+			continue
+		}
+		seen[part.Device] = true
+
+		usage, err := disk.Usage(part.Mountpoint)
+		if err != nil || usage.Total == 0 {
+			continue
+		}
+		disks = append(disks, protocol.DiskUsage{
+			Mount:       part.Mountpoint,
+			Total:       usage.Total,
+			Used:        usage.Used,
+			UsedPercent: usage.UsedPercent,
+		})
+	}
+	return disks
+}
+
+// collectWireGuard reports every WireGuard interface, or none when wg
+// cannot be read
+func collectWireGuard() []protocol.WireGuardStatus {
+	ifaces, err := ReadWireGuard()
+	if err != nil {
+		return nil
+	}
+	return ifaces
+}
+
+// ReadWireGuard reads every WireGuard interface from `wg show all dump`.
+// Interface lines have 5 fields and peer lines 9, both led by the interface.
+func ReadWireGuard() ([]protocol.WireGuardStatus, error) {
+	output, err := exec.Command("sudo", "-n", "wg", "show", "all", "dump").Output()
+	if err != nil {
+		return nil, fmt.Errorf("wg show failed: %w", err)
+	}
+
+	var ifaces []protocol.WireGuardStatus
+	index := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		switch len(fields) {
+		case 5:
+			index[fields[0]] = len(ifaces)
+			ifaces = append(ifaces, protocol.WireGuardStatus{Interface: fields[0], Active: true})
+		case 9:
+			i, ok := index[fields[0]]
+			if !ok {
+				continue
+			}
+			peer := protocol.WireGuardPeerStatus{PublicKey: fields[1]}
+			if fields[3] != "(none)" {
+				peer.Endpoint = fields[3]
+			}
+			peer.LatestHandshake, _ = strconv.ParseInt(fields[5], 10, 64)
+			peer.RxBytes, _ = strconv.ParseUint(fields[6], 10, 64)
+			peer.TxBytes, _ = strconv.ParseUint(fields[7], 10, 64)
+			ifaces[i].Peers = append(ifaces[i].Peers, peer)
+		}
+	}
+	return ifaces, nil
+}
+
+// WireGuardPeers returns the peers of one interface; an interface that is
+// not up is an error
+func WireGuardPeers(iface string) ([]protocol.WireGuardPeerStatus, error) {
+	ifaces, err := ReadWireGuard()
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ifaces {
+		if status.Interface == iface {
+			return status.Peers, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s is not up", iface)
+}
+
+// collectTCP reads established connections from /proc/net/snmp and socket
+// counts from /proc/net/sockstat, which is far cheaper than listing sockets
+func collectTCP() *protocol.TCPStats {
+	counters, err := net.ProtoCounters([]string{"tcp"})
+	if err != nil || len(counters) == 0 {
+		return nil
+	}
+	tcp := &protocol.TCPStats{Established: uint64(counters[0].Stats["CurrEstab"])}
+
+	f, err := os.Open("/proc/net/sockstat")
+	if err != nil {
+		return tcp
+	}
+	defer f.Close()
+
+	// TCP: inuse 5 orphan 0 tw 2 alloc 7 mem 1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "TCP:" {
+			continue
+		}
+		for i := 1; i+1 < len(fields); i += 2 {
+			v, _ := strconv.ParseUint(fields[i+1], 10, 64)
+			switch fields[i] {
+			case "inuse":
+				tcp.InUse = v
+			case "tw":
+				tcp.TimeWait = v
+			}
+		}
+	}
+	return tcp
+}
+
+// singBoxRSS returns the resident memory of sing-box's main process, or 0
+// when it is not running
+func singBoxRSS() uint64 {
+	output, err := exec.Command("systemctl", "show", "-p", "MainPID", "--value", "sing-box").Output()
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 32)
+	if err != nil || pid == 0 {
+		return 0
+	}
+	proc, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return 0
+	}
+	info, err := proc.MemoryInfo()
+	if err != nil {
+		return 0
+	}
+	return info.RSS
+}
+
 // GetSystemStats is a convenience function for simple usage
 func GetSystemStats() (cpu float64, ram float64, uptime uint64) {
 	collector := NewCollector()
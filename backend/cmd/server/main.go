@@ -2,8 +2,10 @@ package main
 
 import (
     "context"
+    "crypto/tls"
     "fmt"
     "net"
+    "net/url"
     "os"
     "os/signal"
     "strings"
@@ -118,7 +120,7 @@ func main() {
 	})
 
 	// Setup API routes
-    installerService := transporthttp.SetupRoutes(app, transporthttp.RouterConfig{
+    installerService, agentCA, taskService := transporthttp.SetupRoutes(app, transporthttp.RouterConfig{
         DB:            database,
         Logger:        log,
         Config:        cfg,
@@ -127,6 +129,10 @@ func main() {
         EnableTaskCorrelation: cfg.Features.EnableTaskCorrelation,
     })
 
+	// Background workers stop when the server shuts down
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	go taskService.StartReaper(workerCtx)
+
 	// Validate agent binary existence
 	if err := installerService.ValidateBinaryExistence(); err != nil {
 		log.Warnf("Agent binary is missing; Node installation will fail until the binary is placed in the correct folder (bin/netly-agent, agent/netly-agent, or ../agent/netly-agent): %v", err)
@@ -181,9 +187,49 @@ func main() {
 
     log.Infof("server started on %s", addr)
 
-	gracefulShutdown(app, database, log)
+	if cfg.AgentTLS.Enabled {
+		startAgentTLSListener(app, cfg, agentCA, log)
+	}
+
+	gracefulShutdown(app, database, stopWorkers, log)
 }
 
+// startAgentTLSListener serves the same app on a second port that requires a
+// client certificate from the agent CA
+func startAgentTLSListener(app *fiber.App, cfg *config.Config, agentCA *services.CertificateAuthority, log *logger.Logger) {
+	hosts := cfg.AgentTLS.Hostnames
+	if len(hosts) == 0 {
+		if u, err := url.Parse(cfg.AgentTLS.PublicURL); err == nil && u.Hostname() != "" {
+			hosts = []string{u.Hostname()}
+		}
+	}
+	if len(hosts) == 0 {
+		log.Warnf("agent mTLS listener has no hostnames; set agent_tls.hostnames or agent_tls.public_url")
+	}
+
+	tlsConfig, err := agentCA.ServerTLSConfig(hosts)
+	if err != nil {
+		log.Fatalf("failed to build agent TLS config: %v", err)
+	}
+
+	port := cfg.AgentTLS.Port
+	if port == 0 {
+		port = 8443
+	}
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, port)
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		log.Fatalf("agent mTLS listener failed to start: %v", err)
+	}
+
+	go func() {
+		if err := app.Listener(tls.NewListener(ln, tlsConfig)); err != nil {
+			log.Fatalf("agent mTLS listener failed: %v", err)
+		}
+	}()
+
+	log.Infof("agent mTLS listener started on %s for %v", addr, hosts)
+}
 
 func globalErrorHandler(log *logger.Logger) fiber.ErrorHandler {
 	return func(c *fiber.Ctx, err error) error {
@@ -222,12 +268,13 @@ func globalErrorHandler(log *logger.Logger) fiber.ErrorHandler {
 	}
 }
 
-func gracefulShutdown(app *fiber.App, database *gorm.DB, log *logger.Logger) {
+func gracefulShutdown(app *fiber.App, database *gorm.DB, stopWorkers context.CancelFunc, log *logger.Logger) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	<-quit
 	log.Info("shutting down server...")
+	stopWorkers()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -17,6 +17,8 @@ type Config struct {
     PortAM   PortAMConfig   `mapstructure:"portam"`
     Features FeaturesConfig `mapstructure:"features"`
     Auth     AuthConfig     `mapstructure:"auth"`
+    Commands CommandsConfig `mapstructure:"commands"`
+    AgentTLS AgentTLSConfig `mapstructure:"agent_tls"`
 }
 
 type IPAMConfig struct {
@@ -86,6 +88,32 @@ type AuthConfig struct {
     AllowedOrigins []string `mapstructure:"allowed_origins"`
 }
 
+// CommandsConfig controls the agent command queue lifecycle
+type CommandsConfig struct {
+	ProcessingTimeout time.Duration `mapstructure:"processing_timeout"`
+	MaxAttempts       int           `mapstructure:"max_attempts"`
+	ReapInterval      time.Duration `mapstructure:"reap_interval"`
+	DefaultTTL        time.Duration `mapstructure:"default_ttl"`
+}
+
+// AgentTLSConfig controls the mutual-TLS listener agents connect to. Its
+// certificates come from the internal CA, so it has to be reachable directly
+// rather than through a TLS-terminating proxy.
+type AgentTLSConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	Port    int  `mapstructure:"port"`
+	// PublicURL is the https:// URL agents use to reach this listener
+	PublicURL string `mapstructure:"public_url"`
+	// Hostnames and IPs the listener's certificate is valid for
+	Hostnames    []string      `mapstructure:"hostnames"`
+	CertValidity time.Duration `mapstructure:"cert_validity"`
+	// RequireClientCert rejects agent requests that do not present a client
+	// certificate, on every listener
+	RequireClientCert bool `mapstructure:"require_client_cert"`
+	// AgentPort is where agents serve their control API (listen_port in
+	// agent.yaml). Zero leaves the backend unable to call agents.
+	AgentPort int `mapstructure:"agent_port"`
+}
 
 func Load(path string) (*Config, error) {
 	viper.SetConfigFile(path)
@@ -2,6 +2,7 @@ package ports
 
 import (
 	"context"
+	"time"
 
 	"github.com/netly/backend/internal/domain"
 )
@@ -15,10 +16,25 @@ type NodeRepository interface {
 	Update(ctx context.Context, node *domain.Node) error
 	UpdateStatus(ctx context.Context, id uint, status string) error
 	UpdateLastLog(ctx context.Context, id uint, log string) error
+	UpdateHealth(ctx context.Context, id uint, health domain.JSONB) error
+	UpdateConfigDrift(ctx context.Context, id uint, drifted bool) error
+	UpdateAgentTokenHash(ctx context.Context, id uint, hash string) error
 	Restore(ctx context.Context, node *domain.Node) error
 	Delete(ctx context.Context, id uint) error
 }
 
+type AgentCertificateRepository interface {
+	Create(ctx context.Context, cert *domain.AgentCertificate) error
+	ListByNode(ctx context.Context, nodeID uint) ([]domain.AgentCertificate, error)
+	ListRevoked(ctx context.Context) ([]domain.AgentCertificate, error)
+	RevokeByNode(ctx context.Context, nodeID uint) ([]domain.AgentCertificate, error)
+}
+
+type NodeStatsRepository interface {
+	CreateBatch(ctx context.Context, samples []domain.NodeStatsSample) error
+	ListByNode(ctx context.Context, nodeID uint, since time.Time, limit int) ([]domain.NodeStatsSample, error)
+}
+
 type TunnelRepository interface {
 	Create(ctx context.Context, tunnel *domain.Tunnel) error
 	GetByID(ctx context.Context, id uint) (*domain.Tunnel, error)
@@ -51,3 +67,51 @@ type SystemSettingRepository interface {
 	GetByCategory(ctx context.Context, category string) ([]domain.SystemSetting, error)
 	Delete(ctx context.Context, key string) error
 }
+
+type TaskRepository interface {
+	Create(ctx context.Context, task *domain.Task) error
+	GetByID(ctx context.Context, id string) (*domain.Task, error)
+	Update(ctx context.Context, task *domain.Task) error
+}
+
+// CommandFilter narrows a command listing. Zero values match everything.
+type CommandFilter struct {
+	NodeID uint
+	Status domain.CommandStatus
+	Limit  int
+}
+
+type CommandRepository interface {
+	Create(ctx context.Context, cmd *domain.Command) error
+	GetByID(ctx context.Context, id string) (*domain.Command, error)
+	// GetByIdempotencyKey finds the pending or processing command queued
+	// under key for the node
+	GetByIdempotencyKey(ctx context.Context, nodeID uint, key string) (*domain.Command, error)
+	GetPendingByNodeID(ctx context.Context, nodeID uint) ([]*domain.Command, error)
+	List(ctx context.Context, filter CommandFilter) ([]*domain.Command, error)
+	GetStaleProcessing(ctx context.Context, dispatchedBefore time.Time) ([]*domain.Command, error)
+	Update(ctx context.Context, cmd *domain.Command) error
+	// UpdateIfStatus saves cmd only while its stored status is still from
+	// and reports whether it did
+	UpdateIfStatus(ctx context.Context, cmd *domain.Command, from domain.CommandStatus) (bool, error)
+	UpdateStatus(ctx context.Context, id string, status domain.CommandStatus, result string, errStr string) error
+}
+
+type CommandOutputRepository interface {
+	Append(ctx context.Context, chunks []domain.CommandOutputChunk) error
+	ListAfter(ctx context.Context, commandID string, afterSeq int, limit int) ([]domain.CommandOutputChunk, error)
+}
+
+type ManagedFileRepository interface {
+	Upsert(ctx context.Context, file *domain.ManagedFile) error
+	Get(ctx context.Context, nodeID uint, path string) (*domain.ManagedFile, error)
+	ListByNode(ctx context.Context, nodeID uint) ([]domain.ManagedFile, error)
+	Delete(ctx context.Context, nodeID uint, path string) error
+}
+
+type ConfigRevisionRepository interface {
+	Create(ctx context.Context, rev *domain.ConfigRevision) error
+	Get(ctx context.Context, nodeID uint, path, revision string) (*domain.ConfigRevision, error)
+	ListByNode(ctx context.Context, nodeID uint, limit int) ([]domain.ConfigRevision, error)
+	ListByFile(ctx context.Context, nodeID uint, path string) ([]domain.ConfigRevision, error)
+}
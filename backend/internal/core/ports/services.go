@@ -2,6 +2,7 @@ package ports
 
 import (
 	"context"
+	"time"
 
 	"github.com/netly/backend/internal/domain"
 )
@@ -18,6 +19,8 @@ type NodeService interface {
 	GetTaskStatus(taskID string) (*domain.Task, error)                  // Added Task status retrieval
 	GetNodeAuth(ctx context.Context, id uint) (user, password, sshKey string, err error)
 	UpdateNodeStats(ctx context.Context, id uint, stats domain.JSONB) error
+	RecordStatsSamples(ctx context.Context, id uint, samples []domain.NodeStatsSample) error
+	GetStatsHistory(ctx context.Context, id uint, since time.Time, limit int) ([]domain.NodeStatsSample, error)
 }
 
 type CreateNodeInput struct {
@@ -101,13 +104,48 @@ type FQDNAMService interface {
 // TaskService handles async tasks and command dispatch to agents
 type TaskService interface {
 	// Task management (existing)
-	CreateTask(taskType string) *domain.Task
+	CreateTask(taskType string) (*domain.Task, error)
 	UpdateTask(id string, status string, progress int, msg string) error
 	FailTask(id string, errStr string) error
 	GetTask(id string) (*domain.Task, error)
 
 	// Command dispatch (new)
-	CreateCommand(nodeID uint, cmdType domain.CommandType, payload domain.JSONB) (*domain.Command, error)
+	CreateCommand(nodeID uint, cmdType domain.CommandType, payload domain.JSONB, opts CommandOptions) (*domain.Command, error)
 	GetPendingCommands(nodeID uint) ([]*domain.Command, error)
+	GetCommand(commandID string) (*domain.Command, error)
+	ListCommands(filter CommandFilter) ([]*domain.Command, error)
 	UpdateCommandStatus(commandID string, status domain.CommandStatus, result string, errStr string) error
+	MarkCommandDispatched(commandID string) error
+	CompleteCommand(nodeID uint, commandID string, success bool, output string, errStr string) (*domain.Command, error)
+	AcknowledgeCommand(nodeID uint, commandID string) error
+	DispatchPendingCommands(nodeID uint) (int, error)
+	CancelCommand(commandID string) (*domain.Command, error)
+
+	// Output streamed by agents while a command runs
+	AppendCommandOutput(nodeID uint, commandID string, chunks []domain.CommandOutputChunk) error
+	GetCommandOutput(commandID string, afterSeq int, limit int) ([]domain.CommandOutputChunk, error)
+}
+
+// CommandOptions tunes how a queued command is delivered
+type CommandOptions struct {
+	// Priority orders delivery; higher runs first
+	Priority int
+	// TTL is how long the command may wait for its agent. Zero uses the
+	// configured default, a negative value never expires.
+	TTL time.Duration
+	// IdempotencyKey makes repeated CreateCommand calls for the same node
+	// return the command that was already queued
+	IdempotencyKey string
+	// Timeout stops the command on the agent once it has run this long.
+	// Zero leaves it to the agent's own limits.
+	Timeout time.Duration
+	// MaxAttempts caps deliveries of a command whose result never arrives.
+	// Zero uses the configured default.
+	MaxAttempts int
+}
+
+// CommandPusher delivers commands over a live agent connection
+type CommandPusher interface {
+	IsConnected(nodeID uint) bool
+	Push(cmd *domain.Command) error
 }
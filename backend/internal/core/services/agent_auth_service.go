@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+// AgentAuthService issues per-node agent tokens and verifies them. Tokens are
+// never stored; the node row keeps their SHA-256.
+type AgentAuthService struct {
+	nodeRepo          ports.NodeRepository
+	ca                *CertificateAuthority
+	requireClientCert bool
+	logger            *logger.Logger
+}
+
+type AgentAuthServiceConfig struct {
+	NodeRepo ports.NodeRepository
+	// CA, when set, lets agents authenticate with their client certificate
+	CA *CertificateAuthority
+	// RequireClientCert rejects requests that did not arrive over mTLS
+	RequireClientCert bool
+	Logger            *logger.Logger
+}
+
+func NewAgentAuthService(cfg AgentAuthServiceConfig) *AgentAuthService {
+	return &AgentAuthService{
+		nodeRepo:          cfg.NodeRepo,
+		ca:                cfg.CA,
+		requireClientCert: cfg.RequireClientCert && cfg.CA != nil,
+		logger:            cfg.Logger,
+	}
+}
+
+// IssueToken generates a new token for the node, replacing (and thereby
+// revoking) any previous one. The plain token is only ever returned here.
+func (s *AgentAuthService) IssueToken(ctx context.Context, nodeID uint) (string, error) {
+	if _, err := s.nodeRepo.GetByID(ctx, nodeID); err != nil {
+		return "", ErrNodeNotFound
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate agent token: %w", err)
+	}
+	token := fmt.Sprintf("%s%d_%s", protocol.AgentTokenPrefix, nodeID, base64.RawURLEncoding.EncodeToString(secret))
+
+	if err := s.nodeRepo.UpdateAgentTokenHash(ctx, nodeID, hashAgentToken(token)); err != nil {
+		return "", fmt.Errorf("failed to store agent token: %w", err)
+	}
+
+	s.logger.Infow("agent_token_issued", "node_id", nodeID)
+	return token, nil
+}
+
+// HasToken reports whether the node has been issued an agent token
+func (s *AgentAuthService) HasToken(ctx context.Context, nodeID uint) (bool, error) {
+	node, err := s.nodeRepo.GetByID(ctx, nodeID)
+	if err != nil {
+		return false, ErrNodeNotFound
+	}
+	return node.AgentTokenHash != "", nil
+}
+
+// Authenticate returns the node a token belongs to. The node ID in the token
+// only selects which hash to compare against; the secret is what
+// authenticates, so a token is rejected unless it matches that hash.
+func (s *AgentAuthService) Authenticate(ctx context.Context, token string) (uint, error) {
+	nodeID, ok := protocol.NodeIDFromToken(token)
+	if !ok {
+		return 0, ErrAgentTokenInvalid
+	}
+
+	node, err := s.nodeRepo.GetByID(ctx, nodeID)
+	if err != nil || node.AgentTokenHash == "" {
+		return 0, ErrAgentTokenInvalid
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAgentToken(token)), []byte(node.AgentTokenHash)) != 1 {
+		s.logger.Warnw("agent_token_mismatch", "node_id", nodeID)
+		return 0, ErrAgentTokenInvalid
+	}
+	return nodeID, nil
+}
+
+// AuthenticateRequest resolves the node behind an agent request. A verified
+// client certificate is trusted on its own; a bearer token sent alongside it
+// must name the same node.
+func (s *AgentAuthService) AuthenticateRequest(ctx context.Context, state *tls.ConnectionState, token string) (uint, error) {
+	var certNodeID uint
+	if s.ca != nil {
+		if id, ok := s.ca.NodeIDFromTLS(state); ok {
+			certNodeID = id
+		}
+	}
+
+	if certNodeID == 0 {
+		if s.requireClientCert {
+			return 0, ErrAgentClientCertRequired
+		}
+		return s.Authenticate(ctx, token)
+	}
+
+	if token != "" {
+		tokenNodeID, err := s.Authenticate(ctx, token)
+		if err != nil {
+			return 0, err
+		}
+		if tokenNodeID != certNodeID {
+			s.logger.Warnw("agent_identity_mismatch", "cert_node_id", certNodeID, "token_node_id", tokenNodeID)
+			return 0, ErrAgentIdentityMismatch
+		}
+	}
+	return certNodeID, nil
+}
+
+func hashAgentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+const agentControlTimeout = 15 * time.Second
+
+// AgentControlService calls the control API agents serve on their node. The
+// connection is mTLS with the CA's certificates and every request is also
+// signed with the agent signing key, so the agent checks both who is calling
+// and that the call is fresh.
+type AgentControlService struct {
+	nodeRepo     ports.NodeRepository
+	timelineRepo ports.TimelineRepository
+	ca           *CertificateAuthority
+	keyManager   *KeyManager
+	agentPort    int
+	logger       *logger.Logger
+}
+
+type AgentControlServiceConfig struct {
+	NodeRepo     ports.NodeRepository
+	TimelineRepo ports.TimelineRepository
+	CA           *CertificateAuthority
+	KeyManager   *KeyManager
+	// AgentPort is the listen_port agents serve the control API on
+	AgentPort int
+	Logger    *logger.Logger
+}
+
+func NewAgentControlService(cfg AgentControlServiceConfig) *AgentControlService {
+	return &AgentControlService{
+		nodeRepo:     cfg.NodeRepo,
+		timelineRepo: cfg.TimelineRepo,
+		ca:           cfg.CA,
+		keyManager:   cfg.KeyManager,
+		agentPort:    cfg.AgentPort,
+		logger:       cfg.Logger,
+	}
+}
+
+// Status asks the agent on nodeID how it is doing
+func (s *AgentControlService) Status(ctx context.Context, nodeID uint) (*protocol.AgentStatus, error) {
+	var status protocol.AgentStatus
+	if err := s.call(ctx, nodeID, http.MethodGet, protocol.ControlStatusPath, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Diagnostics runs the agent's local checks on nodeID
+func (s *AgentControlService) Diagnostics(ctx context.Context, nodeID uint) (*protocol.AgentDiagnostics, error) {
+	var diag protocol.AgentDiagnostics
+	if err := s.call(ctx, nodeID, http.MethodGet, protocol.ControlDiagnosticsPath, &diag); err != nil {
+		return nil, err
+	}
+	return &diag, nil
+}
+
+// SelfDestruct asks the agent on nodeID to remove everything Netly put on
+// the node, itself included. The agent reports each stage back through
+// RecordDestructProgress.
+func (s *AgentControlService) SelfDestruct(ctx context.Context, nodeID uint) error {
+	if err := s.call(ctx, nodeID, http.MethodDelete, protocol.ControlSelfPath, nil); err != nil {
+		recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+			Type:         domain.EventTypeAgentDestruct,
+			Status:       domain.EventStatusFailed,
+			ResourceType: "node",
+			ResourceID:   nodeID,
+			Message:      "Agent self-destruct request failed",
+			Meta:         map[string]interface{}{"error": err.Error()},
+		})
+		return err
+	}
+	s.logger.Infow("agent_destruct_requested", "node_id", nodeID)
+	recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+		Type:         domain.EventTypeAgentDestruct,
+		Status:       domain.EventStatusPending,
+		ResourceType: "node",
+		ResourceID:   nodeID,
+		Message:      "Agent self-destruct requested",
+	})
+	return nil
+}
+
+// RecordDestructProgress stores a stage reported by a destructing agent
+func (s *AgentControlService) RecordDestructProgress(ctx context.Context, nodeID uint, progress protocol.DestructProgress) {
+	status := domain.EventStatusPending
+	switch {
+	case progress.Error != "":
+		status = domain.EventStatusFailed
+	case progress.Stage == protocol.DestructRemovingAgent:
+		status = domain.EventStatusSuccess
+	}
+
+	if progress.Error != "" {
+		s.logger.Warnw("agent_destruct_stage_failed", "node_id", nodeID, "stage", progress.Stage, "error", progress.Error)
+	} else {
+		s.logger.Infow("agent_destruct_stage", "node_id", nodeID, "stage", progress.Stage)
+	}
+
+	meta := map[string]interface{}{"stage": progress.Stage}
+	if progress.Error != "" {
+		meta["error"] = progress.Error
+	}
+	recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+		Type:         domain.EventTypeAgentDestruct,
+		Status:       status,
+		ResourceType: "node",
+		ResourceID:   nodeID,
+		Message:      fmt.Sprintf("Agent self-destruct: %s", progress.Stage),
+		Meta:         meta,
+	})
+}
+
+func (s *AgentControlService) call(ctx context.Context, nodeID uint, method, path string, out interface{}) error {
+	if s.agentPort == 0 {
+		return ErrAgentControlDisabled
+	}
+	node, err := s.nodeRepo.GetByID(ctx, nodeID)
+	if err != nil {
+		return ErrNodeNotFound
+	}
+
+	tlsConfig, err := s.ca.ClientTLSConfig(nodeID)
+	if err != nil {
+		return fmt.Errorf("agent control: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{Timeout: agentControlTimeout, Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("agent control: %w", err)
+	}
+	signed := protocol.ControlRequest{
+		Method:    method,
+		Path:      path,
+		NodeID:    nodeID,
+		Timestamp: time.Now().Unix(),
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+	}
+
+	url := fmt.Sprintf("https://%s%s", net.JoinHostPort(node.IP, strconv.Itoa(s.agentPort)), path)
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(signed.Body))
+	if err != nil {
+		return fmt.Errorf("agent control: %w", err)
+	}
+	req.Header.Set(protocol.ControlTimestampHeader, strconv.FormatInt(signed.Timestamp, 10))
+	req.Header.Set(protocol.ControlNonceHeader, signed.Nonce)
+	req.Header.Set(protocol.ControlSignatureHeader, base64.StdEncoding.EncodeToString(s.keyManager.SignForAgent(signed.SigningMessage())))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		s.logger.Warnw("agent_control_unreachable", "node_id", nodeID, "path", path, "error", err)
+		return fmt.Errorf("%w: %v", ErrAgentControlUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAgentControlUnreachable, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		s.logger.Warnw("agent_control_rejected", "node_id", nodeID, "path", path, "status", resp.StatusCode)
+		return fmt.Errorf("%w: status %d: %s", ErrAgentControlRejected, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("agent control: invalid response: %w", err)
+	}
+	return nil
+}
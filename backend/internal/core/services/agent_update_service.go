@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+// agentArchitectures are the builds published under bin/uploads
+var agentArchitectures = []string{"amd64", "arm64"}
+
+// AgentUpdateService queues signed CMD_UPDATE_AGENT commands pointing at the
+// binaries served from /downloads
+type AgentUpdateService struct {
+	nodeRepo          ports.NodeRepository
+	taskService       ports.TaskService
+	keyManager        *KeyManager
+	settingService    *SystemSettingService
+	logger            *logger.Logger
+	binDir            string
+	fallbackPublicURL string
+}
+
+type AgentUpdateServiceConfig struct {
+	NodeRepo          ports.NodeRepository
+	TaskService       ports.TaskService
+	KeyManager        *KeyManager
+	SettingService    *SystemSettingService
+	Logger            *logger.Logger
+	BinDir            string
+	FallbackPublicURL string
+}
+
+func NewAgentUpdateService(cfg AgentUpdateServiceConfig) *AgentUpdateService {
+	binDir := cfg.BinDir
+	if binDir == "" {
+		binDir = "bin/uploads"
+	}
+	return &AgentUpdateService{
+		nodeRepo:          cfg.NodeRepo,
+		taskService:       cfg.TaskService,
+		keyManager:        cfg.KeyManager,
+		settingService:    cfg.SettingService,
+		logger:            cfg.Logger,
+		binDir:            binDir,
+		fallbackPublicURL: cfg.FallbackPublicURL,
+	}
+}
+
+// QueueUpdate hashes and signs every published agent binary and queues a
+// CMD_UPDATE_AGENT for the node. The agent picks the artifact for its arch.
+func (s *AgentUpdateService) QueueUpdate(ctx context.Context, nodeID uint, version string) (*domain.Command, error) {
+	if version == "" {
+		return nil, ErrAgentUpdateNoVersion
+	}
+	if _, err := s.nodeRepo.GetByID(ctx, nodeID); err != nil {
+		return nil, ErrNodeNotFound
+	}
+
+	baseURL := s.fallbackPublicURL
+	if settings, err := s.settingService.GetSettingsStruct(); err == nil && settings.PublicURL != "" {
+		baseURL = settings.PublicURL
+	}
+	if baseURL == "" {
+		return nil, ErrAgentUpdateNoURL
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	update := protocol.UpdateAgentPayload{
+		Version:   version,
+		Artifacts: make(map[string]protocol.UpdateArtifact),
+	}
+	for _, arch := range agentArchitectures {
+		name := "netly-agent-" + arch
+		sum, err := fileSHA256(filepath.Join(s.binDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", name, err)
+		}
+
+		signature := s.keyManager.SignForAgent(protocol.UpdateSigningMessage(version, arch, sum))
+		update.Artifacts[arch] = protocol.UpdateArtifact{
+			URL:       fmt.Sprintf("%s/downloads/%s", baseURL, name),
+			SHA256:    sum,
+			Signature: base64.StdEncoding.EncodeToString(signature),
+		}
+	}
+	if len(update.Artifacts) == 0 {
+		return nil, ErrAgentUpdateNoBinaries
+	}
+
+	raw, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+	var payload domain.JSONB
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	cmd, err := s.taskService.CreateCommand(nodeID, domain.CmdUpdateAgent, payload, ports.CommandOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Infow("agent_update_queued", "node_id", nodeID, "version", version, "command_id", cmd.ID, "artifacts", len(update.Artifacts))
+	return cmd, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,460 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+const (
+	caValidity              = 10 * 365 * 24 * time.Hour
+	defaultNodeCertValidity = 90 * 24 * time.Hour
+	backendCertValidity     = 365 * 24 * time.Hour
+)
+
+// CertificateAuthority is the internal CA behind agent mTLS. It issues each
+// node a certificate naming its node ID, issues the backend's own serving
+// certificate and tracks revocations. Like KeyManager it keeps its key pair
+// in system settings.
+type CertificateAuthority struct {
+	settingService *SystemSettingService
+	certRepo       ports.AgentCertificateRepository
+	nodeRepo       ports.NodeRepository
+	logger         *logger.Logger
+	certValidity   time.Duration
+
+	mu      sync.RWMutex
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	revoked map[string]bool
+
+	clientMu   sync.Mutex
+	clientCert *tls.Certificate
+}
+
+type CertificateAuthorityConfig struct {
+	SettingService *SystemSettingService
+	CertRepo       ports.AgentCertificateRepository
+	NodeRepo       ports.NodeRepository
+	Logger         *logger.Logger
+	CertValidity   time.Duration
+}
+
+func NewCertificateAuthority(cfg CertificateAuthorityConfig) *CertificateAuthority {
+	validity := cfg.CertValidity
+	if validity == 0 {
+		validity = defaultNodeCertValidity
+	}
+	return &CertificateAuthority{
+		settingService: cfg.SettingService,
+		certRepo:       cfg.CertRepo,
+		nodeRepo:       cfg.NodeRepo,
+		logger:         cfg.Logger,
+		certValidity:   validity,
+		revoked:        make(map[string]bool),
+	}
+}
+
+// Initialize loads the CA from settings, generating it on first start, and
+// loads the revocation list
+func (ca *CertificateAuthority) Initialize(ctx context.Context) error {
+	settings, err := ca.settingService.GetSettingsStruct()
+	if err != nil {
+		return fmt.Errorf("failed to get settings: %w", err)
+	}
+
+	if settings.AgentCACert != "" && settings.AgentCAKey != "" {
+		if err := ca.load(settings.AgentCACert, settings.AgentCAKey); err != nil {
+			return err
+		}
+		ca.logger.Info("Agent CA loaded from database")
+	} else {
+		ca.logger.Info("Generating new agent CA...")
+		if err := ca.generate(); err != nil {
+			return fmt.Errorf("failed to generate agent CA: %w", err)
+		}
+	}
+
+	revoked, err := ca.certRepo.ListRevoked(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load revoked certificates: %w", err)
+	}
+	ca.mu.Lock()
+	for _, c := range revoked {
+		ca.revoked[c.Serial] = true
+	}
+	ca.mu.Unlock()
+	return nil
+}
+
+func (ca *CertificateAuthority) load(certPEM, keyPEM string) error {
+	certBlock, _ := pem.Decode([]byte(certPEM))
+	keyBlock, _ := pem.Decode([]byte(keyPEM))
+	if certBlock == nil || keyBlock == nil {
+		return fmt.Errorf("stored agent CA is not valid PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("stored agent CA certificate is invalid: %w", err)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("stored agent CA key is invalid: %w", err)
+	}
+
+	ca.mu.Lock()
+	ca.cert, ca.key, ca.certPEM = cert, key, certPEM
+	ca.mu.Unlock()
+	return nil
+}
+
+func (ca *CertificateAuthority) generate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Netly Agent CA", Organization: []string{"Netly"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err := ca.load(certPEM, keyPEM); err != nil {
+		return err
+	}
+	return ca.settingService.UpdateAgentCA(certPEM, keyPEM)
+}
+
+// CACertPEM returns the CA certificate agents trust
+func (ca *CertificateAuthority) CACertPEM() string {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	return ca.certPEM
+}
+
+// IssueNodeCertificate generates a key pair for the node and signs it. Used
+// at install time, when the key can be handed over together with the token.
+func (ca *CertificateAuthority) IssueNodeCertificate(ctx context.Context, nodeID uint) (certPEM, keyPEM string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate node key: %w", err)
+	}
+	certPEM, _, err = ca.signNode(ctx, nodeID, &key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	return certPEM, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), nil
+}
+
+// SignNodeCSR renews a node's certificate from a CSR generated on the node.
+// The identity comes from nodeID, never from the CSR subject.
+func (ca *CertificateAuthority) SignNodeCSR(ctx context.Context, nodeID uint, csrPEM string) (string, time.Time, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", time.Time{}, ErrCertInvalidCSR
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		return "", time.Time{}, ErrCertInvalidCSR
+	}
+	return ca.signNode(ctx, nodeID, csr.PublicKey)
+}
+
+func (ca *CertificateAuthority) signNode(ctx context.Context, nodeID uint, pub crypto.PublicKey) (string, time.Time, error) {
+	node, err := ca.nodeRepo.GetByID(ctx, nodeID)
+	if err != nil {
+		return "", time.Time{}, ErrNodeNotFound
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("netly-node-%d", nodeID), Organization: []string{"Netly"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(ca.certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// Nodes present this certificate to the backend and serve with it
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		URIs:        []*url.URL{protocol.NodeIdentityURI(nodeID)},
+	}
+	for _, addr := range []string{node.IP, node.PrivateIP} {
+		if ip := net.ParseIP(addr); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+	}
+
+	der, err := ca.sign(tmpl, pub)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := ca.certRepo.Create(ctx, &domain.AgentCertificate{
+		NodeID:    nodeID,
+		Serial:    serialString(serial),
+		NotBefore: tmpl.NotBefore,
+		NotAfter:  tmpl.NotAfter,
+	}); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to record certificate: %w", err)
+	}
+
+	ca.logger.Infow("agent_cert_issued", "node_id", nodeID, "serial", serialString(serial), "not_after", tmpl.NotAfter)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), tmpl.NotAfter, nil
+}
+
+func (ca *CertificateAuthority) sign(tmpl *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	if ca.cert == nil {
+		return nil, errors.New("ca: not initialized")
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+}
+
+// RevokeNode revokes every certificate issued to the node
+func (ca *CertificateAuthority) RevokeNode(ctx context.Context, nodeID uint) (int, error) {
+	certs, err := ca.certRepo.RevokeByNode(ctx, nodeID)
+	if err != nil {
+		return 0, err
+	}
+
+	ca.mu.Lock()
+	for _, c := range certs {
+		ca.revoked[c.Serial] = true
+	}
+	ca.mu.Unlock()
+
+	ca.logger.Infow("agent_certs_revoked", "node_id", nodeID, "count", len(certs))
+	return len(certs), nil
+}
+
+// ListNodeCertificates returns the certificates issued to a node, newest first
+func (ca *CertificateAuthority) ListNodeCertificates(ctx context.Context, nodeID uint) ([]domain.AgentCertificate, error) {
+	return ca.certRepo.ListByNode(ctx, nodeID)
+}
+
+// IsRevoked reports whether the certificate has been revoked
+func (ca *CertificateAuthority) IsRevoked(cert *x509.Certificate) bool {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	return ca.revoked[serialString(cert.SerialNumber)]
+}
+
+// ServerTLSConfig issues the backend's serving certificate for hosts and
+// returns a config that requires a valid, unrevoked node certificate
+func (ca *CertificateAuthority) ServerTLSConfig(hosts []string) (*tls.Config, error) {
+	cert, err := ca.issueBackendCertificate(hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return errors.New("no verified client certificate")
+			}
+			leaf := chains[0][0]
+			if _, ok := protocol.NodeIDFromCertificate(leaf); !ok {
+				return errors.New("client certificate carries no node identity")
+			}
+			if ca.IsRevoked(leaf) {
+				return fmt.Errorf("client certificate %s is revoked", serialString(leaf.SerialNumber))
+			}
+			return nil
+		},
+	}, nil
+}
+
+// ClientTLSConfig returns a config for calling the agent on nodeID. The
+// backend presents its own certificate, and the agent must present an
+// unrevoked certificate naming that node. Nodes are matched by identity
+// rather than by address, since the backend may reach them on an address
+// their certificate does not list.
+func (ca *CertificateAuthority) ClientTLSConfig(nodeID uint) (*tls.Config, error) {
+	cert, err := ca.backendClientCertificate()
+	if err != nil {
+		return nil, err
+	}
+	pool := ca.pool()
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		// Chain and identity are checked in VerifyConnection instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("agent presented no certificate")
+			}
+			leaf := state.PeerCertificates[0]
+			intermediates := x509.NewCertPool()
+			for _, c := range state.PeerCertificates[1:] {
+				intermediates.AddCert(c)
+			}
+			if _, err := leaf.Verify(x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}); err != nil {
+				return fmt.Errorf("agent certificate: %w", err)
+			}
+			if id, ok := protocol.NodeIDFromCertificate(leaf); !ok || id != nodeID {
+				return fmt.Errorf("agent certificate does not identify node %d", nodeID)
+			}
+			if ca.IsRevoked(leaf) {
+				return fmt.Errorf("agent certificate %s is revoked", serialString(leaf.SerialNumber))
+			}
+			return nil
+		},
+	}, nil
+}
+
+// backendClientCertificate returns the certificate the backend presents to
+// agents, issuing a new one once less than a tenth of its lifetime is left
+func (ca *CertificateAuthority) backendClientCertificate() (tls.Certificate, error) {
+	ca.clientMu.Lock()
+	defer ca.clientMu.Unlock()
+
+	if ca.clientCert != nil && time.Until(ca.clientCert.Leaf.NotAfter) > backendCertValidity/10 {
+		return *ca.clientCert, nil
+	}
+	cert, err := ca.issueBackendCertificate(nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	ca.clientCert = &cert
+	return cert, nil
+}
+
+// issueBackendCertificate signs a fresh certificate carrying the backend
+// identity, valid for hosts
+func (ca *CertificateAuthority) issueBackendCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	backendURI, _ := url.Parse(protocol.BackendIdentityURI)
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "netly-backend", Organization: []string{"Netly"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(backendCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// The backend also uses this certificate when it calls agents
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:        []*url.URL{backendURI},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := ca.sign(tmpl, &key.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	ca.mu.RLock()
+	caDER := ca.cert.Raw
+	ca.mu.RUnlock()
+
+	return tls.Certificate{
+		Certificate: [][]byte{der, caDER},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func (ca *CertificateAuthority) pool() *x509.CertPool {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// NodeIDFromTLS returns the node identified by a verified client certificate
+func (ca *CertificateAuthority) NodeIDFromTLS(state *tls.ConnectionState) (uint, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return 0, false
+	}
+	leaf := state.VerifiedChains[0][0]
+	if ca.IsRevoked(leaf) {
+		return 0, false
+	}
+	return protocol.NodeIDFromCertificate(leaf)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func serialString(serial *big.Int) string {
+	return hex.EncodeToString(serial.Bytes())
+}
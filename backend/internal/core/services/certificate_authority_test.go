@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"go.uber.org/zap"
+)
+
+// fakeNodeRepo answers GetByID for any node; nothing else is used here
+type fakeNodeRepo struct {
+	ports.NodeRepository
+}
+
+func (fakeNodeRepo) GetByID(ctx context.Context, id uint) (*domain.Node, error) {
+	return &domain.Node{ID: id, IP: "127.0.0.1"}, nil
+}
+
+type fakeCertRepo struct {
+	certs []domain.AgentCertificate
+}
+
+func (r *fakeCertRepo) Create(ctx context.Context, cert *domain.AgentCertificate) error {
+	r.certs = append(r.certs, *cert)
+	return nil
+}
+
+func (r *fakeCertRepo) ListByNode(ctx context.Context, nodeID uint) ([]domain.AgentCertificate, error) {
+	var out []domain.AgentCertificate
+	for _, c := range r.certs {
+		if c.NodeID == nodeID {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeCertRepo) ListRevoked(ctx context.Context) ([]domain.AgentCertificate, error) {
+	var out []domain.AgentCertificate
+	for _, c := range r.certs {
+		if c.RevokedAt != nil {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeCertRepo) RevokeByNode(ctx context.Context, nodeID uint) ([]domain.AgentCertificate, error) {
+	now := time.Now()
+	var out []domain.AgentCertificate
+	for i := range r.certs {
+		if r.certs[i].NodeID == nodeID && r.certs[i].RevokedAt == nil {
+			r.certs[i].RevokedAt = &now
+			out = append(out, r.certs[i])
+		}
+	}
+	return out, nil
+}
+
+// newTestCA loads a freshly generated CA without going through settings
+func newTestCA(t *testing.T) *CertificateAuthority {
+	t.Helper()
+	ca := NewCertificateAuthority(CertificateAuthorityConfig{
+		CertRepo: &fakeCertRepo{},
+		NodeRepo: fakeNodeRepo{},
+		Logger:   &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+	})
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Netly Agent CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ca.load(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// handshake connects to a server using config with the node certificate
+func handshake(t *testing.T, ca *CertificateAuthority, config *tls.Config, certPEM, keyPEM string) error {
+	t.Helper()
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(ca.CACertPEM()))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- tls.Server(conn, config).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   "localhost",
+	})
+	if err == nil {
+		conn.Close()
+	}
+	return <-done
+}
+
+func TestServerTLSConfigRejectsRevoked(t *testing.T) {
+	ca := newTestCA(t)
+	ctx := context.Background()
+	config, err := ca.ServerTLSConfig([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM, err := ca.IssueNodeCertificate(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, ca, config, certPEM, keyPEM); err != nil {
+		t.Fatalf("valid node certificate rejected: %v", err)
+	}
+
+	if n, err := ca.RevokeNode(ctx, 7); err != nil || n != 1 {
+		t.Fatalf("RevokeNode = %d, %v, want 1 certificate", n, err)
+	}
+	err = handshake(t, ca, config, certPEM, keyPEM)
+	if err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("revoked certificate: err = %v, want a revocation error", err)
+	}
+}
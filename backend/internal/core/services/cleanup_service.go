@@ -128,6 +128,7 @@ sudo systemctl stop sing-box 2>/dev/null || true
 sudo rm -f /etc/systemd/system/netly-agent.service
 sudo rm -f /usr/local/bin/netly-agent
 sudo rm -rf /etc/netly
+sudo rm -rf /var/lib/netly
 sudo systemctl daemon-reload
 echo "Hard uninstall completed"
 `
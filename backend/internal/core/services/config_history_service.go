@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// configHistoryLimit caps a node's revision listing across all files
+const configHistoryLimit = 200
+
+// ConfigHistoryService records the revisions agents keep of managed files and
+// rolls files back to them
+type ConfigHistoryService struct {
+	revisionRepo ports.ConfigRevisionRepository
+	nodeRepo     ports.NodeRepository
+	timelineRepo ports.TimelineRepository
+	taskService  ports.TaskService
+	logger       *logger.Logger
+}
+
+type ConfigHistoryServiceConfig struct {
+	RevisionRepo ports.ConfigRevisionRepository
+	NodeRepo     ports.NodeRepository
+	TimelineRepo ports.TimelineRepository
+	TaskService  ports.TaskService
+	Logger       *logger.Logger
+}
+
+func NewConfigHistoryService(cfg ConfigHistoryServiceConfig) *ConfigHistoryService {
+	return &ConfigHistoryService{
+		revisionRepo: cfg.RevisionRepo,
+		nodeRepo:     cfg.NodeRepo,
+		timelineRepo: cfg.TimelineRepo,
+		taskService:  cfg.TaskService,
+		logger:       cfg.Logger,
+	}
+}
+
+// RevisionDiff is a revision in a file's history with the change it made to
+// the one before it, as a unified diff
+type RevisionDiff struct {
+	domain.ConfigRevision
+	Diff string `json:"diff"`
+}
+
+// RecordCommand stores the revisions a successful command produced. Keys and
+// credentials are redacted first; the agent keeps the real content, so a
+// rollback still restores them.
+func (s *ConfigHistoryService) RecordCommand(ctx context.Context, nodeID uint, cmd *domain.Command, files []protocol.ManagedFile) {
+	for _, f := range files {
+		if f.Revision == "" {
+			continue
+		}
+		rev := &domain.ConfigRevision{
+			NodeID:      nodeID,
+			Path:        f.Path,
+			Revision:    f.Revision,
+			Digest:      f.Digest,
+			Unit:        f.Unit,
+			Content:     redactSecrets(f.Path, f.Content),
+			CommandID:   cmd.ID,
+			CommandType: cmd.Type,
+		}
+		if err := s.revisionRepo.Create(ctx, rev); err != nil {
+			s.logger.Warnw("config_revision_record_failed", "node_id", nodeID, "path", f.Path, "command_id", cmd.ID, "error", err)
+		}
+	}
+}
+
+// Revisions lists the node's newest revisions across all its files
+func (s *ConfigHistoryService) Revisions(ctx context.Context, nodeID uint) ([]domain.ConfigRevision, error) {
+	if _, err := s.nodeRepo.GetByID(ctx, nodeID); err != nil {
+		return nil, ErrNodeNotFound
+	}
+	return s.revisionRepo.ListByNode(ctx, nodeID, configHistoryLimit)
+}
+
+// History lists a file's revisions, newest first, each with its diff to the
+// revision before it. The oldest is diffed against an empty file.
+func (s *ConfigHistoryService) History(ctx context.Context, nodeID uint, path string) ([]RevisionDiff, error) {
+	if _, err := s.nodeRepo.GetByID(ctx, nodeID); err != nil {
+		return nil, ErrNodeNotFound
+	}
+	revs, err := s.revisionRepo.ListByFile(ctx, nodeID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]RevisionDiff, len(revs))
+	for i, rev := range revs {
+		var before, fromName string
+		if i+1 < len(revs) {
+			before, fromName = revs[i+1].Content, revs[i+1].Revision
+		}
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(before),
+			B:        difflib.SplitLines(rev.Content),
+			FromFile: fromName,
+			ToFile:   rev.Revision,
+			Context:  3,
+		})
+		if err != nil {
+			return nil, err
+		}
+		rev.Content = ""
+		history[i] = RevisionDiff{ConfigRevision: rev, Diff: diff}
+	}
+	return history, nil
+}
+
+// Revision returns one revision with its full content
+func (s *ConfigHistoryService) Revision(ctx context.Context, nodeID uint, path, revision string) (*domain.ConfigRevision, error) {
+	rev, err := s.revisionRepo.Get(ctx, nodeID, path, revision)
+	if err != nil {
+		return nil, ErrConfigRevisionNotFound
+	}
+	return rev, nil
+}
+
+// Rollback queues a CMD_ROLLBACK_CONFIG restoring the revision and restarting
+// the unit that served the file then. The agent only keeps its newest
+// revisions, so older ones recorded here may be refused by the node.
+func (s *ConfigHistoryService) Rollback(ctx context.Context, nodeID uint, path, revision string) (*domain.Command, error) {
+	rev, err := s.Revision(ctx, nodeID, path, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := toJSONB(protocol.RollbackConfigPayload{Path: rev.Path, Revision: rev.Revision, Service: rev.Unit})
+	cmd, err := s.taskService.CreateCommand(nodeID, domain.CmdRollbackConfig, payload, ports.CommandOptions{})
+	if err != nil {
+		s.logger.Errorw("config_rollback_dispatch_failed", "node_id", nodeID, "path", path, "revision", revision, "error", err)
+		return nil, err
+	}
+	s.logger.Infow("config_rollback_dispatched", "node_id", nodeID, "path", path, "revision", revision, "command_id", cmd.ID)
+
+	recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+		Type:         domain.EventTypeConfigRollback,
+		Status:       domain.EventStatusPending,
+		ResourceType: "node",
+		ResourceID:   nodeID,
+		Message:      fmt.Sprintf("Rolling %s back to revision %s", path, revision),
+		Meta: map[string]interface{}{
+			"path":       path,
+			"revision":   revision,
+			"command_id": cmd.ID,
+		},
+	})
+	return cmd, nil
+}
+
+// redactedValue replaces a secret in stored revisions
+const redactedValue = "<redacted>"
+
+var (
+	// wireGuardSecrets are the wg-quick settings that hold keys
+	wireGuardSecrets = regexp.MustCompile(`(?im)^(\s*(?:PrivateKey|PresharedKey)\s*=\s*).*$`)
+
+	// singBoxSecrets are the sing-box fields that hold keys and credentials
+	singBoxSecrets = map[string]bool{
+		"password":       true,
+		"uuid":           true,
+		"private_key":    true,
+		"pre_shared_key": true,
+		"psk":            true,
+		"key":            true,
+		"short_id":       true,
+		"auth_str":       true,
+		"secret":         true,
+		"token":          true,
+	}
+)
+
+// redactSecrets blanks the keys and credentials in a managed file. JSON
+// files are rewritten with every secret field replaced; wg-quick files lose
+// their key settings. Anything else is stored as it is.
+func redactSecrets(path, content string) string {
+	switch {
+	case strings.HasSuffix(path, ".json"):
+		var doc interface{}
+		dec := json.NewDecoder(strings.NewReader(content))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return redactedValue
+		}
+		var out strings.Builder
+		enc := json.NewEncoder(&out)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(redactJSON(doc)); err != nil {
+			return redactedValue
+		}
+		return out.String()
+	case strings.HasSuffix(path, ".conf"):
+		return wireGuardSecrets.ReplaceAllString(content, "${1}"+redactedValue)
+	}
+	return content
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if singBoxSecrets[k] {
+				v[k] = redactedValue
+				continue
+			}
+			v[k] = redactJSON(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactJSON(child)
+		}
+	}
+	return v
+}
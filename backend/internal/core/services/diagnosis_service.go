@@ -0,0 +1,400 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+// Hop statuses of a tunnel diagnosis
+const (
+	HopOK       = "ok"
+	HopDegraded = "degraded"
+	HopBroken   = "broken"
+	// HopUnknown means an end did not report back in time
+	HopUnknown = "unknown"
+)
+
+const (
+	defaultDiagnosisTimeout = 45 * time.Second
+	diagnosisPollInterval   = 500 * time.Millisecond
+	// degradedLoss is the packet loss, in percent, a working hop is
+	// degraded at
+	degradedLoss = 20
+	// staleHandshake is how old a WireGuard handshake may get; peers rekey
+	// every two minutes while traffic or keepalives flow
+	staleHandshake = 180
+)
+
+// DiagnosisService probes a tunnel's hops from both ends and reports which
+// one is broken
+type DiagnosisService struct {
+	tunnelRepo  ports.TunnelRepository
+	nodeRepo    ports.NodeRepository
+	taskService ports.TaskService
+	logger      *logger.Logger
+	timeout     time.Duration
+}
+
+type DiagnosisServiceConfig struct {
+	TunnelRepo  ports.TunnelRepository
+	NodeRepo    ports.NodeRepository
+	TaskService ports.TaskService
+	Logger      *logger.Logger
+	// Timeout bounds how long a diagnosis waits for the agents; zero uses
+	// 45 seconds
+	Timeout time.Duration
+}
+
+func NewDiagnosisService(cfg DiagnosisServiceConfig) *DiagnosisService {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultDiagnosisTimeout
+	}
+	return &DiagnosisService{
+		tunnelRepo:  cfg.TunnelRepo,
+		nodeRepo:    cfg.NodeRepo,
+		taskService: cfg.TaskService,
+		logger:      cfg.Logger,
+		timeout:     timeout,
+	}
+}
+
+// TunnelDiagnosis is the outcome of probing every hop of a tunnel
+type TunnelDiagnosis struct {
+	TunnelID uint `json:"tunnel_id"`
+	Healthy  bool `json:"healthy"`
+	// BrokenHop names the first hop found broken, if any
+	BrokenHop string         `json:"broken_hop,omitempty"`
+	Hops      []HopDiagnosis `json:"hops"`
+}
+
+// HopDiagnosis is one hop probed from both of its ends. Forward results come
+// from FromNodeID, reverse ones from ToNodeID.
+type HopDiagnosis struct {
+	Name       string                 `json:"name"`
+	FromNodeID uint                   `json:"from_node_id"`
+	ToNodeID   uint                   `json:"to_node_id"`
+	Status     string                 `json:"status"`
+	Reason     string                 `json:"reason,omitempty"`
+	Forward    []protocol.ProbeResult `json:"forward"`
+	Reverse    []protocol.ProbeResult `json:"reverse"`
+}
+
+// hop is a link between two nodes as the tunnel built it. The ifaces and
+// tunnel addresses are set for WireGuard only; reversePort is what from
+// listens on, if anything.
+type hop struct {
+	name               string
+	from, to           *domain.Node
+	fromIface, toIface string
+	fromTunIP, toTunIP string
+	port, reversePort  int
+	transport          string
+}
+
+// Diagnose queues a CMD_PROBE on every node of the tunnel, waits for them and
+// judges each hop. Ends that do not answer in time leave their hops unknown.
+func (s *DiagnosisService) Diagnose(ctx context.Context, tunnelID uint) (*TunnelDiagnosis, error) {
+	tunnel, err := s.tunnelRepo.GetByID(ctx, tunnelID)
+	if err != nil {
+		return nil, ErrTunnelNotFound
+	}
+	hops, err := s.tunnelHops(ctx, tunnel)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := make(map[uint][]protocol.ProbeSpec)
+	for i, h := range hops {
+		specs[h.from.ID] = append(specs[h.from.ID], hopSpecs(i, "forward", h.to, h.port, h.transport, h.fromIface, h.toTunIP)...)
+		specs[h.to.ID] = append(specs[h.to.ID], hopSpecs(i, "reverse", h.from, h.reversePort, h.transport, h.toIface, h.fromTunIP)...)
+	}
+
+	commands := make(map[uint]string, len(specs))
+	for nodeID, nodeSpecs := range specs {
+		payload := toJSONB(protocol.ProbePayload{Probes: nodeSpecs})
+		cmd, err := s.taskService.CreateCommand(nodeID, domain.CmdProbe, payload, ports.CommandOptions{
+			TTL:     s.timeout,
+			Timeout: s.timeout,
+		})
+		if err != nil {
+			s.logger.Warnw("tunnel_diagnose_dispatch_failed", "tunnel_id", tunnelID, "node_id", nodeID, "error", err)
+			continue
+		}
+		commands[nodeID] = cmd.ID
+	}
+	s.logger.Infow("tunnel_diagnose_dispatched", "tunnel_id", tunnelID, "nodes", len(commands))
+
+	reports := s.awaitReports(ctx, commands)
+
+	diagnosis := &TunnelDiagnosis{TunnelID: tunnelID, Healthy: true, Hops: make([]HopDiagnosis, 0, len(hops))}
+	for i, h := range hops {
+		d := judgeHop(i, h, reports)
+		if d.Status != HopOK {
+			diagnosis.Healthy = false
+		}
+		if d.Status == HopBroken && diagnosis.BrokenHop == "" {
+			diagnosis.BrokenHop = d.Name
+		}
+		diagnosis.Hops = append(diagnosis.Hops, d)
+	}
+	s.logger.Infow("tunnel_diagnose_done", "tunnel_id", tunnelID, "healthy", diagnosis.Healthy, "broken_hop", diagnosis.BrokenHop)
+	return diagnosis, nil
+}
+
+// tunnelHops lists a tunnel's hops: one for a direct tunnel, entry to relay
+// and relay to exit for a chain
+func (s *DiagnosisService) tunnelHops(ctx context.Context, t *domain.Tunnel) ([]hop, error) {
+	node := func(id uint) (*domain.Node, error) {
+		n, err := s.nodeRepo.GetByID(ctx, id)
+		if err != nil {
+			return nil, ErrNodeNotFound
+		}
+		return n, nil
+	}
+
+	if t.Type != domain.TunnelTypeChain {
+		source, err := node(t.SourceNodeID)
+		if err != nil {
+			return nil, err
+		}
+		dest, err := node(t.DestNodeID)
+		if err != nil {
+			return nil, err
+		}
+		h := hop{
+			name:      fmt.Sprintf("%s -> %s", source.Name, dest.Name),
+			from:      source,
+			to:        dest,
+			port:      t.DestPort,
+			transport: tunnelTransport(t.Protocol),
+		}
+		if t.Protocol == domain.TunnelProtocolWireGuard {
+			server, client, err := deriveWGIPs(t.InternalIPv4)
+			if err != nil {
+				return nil, fmt.Errorf("%w: tunnel has no usable address: %v", ErrTunnelInvalidInput, err)
+			}
+			h.fromIface = wireguardInterface(t.ID, "")
+			h.toIface = h.fromIface
+			h.fromTunIP, h.toTunIP = hostIP(client), hostIP(server)
+			h.reversePort = t.SourcePort
+		}
+		return []hop{h}, nil
+	}
+
+	var segments struct {
+		SegmentA chainSegment `json:"segment_a"`
+		SegmentB chainSegment `json:"segment_b"`
+	}
+	raw, _ := json.Marshal(t.Segments)
+	if err := json.Unmarshal(raw, &segments); err != nil {
+		return nil, fmt.Errorf("%w: chain segments unreadable: %v", ErrTunnelInvalidInput, err)
+	}
+	entry, err := node(segments.SegmentA.SourceID)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := node(segments.SegmentA.DestID)
+	if err != nil {
+		return nil, err
+	}
+	exit, err := node(segments.SegmentB.DestID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The relay runs one interface per segment
+	segmentA, segmentB := wireguardInterface(t.ID, "a"), wireguardInterface(t.ID, "b")
+	return []hop{
+		{
+			name: fmt.Sprintf("%s -> %s", entry.Name, relay.Name),
+			from: entry, to: relay,
+			fromIface: segmentA, toIface: segmentA,
+			fromTunIP: hostIP(segments.SegmentA.EntryIP), toTunIP: hostIP(segments.SegmentA.RelayIP),
+			port: segments.SegmentA.DestPort, transport: protocol.PortUDP,
+		},
+		{
+			name: fmt.Sprintf("%s -> %s", relay.Name, exit.Name),
+			from: relay, to: exit,
+			fromIface: segmentB, toIface: segmentB,
+			fromTunIP: hostIP(segments.SegmentB.RelayIP), toTunIP: hostIP(segments.SegmentB.ExitIP),
+			port: segments.SegmentB.DestPort, transport: protocol.PortUDP,
+		},
+	}, nil
+}
+
+// chainSegment is one hop of a chain as CreateChain stores it
+type chainSegment struct {
+	SourceID uint   `json:"source_id"`
+	DestID   uint   `json:"dest_id"`
+	DestPort int    `json:"dest_port"`
+	EntryIP  string `json:"entry_ip"`
+	RelayIP  string `json:"relay_ip"`
+	ExitIP   string `json:"exit_ip"`
+}
+
+// hopSpecs builds the probes one end runs toward the other: a ping of its
+// public address, a check of the port it listens on and, for WireGuard, a
+// ping through the tunnel
+func hopSpecs(index int, dir string, target *domain.Node, port int, transport, iface, tunIP string) []protocol.ProbeSpec {
+	name := func(kind string) string { return fmt.Sprintf("hop%d/%s/%s", index, dir, kind) }
+	ip := getNodeEndpointIP(target)
+
+	specs := []protocol.ProbeSpec{{Name: name("icmp"), Type: protocol.ProbeICMP, Target: ip}}
+	if port > 0 {
+		probeType := protocol.ProbeUDP
+		if transport == protocol.PortTCP {
+			probeType = protocol.ProbeTCP
+		}
+		specs = append(specs, protocol.ProbeSpec{Name: name("port"), Type: probeType, Target: net.JoinHostPort(ip, strconv.Itoa(port))})
+	}
+	if iface != "" && tunIP != "" {
+		specs = append(specs, protocol.ProbeSpec{Name: name("tunnel"), Type: protocol.ProbeWireGuard, Target: tunIP, Interface: iface})
+	}
+	return specs
+}
+
+// awaitReports waits until every command finished or the timeout passed and
+// returns the probe reports by node. Nodes missing from the result did not
+// answer.
+func (s *DiagnosisService) awaitReports(ctx context.Context, commands map[uint]string) map[uint]protocol.ProbeReport {
+	reports := make(map[uint]protocol.ProbeReport, len(commands))
+	pending := make(map[uint]string, len(commands))
+	for nodeID, id := range commands {
+		pending[nodeID] = id
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return reports
+		case <-time.After(diagnosisPollInterval):
+		}
+		for nodeID, id := range pending {
+			cmd, err := s.taskService.GetCommand(id)
+			if err != nil {
+				delete(pending, nodeID)
+				continue
+			}
+			switch cmd.Status {
+			case domain.CommandStatusPending, domain.CommandStatusProcessing:
+				continue
+			case domain.CommandStatusCompleted:
+				var report protocol.ProbeReport
+				if err := json.Unmarshal([]byte(cmd.Result), &report); err == nil {
+					reports[nodeID] = report
+				}
+			}
+			delete(pending, nodeID)
+		}
+	}
+	return reports
+}
+
+// judgeHop rates both directions of a hop and keeps the worse
+func judgeHop(index int, h hop, reports map[uint]protocol.ProbeReport) HopDiagnosis {
+	d := HopDiagnosis{
+		Name:       h.name,
+		FromNodeID: h.from.ID,
+		ToNodeID:   h.to.ID,
+		Forward:    hopResults(reports, h.from.ID, index, "forward"),
+		Reverse:    hopResults(reports, h.to.ID, index, "reverse"),
+	}
+	_, fromAnswered := reports[h.from.ID]
+	_, toAnswered := reports[h.to.ID]
+
+	forwardStatus, forwardReason := judgeDirection(fromAnswered, h.from, h.to, h.port, h.transport, d.Forward)
+	reverseStatus, reverseReason := judgeDirection(toAnswered, h.to, h.from, h.reversePort, h.transport, d.Reverse)
+	d.Status, d.Reason = forwardStatus, forwardReason
+	if hopSeverity(reverseStatus) > hopSeverity(forwardStatus) {
+		d.Status, d.Reason = reverseStatus, reverseReason
+	}
+	return d
+}
+
+// judgeDirection rates what from measured toward to. A working tunnel
+// settles it; otherwise the port and then the underlay tell where it stops.
+func judgeDirection(answered bool, from, to *domain.Node, port int, transport string, results []protocol.ProbeResult) (string, string) {
+	if !answered {
+		return HopUnknown, fmt.Sprintf("%s did not report probe results in time", from.Name)
+	}
+
+	var icmp, portCheck, tunnel *protocol.ProbeResult
+	for i := range results {
+		switch results[i].Name[strings.LastIndex(results[i].Name, "/")+1:] {
+		case "icmp":
+			icmp = &results[i]
+		case "port":
+			portCheck = &results[i]
+		case "tunnel":
+			tunnel = &results[i]
+		}
+	}
+
+	if tunnel != nil && tunnel.OK {
+		if tunnel.LossPercent >= degradedLoss {
+			return HopDegraded, fmt.Sprintf("%.0f%% loss through the tunnel from %s to %s", tunnel.LossPercent, from.Name, to.Name)
+		}
+		return HopOK, ""
+	}
+	if portCheck != nil && !portCheck.OK {
+		if icmp != nil && !icmp.OK {
+			return HopBroken, fmt.Sprintf("%s cannot reach %s: no ping reply and port %d/%s unreachable", from.Name, to.Name, port, transport)
+		}
+		return HopBroken, fmt.Sprintf("port %d/%s on %s is unreachable from %s: check its firewall and service", port, transport, to.Name, from.Name)
+	}
+	if tunnel != nil {
+		if tunnel.HandshakeAge < 0 || tunnel.HandshakeAge > staleHandshake {
+			return HopBroken, fmt.Sprintf("no recent WireGuard handshake on %s toward %s: check keys, endpoint and UDP filtering", from.Name, to.Name)
+		}
+		return HopBroken, fmt.Sprintf("WireGuard handshakes but %s gets no reply from %s through the tunnel: check addresses and routing", from.Name, to.Name)
+	}
+	if portCheck == nil && icmp != nil && !icmp.OK {
+		// Nothing listens on this end; a failed ping alone may be filtering
+		return HopOK, ""
+	}
+	if icmp != nil && icmp.OK && icmp.LossPercent >= degradedLoss {
+		return HopDegraded, fmt.Sprintf("%.0f%% ping loss from %s to %s", icmp.LossPercent, from.Name, to.Name)
+	}
+	return HopOK, ""
+}
+
+func hopResults(reports map[uint]protocol.ProbeReport, nodeID uint, index int, dir string) []protocol.ProbeResult {
+	prefix := fmt.Sprintf("hop%d/%s/", index, dir)
+	results := []protocol.ProbeResult{}
+	for _, r := range reports[nodeID].Results {
+		if strings.HasPrefix(r.Name, prefix) {
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+func hopSeverity(status string) int {
+	switch status {
+	case HopBroken:
+		return 3
+	case HopUnknown:
+		return 2
+	case HopDegraded:
+		return 1
+	}
+	return 0
+}
+
+// hostIP strips the prefix length from an interface address
+func hostIP(cidr string) string {
+	ip, _, _ := strings.Cut(cidr, "/")
+	return ip
+}
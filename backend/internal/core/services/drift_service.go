@@ -0,0 +1,312 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+// DriftService compares the files agents report with what the backend last
+// wrote to them. The intended state is whatever the agent reported right
+// after the writing command succeeded, since WireGuard and sing-box configs
+// are rendered on the node and the backend never sees their final bytes.
+type DriftService struct {
+	nodeRepo     ports.NodeRepository
+	fileRepo     ports.ManagedFileRepository
+	timelineRepo ports.TimelineRepository
+	taskService  ports.TaskService
+	logger       *logger.Logger
+}
+
+type DriftServiceConfig struct {
+	NodeRepo     ports.NodeRepository
+	FileRepo     ports.ManagedFileRepository
+	TimelineRepo ports.TimelineRepository
+	TaskService  ports.TaskService
+	Logger       *logger.Logger
+}
+
+func NewDriftService(cfg DriftServiceConfig) *DriftService {
+	return &DriftService{
+		nodeRepo:     cfg.NodeRepo,
+		fileRepo:     cfg.FileRepo,
+		timelineRepo: cfg.TimelineRepo,
+		taskService:  cfg.TaskService,
+		logger:       cfg.Logger,
+	}
+}
+
+// Files lists the node's managed files with their intended and last reported
+// state
+func (s *DriftService) Files(ctx context.Context, nodeID uint) ([]domain.ManagedFile, error) {
+	if _, err := s.nodeRepo.GetByID(ctx, nodeID); err != nil {
+		return nil, ErrNodeNotFound
+	}
+	return s.fileRepo.ListByNode(ctx, nodeID)
+}
+
+// RecordApplied takes the files a successful command left behind as the new
+// intended state. A file reported without a digest was removed by the command
+// and is no longer tracked.
+func (s *DriftService) RecordApplied(ctx context.Context, nodeID uint, cmd *domain.Command, files []protocol.ManagedFile) {
+	now := time.Now()
+	resolved := false
+	for _, f := range files {
+		existing, _ := s.fileRepo.Get(ctx, nodeID, f.Path)
+		if f.Digest == "" {
+			if existing != nil {
+				_ = s.fileRepo.Delete(ctx, nodeID, f.Path)
+				resolved = resolved || existing.Drifted
+			}
+			continue
+		}
+
+		file := existing
+		if file == nil {
+			file = &domain.ManagedFile{NodeID: nodeID, Path: f.Path}
+		}
+		// A command that only started or stopped the unit keeps the writer on
+		// record, so re-applying still restores the content
+		if file.CommandID == "" || file.IntendedDigest != f.Digest {
+			file.CommandID = cmd.ID
+			file.CommandType = cmd.Type
+		}
+		wasDrifted := file.Drifted
+		file.Unit = f.Unit
+		file.IntendedDigest, file.ActualDigest = f.Digest, f.Digest
+		file.IntendedUnitState, file.ActualUnitState = f.UnitState, f.UnitState
+		file.Drifted, file.DriftedAt, file.CheckedAt = false, nil, &now
+		if err := s.fileRepo.Upsert(ctx, file); err != nil {
+			continue
+		}
+
+		if wasDrifted {
+			resolved = true
+			recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+				Type:         domain.EventTypeConfigDriftResolved,
+				Status:       domain.EventStatusSuccess,
+				ResourceType: "node",
+				ResourceID:   nodeID,
+				Message:      fmt.Sprintf("%s was rewritten by %s", f.Path, cmd.Type),
+				Meta:         driftMeta(file),
+			})
+		}
+	}
+	if resolved {
+		s.refreshNode(ctx, nodeID)
+	}
+}
+
+// RecordReport compares a heartbeat's drift report with the intended state.
+// Drift and its resolution are recorded on the timeline once each, when they
+// happen. Files not seen before are taken as intended, and tracked files the
+// agent no longer lists are dropped.
+func (s *DriftService) RecordReport(ctx context.Context, nodeID uint, files []protocol.ManagedFile) {
+	known, err := s.fileRepo.ListByNode(ctx, nodeID)
+	if err != nil {
+		return
+	}
+	byPath := make(map[string]*domain.ManagedFile, len(known))
+	for i := range known {
+		byPath[known[i].Path] = &known[i]
+	}
+
+	// A command still running may be halfway through rewriting a file; its
+	// result sets the new intent, so comparing now would only raise noise
+	busy := s.commandRunning(nodeID)
+
+	now := time.Now()
+	reported := make(map[string]bool, len(files))
+	for _, f := range files {
+		reported[f.Path] = true
+		file, ok := byPath[f.Path]
+		if !ok {
+			if f.Digest == "" {
+				continue
+			}
+			file = &domain.ManagedFile{
+				NodeID:            nodeID,
+				Path:              f.Path,
+				IntendedDigest:    f.Digest,
+				IntendedUnitState: f.UnitState,
+			}
+			byPath[f.Path] = file
+		}
+		file.Unit = f.Unit
+		file.ActualDigest, file.ActualUnitState = f.Digest, f.UnitState
+		file.CheckedAt = &now
+
+		if !busy {
+			switch inSync := file.InSync(); {
+			case !inSync && !file.Drifted:
+				file.Drifted, file.DriftedAt = true, &now
+				s.logger.Warnw("config_drift_detected", "node_id", nodeID, "path", f.Path)
+				recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+					Type:         domain.EventTypeConfigDrift,
+					Status:       domain.EventStatusFailed,
+					ResourceType: "node",
+					ResourceID:   nodeID,
+					Message:      driftMessage(file),
+					Meta:         driftMeta(file),
+				})
+			case inSync && file.Drifted:
+				file.Drifted, file.DriftedAt = false, nil
+				recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+					Type:         domain.EventTypeConfigDriftResolved,
+					Status:       domain.EventStatusSuccess,
+					ResourceType: "node",
+					ResourceID:   nodeID,
+					Message:      fmt.Sprintf("%s matches the intended config again", f.Path),
+					Meta:         driftMeta(file),
+				})
+			}
+		}
+		_ = s.fileRepo.Upsert(ctx, file)
+	}
+
+	for path := range byPath {
+		if !reported[path] {
+			s.logger.Infow("managed_file_dropped", "node_id", nodeID, "path", path)
+			_ = s.fileRepo.Delete(ctx, nodeID, path)
+			delete(byPath, path)
+		}
+	}
+
+	if !busy {
+		drifted := false
+		for _, file := range byPath {
+			drifted = drifted || file.Drifted
+		}
+		_ = s.nodeRepo.UpdateConfigDrift(ctx, nodeID, drifted)
+	}
+}
+
+// Reapply queues the command that last wrote the file again, restoring the
+// intended config. Its result resolves the drift. The copy keeps the
+// writer's priority and limits, and is keyed by the drift record so repeated
+// requests return the copy still open instead of queueing another.
+func (s *DriftService) Reapply(ctx context.Context, nodeID uint, path string) (*domain.Command, error) {
+	file, err := s.fileRepo.Get(ctx, nodeID, path)
+	if err != nil {
+		return nil, ErrManagedFileNotFound
+	}
+	if file.CommandID == "" {
+		return nil, ErrDriftNoIntent
+	}
+	writer, err := s.taskService.GetCommand(file.CommandID)
+	if err != nil {
+		return nil, ErrDriftNoIntent
+	}
+
+	cmd, err := s.taskService.CreateCommand(nodeID, writer.Type, writer.Payload, ports.CommandOptions{
+		Priority:       writer.Priority,
+		IdempotencyKey: fmt.Sprintf("reapply-%d-%s", file.ID, writer.ID),
+		Timeout:        time.Duration(writer.Timeout) * time.Second,
+		MaxAttempts:    writer.MaxAttempts,
+	})
+	if err != nil {
+		s.logger.Errorw("config_reapply_dispatch_failed", "node_id", nodeID, "path", path, "error", err)
+		return nil, err
+	}
+	s.logger.Infow("config_reapply_dispatched", "node_id", nodeID, "path", path, "command_id", cmd.ID, "from_command", writer.ID)
+	recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+		Type:         domain.EventTypeConfigReapplied,
+		Status:       domain.EventStatusPending,
+		ResourceType: "node",
+		ResourceID:   nodeID,
+		Message:      fmt.Sprintf("Re-applying %s with %s", path, writer.Type),
+		Meta:         driftMeta(file),
+	})
+	return cmd, nil
+}
+
+// Adopt accepts the file as the node has it now. No command reproduces that
+// state, so the file can no longer be re-applied until a command writes it
+// again. Adopting a removed file stops tracking it.
+func (s *DriftService) Adopt(ctx context.Context, nodeID uint, path string) (*domain.ManagedFile, error) {
+	file, err := s.fileRepo.Get(ctx, nodeID, path)
+	if err != nil {
+		return nil, ErrManagedFileNotFound
+	}
+
+	if file.ActualDigest == "" {
+		if err := s.fileRepo.Delete(ctx, nodeID, path); err != nil {
+			return nil, err
+		}
+	} else {
+		file.IntendedDigest, file.IntendedUnitState = file.ActualDigest, file.ActualUnitState
+		file.CommandID, file.CommandType = "", ""
+		file.Drifted, file.DriftedAt = false, nil
+		if err := s.fileRepo.Upsert(ctx, file); err != nil {
+			return nil, err
+		}
+	}
+
+	s.logger.Infow("config_adopted", "node_id", nodeID, "path", path)
+	recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+		Type:         domain.EventTypeConfigAdopted,
+		Status:       domain.EventStatusSuccess,
+		ResourceType: "node",
+		ResourceID:   nodeID,
+		Message:      fmt.Sprintf("Adopted %s as found on the node", path),
+		Meta:         driftMeta(file),
+	})
+	s.refreshNode(ctx, nodeID)
+	return file, nil
+}
+
+func (s *DriftService) commandRunning(nodeID uint) bool {
+	cmds, err := s.taskService.ListCommands(ports.CommandFilter{
+		NodeID: nodeID,
+		Status: domain.CommandStatusProcessing,
+		Limit:  1,
+	})
+	return err == nil && len(cmds) > 0
+}
+
+// refreshNode sets the node's drift flag from its tracked files
+func (s *DriftService) refreshNode(ctx context.Context, nodeID uint) {
+	files, err := s.fileRepo.ListByNode(ctx, nodeID)
+	if err != nil {
+		return
+	}
+	drifted := false
+	for _, f := range files {
+		drifted = drifted || f.Drifted
+	}
+	_ = s.nodeRepo.UpdateConfigDrift(ctx, nodeID, drifted)
+}
+
+// driftMessage says what differs, content first
+func driftMessage(f *domain.ManagedFile) string {
+	switch {
+	case f.ActualDigest == "":
+		return fmt.Sprintf("%s was removed from the node", f.Path)
+	case f.ActualDigest != f.IntendedDigest:
+		return fmt.Sprintf("%s was changed on the node", f.Path)
+	default:
+		return fmt.Sprintf("%s is %s, expected %s", f.Unit, f.ActualUnitState, f.IntendedUnitState)
+	}
+}
+
+func driftMeta(f *domain.ManagedFile) map[string]interface{} {
+	meta := map[string]interface{}{
+		"path":            f.Path,
+		"intended_digest": f.IntendedDigest,
+		"actual_digest":   f.ActualDigest,
+	}
+	if f.Unit != "" {
+		meta["unit"] = f.Unit
+		meta["intended_unit_state"] = f.IntendedUnitState
+		meta["actual_unit_state"] = f.ActualUnitState
+	}
+	if f.CommandID != "" {
+		meta["command_id"] = f.CommandID
+	}
+	return meta
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// fakeFileRepo serves one managed file; nothing else is used here
+type fakeFileRepo struct {
+	ports.ManagedFileRepository
+	file domain.ManagedFile
+}
+
+func (r *fakeFileRepo) Get(ctx context.Context, nodeID uint, path string) (*domain.ManagedFile, error) {
+	if nodeID != r.file.NodeID || path != r.file.Path {
+		return nil, gorm.ErrRecordNotFound
+	}
+	file := r.file
+	return &file, nil
+}
+
+func TestReapplyKeepsWriterOptions(t *testing.T) {
+	writer := domain.Command{
+		ID:          "w1",
+		NodeID:      1,
+		Type:        domain.CmdWGApplyInterface,
+		Status:      domain.CommandStatusCompleted,
+		Payload:     domain.JSONB{"interface": "wg0"},
+		Priority:    10,
+		MaxAttempts: 5,
+		Timeout:     30,
+	}
+	repo := newFakeCommandRepo(writer)
+	s := NewDriftService(DriftServiceConfig{
+		FileRepo:    &fakeFileRepo{file: domain.ManagedFile{ID: 3, NodeID: 1, Path: "/etc/wireguard/wg0.conf", CommandID: "w1", Drifted: true}},
+		TaskService: newTestTaskService(repo),
+		Logger:      &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+	})
+
+	first, err := s.Reapply(context.Background(), 1, "/etc/wireguard/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Type != writer.Type || first.Priority != 10 || first.MaxAttempts != 5 || first.Timeout != 30 {
+		t.Fatalf("reapplied command = %+v, want the writer's options", first)
+	}
+
+	// A second click while the first copy is queued returns that copy
+	second, err := s.Reapply(context.Background(), 1, "/etc/wireguard/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID {
+		t.Fatalf("second reapply queued %s next to %s", second.ID, first.ID)
+	}
+}
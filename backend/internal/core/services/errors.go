@@ -40,6 +40,58 @@ var (
 	ErrServiceInvalidInput = errors.New("service: invalid input")
 )
 
+// Task errors
+var (
+	ErrTaskNotFound = errors.New("task: not found")
+)
+
+// Command errors
+var (
+	ErrCommandNotFound        = errors.New("command: not found")
+	ErrCommandNodeMismatch    = errors.New("command: does not belong to this node")
+	ErrCommandAlreadyFinished = errors.New("command: already completed or failed")
+	ErrCommandNotCancellable  = errors.New("command: cannot be cancelled")
+	ErrCommandStatusChanged   = errors.New("command: status changed concurrently")
+)
+
+// Agent auth errors
+var (
+	ErrAgentTokenInvalid       = errors.New("agent auth: invalid token")
+	ErrAgentClientCertRequired = errors.New("agent auth: client certificate required")
+	ErrAgentIdentityMismatch   = errors.New("agent auth: token and client certificate name different nodes")
+	ErrCertInvalidCSR          = errors.New("ca: invalid certificate request")
+)
+
+// Agent control errors
+var (
+	ErrAgentControlDisabled    = errors.New("agent control: agent_tls.agent_port is not configured")
+	ErrAgentControlUnreachable = errors.New("agent control: agent did not answer")
+	ErrAgentControlRejected    = errors.New("agent control: agent rejected the request")
+)
+
+// Agent update errors
+var (
+	ErrAgentUpdateNoBinaries = errors.New("agent update: no agent binaries found in bin/uploads")
+	ErrAgentUpdateNoURL      = errors.New("agent update: public URL is not configured")
+	ErrAgentUpdateNoVersion  = errors.New("agent update: version is required")
+)
+
+// Drift errors
+var (
+	ErrManagedFileNotFound = errors.New("drift: file is not managed on this node")
+	ErrDriftNoIntent       = errors.New("drift: no command on record wrote this file")
+)
+
+// Config history errors
+var (
+	ErrConfigRevisionNotFound = errors.New("config history: revision not found")
+)
+
+// Setting errors
+var (
+	ErrSettingInvalid = errors.New("setting: invalid value")
+)
+
 // Installer errors
 var (
 	ErrInstallationFailed   = errors.New("installer: installation failed")
@@ -2,6 +2,8 @@ package factory
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/netly/backend/internal/domain/singbox"
 	"github.com/netly/backend/pkg/utils/keygen"
@@ -46,11 +48,15 @@ type ChainConfigParams struct {
 	}
 }
 
+// ChainConfigResult holds the WireGuard interfaces of a chain. The relay
+// runs two: one faces the entry, the uplink carries its traffic on to the
+// exit.
 type ChainConfigResult struct {
-	EntryConfig string            `json:"entry_config"`
-	RelayConfig string            `json:"relay_config"`
-	ExitConfig  string            `json:"exit_config"`
-	Metadata    map[string]string `json:"metadata"`
+	EntryConfig       singbox.WireGuardConfig `json:"entry_config"`
+	RelayConfig       singbox.WireGuardConfig `json:"relay_config"`
+	RelayUplinkConfig singbox.WireGuardConfig `json:"relay_uplink_config"`
+	ExitConfig        singbox.WireGuardConfig `json:"exit_config"`
+	Metadata          map[string]string       `json:"metadata"`
 }
 
 func (s *FactoryService) GenerateChainConfig(params ChainConfigParams) (*ChainConfigResult, error) {
@@ -76,91 +82,77 @@ func (s *FactoryService) generateWireGuardChain(params ChainConfigParams) (*Chai
 
 	// 1. Entry Config (Client)
 	// Connects to Relay (Segment A)
-	entryConfig := fmt.Sprintf(`[Interface]
-PrivateKey = %s
-Address = %s
-DNS = 1.1.1.1
-
-[Peer]
-PublicKey = %s
-Endpoint = %s:%d
-AllowedIPs = 0.0.0.0/0
-PersistentKeepalive = 25`,
-		entryPriv,
-		params.SegmentA.EntryIP,
-		relayAPub,
-		params.SegmentA.RelayPublicIP,
-		params.SegmentA.RelayPort)
+	entryConfig := singbox.WireGuardConfig{
+		Interface: singbox.WireGuardInterface{
+			PrivateKey: entryPriv,
+			Address:    []string{params.SegmentA.EntryIP},
+			DNS:        []string{"1.1.1.1"},
+		},
+		Peers: []singbox.WireGuardPeer{{
+			PublicKey:           relayAPub,
+			Endpoint:            net.JoinHostPort(params.SegmentA.RelayPublicIP, strconv.Itoa(params.SegmentA.RelayPort)),
+			AllowedIPs:          []string{"0.0.0.0/0"},
+			PersistentKeepalive: 25,
+		}},
+	}
 
 	// 2. Relay Config (Middleman)
-	// Interface A (Incoming from Entry) - wg0
-	relayConfigA := fmt.Sprintf(`[Interface]
-# Segment A (Listener)
-PrivateKey = %s
-ListenPort = %d
-Address = %s
-PostUp = sysctl -w net.ipv4.ip_forward=1; sysctl -w net.ipv6.conf.all.forwarding=1; iptables -A FORWARD -i wg0 -j ACCEPT
-PostDown = iptables -D FORWARD -i wg0 -j ACCEPT
-Table = off
-
-[Peer]
-# Entry Node
-PublicKey = %s
-AllowedIPs = %s`,
-		relayAPriv,
-		params.SegmentA.RelayPort,
-		params.SegmentA.RelayIP,
-		entryPub,
-		params.SegmentA.EntryIP)
-
-	// Interface B (Outgoing to Exit) - wg1
-	relayConfigB := fmt.Sprintf(`[Interface]
-# Segment B (Client)
-PrivateKey = %s
-Address = %s
-Table = off
-PostUp = ip rule add from %s table 200; ip route add default dev wg1 table 200
-PostDown = ip rule del from %s table 200
-
-[Peer]
-# Exit Node
-PublicKey = %s
-Endpoint = %s:%d
-AllowedIPs = 0.0.0.0/0
-PersistentKeepalive = 25`,
-		relayBPriv,
-		params.SegmentB.RelayIP,
-		params.SegmentA.RelayIP,
-		params.SegmentA.RelayIP,
-		exitPub,
-		params.SegmentB.ExitPublicIP,
-		params.SegmentB.ExitPort)
+	// Interface A (Incoming from Entry)
+	relayConfigA := singbox.WireGuardConfig{
+		Interface: singbox.WireGuardInterface{
+			PrivateKey: relayAPriv,
+			ListenPort: params.SegmentA.RelayPort,
+			Address:    []string{params.SegmentA.RelayIP},
+			Table:      "off",
+			Forward:    true,
+		},
+		Peers: []singbox.WireGuardPeer{{
+			PublicKey:  entryPub,
+			AllowedIPs: []string{params.SegmentA.EntryIP},
+		}},
+	}
 
-	relayConfig := relayConfigA + "\n\n---SPLIT---\n\n" + relayConfigB
+	// Interface B (Outgoing to Exit)
+	relayConfigB := singbox.WireGuardConfig{
+		Interface: singbox.WireGuardInterface{
+			PrivateKey: relayBPriv,
+			Address:    []string{params.SegmentB.RelayIP},
+			Table:      "off",
+			// Only traffic arriving from the entry leaves through B; the
+			// agent routes it through a table of its own
+			SourceRoute: &singbox.WireGuardSourceRoute{
+				From: []string{params.SegmentA.RelayIP},
+			},
+		},
+		Peers: []singbox.WireGuardPeer{{
+			PublicKey:           exitPub,
+			Endpoint:            net.JoinHostPort(params.SegmentB.ExitPublicIP, strconv.Itoa(params.SegmentB.ExitPort)),
+			AllowedIPs:          []string{"0.0.0.0/0"},
+			PersistentKeepalive: 25,
+		}},
+	}
 
 	// 3. Exit Config (Server)
 	// Listens for Relay (Segment B)
-	exitConfig := fmt.Sprintf(`[Interface]
-PrivateKey = %s
-ListenPort = %d
-Address = %s
-PostUp = iptables -A FORWARD -i wg0 -j ACCEPT; iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
-PostDown = iptables -D FORWARD -i wg0 -j ACCEPT; iptables -t nat -D POSTROUTING -o eth0 -j MASQUERADE
-
-[Peer]
-# Relay Node
-PublicKey = %s
-AllowedIPs = %s`,
-		exitPriv,
-		params.SegmentB.ExitPort,
-		params.SegmentB.ExitIP,
-		relayBPub,
-		params.SegmentB.RelayIP)
+	exitConfig := singbox.WireGuardConfig{
+		Interface: singbox.WireGuardInterface{
+			PrivateKey: exitPriv,
+			ListenPort: params.SegmentB.ExitPort,
+			Address:    []string{params.SegmentB.ExitIP},
+			Forward:    true,
+			Masquerade: true,
+		},
+		Peers: []singbox.WireGuardPeer{{
+			PublicKey:  relayBPub,
+			AllowedIPs: []string{params.SegmentB.RelayIP},
+		}},
+	}
 
 	return &ChainConfigResult{
-		EntryConfig: entryConfig,
-		RelayConfig: relayConfig,
-		ExitConfig:  exitConfig,
+		EntryConfig:       entryConfig,
+		RelayConfig:       relayConfigA,
+		RelayUplinkConfig: relayConfigB,
+		ExitConfig:        exitConfig,
 		Metadata: map[string]string{
 			"entry_pub":   entryPub,
 			"relay_a_pub": relayAPub,
@@ -270,8 +262,6 @@ func (s *FactoryService) generateWireGuard(params ConfigParams) (*ConfigResult,
 PrivateKey = %s
 ListenPort = %d
 Address = %s
-PostUp = iptables -A FORWARD -i wg0 -j ACCEPT; iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
-PostDown = iptables -D FORWARD -i wg0 -j ACCEPT; iptables -t nat -D POSTROUTING -o eth0 -j MASQUERADE
 
 [Peer]
 PublicKey = %s
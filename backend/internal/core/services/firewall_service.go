@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+// FirewallService derives the inbound ports each node needs from its tunnels
+// and services and keeps the agent's firewall chain in line with them
+type FirewallService struct {
+	nodeRepo    ports.NodeRepository
+	tunnelRepo  ports.TunnelRepository
+	serviceRepo ports.ServiceRepository
+	taskService ports.TaskService
+	logger      *logger.Logger
+}
+
+type FirewallServiceConfig struct {
+	NodeRepo    ports.NodeRepository
+	TunnelRepo  ports.TunnelRepository
+	ServiceRepo ports.ServiceRepository
+	TaskService ports.TaskService
+	Logger      *logger.Logger
+}
+
+func NewFirewallService(cfg FirewallServiceConfig) *FirewallService {
+	return &FirewallService{
+		nodeRepo:    cfg.NodeRepo,
+		tunnelRepo:  cfg.TunnelRepo,
+		serviceRepo: cfg.ServiceRepo,
+		taskService: cfg.TaskService,
+		logger:      cfg.Logger,
+	}
+}
+
+// InboundPorts lists the ports the node's tunnels and services listen on,
+// sorted by port
+func (s *FirewallService) InboundPorts(ctx context.Context, nodeID uint) ([]protocol.PortOpening, error) {
+	if _, err := s.nodeRepo.GetByID(ctx, nodeID); err != nil {
+		return nil, ErrNodeNotFound
+	}
+
+	openings := []protocol.PortOpening{}
+	seen := make(map[protocol.PortOpening]bool)
+	add := func(o protocol.PortOpening) {
+		key := protocol.PortOpening{Port: o.Port, Protocol: o.Protocol}
+		if o.Port <= 0 || seen[key] {
+			return
+		}
+		seen[key] = true
+		openings = append(openings, o)
+	}
+
+	tunnels, err := s.tunnelRepo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tunnels {
+		for _, o := range tunnelOpenings(&tunnels[i], nodeID) {
+			add(o)
+		}
+	}
+
+	services, err := s.serviceRepo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range services {
+		add(protocol.PortOpening{
+			Port:     svc.ListenPort,
+			Protocol: serviceTransport(svc.Protocol),
+			Owner:    fmt.Sprintf("service-%d", svc.ID),
+		})
+	}
+
+	sort.SliceStable(openings, func(i, j int) bool {
+		if openings[i].Port != openings[j].Port {
+			return openings[i].Port < openings[j].Port
+		}
+		return openings[i].Protocol < openings[j].Protocol
+	})
+	return openings, nil
+}
+
+// SyncNode queues a CMD_FIREWALL_SYNC carrying the node's full set of
+// openings. The agent closes whatever is no longer listed, so a sync after a
+// delete is what removes the port. Each sync is a new command: an older one
+// still queued must not stand in for the current set.
+func (s *FirewallService) SyncNode(ctx context.Context, nodeID uint) (*domain.Command, error) {
+	openings, err := s.InboundPorts(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := toJSONB(protocol.FirewallSyncPayload{Openings: openings})
+	cmd, err := s.taskService.CreateCommand(nodeID, domain.CmdFirewallSync, payload, ports.CommandOptions{})
+	if err != nil {
+		s.logger.Errorw("firewall_sync_dispatch_failed", "node_id", nodeID, "error", err)
+		return nil, err
+	}
+	s.logger.Infow("firewall_sync_dispatched", "node_id", nodeID, "command_id", cmd.ID, "openings", len(openings))
+	return cmd, nil
+}
+
+// SyncNodes syncs each node once, logging failures; tunnel and service
+// changes call it after their own commands are queued
+func (s *FirewallService) SyncNodes(ctx context.Context, nodeIDs ...uint) {
+	done := make(map[uint]bool, len(nodeIDs))
+	for _, id := range nodeIDs {
+		if id == 0 || done[id] {
+			continue
+		}
+		done[id] = true
+		if _, err := s.SyncNode(ctx, id); err != nil {
+			s.logger.Warnw("firewall_sync_failed", "node_id", id, "error", err)
+		}
+	}
+}
+
+// tunnelOpenings lists the ports a tunnel listens on at nodeID. WireGuard
+// listens on both ends of a direct tunnel; a sing-box tunnel only on its
+// dest. In a chain the relay and the exit listen, the entry only dials out.
+func tunnelOpenings(t *domain.Tunnel, nodeID uint) []protocol.PortOpening {
+	owner := fmt.Sprintf("tunnel-%d", t.ID)
+	transport := tunnelTransport(t.Protocol)
+	var openings []protocol.PortOpening
+
+	if t.Type == domain.TunnelTypeChain {
+		if port, ok := chainRelayPort(t, nodeID); ok {
+			openings = append(openings, protocol.PortOpening{Port: port, Protocol: protocol.PortUDP, Owner: owner})
+		}
+		if t.DestNodeID == nodeID {
+			openings = append(openings, protocol.PortOpening{Port: t.DestPort, Protocol: protocol.PortUDP, Owner: owner})
+		}
+		return openings
+	}
+
+	if t.SourceNodeID == nodeID && t.Protocol == domain.TunnelProtocolWireGuard {
+		openings = append(openings, protocol.PortOpening{Port: t.SourcePort, Protocol: transport, Owner: owner})
+	}
+	if t.DestNodeID == nodeID {
+		openings = append(openings, protocol.PortOpening{Port: t.DestPort, Protocol: transport, Owner: owner})
+	}
+	return openings
+}
+
+// chainRelayPort returns the port a chain's relay listens on for the entry,
+// if nodeID is that relay
+func chainRelayPort(t *domain.Tunnel, nodeID uint) (int, bool) {
+	if t.Type != domain.TunnelTypeChain || t.Segments == nil {
+		return 0, false
+	}
+	var segments struct {
+		SegmentA struct {
+			DestID   uint `json:"dest_id"`
+			DestPort int  `json:"dest_port"`
+		} `json:"segment_a"`
+	}
+	raw, _ := json.Marshal(t.Segments)
+	if err := json.Unmarshal(raw, &segments); err != nil || segments.SegmentA.DestID != nodeID {
+		return 0, false
+	}
+	return segments.SegmentA.DestPort, segments.SegmentA.DestPort > 0
+}
+
+// tunnelTransport is what a tunnel protocol runs over; chains are always
+// WireGuard
+func tunnelTransport(p domain.TunnelProtocol) string {
+	if p == domain.TunnelProtocolReality {
+		return protocol.PortTCP
+	}
+	return protocol.PortUDP
+}
+
+func serviceTransport(p domain.ServiceProtocol) string {
+	if p == domain.ServiceProtocolVLESS {
+		return protocol.PortTCP
+	}
+	return protocol.PortUDP
+}
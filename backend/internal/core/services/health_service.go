@@ -0,0 +1,371 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+const singBoxUnit = "sing-box"
+
+// HealthService turns the components agents report in heartbeats into node,
+// tunnel and service health. Each report is compared with the node's previous
+// one so a component going down or recovering is recorded once.
+type HealthService struct {
+	nodeRepo     ports.NodeRepository
+	tunnelRepo   ports.TunnelRepository
+	serviceRepo  ports.ServiceRepository
+	timelineRepo ports.TimelineRepository
+	logger       *logger.Logger
+}
+
+type HealthServiceConfig struct {
+	NodeRepo     ports.NodeRepository
+	TunnelRepo   ports.TunnelRepository
+	ServiceRepo  ports.ServiceRepository
+	TimelineRepo ports.TimelineRepository
+	Logger       *logger.Logger
+}
+
+func NewHealthService(cfg HealthServiceConfig) *HealthService {
+	return &HealthService{
+		nodeRepo:     cfg.NodeRepo,
+		tunnelRepo:   cfg.TunnelRepo,
+		serviceRepo:  cfg.ServiceRepo,
+		timelineRepo: cfg.TimelineRepo,
+		logger:       cfg.Logger,
+	}
+}
+
+// nodeHealth is the shape of Node.Health
+type nodeHealth struct {
+	ReportedAt int64                      `json:"reported_at"`
+	Components []protocol.ComponentHealth `json:"components"`
+}
+
+func decodeNodeHealth(raw domain.JSONB) (*nodeHealth, bool) {
+	if raw == nil {
+		return nil, false
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, false
+	}
+	var h nodeHealth
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, false
+	}
+	return &h, true
+}
+
+func (h *nodeHealth) component(name string) (protocol.ComponentHealth, bool) {
+	for _, c := range h.Components {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return protocol.ComponentHealth{}, false
+}
+
+// RecordComponentHealth stores the components nodeID reported, records a
+// timeline event for each that went down or recovered, and re-derives the
+// health of the tunnels and services that depend on the node.
+func (s *HealthService) RecordComponentHealth(ctx context.Context, nodeID uint, components []protocol.ComponentHealth) error {
+	node, err := s.nodeRepo.GetByID(ctx, nodeID)
+	if err != nil {
+		return ErrNodeNotFound
+	}
+	previous, _ := decodeNodeHealth(node.Health)
+
+	current := &nodeHealth{ReportedAt: time.Now().Unix(), Components: components}
+	for _, c := range components {
+		var was *protocol.ComponentHealth
+		if previous != nil {
+			if p, ok := previous.component(c.Name); ok {
+				was = &p
+			}
+		}
+		s.recordTransition(ctx, nodeID, was, c)
+	}
+
+	if err := s.nodeRepo.UpdateHealth(ctx, nodeID, toJSONB(current)); err != nil {
+		return fmt.Errorf("failed to store node health: %w", err)
+	}
+
+	s.evaluateTunnels(ctx, nodeID, current)
+	s.evaluateServices(ctx, nodeID, current)
+	return nil
+}
+
+// recordTransition logs a component whose health changed. A component seen
+// for the first time only counts when it is down, e.g. a unit that never
+// started.
+func (s *HealthService) recordTransition(ctx context.Context, nodeID uint, was *protocol.ComponentHealth, now protocol.ComponentHealth) {
+	healthy := now.Healthy()
+	if was == nil && healthy || was != nil && was.Healthy() == healthy {
+		return
+	}
+
+	meta := map[string]interface{}{
+		"component": now.Name,
+		"kind":      now.Kind,
+		"state":     now.State,
+	}
+	if now.Interface != "" {
+		meta["interface"] = now.Interface
+		meta["interface_up"] = now.InterfaceUp
+	}
+	if now.Detail != "" {
+		meta["detail"] = now.Detail
+	}
+
+	if healthy {
+		s.logger.Infow("node_component_recovered", "node_id", nodeID, "component", now.Name)
+		recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+			Type:         domain.EventTypeComponentRecovered,
+			Status:       domain.EventStatusSuccess,
+			ResourceType: "node",
+			ResourceID:   nodeID,
+			Message:      fmt.Sprintf("%s recovered", now.Name),
+			Meta:         meta,
+		})
+		return
+	}
+	s.logger.Warnw("node_component_down", "node_id", nodeID, "component", now.Name, "state", now.State, "interface_up", now.InterfaceUp)
+	recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+		Type:         domain.EventTypeComponentDown,
+		Status:       domain.EventStatusFailed,
+		ResourceType: "node",
+		ResourceID:   nodeID,
+		Message:      fmt.Sprintf("%s is down (%s)", now.Name, now.State),
+		Meta:         meta,
+	})
+}
+
+// tunnelRequirement is a unit a tunnel needs running on one of its nodes,
+// and the port it must listen on if the tunnel's inbound is served by it
+type tunnelRequirement struct {
+	nodeID uint
+	unit   string
+	port   int
+}
+
+// tunnelRequirements mirrors what CreateTunnel and CreateChain dispatch
+func tunnelRequirements(tunnel domain.Tunnel) []tunnelRequirement {
+	if tunnel.Type == domain.TunnelTypeChain {
+		nodes := tunnelNodes(tunnel)
+		if len(nodes) != 3 {
+			return nil
+		}
+		segmentA, segmentB := wgQuickUnit(tunnel.ID, "a"), wgQuickUnit(tunnel.ID, "b")
+		return []tunnelRequirement{
+			{nodeID: nodes[0], unit: segmentA},
+			{nodeID: nodes[1], unit: segmentA},
+			{nodeID: nodes[1], unit: segmentB},
+			{nodeID: nodes[2], unit: segmentB},
+		}
+	}
+	if tunnel.Protocol == domain.TunnelProtocolWireGuard {
+		unit := wgQuickUnit(tunnel.ID, "")
+		return []tunnelRequirement{
+			{nodeID: tunnel.SourceNodeID, unit: unit},
+			{nodeID: tunnel.DestNodeID, unit: unit},
+		}
+	}
+	// The source of a sing-box tunnel only holds the client link
+	return []tunnelRequirement{{nodeID: tunnel.DestNodeID, unit: singBoxUnit, port: tunnel.DestPort}}
+}
+
+func wgQuickUnit(tunnelID uint, segment string) string {
+	return "wg-quick@" + wireguardInterface(tunnelID, segment)
+}
+
+// tunnelNodes returns every node a tunnel runs on, chain hops included
+func tunnelNodes(tunnel domain.Tunnel) []uint {
+	if tunnel.Type != domain.TunnelTypeChain {
+		return []uint{tunnel.SourceNodeID, tunnel.DestNodeID}
+	}
+	var hops struct {
+		Nodes []uint `json:"nodes"`
+	}
+	raw, _ := json.Marshal(tunnel.Hops)
+	if err := json.Unmarshal(raw, &hops); err != nil {
+		return nil
+	}
+	return hops.Nodes
+}
+
+// satisfied reports whether the requirement holds, and false for known when
+// the node has not reported its components yet
+func (r tunnelRequirement) satisfied(h *nodeHealth) (ok bool, known bool) {
+	if h == nil {
+		return false, false
+	}
+	c, found := h.component(r.unit)
+	if !found || !c.Healthy() {
+		return false, true
+	}
+	return r.port == 0 || listensOn(c, r.port), true
+}
+
+func listensOn(c protocol.ComponentHealth, port int) bool {
+	for _, p := range c.ListenPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateTunnels flips the tunnels running on nodeID between active and
+// failed. A pending tunnel becomes active once every node reports what it
+// needs and stays pending until then, as its commands may still be running.
+// Tunnels with a node whose health is not known yet are left alone.
+func (s *HealthService) evaluateTunnels(ctx context.Context, nodeID uint, reported *nodeHealth) {
+	tunnels, err := s.tunnelRepo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		s.logger.Warnw("health_list_tunnels_failed", "node_id", nodeID, "error", err)
+		return
+	}
+
+	health := map[uint]*nodeHealth{nodeID: reported}
+	lookup := func(id uint) *nodeHealth {
+		if h, ok := health[id]; ok {
+			return h
+		}
+		var h *nodeHealth
+		if node, err := s.nodeRepo.GetByID(ctx, id); err == nil {
+			h, _ = decodeNodeHealth(node.Health)
+		}
+		health[id] = h
+		return h
+	}
+
+	for i := range tunnels {
+		tunnel := &tunnels[i]
+		pending := tunnel.Status == domain.TunnelStatusPending
+
+		healthy, known := true, true
+		var missing []string
+		for _, req := range tunnelRequirements(*tunnel) {
+			ok, k := req.satisfied(lookup(req.nodeID))
+			if !k {
+				known = false
+				break
+			}
+			if !ok {
+				healthy = false
+				missing = append(missing, fmt.Sprintf("%s on node %d", req.unit, req.nodeID))
+			}
+		}
+		if !known {
+			continue
+		}
+
+		status := domain.TunnelStatusActive
+		if !healthy {
+			if pending {
+				continue
+			}
+			status = domain.TunnelStatusFailed
+		}
+		if tunnel.Status == status {
+			continue
+		}
+		tunnel.Status = status
+		if err := s.tunnelRepo.Update(ctx, tunnel); err != nil {
+			s.logger.Errorw("health_update_tunnel_failed", "tunnel_id", tunnel.ID, "error", err)
+			continue
+		}
+
+		if pending {
+			s.logger.Infow("tunnel_active", "tunnel_id", tunnel.ID)
+			recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+				Type:         domain.EventTypeTunnelReady,
+				Status:       domain.EventStatusSuccess,
+				ResourceType: "tunnel",
+				ResourceID:   tunnel.ID,
+				Message:      "Tunnel is active",
+				Meta:         map[string]interface{}{"node_id": nodeID},
+			})
+		} else if healthy {
+			s.logger.Infow("tunnel_recovered", "tunnel_id", tunnel.ID)
+			recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+				Type:         domain.EventTypeTunnelReady,
+				Status:       domain.EventStatusSuccess,
+				ResourceType: "tunnel",
+				ResourceID:   tunnel.ID,
+				Message:      "Tunnel recovered",
+				Meta:         map[string]interface{}{"node_id": nodeID},
+			})
+		} else {
+			s.logger.Warnw("tunnel_down", "tunnel_id", tunnel.ID, "missing", missing)
+			recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+				Type:         domain.EventTypeTunnelFailed,
+				Status:       domain.EventStatusFailed,
+				ResourceType: "tunnel",
+				ResourceID:   tunnel.ID,
+				Message:      "Tunnel is down",
+				Meta:         map[string]interface{}{"node_id": nodeID, "missing": missing},
+			})
+		}
+	}
+}
+
+// evaluateServices marks each service on nodeID healthy while sing-box is up
+// and listening on the service's port
+func (s *HealthService) evaluateServices(ctx context.Context, nodeID uint, reported *nodeHealth) {
+	svcs, err := s.serviceRepo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		s.logger.Warnw("health_list_services_failed", "node_id", nodeID, "error", err)
+		return
+	}
+
+	for i := range svcs {
+		svc := &svcs[i]
+		req := tunnelRequirement{nodeID: nodeID, unit: singBoxUnit, port: svc.ListenPort}
+		ok, _ := req.satisfied(reported)
+
+		health := domain.ServiceHealthHealthy
+		if !ok {
+			health = domain.ServiceHealthDown
+		}
+		if svc.Health == health {
+			continue
+		}
+		previous := svc.Health
+		svc.Health = health
+		if err := s.serviceRepo.Update(ctx, svc); err != nil {
+			s.logger.Errorw("health_update_service_failed", "service_id", svc.ID, "error", err)
+			continue
+		}
+
+		switch {
+		case ok && previous == domain.ServiceHealthDown:
+			recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+				Type:         domain.EventTypeServiceRecovered,
+				Status:       domain.EventStatusSuccess,
+				ResourceType: "service",
+				ResourceID:   svc.ID,
+				Message:      fmt.Sprintf("Service %s recovered", svc.Name),
+				Meta:         map[string]interface{}{"node_id": nodeID, "port": svc.ListenPort},
+			})
+		case !ok:
+			s.logger.Warnw("service_down", "service_id", svc.ID, "node_id", nodeID, "port", svc.ListenPort)
+			recordTimelineEvent(ctx, s.timelineRepo, s.logger, timelineEvent{
+				Type:         domain.EventTypeServiceDown,
+				Status:       domain.EventStatusFailed,
+				ResourceType: "service",
+				ResourceID:   svc.ID,
+				Message:      fmt.Sprintf("Service %s is down", svc.Name),
+				Meta:         map[string]interface{}{"node_id": nodeID, "port": svc.ListenPort},
+			})
+		}
+	}
+}
@@ -20,6 +20,8 @@ const (
 	EventTypeInstallation = "AGENT_INSTALLATION"
 	AgentBinaryPath       = "/usr/local/bin/netly-agent"
 	AgentServicePath      = "/etc/systemd/system/netly-agent.service"
+	AgentConfigPath       = "/etc/netly/agent.yaml"
+	AgentTLSDir           = "/etc/netly/tls"
 )
 
 type installerService struct {
@@ -28,15 +30,27 @@ type installerService struct {
 	logger                *logger.Logger
 	enableTaskCorrelation bool
 	publicURL             string
+	agentAuth             *AgentAuthService
+	ca                    *CertificateAuthority
+	agentTLSURL           string
+	keyManager            *KeyManager
 }
 
-func NewInstallerService(timelineRepo ports.TimelineRepository, nodeRepo ports.NodeRepository, log *logger.Logger, enableTaskCorrelation bool, publicURL string) ports.InstallerService {
+// NewInstallerService creates the SSH installer. When agentTLSURL is set the
+// node also gets a client certificate and talks to the mTLS listener. The
+// agent is pinned to keyManager's verify key, so it only runs commands this
+// backend signed.
+func NewInstallerService(timelineRepo ports.TimelineRepository, nodeRepo ports.NodeRepository, log *logger.Logger, enableTaskCorrelation bool, publicURL string, agentAuth *AgentAuthService, ca *CertificateAuthority, agentTLSURL string, keyManager *KeyManager) ports.InstallerService {
 	return &installerService{
 		timelineRepo:          timelineRepo,
 		nodeRepo:              nodeRepo,
 		logger:                log,
 		enableTaskCorrelation: enableTaskCorrelation,
 		publicURL:             publicURL,
+		agentAuth:             agentAuth,
+		ca:                    ca,
+		agentTLSURL:           agentTLSURL,
+		keyManager:            keyManager,
 	}
 }
 
@@ -152,9 +166,26 @@ func (s *installerService) InstallAgent(ctx context.Context, node *domain.Node,
 		s.logger.Warnw("failed to ensure ssh persistence", "node_id", node.ID, "error", err)
 	}
 
-	// Step 4: Create and start systemd service
+	// Step 4: Issue the agent's credentials; this revokes any previous token
+	token, err := s.agentAuth.IssueToken(ctx, node.ID)
+	if err != nil {
+		s.handleInstallationError(ctx, node, fmt.Sprintf("Issuing agent token failed: %v", err))
+		return fmt.Errorf("%w: %v", ErrServiceStartFailed, err)
+	}
+
+	backendURL := s.publicURL
+	if s.agentTLSURL != "" {
+		s.logger.Infow("deploying agent certificate", "node_id", node.ID)
+		if err := s.deployCertificate(ctx, sshClient, &currentConn, node.ID); err != nil {
+			s.handleInstallationError(ctx, node, fmt.Sprintf("Certificate deployment failed: %v", err))
+			return fmt.Errorf("%w: %v", ErrAgentDeployFailed, err)
+		}
+		backendURL = s.agentTLSURL
+	}
+
+	// Step 5: Create and start systemd service
 	s.logger.Infow("starting service", "node_id", node.ID)
-	if err := s.startService(ctx, sshClient, &currentConn); err != nil {
+	if err := s.startService(ctx, sshClient, &currentConn, backendURL, token); err != nil {
 		s.handleInstallationError(ctx, node, fmt.Sprintf("Service start failed: %v", err))
 		return fmt.Errorf("%w: %v", ErrServiceStartFailed, err)
 	}
@@ -320,35 +351,79 @@ WantedBy=multi-user.target`
 	return nil
 }
 
-func (s *installerService) startService(ctx context.Context, client *remote.SSHClient, conn **ssh.Client) error {
+// deployCertificate issues the node a client certificate and writes it, its
+// key and the CA to AgentTLSDir
+func (s *installerService) deployCertificate(ctx context.Context, client *remote.SSHClient, conn **ssh.Client, nodeID uint) error {
+	certPEM, keyPEM, err := s.ca.IssueNodeCertificate(ctx, nodeID)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"ca.pem":    s.ca.CACertPEM(),
+		"agent.pem": certPEM,
+		"agent.key": keyPEM,
+	}
+	for name, content := range files {
+		path := AgentTLSDir + "/" + name
+		cmd := fmt.Sprintf("sudo mkdir -p %s && sudo chmod 700 %s && echo '%s' | sudo tee %s > /dev/null && sudo chmod 600 %s",
+			AgentTLSDir, AgentTLSDir, strings.TrimSpace(content), path, path)
+		cmdCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		_, err := s.executeWithRetry(cmdCtx, client, conn, cmd)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (s *installerService) startService(ctx context.Context, client *remote.SSHClient, conn **ssh.Client, backendURL, token string) error {
+	configContent := fmt.Sprintf(`backend_url: "%s"
+node_token: "%s"
+log_path: "/var/log/netly-agent.log"
+heartbeat_interval: 10s
+signing_public_key: "%s"`, backendURL, token, s.keyManager.GetAgentVerifyKey())
+	if s.agentTLSURL != "" {
+		configContent += fmt.Sprintf(`
+ca_file: "%[1]s/ca.pem"
+cert_file: "%[1]s/agent.pem"
+key_file: "%[1]s/agent.key"`, AgentTLSDir)
+	}
+
 	serviceContent := fmt.Sprintf(`[Unit]
 Description=Netly Agent
 After=network.target
 
 [Service]
 Type=simple
-ExecStart=%s start
+ExecStart=%s --config %s
+ExecReload=/bin/kill -HUP $MAINPID
 Restart=always
 RestartSec=5
-Environment="NETLY_BACKEND_URL=%s"
-Environment="NETLY_AGENT_TOKEN=%s"
-Environment="LOG_LEVEL=info"
 StandardOutput=journal
 StandardError=journal
 
 [Install]
-WantedBy=multi-user.target`, AgentBinaryPath, s.publicURL, "change-me-agent")
+WantedBy=multi-user.target`, AgentBinaryPath, AgentConfigPath)
 
 	// Use echo | sudo tee
 	// Escape single quotes just in case, though there shouldn't be any in this content usually
+	safeConfig := strings.ReplaceAll(configContent, "'", "'\\''")
 	safeContent := strings.ReplaceAll(serviceContent, "'", "'\\''")
-	createServiceCmd := fmt.Sprintf("echo '%s' | sudo tee %s > /dev/null", safeContent, AgentServicePath)
-
-	cmdCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+	writeCommands := []string{
+		// The config holds the node's token, so keep it root-only
+		fmt.Sprintf("sudo mkdir -p /etc/netly && echo '%s' | sudo tee %s > /dev/null && sudo chmod 600 %s", safeConfig, AgentConfigPath, AgentConfigPath),
+		fmt.Sprintf("echo '%s' | sudo tee %s > /dev/null", safeContent, AgentServicePath),
+	}
 
-	if _, err := s.executeWithRetry(cmdCtx, client, conn, createServiceCmd); err != nil {
-		return err
+	for _, cmd := range writeCommands {
+		cmdCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		_, err := s.executeWithRetry(cmdCtx, client, conn, cmd)
+		cancel()
+		if err != nil {
+			return err
+		}
 	}
 
 	prepCommands := []string{
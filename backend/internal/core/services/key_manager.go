@@ -3,10 +3,12 @@ package services
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 
 	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -15,6 +17,10 @@ type KeyManager struct {
 	logger         *logger.Logger
 	privateKey     string
 	publicKey      string
+
+	// Ed25519 key pair agents use to verify what the backend sends them
+	signingKey ed25519.PrivateKey
+	verifyKey  ed25519.PublicKey
 }
 
 func NewKeyManager(settingService *SystemSettingService, logger *logger.Logger) *KeyManager {
@@ -30,6 +36,10 @@ func (km *KeyManager) Initialize() error {
 		return fmt.Errorf("failed to get settings: %w", err)
 	}
 
+	if err := km.initSigningKeys(settings.AgentSigningKey); err != nil {
+		return fmt.Errorf("failed to initialize agent signing key: %w", err)
+	}
+
 	if settings.SSHPrivateKey != "" && settings.SSHPublicKey != "" {
 		km.privateKey = settings.SSHPrivateKey
 		km.publicKey = settings.SSHPublicKey
@@ -46,6 +56,32 @@ func (km *KeyManager) Initialize() error {
 	return nil
 }
 
+func (km *KeyManager) initSigningKeys(stored string) error {
+	if stored != "" {
+		seed, err := base64.StdEncoding.DecodeString(stored)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("stored agent signing key is invalid")
+		}
+		km.signingKey = ed25519.NewKeyFromSeed(seed)
+		km.verifyKey = km.signingKey.Public().(ed25519.PublicKey)
+		km.logger.Info("Agent signing key loaded from database")
+		return nil
+	}
+
+	km.logger.Info("Generating new agent signing key...")
+	verifyKey, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	km.signingKey = signingKey
+	km.verifyKey = verifyKey
+
+	return km.settingService.UpdateAgentSigningKeys(
+		base64.StdEncoding.EncodeToString(signingKey.Seed()),
+		km.GetAgentVerifyKey(),
+	)
+}
+
 func (km *KeyManager) generateAndSaveKeys() error {
 	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -77,3 +113,18 @@ func (km *KeyManager) GetPublicKey() string {
 func (km *KeyManager) GetPrivateKey() string {
 	return km.privateKey
 }
+
+// GetAgentVerifyKey returns the base64 public key agents are provisioned with
+func (km *KeyManager) GetAgentVerifyKey() string {
+	return base64.StdEncoding.EncodeToString(km.verifyKey)
+}
+
+// SignForAgent signs msg with the agent signing key
+func (km *KeyManager) SignForAgent(msg []byte) []byte {
+	return ed25519.Sign(km.signingKey, msg)
+}
+
+// SignCommand sets the signature agents check before running cmd
+func (km *KeyManager) SignCommand(cmd *protocol.Command) {
+	cmd.Signature = base64.StdEncoding.EncodeToString(km.SignForAgent(protocol.CommandSigningMessage(*cmd)))
+}
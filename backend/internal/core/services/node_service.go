@@ -29,6 +29,7 @@ const (
 
 type nodeService struct {
 	repo          ports.NodeRepository
+	statsRepo     ports.NodeStatsRepository
 	installer     ports.InstallerService
 	taskService   *TaskService
 	cleanup       *CleanupService
@@ -42,6 +43,7 @@ type nodeService struct {
 
 type NodeServiceConfig struct {
 	Repository    ports.NodeRepository
+	StatsRepo     ports.NodeStatsRepository
 	Installer     ports.InstallerService
 	TaskService   *TaskService
 	Cleanup       *CleanupService
@@ -54,6 +56,7 @@ type NodeServiceConfig struct {
 func NewNodeService(cfg NodeServiceConfig) ports.NodeService {
 	return &nodeService{
 		repo:          cfg.Repository,
+		statsRepo:     cfg.StatsRepo,
 		installer:     cfg.Installer,
 		taskService:   cfg.TaskService,
 		cleanup:       cfg.Cleanup,
@@ -322,7 +325,10 @@ func (s *nodeService) InstallAgentAsync(ctx context.Context, nodeID uint) (strin
 	}
 
 	// Create Task
-	task := s.taskService.CreateTask("AGENT_INSTALLATION")
+	task, err := s.taskService.CreateTask("AGENT_INSTALLATION")
+	if err != nil {
+		return "", fmt.Errorf("failed to create installation task: %w", err)
+	}
 
 	node.Status = domain.NodeStatusInstalling
 	s.repo.Update(ctx, node)
@@ -553,3 +559,25 @@ func (s *nodeService) UpdateNodeStats(ctx context.Context, id uint, stats domain
 
 	return s.repo.Update(ctx, node)
 }
+
+// RecordStatsSamples adds samples to the node's stats history
+func (s *nodeService) RecordStatsSamples(ctx context.Context, id uint, samples []domain.NodeStatsSample) error {
+	if s.statsRepo == nil {
+		return nil
+	}
+	for i := range samples {
+		samples[i].NodeID = id
+	}
+	return s.statsRepo.CreateBatch(ctx, samples)
+}
+
+// GetStatsHistory returns up to limit samples collected after since
+func (s *nodeService) GetStatsHistory(ctx context.Context, id uint, since time.Time, limit int) ([]domain.NodeStatsSample, error) {
+	if _, err := s.repo.GetByID(ctx, id); err != nil {
+		return nil, ErrNodeNotFound
+	}
+	if s.statsRepo == nil {
+		return []domain.NodeStatsSample{}, nil
+	}
+	return s.statsRepo.ListByNode(ctx, id, since, limit)
+}
@@ -103,6 +103,9 @@ func (s *portamService) getUsedPorts(ctx context.Context, nodeID uint) (map[int]
         if t.DestNodeID == nodeID {
             usedPorts[t.DestPort] = true
         }
+        if port, ok := chainRelayPort(&t, nodeID); ok {
+            usedPorts[port] = true
+        }
     }
 
 	// Get ports from services
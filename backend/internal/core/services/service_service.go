@@ -18,6 +18,8 @@ type ServiceServiceConfig struct {
     FQDNAMSvc   ports.FQDNAMService
     Logger      *logger.Logger
     EnableLocks bool
+    // Firewall, when set, opens and closes the services' ports on the nodes
+    Firewall *FirewallService
 }
 
 type serviceService struct {
@@ -26,6 +28,7 @@ type serviceService struct {
     tunnelRepo  ports.TunnelRepository
     fqdnamSvc   ports.FQDNAMService
     logger      *logger.Logger
+    firewall    *FirewallService
     mu          sync.Mutex
     locks       map[string]*sync.Mutex
     enableLocks bool
@@ -38,6 +41,7 @@ func NewServiceService(cfg ServiceServiceConfig) ports.ServiceService {
         tunnelRepo:  cfg.TunnelRepo,
         fqdnamSvc:   cfg.FQDNAMSvc,
         logger:      cfg.Logger,
+        firewall:    cfg.Firewall,
         locks:       make(map[string]*sync.Mutex),
         enableLocks: cfg.EnableLocks,
     }
@@ -116,6 +120,10 @@ func (s *serviceService) CreateService(ctx context.Context, input ports.CreateSe
         return nil, err
     }
 
+    if s.firewall != nil {
+        s.firewall.SyncNodes(ctx, service.NodeID)
+    }
+
     return service, nil
 }
 
@@ -137,5 +145,11 @@ func (s *serviceService) DeleteService(ctx context.Context, id uint) error {
         fmt.Sprintf("node:%d", svc.NodeID),
     )
     defer unlock()
-    return s.repo.Delete(ctx, id)
+    if err := s.repo.Delete(ctx, id); err != nil {
+        return err
+    }
+    if s.firewall != nil {
+        s.firewall.SyncNodes(ctx, svc.NodeID)
+    }
+    return nil
 }
@@ -2,13 +2,18 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/netly/backend/internal/core/ports"
 	"github.com/netly/backend/internal/domain"
 	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
 )
 
 type SystemSettingService struct {
@@ -81,8 +86,56 @@ func (s *SystemSettingService) UpdateSSHKeys(privateKey, publicKey string) error
 	return s.repo.Set(ctx, pubSetting)
 }
 
+// UpdateAgentSigningKeys stores the Ed25519 key pair used to sign artifacts
+// sent to agents
+func (s *SystemSettingService) UpdateAgentSigningKeys(signingKey, verifyKey string) error {
+	ctx := context.Background()
+	unlock := s.lockKeys("setting:agent_signing_key", "setting:agent_verify_key")
+	defer unlock()
+
+	if err := s.repo.Set(ctx, &domain.SystemSetting{
+		Key:      "agent_signing_key",
+		Value:    signingKey,
+		Type:     "string",
+		Category: "security",
+	}); err != nil {
+		return err
+	}
+
+	return s.repo.Set(ctx, &domain.SystemSetting{
+		Key:      "agent_verify_key",
+		Value:    verifyKey,
+		Type:     "string",
+		Category: "security",
+	})
+}
+
+// UpdateAgentCA stores the PEM certificate and key of the internal CA that
+// issues agent certificates
+func (s *SystemSettingService) UpdateAgentCA(certPEM, keyPEM string) error {
+	ctx := context.Background()
+	unlock := s.lockKeys("setting:agent_ca_cert", "setting:agent_ca_key")
+	defer unlock()
+
+	if err := s.repo.Set(ctx, &domain.SystemSetting{
+		Key:      "agent_ca_cert",
+		Value:    certPEM,
+		Type:     "string",
+		Category: "security",
+	}); err != nil {
+		return err
+	}
+
+	return s.repo.Set(ctx, &domain.SystemSetting{
+		Key:      "agent_ca_key",
+		Value:    keyPEM,
+		Type:     "string",
+		Category: "security",
+	})
+}
+
 func (s *SystemSettingService) GetSettings(ctx context.Context) (map[string]string, error) {
-	categories := []string{"ipam", "dns", "telegram", "policy", "integration", "general", "security", "tunnel"}
+	categories := []string{"ipam", "dns", "telegram", "policy", "integration", "general", "security", "tunnel", "agent"}
 	result := make(map[string]string)
 
 	for _, cat := range categories {
@@ -109,6 +162,10 @@ func (s *SystemSettingService) GetSettingsStruct() (*domain.SystemSettings, erro
 	return &domain.SystemSettings{
 		SSHPrivateKey:          settingsMap["ssh_private_key"],
 		SSHPublicKey:           settingsMap["ssh_public_key"],
+		AgentSigningKey:        settingsMap["agent_signing_key"],
+		AgentVerifyKey:         settingsMap["agent_verify_key"],
+		AgentCACert:            settingsMap["agent_ca_cert"],
+		AgentCAKey:             settingsMap["agent_ca_key"],
 		CloudflareToken:        settingsMap["cloudflare_token"],
 		CloudflareEmail:        settingsMap["cloudflare_email"],
 		CloudflareGlobalKey:    settingsMap["cloudflare_global_key"],
@@ -129,9 +186,30 @@ func (s *SystemSettingService) UpdateSettings(ctx context.Context, settings map[
 		unlock := s.lockKeys(keys...)
 		defer unlock()
 	}
+	// Agent settings are checked up front so a bad one stores nothing
+	agentValues := make(map[string]string)
+	for key, val := range settings {
+		if !agentSettingKeys[key] {
+			continue
+		}
+		normalized, err := agentSettingValue(key, val)
+		if err != nil {
+			return err
+		}
+		agentValues[key] = normalized
+	}
+
 	for key, val := range settings {
 		var strVal string
 
+		if normalized, ok := agentValues[key]; ok {
+			if err := s.repo.Set(ctx, &domain.SystemSetting{Key: key, Value: normalized, Type: "string", Category: "agent"}); err != nil {
+				s.logger.Errorw("failed to set setting", "key", key, "error", err)
+				return err
+			}
+			continue
+		}
+
 		switch v := val.(type) {
 		case string:
 			strVal = v
@@ -177,3 +255,158 @@ func (s *SystemSettingService) UpdateSettings(ctx context.Context, settings map[
 	}
 	return nil
 }
+
+// Agent settings pushed to every agent with its heartbeat response. Empty
+// values leave each agent's agent.yaml in force.
+const (
+	SettingAgentHeartbeatInterval = "agent_heartbeat_interval"
+	SettingAgentLogLevel          = "agent_log_level"
+	SettingAgentEnabledCommands   = "agent_enabled_commands"
+	SettingAgentProbes            = "agent_probes"
+)
+
+var agentSettingKeys = map[string]bool{
+	SettingAgentHeartbeatInterval: true,
+	SettingAgentLogLevel:          true,
+	SettingAgentEnabledCommands:   true,
+	SettingAgentProbes:            true,
+}
+
+var agentLogLevels = []string{"debug", "info", "warn", "error"}
+
+// agentSettingValue validates an agent setting and returns it in its stored
+// form: the interval in seconds, enabled commands comma separated and probes
+// as a JSON array. Lists may be given as strings or arrays.
+func agentSettingValue(key string, val interface{}) (string, error) {
+	if val == nil {
+		return "", nil
+	}
+
+	switch key {
+	case SettingAgentHeartbeatInterval:
+		var seconds int
+		switch v := val.(type) {
+		case float64:
+			seconds = int(v)
+		case string:
+			if v == "" {
+				return "", nil
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return "", fmt.Errorf("%w: %s must be a number of seconds", ErrSettingInvalid, key)
+			}
+			seconds = n
+		default:
+			return "", fmt.Errorf("%w: %s must be a number of seconds", ErrSettingInvalid, key)
+		}
+		if seconds < 0 {
+			return "", fmt.Errorf("%w: %s cannot be negative", ErrSettingInvalid, key)
+		}
+		if seconds == 0 {
+			return "", nil
+		}
+		return strconv.Itoa(seconds), nil
+
+	case SettingAgentLogLevel:
+		level, _ := val.(string)
+		if level != "" && !slices.Contains(agentLogLevels, level) {
+			return "", fmt.Errorf("%w: %s must be one of %s", ErrSettingInvalid, key, strings.Join(agentLogLevels, ", "))
+		}
+		return level, nil
+
+	case SettingAgentEnabledCommands:
+		var types []string
+		switch v := val.(type) {
+		case string:
+			types = strings.Split(v, ",")
+		case []interface{}:
+			for _, t := range v {
+				str, ok := t.(string)
+				if !ok {
+					return "", fmt.Errorf("%w: %s must list command types", ErrSettingInvalid, key)
+				}
+				types = append(types, str)
+			}
+		default:
+			return "", fmt.Errorf("%w: %s must list command types", ErrSettingInvalid, key)
+		}
+		var clean []string
+		for _, t := range types {
+			if t = strings.TrimSpace(t); t != "" {
+				clean = append(clean, t)
+			}
+		}
+		return strings.Join(clean, ","), nil
+
+	case SettingAgentProbes:
+		raw := []byte(nil)
+		if str, ok := val.(string); ok {
+			if str == "" {
+				return "", nil
+			}
+			raw = []byte(str)
+		} else {
+			var err error
+			if raw, err = json.Marshal(val); err != nil {
+				return "", fmt.Errorf("%w: %s: %v", ErrSettingInvalid, key, err)
+			}
+		}
+		var probes []protocol.ProbeSchedule
+		if err := json.Unmarshal(raw, &probes); err != nil {
+			return "", fmt.Errorf("%w: %s must be a JSON array of probes: %v", ErrSettingInvalid, key, err)
+		}
+		names := make(map[string]bool)
+		for _, p := range probes {
+			switch {
+			case p.Name == "" || names[p.Name]:
+				return "", fmt.Errorf("%w: %s: every probe needs a unique name", ErrSettingInvalid, key)
+			case p.Type != protocol.ProbeTCP:
+				return "", fmt.Errorf("%w: %s: probe %s has unsupported type %q", ErrSettingInvalid, key, p.Name, p.Type)
+			case p.Target == "" || p.Interval <= 0:
+				return "", fmt.Errorf("%w: %s: probe %s needs a target and a positive interval", ErrSettingInvalid, key, p.Name)
+			}
+			names[p.Name] = true
+		}
+		if len(probes) == 0 {
+			return "", nil
+		}
+		out, _ := json.Marshal(probes)
+		return string(out), nil
+	}
+	return "", fmt.Errorf("%w: unknown agent setting %s", ErrSettingInvalid, key)
+}
+
+// AgentRemoteConfig builds the config pushed to agents from the agent
+// settings, or nil when none is set. Stored values were validated on the way
+// in, so one that no longer parses is skipped.
+func (s *SystemSettingService) AgentRemoteConfig(ctx context.Context) (*protocol.RemoteConfig, error) {
+	settings, err := s.repo.GetByCategory(ctx, "agent")
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg protocol.RemoteConfig
+	for _, setting := range settings {
+		if setting.Value == "" {
+			continue
+		}
+		switch setting.Key {
+		case SettingAgentHeartbeatInterval:
+			cfg.HeartbeatInterval, _ = strconv.Atoi(setting.Value)
+		case SettingAgentLogLevel:
+			cfg.LogLevel = setting.Value
+		case SettingAgentEnabledCommands:
+			cfg.EnabledCommands = strings.Split(setting.Value, ",")
+		case SettingAgentProbes:
+			if err := json.Unmarshal([]byte(setting.Value), &cfg.Probes); err != nil {
+				s.logger.Warnw("agent_probes_setting_invalid", "error", err)
+			}
+		}
+	}
+
+	if cfg.HeartbeatInterval == 0 && cfg.LogLevel == "" && len(cfg.EnabledCommands) == 0 && len(cfg.Probes) == 0 {
+		return nil, nil
+	}
+	return &cfg, nil
+}
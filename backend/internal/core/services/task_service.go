@@ -1,36 +1,81 @@
 package services
 
 import (
+	"context"
 	"errors"
-	"sync"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/netly/backend/internal/config"
+	"github.com/netly/backend/internal/core/ports"
 	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"gorm.io/gorm"
 )
 
+// cancelPriority puts a CMD_CANCEL ahead of anything else queued for its node
+const cancelPriority = 1000
+
+// TaskService persists install tasks and the agent command queue so that
+// neither is lost when the backend restarts.
 type TaskService struct {
-	tasks    map[string]*domain.Task
-	commands map[string]*domain.Command
-	mu       sync.RWMutex
+	taskRepo          ports.TaskRepository
+	commandRepo       ports.CommandRepository
+	outputRepo        ports.CommandOutputRepository
+	pusher            ports.CommandPusher
+	logger            *logger.Logger
+	processingTimeout time.Duration
+	maxAttempts       int
+	reapInterval      time.Duration
+	defaultTTL        time.Duration
+}
+
+type TaskServiceConfig struct {
+	TaskRepo    ports.TaskRepository
+	CommandRepo ports.CommandRepository
+	OutputRepo  ports.CommandOutputRepository
+	Logger      *logger.Logger
+	Config      config.CommandsConfig
 }
 
-func NewTaskService() *TaskService {
-	return &TaskService{
-		tasks:    make(map[string]*domain.Task),
-		commands: make(map[string]*domain.Command),
+func NewTaskService(cfg TaskServiceConfig) *TaskService {
+	s := &TaskService{
+		taskRepo:          cfg.TaskRepo,
+		commandRepo:       cfg.CommandRepo,
+		outputRepo:        cfg.OutputRepo,
+		logger:            cfg.Logger,
+		processingTimeout: cfg.Config.ProcessingTimeout,
+		maxAttempts:       cfg.Config.MaxAttempts,
+		reapInterval:      cfg.Config.ReapInterval,
+		defaultTTL:        cfg.Config.DefaultTTL,
+	}
+	if s.processingTimeout == 0 {
+		s.processingTimeout = 5 * time.Minute
 	}
+	if s.maxAttempts == 0 {
+		s.maxAttempts = 3
+	}
+	if s.reapInterval == 0 {
+		s.reapInterval = 30 * time.Second
+	}
+	if s.defaultTTL == 0 {
+		s.defaultTTL = 24 * time.Hour
+	}
+	return s
 }
 
-// ==================== Task Management ====================
+// SetPusher enables push delivery. Commands for agents holding a live stream
+// are sent immediately; everyone else picks them up on the next heartbeat.
+func (s *TaskService) SetPusher(p ports.CommandPusher) {
+	s.pusher = p
+}
 
-func (s *TaskService) CreateTask(taskType string) *domain.Task {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// ==================== Task Management ====================
 
-	id := uuid.New().String()
+func (s *TaskService) CreateTask(taskType string) (*domain.Task, error) {
 	task := &domain.Task{
-		ID:        id,
+		ID:        uuid.New().String(),
 		Type:      taskType,
 		Status:    "pending",
 		Progress:  0,
@@ -39,17 +84,18 @@ func (s *TaskService) CreateTask(taskType string) *domain.Task {
 		UpdatedAt: time.Now(),
 	}
 
-	s.tasks[id] = task
-	return task
+	if err := s.taskRepo.Create(context.Background(), task); err != nil {
+		s.logger.Errorw("task_create_failed", "type", taskType, "error", err)
+		return nil, err
+	}
+	return task, nil
 }
 
 func (s *TaskService) UpdateTask(id string, status string, progress int, msg string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	task, exists := s.tasks[id]
-	if !exists {
-		return errors.New("task not found")
+	ctx := context.Background()
+	task, err := s.getTask(ctx, id)
+	if err != nil {
+		return err
 	}
 
 	task.Status = status
@@ -57,16 +103,14 @@ func (s *TaskService) UpdateTask(id string, status string, progress int, msg str
 	task.Message = msg
 	task.UpdatedAt = time.Now()
 
-	return nil
+	return s.taskRepo.Update(ctx, task)
 }
 
 func (s *TaskService) FailTask(id string, errStr string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	task, exists := s.tasks[id]
-	if !exists {
-		return errors.New("task not found")
+	ctx := context.Background()
+	task, err := s.getTask(ctx, id)
+	if err != nil {
+		return err
 	}
 
 	task.Status = "failed"
@@ -74,76 +118,433 @@ func (s *TaskService) FailTask(id string, errStr string) error {
 	task.Message = "Task failed"
 	task.UpdatedAt = time.Now()
 
-	return nil
+	return s.taskRepo.Update(ctx, task)
 }
 
 func (s *TaskService) GetTask(id string) (*domain.Task, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	return s.getTask(context.Background(), id)
+}
 
-	task, exists := s.tasks[id]
-	if !exists {
-		return nil, errors.New("task not found")
+// getTask tells a missing task apart from a failed lookup
+func (s *TaskService) getTask(ctx context.Context, id string) (*domain.Task, error) {
+	task, err := s.taskRepo.GetByID(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTaskNotFound
 	}
-
-	// Return a copy to avoid race conditions
-	taskCopy := *task
-	return &taskCopy, nil
+	if err != nil {
+		return nil, fmt.Errorf("failed to load task %s: %w", id, err)
+	}
+	return task, nil
 }
 
 // ==================== Command Dispatch ====================
 
-// CreateCommand creates a new command for a specific node
-func (s *TaskService) CreateCommand(nodeID uint, cmdType domain.CommandType, payload domain.JSONB) (*domain.Command, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// CreateCommand creates a new command for a specific node. If opts carries an
+// idempotency key that a still pending or processing command for this node
+// was queued under, that command is returned instead of queueing a second
+// one. Finished commands do not hold on to their key.
+func (s *TaskService) CreateCommand(nodeID uint, cmdType domain.CommandType, payload domain.JSONB, opts ports.CommandOptions) (*domain.Command, error) {
+	ctx := context.Background()
+	if opts.IdempotencyKey != "" {
+		if existing, err := s.commandRepo.GetByIdempotencyKey(ctx, nodeID, opts.IdempotencyKey); err == nil {
+			s.logger.Infow("command_create_deduplicated", "command_id", existing.ID, "node_id", nodeID, "key", opts.IdempotencyKey)
+			return existing, nil
+		}
+	}
 
-	id := uuid.New().String()
+	now := time.Now()
 	cmd := &domain.Command{
-		ID:        id,
-		NodeID:    nodeID,
-		Type:      cmdType,
-		Status:    domain.CommandStatusPending,
-		Payload:   payload,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:             uuid.New().String(),
+		NodeID:         nodeID,
+		Type:           cmdType,
+		Status:         domain.CommandStatusPending,
+		Payload:        payload,
+		Priority:       opts.Priority,
+		IdempotencyKey: opts.IdempotencyKey,
+		Timeout:        int(opts.Timeout / time.Second),
+		MaxAttempts:    s.maxAttempts,
+		CreatedAt:      now,
+		UpdatedAt:      now,
 	}
 
-	s.commands[id] = cmd
+	if opts.MaxAttempts > 0 {
+		cmd.MaxAttempts = opts.MaxAttempts
+	}
+
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = s.defaultTTL
+	}
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		cmd.ExpiresAt = &expiresAt
+	}
+
+	if err := s.commandRepo.Create(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	s.push(ctx, cmd)
 	return cmd, nil
 }
 
-// GetPendingCommands retrieves all pending commands for a specific node
+// GetPendingCommands retrieves the deliverable commands for a node, highest
+// priority first. Commands whose TTL ran out are marked expired and skipped.
 func (s *TaskService) GetPendingCommands(nodeID uint) ([]*domain.Command, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	ctx := context.Background()
+	pending, err := s.commandRepo.GetPendingByNodeID(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return s.dropExpired(ctx, pending), nil
+}
+
+// dropExpired marks commands past their expiry and returns the rest
+func (s *TaskService) dropExpired(ctx context.Context, cmds []*domain.Command) []*domain.Command {
+	now := time.Now()
+	live := cmds[:0]
+	for _, cmd := range cmds {
+		if cmd.ExpiresAt == nil || now.Before(*cmd.ExpiresAt) {
+			live = append(live, cmd)
+			continue
+		}
 
-	var pending []*domain.Command
-	for _, cmd := range s.commands {
-		if cmd.NodeID == nodeID && cmd.Status == domain.CommandStatusPending {
-			// Return a copy
-			cmdCopy := *cmd
-			pending = append(pending, &cmdCopy)
+		cmd.Status = domain.CommandStatusExpired
+		cmd.Error = "expired before delivery"
+		cmd.CompletedAt = &now
+		cmd.UpdatedAt = now
+		if ok, err := s.commandRepo.UpdateIfStatus(ctx, cmd, domain.CommandStatusPending); err != nil || !ok {
+			s.logger.Warnw("command_expire_failed", "command_id", cmd.ID, "error", err)
+			continue
 		}
+		s.logger.Warnw("command_expired", "command_id", cmd.ID, "node_id", cmd.NodeID, "type", cmd.Type, "expires_at", cmd.ExpiresAt)
+	}
+	return live
+}
+
+// GetCommand retrieves a single command by ID
+func (s *TaskService) GetCommand(commandID string) (*domain.Command, error) {
+	cmd, err := s.commandRepo.GetByID(context.Background(), commandID)
+	if err != nil {
+		return nil, ErrCommandNotFound
 	}
+	return cmd, nil
+}
 
-	return pending, nil
+// ListCommands lists commands across the fleet, newest first
+func (s *TaskService) ListCommands(filter ports.CommandFilter) ([]*domain.Command, error) {
+	return s.commandRepo.List(context.Background(), filter)
 }
 
 // UpdateCommandStatus updates the status of a command
 func (s *TaskService) UpdateCommandStatus(commandID string, status domain.CommandStatus, result string, errStr string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	err := s.commandRepo.UpdateStatus(context.Background(), commandID, status, result, errStr)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrCommandNotFound
+	}
+	return err
+}
 
-	cmd, exists := s.commands[commandID]
-	if !exists {
-		return errors.New("command not found")
+// MarkCommandDispatched records that a command was handed to its agent
+func (s *TaskService) MarkCommandDispatched(commandID string) error {
+	ctx := context.Background()
+	cmd, err := s.commandRepo.GetByID(ctx, commandID)
+	if err != nil {
+		return ErrCommandNotFound
 	}
+	return s.markDispatched(ctx, cmd)
+}
 
-	cmd.Status = status
-	cmd.Result = result
-	cmd.Error = errStr
-	cmd.UpdatedAt = time.Now()
+// markDispatched moves a pending command to processing. It fails with
+// ErrCommandStatusChanged if another path delivered or finished it first.
+func (s *TaskService) markDispatched(ctx context.Context, cmd *domain.Command) error {
+	from := cmd.Status
+	now := time.Now()
+	cmd.Status = domain.CommandStatusProcessing
+	cmd.Attempts++
+	cmd.DispatchedAt = &now
+	cmd.AckedAt = nil
+	cmd.UpdatedAt = now
 
+	ok, err := s.commandRepo.UpdateIfStatus(ctx, cmd, from)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCommandStatusChanged
+	}
 	return nil
 }
+
+// AcknowledgeCommand records that the agent received a pushed command. The
+// ack is dropped if the result arrives or the command is requeued first.
+func (s *TaskService) AcknowledgeCommand(nodeID uint, commandID string) error {
+	ctx := context.Background()
+	cmd, err := s.commandRepo.GetByID(ctx, commandID)
+	if err != nil {
+		return ErrCommandNotFound
+	}
+	if cmd.NodeID != nodeID {
+		return ErrCommandNodeMismatch
+	}
+	if cmd.Status != domain.CommandStatusProcessing {
+		// Result already arrived or the command was requeued; nothing to ack
+		return nil
+	}
+
+	now := time.Now()
+	cmd.AckedAt = &now
+	cmd.UpdatedAt = now
+	_, err = s.commandRepo.UpdateIfStatus(ctx, cmd, domain.CommandStatusProcessing)
+	return err
+}
+
+// DispatchPendingCommands pushes everything queued for a node over its live
+// stream, e.g. right after the agent connects. It returns how many were sent.
+func (s *TaskService) DispatchPendingCommands(nodeID uint) (int, error) {
+	ctx := context.Background()
+	pending, err := s.commandRepo.GetPendingByNodeID(ctx, nodeID)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, cmd := range s.dropExpired(ctx, pending) {
+		if !s.push(ctx, cmd) {
+			break
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// push sends a pending command over the node's live stream. The command is
+// marked dispatched before it is written so a fast result cannot race the
+// status update; if the write fails it goes back to the queue for polling.
+func (s *TaskService) push(ctx context.Context, cmd *domain.Command) bool {
+	if s.pusher == nil || !s.pusher.IsConnected(cmd.NodeID) {
+		return false
+	}
+
+	if err := s.markDispatched(ctx, cmd); err != nil {
+		s.logger.Warnw("command_push_mark_dispatched_failed", "command_id", cmd.ID, "error", err)
+		return false
+	}
+
+	if err := s.pusher.Push(cmd); err != nil {
+		s.logger.Warnw("command_push_failed", "command_id", cmd.ID, "node_id", cmd.NodeID, "error", err)
+		cmd.Status = domain.CommandStatusPending
+		cmd.Attempts--
+		cmd.DispatchedAt = nil
+		cmd.UpdatedAt = time.Now()
+		if _, err := s.commandRepo.UpdateIfStatus(ctx, cmd, domain.CommandStatusProcessing); err != nil {
+			s.logger.Errorw("command_push_requeue_failed", "command_id", cmd.ID, "error", err)
+		}
+		return false
+	}
+
+	s.logger.Infow("command_pushed", "command_id", cmd.ID, "node_id", cmd.NodeID, "type", cmd.Type, "attempt", cmd.Attempts)
+	return true
+}
+
+// CompleteCommand applies a result reported by the agent. A failed command is
+// not queued again: the agent already ran it, and scripts are not safe to
+// repeat. Only commands whose result never arrived are retried, by the reaper.
+func (s *TaskService) CompleteCommand(nodeID uint, commandID string, success bool, output string, errStr string) (*domain.Command, error) {
+	ctx := context.Background()
+	// The reaper may requeue the command between the read and the write; if
+	// it does, start over from the stored row
+	for try := 0; try < 3; try++ {
+		cmd, err := s.commandRepo.GetByID(ctx, commandID)
+		if err != nil {
+			return nil, ErrCommandNotFound
+		}
+		if cmd.NodeID != nodeID {
+			return nil, ErrCommandNodeMismatch
+		}
+		if cmd.Status.Finished() {
+			return cmd, ErrCommandAlreadyFinished
+		}
+
+		from := cmd.Status
+		now := time.Now()
+		cmd.Result = output
+		cmd.Error = errStr
+		cmd.UpdatedAt = now
+		cmd.CompletedAt = &now
+
+		switch {
+		case success:
+			cmd.Status = domain.CommandStatusCompleted
+		case cmd.CancelRequestedAt != nil:
+			cmd.Status = domain.CommandStatusCancelled
+		default:
+			cmd.Status = domain.CommandStatusFailed
+		}
+
+		ok, err := s.commandRepo.UpdateIfStatus(ctx, cmd, from)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		s.logger.Infow("command_result_applied",
+			"command_id", cmd.ID,
+			"node_id", nodeID,
+			"success", success,
+			"status", cmd.Status,
+			"attempts", cmd.Attempts,
+		)
+		return cmd, nil
+	}
+	return nil, ErrCommandStatusChanged
+}
+
+// ReapStaleCommands returns processing commands whose agent never reported
+// back to the queue, or fails them once they are out of attempts. A command
+// with its own timeout gets that long on top of the processing timeout.
+// Re-delivering is safe because the agent's journal answers a command it
+// already ran with the stored result instead of running it again.
+func (s *TaskService) ReapStaleCommands(ctx context.Context) error {
+	stale, err := s.commandRepo.GetStaleProcessing(ctx, time.Now().Add(-s.processingTimeout))
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range stale {
+		now := time.Now()
+		if cmd.Timeout > 0 && cmd.DispatchedAt != nil &&
+			now.Before(cmd.DispatchedAt.Add(time.Duration(cmd.Timeout)*time.Second+s.processingTimeout)) {
+			continue
+		}
+
+		cmd.UpdatedAt = now
+		switch {
+		case cmd.CancelRequestedAt != nil:
+			cmd.Status = domain.CommandStatusCancelled
+			cmd.Error = "cancelled; the agent never reported back"
+			cmd.CompletedAt = &now
+		case cmd.Attempts < cmd.MaxAttempts:
+			cmd.Status = domain.CommandStatusPending
+		default:
+			cmd.Status = domain.CommandStatusFailed
+			cmd.Error = "timed out waiting for agent result"
+			cmd.CompletedAt = &now
+		}
+		ok, err := s.commandRepo.UpdateIfStatus(ctx, cmd, domain.CommandStatusProcessing)
+		if err != nil {
+			s.logger.Warnw("command_reap_update_failed", "command_id", cmd.ID, "error", err)
+			continue
+		}
+		if !ok {
+			// The result arrived while we were deciding
+			continue
+		}
+		s.logger.Warnw("command_reaped", "command_id", cmd.ID, "node_id", cmd.NodeID, "status", cmd.Status, "attempts", cmd.Attempts)
+	}
+	return nil
+}
+
+// CancelCommand stops a command. One still waiting in the queue is cancelled
+// outright; one its agent has is sent a CMD_CANCEL ahead of everything else
+// queued and ends up cancelled once the agent reports it stopped.
+func (s *TaskService) CancelCommand(commandID string) (*domain.Command, error) {
+	ctx := context.Background()
+	cmd, err := s.commandRepo.GetByID(ctx, commandID)
+	if err != nil {
+		return nil, ErrCommandNotFound
+	}
+	if cmd.Status.Finished() {
+		return cmd, ErrCommandAlreadyFinished
+	}
+	if cmd.Type == domain.CmdCancel {
+		return cmd, ErrCommandNotCancellable
+	}
+
+	now := time.Now()
+	from := cmd.Status
+	// An earlier attempt may still be sitting in the agent's queue
+	delivered := cmd.Status == domain.CommandStatusProcessing || cmd.Attempts > 0
+	if cmd.Status == domain.CommandStatusPending {
+		cmd.Status = domain.CommandStatusCancelled
+		cmd.Error = "cancelled before delivery"
+		cmd.CompletedAt = &now
+	}
+	cmd.CancelRequestedAt = &now
+	cmd.UpdatedAt = now
+	ok, err := s.commandRepo.UpdateIfStatus(ctx, cmd, from)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// The result arrived or the command changed hands since the read
+		if cmd, err = s.commandRepo.GetByID(ctx, commandID); err != nil {
+			return nil, ErrCommandNotFound
+		}
+		if cmd.Status.Finished() {
+			return cmd, ErrCommandAlreadyFinished
+		}
+		return cmd, ErrCommandStatusChanged
+	}
+
+	if delivered {
+		_, err := s.CreateCommand(cmd.NodeID, domain.CmdCancel, domain.JSONB{"command_id": cmd.ID}, ports.CommandOptions{
+			Priority:       cancelPriority,
+			TTL:            s.processingTimeout,
+			IdempotencyKey: "cancel-" + cmd.ID,
+			MaxAttempts:    1,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.logger.Infow("command_cancel_requested", "command_id", cmd.ID, "node_id", cmd.NodeID, "status", cmd.Status, "delivered", delivered)
+	return cmd, nil
+}
+
+// AppendCommandOutput stores output an agent streamed for one of its
+// commands. Output arriving after the result is still kept.
+func (s *TaskService) AppendCommandOutput(nodeID uint, commandID string, chunks []domain.CommandOutputChunk) error {
+	ctx := context.Background()
+	cmd, err := s.commandRepo.GetByID(ctx, commandID)
+	if err != nil {
+		return ErrCommandNotFound
+	}
+	if cmd.NodeID != nodeID {
+		return ErrCommandNodeMismatch
+	}
+	for i := range chunks {
+		chunks[i].CommandID = commandID
+	}
+	return s.outputRepo.Append(ctx, chunks)
+}
+
+// GetCommandOutput returns up to limit chunks of a command's output numbered
+// above afterSeq, so a client can follow a running command by passing the
+// last sequence number it saw
+func (s *TaskService) GetCommandOutput(commandID string, afterSeq int, limit int) ([]domain.CommandOutputChunk, error) {
+	if _, err := s.commandRepo.GetByID(context.Background(), commandID); err != nil {
+		return nil, ErrCommandNotFound
+	}
+	return s.outputRepo.ListAfter(context.Background(), commandID, afterSeq, limit)
+}
+
+// StartReaper runs ReapStaleCommands periodically until ctx is cancelled
+func (s *TaskService) StartReaper(ctx context.Context) {
+	ticker := time.NewTicker(s.reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.ReapStaleCommands(ctx); err != nil {
+				s.logger.Warnw("command_reap_failed", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netly/backend/internal/config"
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// fakeCommandRepo keeps commands in memory with the same status guard as the
+// Postgres repository. afterRead, when set, runs once after the next read, so
+// a test can slip another writer in between a read and its update.
+type fakeCommandRepo struct {
+	mu        sync.Mutex
+	cmds      map[string]domain.Command
+	afterRead func()
+}
+
+func newFakeCommandRepo(cmds ...domain.Command) *fakeCommandRepo {
+	r := &fakeCommandRepo{cmds: make(map[string]domain.Command)}
+	for _, cmd := range cmds {
+		r.cmds[cmd.ID] = cmd
+	}
+	return r
+}
+
+func (r *fakeCommandRepo) get(id string) domain.Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cmds[id]
+}
+
+func (r *fakeCommandRepo) Create(ctx context.Context, cmd *domain.Command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cmds[cmd.ID] = *cmd
+	return nil
+}
+
+func (r *fakeCommandRepo) read() {
+	r.mu.Lock()
+	hook := r.afterRead
+	r.afterRead = nil
+	r.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+}
+
+func (r *fakeCommandRepo) GetByID(ctx context.Context, id string) (*domain.Command, error) {
+	r.mu.Lock()
+	cmd, ok := r.cmds[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	r.read()
+	return &cmd, nil
+}
+
+func (r *fakeCommandRepo) GetByIdempotencyKey(ctx context.Context, nodeID uint, key string) (*domain.Command, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cmd := range r.cmds {
+		if cmd.NodeID == nodeID && cmd.IdempotencyKey == key && !cmd.Status.Finished() {
+			return &cmd, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeCommandRepo) GetPendingByNodeID(ctx context.Context, nodeID uint) ([]*domain.Command, error) {
+	return r.List(ctx, ports.CommandFilter{NodeID: nodeID, Status: domain.CommandStatusPending})
+}
+
+func (r *fakeCommandRepo) List(ctx context.Context, filter ports.CommandFilter) ([]*domain.Command, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []*domain.Command
+	for _, cmd := range r.cmds {
+		if (filter.NodeID == 0 || cmd.NodeID == filter.NodeID) && (filter.Status == "" || cmd.Status == filter.Status) {
+			cmd := cmd
+			out = append(out, &cmd)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Priority > out[j].Priority })
+	return out, nil
+}
+
+func (r *fakeCommandRepo) GetStaleProcessing(ctx context.Context, dispatchedBefore time.Time) ([]*domain.Command, error) {
+	r.mu.Lock()
+	var out []*domain.Command
+	for _, cmd := range r.cmds {
+		if cmd.Status == domain.CommandStatusProcessing && cmd.DispatchedAt != nil && cmd.DispatchedAt.Before(dispatchedBefore) {
+			cmd := cmd
+			out = append(out, &cmd)
+		}
+	}
+	r.mu.Unlock()
+	r.read()
+	return out, nil
+}
+
+func (r *fakeCommandRepo) Update(ctx context.Context, cmd *domain.Command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cmds[cmd.ID] = *cmd
+	return nil
+}
+
+func (r *fakeCommandRepo) UpdateIfStatus(ctx context.Context, cmd *domain.Command, from domain.CommandStatus) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.cmds[cmd.ID]
+	if !ok || stored.Status != from {
+		return false, nil
+	}
+	r.cmds[cmd.ID] = *cmd
+	return true, nil
+}
+
+func (r *fakeCommandRepo) UpdateStatus(ctx context.Context, id string, status domain.CommandStatus, result string, errStr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cmd, ok := r.cmds[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	cmd.Status, cmd.Result, cmd.Error = status, result, errStr
+	r.cmds[id] = cmd
+	return nil
+}
+
+func newTestTaskService(repo ports.CommandRepository) *TaskService {
+	return NewTaskService(TaskServiceConfig{
+		CommandRepo: repo,
+		Logger:      &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		Config:      config.CommandsConfig{ProcessingTimeout: time.Minute, MaxAttempts: 3},
+	})
+}
+
+func processingCommand(id string, attempts int, dispatchedAgo time.Duration) domain.Command {
+	dispatched := time.Now().Add(-dispatchedAgo)
+	return domain.Command{
+		ID:           id,
+		NodeID:       1,
+		Type:         domain.CmdApplyConfig,
+		Status:       domain.CommandStatusProcessing,
+		Attempts:     attempts,
+		MaxAttempts:  3,
+		DispatchedAt: &dispatched,
+	}
+}
+
+func TestCompleteCommand(t *testing.T) {
+	now := time.Now()
+	cancelled := processingCommand("c1", 1, 0)
+	cancelled.CancelRequestedAt = &now
+	done := processingCommand("c1", 1, 0)
+	done.Status, done.Result, done.CompletedAt = domain.CommandStatusCompleted, "first", &now
+
+	tests := []struct {
+		name    string
+		stored  domain.Command
+		nodeID  uint
+		success bool
+		wantErr error
+		want    domain.CommandStatus
+		result  string
+	}{
+		{"success", processingCommand("c1", 1, 0), 1, true, nil, domain.CommandStatusCompleted, "out"},
+		{"failure is not retried", processingCommand("c1", 1, 0), 1, false, nil, domain.CommandStatusFailed, "out"},
+		{"failure after cancel", cancelled, 1, false, nil, domain.CommandStatusCancelled, "out"},
+		{"queued result", processingCommand("c1", 0, 0), 1, true, nil, domain.CommandStatusCompleted, "out"},
+		{"already finished", done, 1, true, ErrCommandAlreadyFinished, domain.CommandStatusCompleted, "first"},
+		{"other node", processingCommand("c1", 1, 0), 2, true, ErrCommandNodeMismatch, domain.CommandStatusProcessing, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeCommandRepo(tt.stored)
+			s := newTestTaskService(repo)
+
+			_, err := s.CompleteCommand(tt.nodeID, "c1", tt.success, "out", "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			got := repo.get("c1")
+			if got.Status != tt.want || got.Result != tt.result {
+				t.Fatalf("stored = %s %q, want %s %q", got.Status, got.Result, tt.want, tt.result)
+			}
+			if tt.want.Finished() && got.CompletedAt == nil {
+				t.Fatal("finished command has no completed_at")
+			}
+		})
+	}
+
+	if _, err := newTestTaskService(newFakeCommandRepo()).CompleteCommand(1, "missing", true, "", ""); !errors.Is(err, ErrCommandNotFound) {
+		t.Fatalf("missing command: err = %v, want %v", err, ErrCommandNotFound)
+	}
+}
+
+func TestCompleteCommandAfterRequeue(t *testing.T) {
+	repo := newFakeCommandRepo(processingCommand("c1", 1, 0))
+	s := newTestTaskService(repo)
+
+	// The reaper requeues the command between the read and the write
+	repo.afterRead = func() {
+		cmd := repo.get("c1")
+		cmd.Status = domain.CommandStatusPending
+		repo.Update(context.Background(), &cmd)
+	}
+	if _, err := s.CompleteCommand(1, "c1", true, "out", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.get("c1"); got.Status != domain.CommandStatusCompleted || got.Result != "out" {
+		t.Fatalf("stored = %s %q, want the late result applied", got.Status, got.Result)
+	}
+}
+
+func TestReapStaleCommands(t *testing.T) {
+	now := time.Now()
+	cancelled := processingCommand("c1", 1, time.Hour)
+	cancelled.CancelRequestedAt = &now
+	ownTimeout := processingCommand("c1", 1, 2*time.Minute)
+	ownTimeout.Timeout = 600
+
+	tests := []struct {
+		name   string
+		stored domain.Command
+		want   domain.CommandStatus
+		errStr string
+	}{
+		{"retried", processingCommand("c1", 1, time.Hour), domain.CommandStatusPending, ""},
+		{"out of attempts", processingCommand("c1", 3, time.Hour), domain.CommandStatusFailed, "timed out waiting for agent result"},
+		{"cancel requested", cancelled, domain.CommandStatusCancelled, "cancelled; the agent never reported back"},
+		{"within its own timeout", ownTimeout, domain.CommandStatusProcessing, ""},
+		{"recently dispatched", processingCommand("c1", 1, time.Second), domain.CommandStatusProcessing, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeCommandRepo(tt.stored)
+			if err := newTestTaskService(repo).ReapStaleCommands(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			got := repo.get("c1")
+			if got.Status != tt.want || got.Error != tt.errStr {
+				t.Fatalf("stored = %s %q, want %s %q", got.Status, got.Error, tt.want, tt.errStr)
+			}
+			if got.Status.Finished() != (got.CompletedAt != nil) {
+				t.Fatalf("completed_at = %v for status %s", got.CompletedAt, got.Status)
+			}
+		})
+	}
+}
+
+func TestReapStaleCommandsKeepsLateResult(t *testing.T) {
+	repo := newFakeCommandRepo(processingCommand("c1", 3, time.Hour))
+	s := newTestTaskService(repo)
+
+	// The result lands after the reaper listed the command
+	repo.afterRead = func() {
+		if _, err := s.CompleteCommand(1, "c1", true, "out", ""); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := s.ReapStaleCommands(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.get("c1"); got.Status != domain.CommandStatusCompleted || got.Result != "out" {
+		t.Fatalf("stored = %s %q, want the result kept", got.Status, got.Result)
+	}
+}
+
+func TestAcknowledgeCommandAfterResult(t *testing.T) {
+	repo := newFakeCommandRepo(processingCommand("c1", 1, 0))
+	s := newTestTaskService(repo)
+
+	// The result is stored between the ack's read and its write
+	repo.afterRead = func() {
+		if _, err := s.CompleteCommand(1, "c1", true, "out", ""); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := s.AcknowledgeCommand(1, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	got := repo.get("c1")
+	if got.Status != domain.CommandStatusCompleted || got.Result != "out" || got.AckedAt != nil {
+		t.Fatalf("stored = %s %q acked=%v, want the result kept", got.Status, got.Result, got.AckedAt)
+	}
+}
+
+func TestCancelCommandRacesResult(t *testing.T) {
+	repo := newFakeCommandRepo(processingCommand("c1", 1, 0))
+	s := newTestTaskService(repo)
+
+	// The result is stored between the cancel's read and its write
+	repo.afterRead = func() {
+		if _, err := s.CompleteCommand(1, "c1", true, "out", ""); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := s.CancelCommand("c1"); !errors.Is(err, ErrCommandAlreadyFinished) {
+		t.Fatalf("err = %v, want %v", err, ErrCommandAlreadyFinished)
+	}
+	got := repo.get("c1")
+	if got.Status != domain.CommandStatusCompleted || got.Result != "out" || got.CompletedAt == nil {
+		t.Fatalf("stored = %s %q, want the result kept", got.Status, got.Result)
+	}
+	if queued, _ := repo.GetPendingByNodeID(context.Background(), 1); len(queued) != 0 {
+		t.Fatalf("queued %s for a finished command", queued[0].Type)
+	}
+
+	// Whichever lands first, a successful result is never lost
+	for i := 0; i < 100; i++ {
+		repo := newFakeCommandRepo(processingCommand("c1", 1, 0))
+		s := newTestTaskService(repo)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.CancelCommand("c1")
+		}()
+		go func() {
+			defer wg.Done()
+			s.CompleteCommand(1, "c1", true, "out", "")
+		}()
+		wg.Wait()
+		if got := repo.get("c1"); got.Status != domain.CommandStatusCompleted || got.Result != "out" {
+			t.Fatalf("run %d: stored = %s %q, want completed", i, got.Status, got.Result)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+)
+
+// timelineEvent is one entry for a resource's timeline
+type timelineEvent struct {
+	Type         string
+	Status       domain.EventStatus
+	ResourceType string
+	ResourceID   uint
+	Message      string
+	Meta         map[string]interface{}
+}
+
+// recordTimelineEvent stores e on the timeline. The timeline is best effort:
+// without a repository nothing is recorded, and a failed write is logged
+// rather than failing the caller.
+func recordTimelineEvent(ctx context.Context, repo ports.TimelineRepository, log *logger.Logger, e timelineEvent) {
+	if repo == nil {
+		return
+	}
+	rid := e.ResourceID
+	event := &domain.TimelineEvent{
+		Type:         e.Type,
+		Status:       e.Status,
+		Message:      e.Message,
+		Meta:         domain.JSONB(e.Meta),
+		ResourceID:   &rid,
+		ResourceType: e.ResourceType,
+		CreatedAt:    time.Now(),
+	}
+	if err := repo.Create(ctx, event); err != nil {
+		log.Errorw("timeline_event_failed", "type", e.Type, "resource_type", e.ResourceType, "resource_id", e.ResourceID, "error", err)
+	}
+}
@@ -2,10 +2,12 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"net"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +17,7 @@ import (
 	"github.com/netly/backend/internal/domain"
 	"github.com/netly/backend/internal/domain/singbox"
 	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
 )
 
 type tunnelService struct {
@@ -26,6 +29,7 @@ type tunnelService struct {
 	taskService  ports.TaskService
 	logger       *logger.Logger
 	timelineRepo ports.TimelineRepository
+	firewall     *FirewallService
 	mu           sync.Mutex
 	locks        map[string]*sync.Mutex
 }
@@ -39,6 +43,8 @@ type TunnelServiceConfig struct {
 	TaskService  ports.TaskService
 	Logger       *logger.Logger
 	TimelineRepo ports.TimelineRepository
+	// Firewall, when set, opens and closes the tunnels' ports on the nodes
+	Firewall *FirewallService
 }
 
 func NewTunnelService(cfg TunnelServiceConfig) ports.TunnelService {
@@ -51,6 +57,7 @@ func NewTunnelService(cfg TunnelServiceConfig) ports.TunnelService {
 		taskService:  cfg.TaskService,
 		logger:       cfg.Logger,
 		timelineRepo: cfg.TimelineRepo,
+		firewall:     cfg.Firewall,
 		locks:        make(map[string]*sync.Mutex),
 	}
 }
@@ -272,72 +279,45 @@ func (s *tunnelService) CreateTunnel(ctx context.Context, input ports.CreateTunn
 			// clientWGIP = x.x.x.2/30 (for source/client)
 
 			// Server config (Dest Node) - gets serverWGIP (.1)
-			serverConf := fmt.Sprintf(`[Interface]
-PrivateKey = %s
-Address = %s
-ListenPort = %d
-PostUp = iptables -A FORWARD -i %%i -j ACCEPT; iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
-PostDown = iptables -D FORWARD -i %%i -j ACCEPT; iptables -t nat -D POSTROUTING -o eth0 -j MASQUERADE
-
-[Peer]
-PublicKey = %s
-AllowedIPs = %s/32
-Endpoint = %s:%d
-PersistentKeepalive = 25`,
-				destNode.WireGuardPrivateKey,
-				serverWGIP, // Server gets .1/30
-				destPort,
-				sourceNode.WireGuardPublicKey,
-				clientIPOnly, // Allow traffic from client's IP
-				sourceEndpointIP,
-				sourcePort)
+			serverConf := singbox.WireGuardConfig{
+				Interface: singbox.WireGuardInterface{
+					PrivateKey: destNode.WireGuardPrivateKey,
+					Address:    []string{serverWGIP}, // Server gets .1/30
+					ListenPort: destPort,
+					Forward:    true,
+					Masquerade: true,
+				},
+				Peers: []singbox.WireGuardPeer{{
+					PublicKey:           sourceNode.WireGuardPublicKey,
+					AllowedIPs:          []string{clientIPOnly + "/32"}, // Allow traffic from client's IP
+					Endpoint:            net.JoinHostPort(sourceEndpointIP, strconv.Itoa(sourcePort)),
+					PersistentKeepalive: 25,
+				}},
+			}
 
 			s.logger.Infow("wireguard_server_config",
 				"dest_node_id", destNode.ID,
 				"server_wg_ip", serverWGIP,
 				"peer_allowed_ip", clientIPOnly+"/32",
-				"peer_endpoint", fmt.Sprintf("%s:%d", sourceEndpointIP, sourcePort))
-
-			// Escape and Dispatch
-			escapedContent := strings.ReplaceAll(serverConf, "'", "'\\''")
-			script := fmt.Sprintf("sudo systemctl stop wg-quick@wg0 2>/dev/null || true && echo '%s' | sudo tee /etc/wireguard/wg0.conf > /dev/null && sudo chmod 600 /etc/wireguard/wg0.conf && sudo systemctl enable --now wg-quick@wg0", escapedContent)
+				"peer_endpoint", net.JoinHostPort(sourceEndpointIP, strconv.Itoa(sourcePort)))
 
-			destPayload := domain.JSONB{
-				"script":      script,
-				"interpreter": "sh",
-			}
-			if _, err := s.taskService.CreateCommand(input.DestNodeID, domain.CmdExecuteScript, destPayload); err != nil {
-				s.logger.Errorw("failed to dispatch command to dest node", "node_id", input.DestNodeID, "error", err)
-			} else {
-				s.logger.Infow("dispatched CMD_EXECUTE_SCRIPT to dest node (WG)", "node_id", input.DestNodeID)
-			}
+			s.dispatchWireGuard(tunnel, input.DestNodeID, "dest", wireguardStep(wireguardInterface(tunnel.ID, ""), serverConf))
 		} else {
-			// Sing-Box/Others: Use ApplyConfig
-			destPayload := domain.JSONB{
-				"target_path": "/etc/sing-box/config.json", // Defaulting path for now, or should be dynamic?
-				// User prompt didn't specify path for SingBox, but existing code used /etc/wireguard/wg0.conf for EVERYTHING which was wrong for SingBox
-				// However, if I change it now, I might break something else.
-				// BUT the code at line 221 hardcoded "/etc/wireguard/wg0.conf".
-				// If protocol is SingBox, writing to wg0.conf is definitely wrong.
-				// Assuming standard singbox path or sticking to what was there (which was wrong but maybe "working" in user's mind until panic?)
-				// Let's use a safe default if it's not wireguard.
-				"content":      inboundContent,
-				"service_name": "sing-box", // Assumed service name
-				"enable":       true,
-				"tunnel_id":    tunnel.ID,
-				"role":         "server",
-			}
-			// Adjust path based on protocol if needed
-			if input.Protocol != "wireguard" {
-				destPayload["target_path"] = "/etc/sing-box/config.json"
-			} else {
-				destPayload["target_path"] = "/etc/wireguard/wg0.conf"
-			}
-
-			if _, err := s.taskService.CreateCommand(input.DestNodeID, domain.CmdApplyConfig, destPayload); err != nil {
-				s.logger.Errorw("failed to dispatch command to dest node", "node_id", input.DestNodeID, "error", err)
+			// Sing-Box/Others: the inbound becomes this tunnel's fragment of the
+			// node's sing-box config, next to whatever else the node serves
+			inbound, err := withSingBoxTag(inboundContent, singBoxKey(tunnel.ID)+"-in")
+			if err != nil {
+				s.logger.Errorw("failed to build sing-box fragment", "tunnel_id", tunnel.ID, "protocol", input.Protocol, "error", err)
 			} else {
-				s.logger.Infow("dispatched CMD_APPLY_CONFIG to dest node", "node_id", input.DestNodeID)
+				destPayload := toJSONB(protocol.SingBoxApplyPayload{
+					Key:             singBoxKey(tunnel.ID),
+					SingBoxFragment: protocol.SingBoxFragment{Inbounds: []json.RawMessage{inbound}},
+				})
+				if _, err := s.taskService.CreateCommand(input.DestNodeID, domain.CmdSingBoxApply, destPayload, tunnelCommandOptions(tunnel.ID, "dest", destPayload)); err != nil {
+					s.logger.Errorw("failed to dispatch command to dest node", "node_id", input.DestNodeID, "error", err)
+				} else {
+					s.logger.Infow("dispatched CMD_SINGBOX_APPLY to dest node", "node_id", input.DestNodeID)
+				}
 			}
 		}
 
@@ -347,44 +327,29 @@ PersistentKeepalive = 25`,
 			// CRITICAL: Client gets DIFFERENT IP than server!
 
 			// Client config - connects to server
-			clientConf := fmt.Sprintf(`[Interface]
-PrivateKey = %s
-Address = %s
-ListenPort = %d
-PostUp = iptables -A FORWARD -i %%i -j ACCEPT; iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
-PostDown = iptables -D FORWARD -i %%i -j ACCEPT; iptables -t nat -D POSTROUTING -o eth0 -j MASQUERADE
-
-[Peer]
-PublicKey = %s
-AllowedIPs = %s/32
-Endpoint = %s:%d
-PersistentKeepalive = 25`,
-				sourceNode.WireGuardPrivateKey,
-				clientWGIP, // Client gets .2/30
-				sourcePort,
-				destNode.WireGuardPublicKey,
-				serverIPOnly, // Allow traffic from server's IP
-				destEndpointIP,
-				destPort)
+			clientConf := singbox.WireGuardConfig{
+				Interface: singbox.WireGuardInterface{
+					PrivateKey: sourceNode.WireGuardPrivateKey,
+					Address:    []string{clientWGIP}, // Client gets .2/30
+					ListenPort: sourcePort,
+					Forward:    true,
+					Masquerade: true,
+				},
+				Peers: []singbox.WireGuardPeer{{
+					PublicKey:           destNode.WireGuardPublicKey,
+					AllowedIPs:          []string{serverIPOnly + "/32"}, // Allow traffic from server's IP
+					Endpoint:            net.JoinHostPort(destEndpointIP, strconv.Itoa(destPort)),
+					PersistentKeepalive: 25,
+				}},
+			}
 
 			s.logger.Infow("wireguard_client_config",
 				"source_node_id", sourceNode.ID,
 				"client_wg_ip", clientWGIP,
 				"peer_allowed_ip", serverIPOnly+"/32",
-				"peer_endpoint", fmt.Sprintf("%s:%d", destEndpointIP, destPort))
+				"peer_endpoint", net.JoinHostPort(destEndpointIP, strconv.Itoa(destPort)))
 
-			escapedContent := strings.ReplaceAll(clientConf, "'", "'\\''")
-			script := fmt.Sprintf("sudo systemctl stop wg-quick@wg0 2>/dev/null || true && echo '%s' | sudo tee /etc/wireguard/wg0.conf > /dev/null && sudo chmod 600 /etc/wireguard/wg0.conf && sudo systemctl enable --now wg-quick@wg0", escapedContent)
-
-			sourcePayload := domain.JSONB{
-				"script":      script,
-				"interpreter": "sh",
-			}
-			if _, err := s.taskService.CreateCommand(input.SourceNodeID, domain.CmdExecuteScript, sourcePayload); err != nil {
-				s.logger.Errorw("failed to dispatch command to source node", "node_id", input.SourceNodeID, "error", err)
-			} else {
-				s.logger.Infow("dispatched CMD_EXECUTE_SCRIPT to source node (WG)", "node_id", input.SourceNodeID)
-			}
+			s.dispatchWireGuard(tunnel, input.SourceNodeID, "source", wireguardStep(wireguardInterface(tunnel.ID, ""), clientConf))
 		} else {
 			// For SingBox Client, ClientConfig is a URL/Link (vless://...).
 			// We probably don't "ApplyConfig" this to a file? Or do we?
@@ -407,23 +372,24 @@ PersistentKeepalive = 25`,
 				"tunnel_id":   tunnel.ID,
 				"role":        "client",
 			}
-			s.taskService.CreateCommand(input.SourceNodeID, domain.CmdApplyConfig, sourcePayload)
+			s.taskService.CreateCommand(input.SourceNodeID, domain.CmdApplyConfig, sourcePayload, tunnelCommandOptions(tunnel.ID, "source", sourcePayload))
 		}
 	}
 
+	if s.firewall != nil {
+		s.firewall.SyncNodes(ctx, input.SourceNodeID, input.DestNodeID)
+	}
+
 	s.logTunnelEvent(ctx, &tunnel.ID, domain.EventTypeTunnelDispatch, domain.EventStatusPending, "Commands queued for Agents", map[string]interface{}{
 		"source_node_id": input.SourceNodeID,
 		"dest_node_id":   input.DestNodeID,
 	})
 
-	tunnel.Status = domain.TunnelStatusActive
+	// The tunnel stays pending; the health service makes it active once its
+	// nodes report the interfaces and listeners up
 	if err := s.tunnelRepo.Update(ctx, tunnel); err != nil {
-		s.logger.Errorw("failed to update tunnel status", "id", tunnel.ID, "error", err)
+		s.logger.Errorw("failed to update tunnel", "id", tunnel.ID, "error", err)
 	}
-	s.logTunnelEvent(ctx, &tunnel.ID, domain.EventTypeTunnelReady, domain.EventStatusSuccess, "Tunnel is active", map[string]interface{}{
-		"source_node_id": input.SourceNodeID,
-		"dest_node_id":   input.DestNodeID,
-	})
 	s.logger.Infow("tunnel_create_step", "step", "persist", "duration_ms", time.Since(step).Milliseconds(), "elapsed_ms", time.Since(start).Milliseconds())
 	s.logger.Infow("tunnel_create_done", "tunnel_id", tunnel.ID, "total_ms", time.Since(start).Milliseconds())
 
@@ -596,10 +562,11 @@ func (s *tunnelService) CreateChain(ctx context.Context, entryID, relayID, exitI
 		Hops:         hops,
 		Segments:     segments,
 		Config: domain.JSONB{
-			"entry_config": chainConfig.EntryConfig,
-			"relay_config": chainConfig.RelayConfig,
-			"exit_config":  chainConfig.ExitConfig,
-			"metadata":     chainConfig.Metadata,
+			"entry_config":        chainConfig.EntryConfig,
+			"relay_config":        chainConfig.RelayConfig,
+			"relay_uplink_config": chainConfig.RelayUplinkConfig,
+			"exit_config":         chainConfig.ExitConfig,
+			"metadata":            chainConfig.Metadata,
 		},
 		Nodes: domain.JSONB{"nodes": []uint{entryID, relayID, exitID}},
 	}
@@ -613,38 +580,24 @@ func (s *tunnelService) CreateChain(ctx context.Context, entryID, relayID, exitI
 		return nil, err
 	}
 
-	// ==================== DISPATCH COMMANDS TO AGENTS (CHAIN) ====================
 	// ==================== DISPATCH COMMANDS TO AGENTS (CHAIN) ====================
 	if s.taskService != nil {
+		segmentA, segmentB := wireguardInterface(tunnel.ID, "a"), wireguardInterface(tunnel.ID, "b")
+
 		// Entry Node (WG Client)
-		escapedEntry := strings.ReplaceAll(chainConfig.EntryConfig, "'", "'\\''")
-		entryScript := fmt.Sprintf("echo '%s' | sudo tee /etc/wireguard/wg0.conf && sudo systemctl enable --now wg-quick@wg0", escapedEntry)
-		s.taskService.CreateCommand(entryID, domain.CmdExecuteScript, domain.JSONB{"script": entryScript, "interpreter": "sh"})
-
-		// Relay Node
-		if strings.Contains(chainConfig.RelayConfig, "---SPLIT---") {
-			parts := strings.Split(chainConfig.RelayConfig, "\n\n---SPLIT---\n\n")
-			if len(parts) >= 2 {
-				// wg0
-				esc0 := strings.ReplaceAll(parts[0], "'", "'\\''")
-				script0 := fmt.Sprintf("echo '%s' | sudo tee /etc/wireguard/wg0.conf && sudo systemctl enable --now wg-quick@wg0", esc0)
-				s.taskService.CreateCommand(relayID, domain.CmdExecuteScript, domain.JSONB{"script": script0, "interpreter": "sh"})
-
-				// wg1
-				esc1 := strings.ReplaceAll(parts[1], "'", "'\\''")
-				script1 := fmt.Sprintf("echo '%s' | sudo tee /etc/wireguard/wg1.conf && sudo systemctl enable --now wg-quick@wg1", esc1)
-				s.taskService.CreateCommand(relayID, domain.CmdExecuteScript, domain.JSONB{"script": script1, "interpreter": "sh"})
-			}
-		} else {
-			esc := strings.ReplaceAll(chainConfig.RelayConfig, "'", "'\\''")
-			script := fmt.Sprintf("echo '%s' | sudo tee /etc/wireguard/wg0.conf && sudo systemctl enable --now wg-quick@wg0", esc)
-			s.taskService.CreateCommand(relayID, domain.CmdExecuteScript, domain.JSONB{"script": script, "interpreter": "sh"})
-		}
+		s.dispatchWireGuard(tunnel, entryID, "entry", wireguardStep(segmentA, chainConfig.EntryConfig))
+
+		// Relay Node: both segments go up together or not at all
+		s.dispatchWireGuard(tunnel, relayID, "relay",
+			wireguardStep(segmentA, chainConfig.RelayConfig),
+			wireguardStep(segmentB, chainConfig.RelayUplinkConfig))
 
 		// Exit Node (WG Server)
-		escapedExit := strings.ReplaceAll(chainConfig.ExitConfig, "'", "'\\''")
-		exitScript := fmt.Sprintf("echo '%s' | sudo tee /etc/wireguard/wg0.conf && sudo systemctl enable --now wg-quick@wg0", escapedExit)
-		s.taskService.CreateCommand(exitID, domain.CmdExecuteScript, domain.JSONB{"script": exitScript, "interpreter": "sh"})
+		s.dispatchWireGuard(tunnel, exitID, "exit", wireguardStep(segmentB, chainConfig.ExitConfig))
+	}
+
+	if s.firewall != nil {
+		s.firewall.SyncNodes(ctx, relayID, exitID)
 	}
 
 	s.logTunnelEvent(ctx, &tunnel.ID, domain.EventTypeTunnelDispatch, domain.EventStatusPending, "Commands queued for Agents", map[string]interface{}{
@@ -653,15 +606,10 @@ func (s *tunnelService) CreateChain(ctx context.Context, entryID, relayID, exitI
 		"exit_id":  exitID,
 	})
 
-	tunnel.Status = domain.TunnelStatusActive
+	// Pending until the health service sees every hop up
 	if err := s.tunnelRepo.Update(ctx, tunnel); err != nil {
-		s.logger.Errorw("failed to update chain tunnel status", "id", tunnel.ID, "error", err)
+		s.logger.Errorw("failed to update chain tunnel", "id", tunnel.ID, "error", err)
 	}
-	s.logTunnelEvent(ctx, &tunnel.ID, domain.EventTypeTunnelReady, domain.EventStatusSuccess, "Tunnel is active", map[string]interface{}{
-		"entry_id": entryID,
-		"relay_id": relayID,
-		"exit_id":  exitID,
-	})
 
 	return tunnel, nil
 }
@@ -688,6 +636,16 @@ func (s *tunnelService) DeleteTunnel(ctx context.Context, id uint) error {
 	)
 	defer unlock()
 
+	// Take the interfaces and listeners down before their IPs and ports can be
+	// handed out again
+	if s.taskService != nil {
+		if tunnel.Type == domain.TunnelTypeChain || tunnel.Protocol == domain.TunnelProtocolWireGuard {
+			s.removeWireGuard(tunnel)
+		} else {
+			s.removeSingBox(tunnel)
+		}
+	}
+
 	// Release IPs
 	if err := s.ipam.ReleaseIPs(ctx, tunnel.InternalIPv4, tunnel.InternalIPv6); err != nil {
 		s.logger.Warnw("failed to release ips", "error", err)
@@ -701,7 +659,15 @@ func (s *tunnelService) DeleteTunnel(ctx context.Context, id uint) error {
 		s.logger.Warnw("failed to release dest port", "error", err)
 	}
 
-	return s.tunnelRepo.Delete(ctx, id)
+	if err := s.tunnelRepo.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	// With the tunnel gone its ports drop out of the nodes' sets
+	if s.firewall != nil {
+		s.firewall.SyncNodes(ctx, tunnelNodes(*tunnel)...)
+	}
+	return nil
 }
 
 // Helpers
@@ -786,3 +752,150 @@ func (s *tunnelService) lockKeys(keys ...string) func() {
 		}
 	}
 }
+
+// wireguardInterface names the interface a tunnel runs on its nodes, with a
+// chain's segment appended. Every tunnel has interfaces of its own, so taking
+// one down never touches another tunnel.
+func wireguardInterface(tunnelID uint, segment string) string {
+	return fmt.Sprintf("wg%d%s", tunnelID, segment)
+}
+
+// wireguardStep applies a WireGuard interface from its typed config. The
+// agent renders the file itself and leaves the interface alone if nothing
+// changed.
+func wireguardStep(iface string, cfg singbox.WireGuardConfig) domain.BatchStep {
+	return domain.BatchStep{
+		Type:    domain.CmdWGApplyInterface,
+		Payload: toJSONB(protocol.WireGuardApplyPayload{Interface: iface, Config: cfg}),
+	}
+}
+
+// wireguardLeg is an interface a tunnel brought up on a node
+type wireguardLeg struct {
+	NodeID    uint   `json:"node_id"`
+	Interface string `json:"interface"`
+}
+
+// wireguardLegs reads the legs recorded in the tunnel's config
+func wireguardLegs(tunnel *domain.Tunnel) []wireguardLeg {
+	raw, ok := tunnel.Config["wireguard"]
+	if !ok {
+		return nil
+	}
+	data, _ := json.Marshal(raw)
+	var legs []wireguardLeg
+	if err := json.Unmarshal(data, &legs); err != nil {
+		return nil
+	}
+	return legs
+}
+
+// recordWireGuardLegs adds the interfaces the steps bring up on the node to
+// the tunnel's config, which is saved with the tunnel
+func recordWireGuardLegs(tunnel *domain.Tunnel, nodeID uint, steps []domain.BatchStep) {
+	legs := wireguardLegs(tunnel)
+	added := false
+	for _, step := range steps {
+		if step.Type != domain.CmdWGApplyInterface {
+			continue
+		}
+		data, _ := json.Marshal(step.Payload)
+		var apply protocol.WireGuardApplyPayload
+		if err := json.Unmarshal(data, &apply); err != nil {
+			continue
+		}
+		legs = append(legs, wireguardLeg{NodeID: nodeID, Interface: apply.Interface})
+		added = true
+	}
+	if !added {
+		return
+	}
+	if tunnel.Config == nil {
+		tunnel.Config = domain.JSONB{}
+	}
+	tunnel.Config["wireguard"] = legs
+}
+
+// removeWireGuard queues the removal of the interfaces the tunnel brought
+// up, one command per node
+func (s *tunnelService) removeWireGuard(tunnel *domain.Tunnel) {
+	legs := wireguardLegs(tunnel)
+	if len(legs) == 0 {
+		s.logger.Warnw("tunnel_remove_no_interfaces", "tunnel_id", tunnel.ID)
+		return
+	}
+
+	var nodes []uint
+	byNode := make(map[uint][]domain.BatchStep)
+	for _, leg := range legs {
+		if _, ok := byNode[leg.NodeID]; !ok {
+			nodes = append(nodes, leg.NodeID)
+		}
+		step := domain.BatchStep{
+			Type:    domain.CmdWGRemoveInterface,
+			Payload: toJSONB(protocol.WireGuardRemovePayload{Interface: leg.Interface}),
+		}
+		byNode[leg.NodeID] = append(byNode[leg.NodeID], step)
+	}
+	for _, nodeID := range nodes {
+		s.dispatchWireGuard(tunnel, nodeID, "remove", byNode[nodeID]...)
+	}
+}
+
+// singBoxKey names a tunnel's fragment in the node's sing-box registry
+func singBoxKey(tunnelID uint) string {
+	return fmt.Sprintf("tunnel-%d", tunnelID)
+}
+
+// withSingBoxTag sets the tag of a sing-box object. Tags must be unique per
+// node, and the factory's defaults are not.
+func withSingBoxTag(content, tag string) (json.RawMessage, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &obj); err != nil {
+		return nil, fmt.Errorf("inbound is not a sing-box object: %w", err)
+	}
+	obj["tag"] = tag
+	return json.Marshal(obj)
+}
+
+// removeSingBox queues the removal of the tunnel's sing-box fragment
+func (s *tunnelService) removeSingBox(tunnel *domain.Tunnel) {
+	payload := toJSONB(protocol.SingBoxRemovePayload{Key: singBoxKey(tunnel.ID)})
+	if _, err := s.taskService.CreateCommand(tunnel.DestNodeID, domain.CmdSingBoxRemove, payload, tunnelCommandOptions(tunnel.ID, "dest-remove", payload)); err != nil {
+		s.logger.Errorw("failed to dispatch sing-box removal", "node_id", tunnel.DestNodeID, "tunnel_id", tunnel.ID, "error", err)
+	}
+}
+
+func toJSONB(v interface{}) domain.JSONB {
+	raw, _ := json.Marshal(v)
+	var out domain.JSONB
+	_ = json.Unmarshal(raw, &out)
+	return out
+}
+
+// tunnelCommandOptions keys a tunnel's command by tunnel, role and payload so
+// a retried create never queues the same configuration twice, while a changed
+// configuration always gets a command of its own
+func tunnelCommandOptions(tunnelID uint, role string, payload domain.JSONB) ports.CommandOptions {
+	data, _ := json.Marshal(payload)
+	sum := sha256.Sum256(data)
+	return ports.CommandOptions{
+		IdempotencyKey: fmt.Sprintf("tunnel-%d-%s-%x", tunnelID, role, sum[:8]),
+	}
+}
+
+// dispatchWireGuard queues the steps for a node: a single step as its own
+// command, several as one CMD_BATCH so they are applied together or not at
+// all. The interfaces the steps bring up are recorded on the tunnel.
+func (s *tunnelService) dispatchWireGuard(tunnel *domain.Tunnel, nodeID uint, role string, steps ...domain.BatchStep) {
+	recordWireGuardLegs(tunnel, nodeID, steps)
+	cmdType, payload := steps[0].Type, steps[0].Payload
+	if len(steps) > 1 {
+		cmdType, payload = domain.CmdBatch, domain.NewBatchPayload(steps...)
+	}
+	if _, err := s.taskService.CreateCommand(nodeID, cmdType, payload, tunnelCommandOptions(tunnel.ID, role, payload)); err != nil {
+		s.logger.Errorw("failed to dispatch wireguard command", "node_id", nodeID, "type", cmdType, "steps", len(steps), "error", err)
+		return
+	}
+	s.logger.Infow("dispatched wireguard command", "node_id", nodeID, "type", cmdType, "steps", len(steps))
+}
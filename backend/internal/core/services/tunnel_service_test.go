@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/core/services/factory"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type fakeTunnelRepo struct {
+	ports.TunnelRepository
+	tunnels map[uint]domain.Tunnel
+	next    uint
+}
+
+func (r *fakeTunnelRepo) Create(ctx context.Context, tunnel *domain.Tunnel) error {
+	r.next++
+	tunnel.ID = r.next
+	r.tunnels[tunnel.ID] = *tunnel
+	return nil
+}
+
+func (r *fakeTunnelRepo) GetByID(ctx context.Context, id uint) (*domain.Tunnel, error) {
+	tunnel, ok := r.tunnels[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &tunnel, nil
+}
+
+func (r *fakeTunnelRepo) Update(ctx context.Context, tunnel *domain.Tunnel) error {
+	r.tunnels[tunnel.ID] = *tunnel
+	return nil
+}
+
+func (r *fakeTunnelRepo) Delete(ctx context.Context, id uint) error {
+	delete(r.tunnels, id)
+	return nil
+}
+
+// fakeIPAM hands out a fresh /30 per tunnel
+type fakeIPAM struct {
+	next int
+}
+
+func (a *fakeIPAM) AllocateTunnelIPs(ctx context.Context) (string, string, error) {
+	a.next++
+	return fmt.Sprintf("10.10.%d.0/30", a.next), fmt.Sprintf("fd00:%d::/64", a.next), nil
+}
+
+func (a *fakeIPAM) ReleaseIPs(ctx context.Context, ipv4, ipv6 string) error {
+	return nil
+}
+
+type fakePortAM struct {
+	ports.PortAMService
+	next int
+}
+
+func (a *fakePortAM) ReservePort(ctx context.Context, nodeID uint, protocol string) (int, error) {
+	a.next++
+	return 51820 + a.next, nil
+}
+
+func (a *fakePortAM) ReleasePort(ctx context.Context, nodeID uint, port int, protocol string) error {
+	return nil
+}
+
+// wireguardInterfaces lists the interfaces named by the node's commands of
+// one type
+func wireguardInterfaces(t *testing.T, repo *fakeCommandRepo, nodeID uint, cmdType domain.CommandType) []string {
+	t.Helper()
+	cmds, err := repo.List(context.Background(), ports.CommandFilter{NodeID: nodeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, cmd := range cmds {
+		if cmd.Type == cmdType {
+			out = append(out, fmt.Sprint(cmd.Payload["interface"]))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestDeleteTunnelKeepsOtherTunnels(t *testing.T) {
+	commands := newFakeCommandRepo()
+	svc := NewTunnelService(TunnelServiceConfig{
+		TunnelRepo:  &fakeTunnelRepo{tunnels: make(map[uint]domain.Tunnel)},
+		NodeRepo:    fakeNodeRepo{},
+		IPAM:        &fakeIPAM{},
+		PortAM:      &fakePortAM{},
+		Factory:     factory.NewFactoryService(),
+		TaskService: newTestTaskService(commands),
+		Logger:      &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+	})
+	ctx := context.Background()
+
+	// Node 1 is the source of both tunnels
+	first, err := svc.CreateTunnel(ctx, ports.CreateTunnelInput{Name: "a", Protocol: domain.TunnelProtocolWireGuard, SourceNodeID: 1, DestNodeID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.CreateTunnel(ctx, ports.CreateTunnelInput{Name: "b", Protocol: domain.TunnelProtocolWireGuard, SourceNodeID: 1, DestNodeID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstIface, secondIface := wireguardInterface(first.ID, ""), wireguardInterface(second.ID, "")
+	if got := wireguardInterfaces(t, commands, 1, domain.CmdWGApplyInterface); fmt.Sprint(got) != fmt.Sprint([]string{firstIface, secondIface}) {
+		t.Fatalf("node 1 applied %v, want an interface per tunnel", got)
+	}
+
+	if err := svc.DeleteTunnel(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		nodeID uint
+		want   []string
+	}{
+		{1, []string{firstIface}},
+		{2, []string{firstIface}},
+		{3, nil},
+	}
+	for _, tt := range tests {
+		got := wireguardInterfaces(t, commands, tt.nodeID, domain.CmdWGRemoveInterface)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Fatalf("node %d removed %v, want %v", tt.nodeID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package domain
+
+import "time"
+
+// AgentCertificate records a client certificate issued to a node by the
+// internal CA. The certificate itself lives on the node; only its serial and
+// validity are kept here so it can be listed and revoked.
+type AgentCertificate struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	NodeID    uint       `gorm:"not null;index" json:"node_id"`
+	Serial    string     `gorm:"size:64;not null;uniqueIndex" json:"serial"`
+	NotBefore time.Time  `json:"not_before"`
+	NotAfter  time.Time  `json:"not_after"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
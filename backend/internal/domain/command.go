@@ -6,13 +6,23 @@ import "time"
 type CommandType string
 
 const (
-	CmdInstallService   CommandType = "CMD_INSTALL_SERVICE"
-	CmdUninstallService CommandType = "CMD_UNINSTALL_SERVICE"
-	CmdRestartService   CommandType = "CMD_RESTART_SERVICE"
-	CmdStopService      CommandType = "CMD_STOP_SERVICE"
-	CmdUpdateConfig     CommandType = "CMD_UPDATE_CONFIG"
-	CmdExecuteScript    CommandType = "CMD_EXECUTE_SCRIPT"
-	CmdApplyConfig      CommandType = "CMD_APPLY_CONFIG"
+	CmdInstallService    CommandType = "CMD_INSTALL_SERVICE"
+	CmdUninstallService  CommandType = "CMD_UNINSTALL_SERVICE"
+	CmdRestartService    CommandType = "CMD_RESTART_SERVICE"
+	CmdStopService       CommandType = "CMD_STOP_SERVICE"
+	CmdUpdateConfig      CommandType = "CMD_UPDATE_CONFIG"
+	CmdExecuteScript     CommandType = "CMD_EXECUTE_SCRIPT"
+	CmdApplyConfig       CommandType = "CMD_APPLY_CONFIG"
+	CmdBatch             CommandType = "CMD_BATCH"
+	CmdUpdateAgent       CommandType = "CMD_UPDATE_AGENT"
+	CmdWGApplyInterface  CommandType = "CMD_WG_APPLY_INTERFACE"
+	CmdWGRemoveInterface CommandType = "CMD_WG_REMOVE_INTERFACE"
+	CmdSingBoxApply      CommandType = "CMD_SINGBOX_APPLY"
+	CmdSingBoxRemove     CommandType = "CMD_SINGBOX_REMOVE"
+	CmdFirewallSync      CommandType = "CMD_FIREWALL_SYNC"
+	CmdRollbackConfig    CommandType = "CMD_ROLLBACK_CONFIG"
+	CmdProbe             CommandType = "CMD_PROBE"
+	CmdCancel            CommandType = "CMD_CANCEL"
 )
 
 // CommandStatus represents the current status of a command
@@ -23,23 +33,59 @@ const (
 	CommandStatusProcessing CommandStatus = "processing"
 	CommandStatusCompleted  CommandStatus = "completed"
 	CommandStatusFailed     CommandStatus = "failed"
+	CommandStatusExpired    CommandStatus = "expired"
+	CommandStatusCancelled  CommandStatus = "cancelled"
 )
 
+// Finished reports whether the command has reached a final status
+func (s CommandStatus) Finished() bool {
+	switch s {
+	case CommandStatusCompleted, CommandStatusFailed, CommandStatusExpired, CommandStatusCancelled:
+		return true
+	}
+	return false
+}
+
 // Command represents a command to be dispatched to an agent
 type Command struct {
-	ID        string        `json:"id"`
-	NodeID    uint          `json:"node_id"`
-	Type      CommandType   `json:"type"`
-	Status    CommandStatus `json:"status"`
-	Payload   JSONB         `json:"payload"`
-	Result    string        `json:"result,omitempty"`
-	Error     string        `json:"error,omitempty"`
-	CreatedAt time.Time     `json:"created_at"`
-	UpdatedAt time.Time     `json:"updated_at"`
+	ID        string        `gorm:"primaryKey;size:36" json:"id"`
+	NodeID    uint          `gorm:"not null;index" json:"node_id"`
+	Type      CommandType   `gorm:"size:50;not null" json:"type"`
+	Status    CommandStatus `gorm:"size:20;not null;default:'pending';index" json:"status"`
+	Payload   JSONB         `gorm:"type:jsonb" json:"payload"`
+	Result    string        `gorm:"type:text" json:"result,omitempty"`
+	Error     string        `gorm:"type:text" json:"error,omitempty"`
+
+	// Ordering and expiry; higher priority is delivered first
+	Priority       int        `gorm:"default:0" json:"priority"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	IdempotencyKey string     `gorm:"size:128" json:"idempotency_key,omitempty"`
+	// Timeout is how many seconds the agent lets the command run; zero
+	// leaves it to the agent
+	Timeout int `gorm:"default:0" json:"timeout,omitempty"`
+
+	// Delivery tracking
+	Attempts     int        `gorm:"default:0" json:"attempts"`
+	MaxAttempts  int        `gorm:"default:3" json:"max_attempts"`
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	AckedAt      *time.Time `json:"acked_at,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	// CancelRequestedAt is set once an operator asked to stop the command
+	// while its agent had it
+	CancelRequestedAt *time.Time `json:"cancel_requested_at,omitempty"`
+
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// BatchStep is one step of a CMD_BATCH command. The agent runs the steps in
+// order and rolls all of them back if any step fails.
+type BatchStep struct {
+	Type    CommandType `json:"type"`
+	Payload JSONB       `json:"payload"`
 }
 
-// HeartbeatResponse represents the response sent to agents during heartbeat
-type HeartbeatResponse struct {
-	Status   string     `json:"status"`
-	Commands []*Command `json:"commands,omitempty"`
+// NewBatchPayload builds the payload for a CMD_BATCH command
+func NewBatchPayload(steps ...BatchStep) JSONB {
+	return JSONB{"steps": steps}
 }
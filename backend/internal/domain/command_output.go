@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// CommandOutputChunk is one numbered piece of the output an agent streamed
+// while a command ran. A chunk the agent resends is stored once.
+type CommandOutputChunk struct {
+	ID        uint   `gorm:"primaryKey" json:"-"`
+	CommandID string `gorm:"size:36;not null;uniqueIndex:idx_command_output_chunks_seq" json:"command_id"`
+	Seq       int    `gorm:"not null;uniqueIndex:idx_command_output_chunks_seq" json:"seq"`
+	Stream    string `gorm:"size:10;not null" json:"stream"`
+	Data      string `gorm:"type:text" json:"data"`
+	// ProducedAt is when the agent read the output
+	ProducedAt time.Time `json:"produced_at"`
+}
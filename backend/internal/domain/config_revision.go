@@ -0,0 +1,20 @@
+package domain
+
+import "time"
+
+// ConfigRevision is a version of a managed file that an agent kept after a
+// command wrote it. The agent names it; a revision several commands left the
+// same is recorded once, with the first of them.
+type ConfigRevision struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	NodeID    uint      `gorm:"not null;uniqueIndex:idx_config_revisions_node_path_rev" json:"node_id"`
+	Path      string    `gorm:"size:512;not null;uniqueIndex:idx_config_revisions_node_path_rev" json:"path"`
+	Revision  string    `gorm:"size:64;not null;uniqueIndex:idx_config_revisions_node_path_rev" json:"revision"`
+	Digest    string    `gorm:"size:64" json:"digest"`
+	Unit      string    `gorm:"size:255" json:"unit,omitempty"`
+	// Content is left out of listings
+	Content     string      `gorm:"type:text" json:"content,omitempty"`
+	CommandID   string      `gorm:"size:36;index" json:"command_id"`
+	CommandType CommandType `gorm:"size:50" json:"command_type"`
+}
@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"strings"
+	"time"
+)
+
+// ManagedFile is a file an agent wrote on the backend's behalf. The intended
+// digest and unit state are what the last command that wrote it left on the
+// node; the actual ones come from the agent's periodic drift report.
+type ManagedFile struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	NodeID    uint      `gorm:"not null;uniqueIndex:idx_managed_files_node_path" json:"node_id"`
+	Path      string    `gorm:"size:512;not null;uniqueIndex:idx_managed_files_node_path" json:"path"`
+	Unit      string    `gorm:"size:255" json:"unit,omitempty"`
+
+	IntendedDigest    string `gorm:"size:64" json:"intended_digest"`
+	IntendedUnitState string `gorm:"size:64" json:"intended_unit_state,omitempty"`
+	// CommandID is the command that last wrote the file; re-applying queues
+	// it again. Empty when the file was adopted from the node as found.
+	CommandID   string      `gorm:"size:36" json:"command_id,omitempty"`
+	CommandType CommandType `gorm:"size:50" json:"command_type,omitempty"`
+
+	ActualDigest    string     `gorm:"size:64" json:"actual_digest"`
+	ActualUnitState string     `gorm:"size:64" json:"actual_unit_state,omitempty"`
+	Drifted         bool       `gorm:"not null;default:false" json:"drifted"`
+	DriftedAt       *time.Time `json:"drifted_at,omitempty"`
+	CheckedAt       *time.Time `json:"checked_at,omitempty"`
+}
+
+// InSync reports whether the node still has the file as intended: the same
+// content, and its unit running or not running as it was left. Sub-states
+// such as "running" versus "exited" are not compared, and a unit the agent
+// could not query counts as unchanged.
+func (f *ManagedFile) InSync() bool {
+	if f.ActualDigest != f.IntendedDigest {
+		return false
+	}
+	if f.Unit == "" || f.IntendedUnitState == "" || f.ActualUnitState == "" || f.ActualUnitState == "unknown" {
+		return true
+	}
+	return unitRunning(f.ActualUnitState) == unitRunning(f.IntendedUnitState)
+}
+
+// unitRunning reads the "active/running" style state the agent reports;
+// a unit starting or reloading counts as running
+func unitRunning(state string) bool {
+	active, _, _ := strings.Cut(state, "/")
+	return active == "active" || active == "activating" || active == "reloading"
+}
@@ -60,6 +60,15 @@ const (
 	ServiceProtocolTUIC     ServiceProtocol = "tuic"
 )
 
+// ServiceHealth is derived from the components the node's agent reports
+type ServiceHealth string
+
+const (
+	ServiceHealthUnknown ServiceHealth = "unknown"
+	ServiceHealthHealthy ServiceHealth = "healthy"
+	ServiceHealthDown    ServiceHealth = "down"
+)
+
 type RoutingMode string
 
 const (
@@ -114,9 +123,14 @@ type Node struct {
 	Status   NodeStatus `gorm:"size:20;not null;default:'pending'" json:"status"`
 	AuthData string     `gorm:"type:text" json:"-"`
 	GeoData  JSONB      `gorm:"type:jsonb" json:"geo_data"`
-	Stats    JSONB      `gorm:"type:jsonb" json:"stats"` // Added Stats field
+	Stats    JSONB      `gorm:"type:jsonb" json:"stats"`            // Added Stats field
+	Health   JSONB      `gorm:"type:jsonb" json:"health,omitempty"` // Managed components from the last heartbeat
 	IsActive bool       `gorm:"default:true" json:"is_active"`
 
+	// ConfigDrift is set while a managed file on the node differs from what
+	// the backend last wrote there
+	ConfigDrift bool `gorm:"default:false" json:"config_drift"`
+
 	// WireGuard Keys
 	WireGuardPrivateKey string `gorm:"type:text" json:"-"`
 	WireGuardPublicKey  string `gorm:"size:255" json:"wireguard_public_key,omitempty"`
@@ -127,6 +141,10 @@ type Node struct {
 	// Last error log for debugging
 	LastLog string `gorm:"type:text" json:"last_log,omitempty"`
 
+	// Agent credentials: only the SHA-256 of the issued token is stored
+	AgentTokenHash     string     `gorm:"size:64" json:"-"`
+	AgentTokenIssuedAt *time.Time `json:"agent_token_issued_at,omitempty"`
+
 	// Relationships
 	SourceTunnels []Tunnel  `gorm:"foreignKey:SourceNodeID" json:"source_tunnels,omitempty"`
 	DestTunnels   []Tunnel  `gorm:"foreignKey:DestNodeID" json:"dest_tunnels,omitempty"`
@@ -171,6 +189,7 @@ type Service struct {
 	RoutingMode  RoutingMode     `gorm:"size:20;not null;default:'direct'" json:"routing_mode"`
 	Config       JSONB           `gorm:"type:jsonb" json:"config"`
 	TotalTraffic int64           `gorm:"default:0" json:"total_traffic"`
+	Health       ServiceHealth   `gorm:"size:20;not null;default:'unknown'" json:"health"`
 
 	// Relationships
 	NodeID uint  `gorm:"not null;index" json:"node_id"`
@@ -194,6 +213,10 @@ type TimelineEvent struct {
 type SystemSettings struct {
 	SSHPrivateKey          string
 	SSHPublicKey           string
+	AgentSigningKey        string
+	AgentVerifyKey         string
+	AgentCACert            string
+	AgentCAKey             string
 	CloudflareToken        string
 	CloudflareEmail        string
 	CloudflareGlobalKey    string
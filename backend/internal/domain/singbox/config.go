@@ -1,5 +1,7 @@
 package singbox
 
+import "github.com/netly/protocol"
+
 // Config represents the root Sing-box configuration
 type Config struct {
 	Log       *LogConfig    `json:"log,omitempty"`
@@ -144,26 +146,14 @@ type MultiplexConfig struct {
 	Brutal  bool `json:"brutal,omitempty"`
 }
 
-// WireGuard specific structures
+// WireGuard specific structures. They are shared with the agent, which
+// renders the wg-quick file from them.
 
-// WireGuardConfig represents a WireGuard configuration file
-type WireGuardConfig struct {
-	Interface WireGuardInterface `json:"interface"`
-	Peers     []WireGuardPeer    `json:"peers"`
-}
+// WireGuardConfig represents a WireGuard interface and its peers
+type WireGuardConfig = protocol.WireGuardConfig
 
-type WireGuardInterface struct {
-	PrivateKey string   `json:"private_key"`
-	Address    []string `json:"address"`
-	ListenPort int      `json:"listen_port,omitempty"`
-	MTU        int      `json:"mtu,omitempty"`
-	DNS        []string `json:"dns,omitempty"`
-}
+type WireGuardInterface = protocol.WireGuardInterface
 
-type WireGuardPeer struct {
-	PublicKey           string   `json:"public_key"`
-	PresharedKey        string   `json:"preshared_key,omitempty"`
-	Endpoint            string   `json:"endpoint,omitempty"`
-	AllowedIPs          []string `json:"allowed_ips"`
-	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
-}
+type WireGuardSourceRoute = protocol.WireGuardSourceRoute
+
+type WireGuardPeer = protocol.WireGuardPeer
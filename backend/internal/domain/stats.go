@@ -0,0 +1,13 @@
+package domain
+
+import "time"
+
+// NodeStatsSample is one heartbeat stats sample kept for a node's history.
+// Samples an agent buffered while the backend was unreachable arrive late but
+// keep the time they were collected, and a resent sample is stored once.
+type NodeStatsSample struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	NodeID      uint      `gorm:"not null;uniqueIndex:idx_node_stats_samples_node_time" json:"node_id"`
+	CollectedAt time.Time `gorm:"not null;uniqueIndex:idx_node_stats_samples_node_time" json:"collected_at"`
+	Stats       JSONB     `gorm:"type:jsonb" json:"stats"`
+}
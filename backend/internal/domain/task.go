@@ -3,12 +3,12 @@ package domain
 import "time"
 
 type Task struct {
-	ID        string    `json:"id"`
-	Type      string    `json:"type"` // e.g., "INSTALL_AGENT"
-	Status    string    `json:"status"` // pending, running, completed, failed
-	Progress  int       `json:"progress"` // 0-100
-	Message   string    `json:"message"`
-	Error     string    `json:"error,omitempty"`
+	ID        string    `gorm:"primaryKey;size:36" json:"id"`
+	Type      string    `gorm:"size:100;not null" json:"type"`                    // e.g., "INSTALL_AGENT"
+	Status    string    `gorm:"size:20;not null;default:'pending'" json:"status"` // pending, running, completed, failed
+	Progress  int       `gorm:"default:0" json:"progress"`                        // 0-100
+	Message   string    `gorm:"type:text" json:"message"`
+	Error     string    `gorm:"type:text" json:"error,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -10,3 +10,25 @@ const (
     EventTypeTunnelFailed   = "TUNNEL_FAILED"
 )
 
+
+// Node component health event types
+const (
+    EventTypeComponentDown      = "COMPONENT_DOWN"
+    EventTypeComponentRecovered = "COMPONENT_RECOVERED"
+    EventTypeServiceDown        = "SERVICE_DOWN"
+    EventTypeServiceRecovered   = "SERVICE_RECOVERED"
+)
+
+// Configuration drift event types
+const (
+    EventTypeConfigDrift         = "CONFIG_DRIFT"
+    EventTypeConfigDriftResolved = "CONFIG_DRIFT_RESOLVED"
+    EventTypeConfigReapplied     = "CONFIG_REAPPLIED"
+    EventTypeConfigAdopted       = "CONFIG_ADOPTED"
+    EventTypeConfigRollback      = "CONFIG_ROLLBACK"
+)
+
+// Agent lifecycle event types
+const (
+    EventTypeAgentDestruct = "AGENT_DESTRUCT"
+)
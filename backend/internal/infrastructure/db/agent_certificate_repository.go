@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"gorm.io/gorm"
+)
+
+type agentCertificateRepository struct {
+	db  *gorm.DB
+	log *logger.Logger
+}
+
+func NewAgentCertificateRepository(db *gorm.DB, log *logger.Logger) ports.AgentCertificateRepository {
+	return &agentCertificateRepository{db: db, log: log}
+}
+
+func (r *agentCertificateRepository) Create(ctx context.Context, cert *domain.AgentCertificate) error {
+	if err := r.db.WithContext(ctx).Create(cert).Error; err != nil {
+		r.log.Errorw("agent_cert_repo_create_failed", "node_id", cert.NodeID, "serial", cert.Serial, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (r *agentCertificateRepository) ListByNode(ctx context.Context, nodeID uint) ([]domain.AgentCertificate, error) {
+	var certs []domain.AgentCertificate
+	if err := r.db.WithContext(ctx).Where("node_id = ?", nodeID).Order("created_at desc").Find(&certs).Error; err != nil {
+		r.log.Errorw("agent_cert_repo_list_failed", "node_id", nodeID, "error", err)
+		return nil, err
+	}
+	return certs, nil
+}
+
+// ListRevoked returns revoked certificates that have not expired yet; expired
+// ones are rejected by the TLS layer anyway
+func (r *agentCertificateRepository) ListRevoked(ctx context.Context) ([]domain.AgentCertificate, error) {
+	var certs []domain.AgentCertificate
+	if err := r.db.WithContext(ctx).Where("revoked_at IS NOT NULL AND not_after > ?", time.Now()).Find(&certs).Error; err != nil {
+		r.log.Errorw("agent_cert_repo_list_revoked_failed", "error", err)
+		return nil, err
+	}
+	return certs, nil
+}
+
+// RevokeByNode revokes every live certificate of the node and returns them
+func (r *agentCertificateRepository) RevokeByNode(ctx context.Context, nodeID uint) ([]domain.AgentCertificate, error) {
+	var certs []domain.AgentCertificate
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("node_id = ? AND revoked_at IS NULL", nodeID).Find(&certs).Error; err != nil {
+			return err
+		}
+		if len(certs) == 0 {
+			return nil
+		}
+		now := time.Now()
+		for i := range certs {
+			certs[i].RevokedAt = &now
+		}
+		return tx.Model(&domain.AgentCertificate{}).
+			Where("node_id = ? AND revoked_at IS NULL", nodeID).
+			Update("revoked_at", now).Error
+	})
+	if err != nil {
+		r.log.Errorw("agent_cert_repo_revoke_failed", "node_id", nodeID, "error", err)
+		return nil, err
+	}
+	return certs, nil
+}
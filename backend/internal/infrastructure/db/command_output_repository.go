@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type commandOutputRepository struct {
+	db  *gorm.DB
+	log *logger.Logger
+}
+
+func NewCommandOutputRepository(db *gorm.DB, log *logger.Logger) ports.CommandOutputRepository {
+	return &commandOutputRepository{db: db, log: log}
+}
+
+// Append stores chunks, skipping any the agent already delivered
+func (r *commandOutputRepository) Append(ctx context.Context, chunks []domain.CommandOutputChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	if err := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&chunks).Error; err != nil {
+		r.log.Errorw("command_output_repo_append_failed", "command_id", chunks[0].CommandID, "count", len(chunks), "error", err)
+		return err
+	}
+	return nil
+}
+
+// ListAfter returns the command's chunks numbered above afterSeq, in order
+func (r *commandOutputRepository) ListAfter(ctx context.Context, commandID string, afterSeq int, limit int) ([]domain.CommandOutputChunk, error) {
+	var chunks []domain.CommandOutputChunk
+	if err := r.db.WithContext(ctx).
+		Where("command_id = ? AND seq > ?", commandID, afterSeq).
+		Order("seq asc").
+		Limit(limit).
+		Find(&chunks).Error; err != nil {
+		r.log.Errorw("command_output_repo_list_failed", "command_id", commandID, "error", err)
+		return nil, err
+	}
+	return chunks, nil
+}
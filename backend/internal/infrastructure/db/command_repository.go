@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"gorm.io/gorm"
+)
+
+type commandRepository struct {
+	db  *gorm.DB
+	log *logger.Logger
+}
+
+func NewCommandRepository(db *gorm.DB, log *logger.Logger) ports.CommandRepository {
+	return &commandRepository{db: db, log: log}
+}
+
+func (r *commandRepository) Create(ctx context.Context, cmd *domain.Command) error {
+	if err := r.db.WithContext(ctx).Create(cmd).Error; err != nil {
+		r.log.Errorw("command_repo_create_failed", "node_id", cmd.NodeID, "type", cmd.Type, "error", err)
+		return err
+	}
+	r.log.Infow("command_repo_create_ok", "id", cmd.ID, "node_id", cmd.NodeID, "type", cmd.Type)
+	return nil
+}
+
+func (r *commandRepository) GetByID(ctx context.Context, id string) (*domain.Command, error) {
+	var cmd domain.Command
+	if err := r.db.WithContext(ctx).Where("id = ?", id).First(&cmd).Error; err != nil {
+		r.log.Errorw("command_repo_get_failed", "id", id, "error", err)
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+func (r *commandRepository) GetByIdempotencyKey(ctx context.Context, nodeID uint, key string) (*domain.Command, error) {
+	var cmd domain.Command
+	if err := r.db.WithContext(ctx).Where("node_id = ? AND idempotency_key = ? AND status IN ?", nodeID, key,
+		[]domain.CommandStatus{domain.CommandStatusPending, domain.CommandStatusProcessing}).First(&cmd).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			r.log.Errorw("command_repo_get_by_key_failed", "node_id", nodeID, "key", key, "error", err)
+		}
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+func (r *commandRepository) GetPendingByNodeID(ctx context.Context, nodeID uint) ([]*domain.Command, error) {
+	var cmds []*domain.Command
+	if err := r.db.WithContext(ctx).
+		Where("node_id = ? AND status = ?", nodeID, domain.CommandStatusPending).
+		Order("priority desc, created_at asc").
+		Find(&cmds).Error; err != nil {
+		r.log.Errorw("command_repo_get_pending_failed", "node_id", nodeID, "error", err)
+		return nil, err
+	}
+	return cmds, nil
+}
+
+func (r *commandRepository) List(ctx context.Context, filter ports.CommandFilter) ([]*domain.Command, error) {
+	query := r.db.WithContext(ctx).Order("created_at desc")
+	if filter.NodeID != 0 {
+		query = query.Where("node_id = ?", filter.NodeID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var cmds []*domain.Command
+	if err := query.Find(&cmds).Error; err != nil {
+		r.log.Errorw("command_repo_list_failed", "node_id", filter.NodeID, "status", filter.Status, "error", err)
+		return nil, err
+	}
+	r.log.Infow("command_repo_list_ok", "count", len(cmds))
+	return cmds, nil
+}
+
+func (r *commandRepository) GetStaleProcessing(ctx context.Context, dispatchedBefore time.Time) ([]*domain.Command, error) {
+	var cmds []*domain.Command
+	if err := r.db.WithContext(ctx).
+		Where("status = ? AND dispatched_at < ?", domain.CommandStatusProcessing, dispatchedBefore).
+		Find(&cmds).Error; err != nil {
+		r.log.Errorw("command_repo_get_stale_failed", "error", err)
+		return nil, err
+	}
+	return cmds, nil
+}
+
+func (r *commandRepository) Update(ctx context.Context, cmd *domain.Command) error {
+	if err := r.db.WithContext(ctx).Save(cmd).Error; err != nil {
+		r.log.Errorw("command_repo_update_failed", "id", cmd.ID, "error", err)
+		return err
+	}
+	r.log.Infow("command_repo_update_ok", "id", cmd.ID, "status", cmd.Status, "attempts", cmd.Attempts)
+	return nil
+}
+
+func (r *commandRepository) UpdateIfStatus(ctx context.Context, cmd *domain.Command, from domain.CommandStatus) (bool, error) {
+	res := r.db.WithContext(ctx).Model(cmd).Where("status = ?", from).Select("*").Updates(cmd)
+	if res.Error != nil {
+		r.log.Errorw("command_repo_update_if_status_failed", "id", cmd.ID, "from", from, "error", res.Error)
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		r.log.Warnw("command_repo_update_if_status_lost", "id", cmd.ID, "from", from, "status", cmd.Status)
+		return false, nil
+	}
+	r.log.Infow("command_repo_update_ok", "id", cmd.ID, "status", cmd.Status, "attempts", cmd.Attempts)
+	return true, nil
+}
+
+func (r *commandRepository) UpdateStatus(ctx context.Context, id string, status domain.CommandStatus, result string, errStr string) error {
+	res := r.db.WithContext(ctx).Model(&domain.Command{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":     status,
+		"result":     result,
+		"error":      errStr,
+		"updated_at": time.Now(),
+	})
+	if res.Error != nil {
+		r.log.Errorw("command_repo_update_status_failed", "id", id, "status", status, "error", res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	r.log.Infow("command_repo_update_status_ok", "id", id, "status", status)
+	return nil
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type configRevisionRepository struct {
+	db  *gorm.DB
+	log *logger.Logger
+}
+
+func NewConfigRevisionRepository(db *gorm.DB, log *logger.Logger) ports.ConfigRevisionRepository {
+	return &configRevisionRepository{db: db, log: log}
+}
+
+// Create stores a revision; one already recorded for the file is kept as is
+func (r *configRevisionRepository) Create(ctx context.Context, rev *domain.ConfigRevision) error {
+	if err := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(rev).Error; err != nil {
+		r.log.Errorw("config_revision_repo_create_failed", "node_id", rev.NodeID, "path", rev.Path, "revision", rev.Revision, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (r *configRevisionRepository) Get(ctx context.Context, nodeID uint, path, revision string) (*domain.ConfigRevision, error) {
+	var rev domain.ConfigRevision
+	if err := r.db.WithContext(ctx).
+		Where("node_id = ? AND path = ? AND revision = ?", nodeID, path, revision).
+		First(&rev).Error; err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// ListByNode returns the node's newest revisions across all files, without
+// their content
+func (r *configRevisionRepository) ListByNode(ctx context.Context, nodeID uint, limit int) ([]domain.ConfigRevision, error) {
+	var revs []domain.ConfigRevision
+	if err := r.db.WithContext(ctx).
+		Omit("content").
+		Where("node_id = ?", nodeID).
+		Order("revision desc").
+		Limit(limit).
+		Find(&revs).Error; err != nil {
+		r.log.Errorw("config_revision_repo_list_failed", "node_id", nodeID, "error", err)
+		return nil, err
+	}
+	return revs, nil
+}
+
+// ListByFile returns every revision of the file, newest first
+func (r *configRevisionRepository) ListByFile(ctx context.Context, nodeID uint, path string) ([]domain.ConfigRevision, error) {
+	var revs []domain.ConfigRevision
+	if err := r.db.WithContext(ctx).
+		Where("node_id = ? AND path = ?", nodeID, path).
+		Order("revision desc").
+		Find(&revs).Error; err != nil {
+		r.log.Errorw("config_revision_repo_list_file_failed", "node_id", nodeID, "path", path, "error", err)
+		return nil, err
+	}
+	return revs, nil
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type managedFileRepository struct {
+	db  *gorm.DB
+	log *logger.Logger
+}
+
+func NewManagedFileRepository(db *gorm.DB, log *logger.Logger) ports.ManagedFileRepository {
+	return &managedFileRepository{db: db, log: log}
+}
+
+// Upsert stores the file, replacing the row kept for the same node and path
+func (r *managedFileRepository) Upsert(ctx context.Context, file *domain.ManagedFile) error {
+	if file.ID != 0 {
+		if err := r.db.WithContext(ctx).Save(file).Error; err != nil {
+			r.log.Errorw("managed_file_repo_upsert_failed", "node_id", file.NodeID, "path", file.Path, "error", err)
+			return err
+		}
+		return nil
+	}
+	if err := r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "node_id"}, {Name: "path"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"updated_at", "unit", "intended_digest", "intended_unit_state", "command_id", "command_type",
+			"actual_digest", "actual_unit_state", "drifted", "drifted_at", "checked_at",
+		}),
+	}).Create(file).Error; err != nil {
+		r.log.Errorw("managed_file_repo_upsert_failed", "node_id", file.NodeID, "path", file.Path, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (r *managedFileRepository) Get(ctx context.Context, nodeID uint, path string) (*domain.ManagedFile, error) {
+	var file domain.ManagedFile
+	if err := r.db.WithContext(ctx).Where("node_id = ? AND path = ?", nodeID, path).First(&file).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// ListByNode returns the node's managed files sorted by path
+func (r *managedFileRepository) ListByNode(ctx context.Context, nodeID uint) ([]domain.ManagedFile, error) {
+	var files []domain.ManagedFile
+	if err := r.db.WithContext(ctx).Where("node_id = ?", nodeID).Order("path asc").Find(&files).Error; err != nil {
+		r.log.Errorw("managed_file_repo_list_failed", "node_id", nodeID, "error", err)
+		return nil, err
+	}
+	return files, nil
+}
+
+func (r *managedFileRepository) Delete(ctx context.Context, nodeID uint, path string) error {
+	if err := r.db.WithContext(ctx).Where("node_id = ? AND path = ?", nodeID, path).Delete(&domain.ManagedFile{}).Error; err != nil {
+		r.log.Errorw("managed_file_repo_delete_failed", "node_id", nodeID, "path", path, "error", err)
+		return err
+	}
+	return nil
+}
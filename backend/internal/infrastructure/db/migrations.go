@@ -15,6 +15,13 @@ func RunMigrations(db *gorm.DB) error {
 		&domain.SystemSetting{},
 		&domain.IPAllocation{},
 		&domain.PortAllocation{},
+		&domain.Task{},
+		&domain.Command{},
+		&domain.AgentCertificate{},
+		&domain.NodeStatsSample{},
+		&domain.CommandOutputChunk{},
+		&domain.ManagedFile{},
+		&domain.ConfigRevision{},
 	)
 	if err != nil {
 		return err
@@ -56,5 +63,26 @@ func createCustomIndexes(db *gorm.DB) error {
 		return err
 	}
 
+	// Index for agents polling their command queue
+	if err := db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_commands_node_status
+		ON commands (node_id, status, created_at)
+	`).Error; err != nil {
+		return err
+	}
+
+	// One open command per idempotency key and node; once it has finished the
+	// key is free for the next change
+	if err := db.Exec(`DROP INDEX IF EXISTS idx_commands_idempotency`).Error; err != nil {
+		return err
+	}
+	if err := db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_commands_idempotency_open
+		ON commands (node_id, idempotency_key)
+		WHERE idempotency_key <> '' AND status IN ('pending', 'processing')
+	`).Error; err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"time"
 
 	"github.com/netly/backend/internal/core/ports"
 	"github.com/netly/backend/internal/domain"
@@ -90,6 +91,34 @@ func (r *nodeRepository) UpdateLastLog(ctx context.Context, id uint, log string)
 	return nil
 }
 
+func (r *nodeRepository) UpdateHealth(ctx context.Context, id uint, health domain.JSONB) error {
+	if err := r.db.WithContext(ctx).Model(&domain.Node{}).Where("id = ?", id).Update("health", health).Error; err != nil {
+		r.log.Errorw("node_repo_update_health_failed", "id", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (r *nodeRepository) UpdateConfigDrift(ctx context.Context, id uint, drifted bool) error {
+	if err := r.db.WithContext(ctx).Model(&domain.Node{}).Where("id = ?", id).Update("config_drift", drifted).Error; err != nil {
+		r.log.Errorw("node_repo_update_config_drift_failed", "id", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (r *nodeRepository) UpdateAgentTokenHash(ctx context.Context, id uint, hash string) error {
+	now := time.Now()
+	if err := r.db.WithContext(ctx).Model(&domain.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"agent_token_hash":      hash,
+		"agent_token_issued_at": &now,
+	}).Error; err != nil {
+		r.log.Errorw("node_repo_update_agent_token_failed", "id", id, "error", err)
+		return err
+	}
+	return nil
+}
+
 func (r *nodeRepository) Restore(ctx context.Context, node *domain.Node) error {
 	node.DeletedAt = gorm.DeletedAt{}
 	if err := r.db.WithContext(ctx).Unscoped().Save(node).Error; err != nil {
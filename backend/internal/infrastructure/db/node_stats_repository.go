@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type nodeStatsRepository struct {
+	db  *gorm.DB
+	log *logger.Logger
+}
+
+func NewNodeStatsRepository(db *gorm.DB, log *logger.Logger) ports.NodeStatsRepository {
+	return &nodeStatsRepository{db: db, log: log}
+}
+
+// CreateBatch stores samples, skipping any the node already reported
+func (r *nodeStatsRepository) CreateBatch(ctx context.Context, samples []domain.NodeStatsSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	if err := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&samples).Error; err != nil {
+		r.log.Errorw("node_stats_repo_create_failed", "node_id", samples[0].NodeID, "count", len(samples), "error", err)
+		return err
+	}
+	return nil
+}
+
+// ListByNode returns the node's samples collected after since, oldest first
+func (r *nodeStatsRepository) ListByNode(ctx context.Context, nodeID uint, since time.Time, limit int) ([]domain.NodeStatsSample, error) {
+	var samples []domain.NodeStatsSample
+	if err := r.db.WithContext(ctx).
+		Where("node_id = ? AND collected_at > ?", nodeID, since).
+		Order("collected_at asc").
+		Limit(limit).
+		Find(&samples).Error; err != nil {
+		r.log.Errorw("node_stats_repo_list_failed", "node_id", nodeID, "error", err)
+		return nil, err
+	}
+	return samples, nil
+}
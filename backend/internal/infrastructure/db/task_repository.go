@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"gorm.io/gorm"
+)
+
+type taskRepository struct {
+	db  *gorm.DB
+	log *logger.Logger
+}
+
+func NewTaskRepository(db *gorm.DB, log *logger.Logger) ports.TaskRepository {
+	return &taskRepository{db: db, log: log}
+}
+
+func (r *taskRepository) Create(ctx context.Context, task *domain.Task) error {
+	if err := r.db.WithContext(ctx).Create(task).Error; err != nil {
+		r.log.Errorw("task_repo_create_failed", "type", task.Type, "error", err)
+		return err
+	}
+	r.log.Infow("task_repo_create_ok", "id", task.ID, "type", task.Type)
+	return nil
+}
+
+func (r *taskRepository) GetByID(ctx context.Context, id string) (*domain.Task, error) {
+	var task domain.Task
+	if err := r.db.WithContext(ctx).Where("id = ?", id).First(&task).Error; err != nil {
+		r.log.Errorw("task_repo_get_failed", "id", id, "error", err)
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (r *taskRepository) Update(ctx context.Context, task *domain.Task) error {
+	if err := r.db.WithContext(ctx).Save(task).Error; err != nil {
+		r.log.Errorw("task_repo_update_failed", "id", task.ID, "error", err)
+		return err
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package db
 
 import (
     "context"
+    "fmt"
 
     "github.com/netly/backend/internal/core/ports"
     "github.com/netly/backend/internal/domain"
@@ -42,7 +43,8 @@ func (r *tunnelRepository) GetByID(ctx context.Context, id uint) (*domain.Tunnel
 func (r *tunnelRepository) GetByNodeID(ctx context.Context, nodeID uint) ([]domain.Tunnel, error) {
     var tunnels []domain.Tunnel
     if err := r.db.WithContext(ctx).
-        Where("source_node_id = ? OR dest_node_id = ?", nodeID, nodeID).
+        // A chain's relay is neither its source nor its dest, only a hop
+        Where("source_node_id = ? OR dest_node_id = ? OR hops -> 'nodes' @> ?::jsonb", nodeID, nodeID, fmt.Sprintf("[%d]", nodeID)).
         Find(&tunnels).Error; err != nil {
         r.log.Errorw("tunnel_repo_get_by_node_failed", "node_id", nodeID, "error", err)
         return nil, err
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -89,7 +90,7 @@ func (c *SSHClient) ConnectWithRetry() (*ssh.Client, error) {
 		},
 	}
 
-	addr := fmt.Sprintf("%s:%d", c.config.Host, c.config.Port)
+	addr := net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.Port))
 	var client *ssh.Client
 	var connectErr error
 
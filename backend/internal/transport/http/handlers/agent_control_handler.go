@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/backend/internal/transport/http/dto"
+	"github.com/netly/protocol"
+)
+
+// AgentControlHandler lets admins reach the control API of a node's agent
+// and takes the progress reports of a self-destruct it started
+type AgentControlHandler struct {
+	service   *services.AgentControlService
+	agentAuth *services.AgentAuthService
+	logger    *logger.Logger
+}
+
+func NewAgentControlHandler(service *services.AgentControlService, agentAuth *services.AgentAuthService, logger *logger.Logger) *AgentControlHandler {
+	return &AgentControlHandler{service: service, agentAuth: agentAuth, logger: logger}
+}
+
+// Status returns what the agent reports about itself
+func (h *AgentControlHandler) Status(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	status, err := h.service.Status(c.Context(), uint(nodeID))
+	if err != nil {
+		return h.controlError(c, uint(nodeID), err)
+	}
+	return c.JSON(status)
+}
+
+// Diagnostics runs the agent's local checks
+func (h *AgentControlHandler) Diagnostics(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	diag, err := h.service.Diagnostics(c.Context(), uint(nodeID))
+	if err != nil {
+		return h.controlError(c, uint(nodeID), err)
+	}
+	return c.JSON(diag)
+}
+
+// SelfDestruct asks the agent to wipe the node. Progress shows up on the
+// node's timeline.
+func (h *AgentControlHandler) SelfDestruct(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	h.logger.Infow("agent_destruct_request", "node_id", nodeID)
+	if err := h.service.SelfDestruct(c.Context(), uint(nodeID)); err != nil {
+		return h.controlError(c, uint(nodeID), err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"status": protocol.DestructAccepted})
+}
+
+// ReportDestructProgress receives a self-destruct stage from an agent
+func (h *AgentControlHandler) ReportDestructProgress(c *fiber.Ctx) error {
+	nodeID, err := nodeIDFromAuth(c, h.agentAuth)
+	if err != nil {
+		h.logger.Warnw("agent_destruct_progress_unauthorized", "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req protocol.DestructProgress
+	if err := c.BodyParser(&req); err != nil || req.Stage == "" {
+		h.logger.Warnw("agent_destruct_progress_body_parse_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	h.service.RecordDestructProgress(c.Context(), nodeID, req)
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+func (h *AgentControlHandler) controlError(c *fiber.Ctx, nodeID uint, err error) error {
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrAgentControlDisabled):
+		return c.Status(fiber.StatusServiceUnavailable).JSON(dto.ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrAgentControlUnreachable), errors.Is(err, services.ErrAgentControlRejected):
+		return c.Status(fiber.StatusBadGateway).JSON(dto.ErrorResponse{Error: err.Error()})
+	default:
+		h.logger.Errorw("agent_control_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+}
@@ -2,14 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
-	"strconv"
+	"errors"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/netly/backend/internal/core/ports"
 	"github.com/netly/backend/internal/core/services"
 	"github.com/netly/backend/internal/domain"
 	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
 )
 
 type AgentHandler struct {
@@ -17,37 +19,27 @@ type AgentHandler struct {
 	taskService ports.TaskService
 	logger      *logger.Logger
 	keyManager  *services.KeyManager
+	agentAuth   *services.AgentAuthService
+	health      *services.HealthService
+	settings    *services.SystemSettingService
+	drift       *services.DriftService
+	history     *services.ConfigHistoryService
 }
 
-func NewAgentHandler(nodeService ports.NodeService, taskService ports.TaskService, logger *logger.Logger, keyManager *services.KeyManager) *AgentHandler {
+func NewAgentHandler(nodeService ports.NodeService, taskService ports.TaskService, logger *logger.Logger, keyManager *services.KeyManager, agentAuth *services.AgentAuthService, health *services.HealthService, settings *services.SystemSettingService, drift *services.DriftService, history *services.ConfigHistoryService) *AgentHandler {
 	return &AgentHandler{
 		nodeService: nodeService,
 		taskService: taskService,
 		logger:      logger,
 		keyManager:  keyManager,
+		agentAuth:   agentAuth,
+		health:      health,
+		settings:    settings,
+		drift:       drift,
+		history:     history,
 	}
 }
 
-type SystemStats struct {
-	CPUUsage    float64 `json:"cpu_usage"`
-	RAMUsage    float64 `json:"ram_usage"`
-	RAMTotal    uint64  `json:"ram_total"`
-	RAMUsed     uint64  `json:"ram_used"`
-	Uptime      uint64  `json:"uptime"`
-	NetworkRx   uint64  `json:"network_rx"`
-	NetworkTx   uint64  `json:"network_tx"`
-	Hostname    string  `json:"hostname"`
-	OS          string  `json:"os"`
-	Platform    string  `json:"platform"`
-	CollectedAt int64   `json:"collected_at"`
-}
-
-type HeartbeatRequest struct {
-	Stats        *SystemStats `json:"stats"`
-	AgentVersion string       `json:"agent_version"`
-	Timestamp    int64        `json:"timestamp"`
-}
-
 type RegisterNodeRequest struct {
 	Token string `json:"token"`
 }
@@ -64,21 +56,14 @@ func (h *AgentHandler) RegisterNode(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Token is required"})
 	}
 
-	// Validate token format: node-token-{id}
-	if !strings.HasPrefix(req.Token, "node-token-") {
-		h.logger.Warnw("register_node_invalid_token_format", "token", req.Token)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token format"})
-	}
-
-	nodeIDStr := strings.TrimPrefix(req.Token, "node-token-")
-	nodeID, err := strconv.Atoi(nodeIDStr)
+	nodeID, err := h.agentAuth.Authenticate(c.Context(), req.Token)
 	if err != nil {
-		h.logger.Warnw("register_node_invalid_node_id", "value", nodeIDStr)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid node ID in token"})
+		h.logger.Warnw("register_node_invalid_token", "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token"})
 	}
 
 	// Verify node exists
-	node, err := h.nodeService.GetNodeByID(c.Context(), uint(nodeID))
+	node, err := h.nodeService.GetNodeByID(c.Context(), nodeID)
 	if err != nil {
 		h.logger.Warnw("register_node_not_found", "node_id", nodeID)
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token"})
@@ -97,45 +82,35 @@ func (h *AgentHandler) RegisterNode(c *fiber.Ctx) error {
 }
 
 func (h *AgentHandler) Heartbeat(c *fiber.Ctx) error {
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		h.logger.Warnw("agent_heartbeat_missing_auth")
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Missing authorization header"})
-	}
-
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		h.logger.Warnw("agent_heartbeat_invalid_auth_header")
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid authorization header"})
-	}
-
-	token := parts[1]
-	if !strings.HasPrefix(token, "node-token-") {
-		h.logger.Warnw("agent_heartbeat_invalid_token_format")
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token format"})
-	}
-
-	nodeIDStr := strings.TrimPrefix(token, "node-token-")
-	nodeID, err := strconv.Atoi(nodeIDStr)
+	nodeID, err := nodeIDFromAuth(c, h.agentAuth)
 	if err != nil {
-		h.logger.Warnw("agent_heartbeat_invalid_node_id", "value", nodeIDStr)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid node ID in token"})
+		h.logger.Warnw("agent_heartbeat_unauthorized", "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	var req HeartbeatRequest
+	var req protocol.HeartbeatRequest
 	if err := c.BodyParser(&req); err != nil {
 		h.logger.Warnw("agent_heartbeat_body_parse_failed", "error", err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
+	version, err := protocol.Negotiate(req.ProtocolVersion)
+	if err != nil {
+		h.logger.Warnw("agent_heartbeat_unsupported_protocol", "node_id", nodeID, "protocol_version", req.ProtocolVersion, "agent_version", req.AgentVersion)
+		return c.Status(fiber.StatusUpgradeRequired).JSON(protocol.HeartbeatResponse{
+			Status:          protocol.StatusUnsupportedVersion,
+			Message:         err.Error(),
+			ProtocolVersion: protocol.Version,
+		})
+	}
+
 	if req.Stats == nil {
 		h.logger.Warnw("agent_heartbeat_missing_stats", "node_id", nodeID)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing stats"})
 	}
 
-	statsJSON, _ := json.Marshal(req.Stats)
-	var statsMap domain.JSONB
-	json.Unmarshal(statsJSON, &statsMap)
+	sample := statsSample(*req.Stats)
+	statsMap := sample.Stats
 
 	h.logger.Infow("agent_heartbeat_received",
 		"node_id", nodeID,
@@ -147,37 +122,256 @@ func (h *AgentHandler) Heartbeat(c *fiber.Ctx) error {
 		"hostname", req.Stats.Hostname,
 	)
 
-	if err := h.nodeService.UpdateNodeStats(c.Context(), uint(nodeID), statsMap); err != nil {
+	if err := h.nodeService.UpdateNodeStats(c.Context(), nodeID, statsMap); err != nil {
 		h.logger.Errorw("agent_heartbeat_update_failed", "node_id", nodeID, "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
+	if err := h.nodeService.RecordStatsSamples(c.Context(), nodeID, []domain.NodeStatsSample{sample}); err != nil {
+		// History is secondary to the live stats; don't fail the heartbeat
+		h.logger.Warnw("agent_heartbeat_history_failed", "node_id", nodeID, "error", err)
+	}
+	// Agents that predate health reporting send no components at all
+	if h.health != nil && req.Components != nil {
+		if err := h.health.RecordComponentHealth(c.Context(), nodeID, req.Components); err != nil {
+			h.logger.Warnw("agent_heartbeat_health_failed", "node_id", nodeID, "error", err)
+		}
+	}
+	// Managed files are only reported every drift interval
+	if h.drift != nil && req.Files != nil {
+		h.drift.RecordReport(c.Context(), nodeID, req.Files)
+	}
+
+	// Settings are loaded before any command is marked dispatched. Without
+	// them the agent would drop its overrides, e.g. re-enable disabled
+	// command types, so the heartbeat fails instead and the agent retries.
+	var remote *protocol.RemoteConfig
+	if h.settings != nil {
+		if remote, err = h.settings.AgentRemoteConfig(c.Context()); err != nil {
+			h.logger.Errorw("agent_heartbeat_remote_config_failed", "node_id", nodeID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to load agent settings"})
+		}
+	}
 
 	// ==================== FETCH PENDING COMMANDS ====================
-	var commands []*domain.Command
+	var commands []protocol.Command
 	if h.taskService != nil {
-		pendingCmds, err := h.taskService.GetPendingCommands(uint(nodeID))
+		pendingCmds, err := h.taskService.GetPendingCommands(nodeID)
 		if err != nil {
 			h.logger.Warnw("agent_heartbeat_get_commands_failed", "node_id", nodeID, "error", err)
 		} else if len(pendingCmds) > 0 {
 			h.logger.Infow("agent_heartbeat_commands_found", "node_id", nodeID, "count", len(pendingCmds))
 
-			// Update command status to Processing
+			// Mark commands as dispatched (Processing) so the reaper can time them out
 			for _, cmd := range pendingCmds {
-				if err := h.taskService.UpdateCommandStatus(cmd.ID, domain.CommandStatusProcessing, "", ""); err != nil {
+				if err := h.taskService.MarkCommandDispatched(cmd.ID); err != nil {
+					// Pushed or finished meanwhile, or not recorded; either way
+					// it must not go out twice
 					h.logger.Warnw("agent_heartbeat_update_command_status_failed", "command_id", cmd.ID, "error", err)
+					continue
+				}
+				// Mirror the attempt MarkCommandDispatched just counted
+				cmd.Attempts++
+				wireCmd, err := toProtocolCommand(cmd, h.keyManager)
+				if err != nil {
+					h.logger.Errorw("agent_heartbeat_encode_command_failed", "command_id", cmd.ID, "error", err)
+					continue
 				}
+				commands = append(commands, wireCmd)
 			}
-			commands = pendingCmds
 		}
 	}
 
 	h.logger.Infow("agent_heartbeat_ok", "node_id", nodeID, "commands_dispatched", len(commands))
 
-	// Return response with commands
-	response := domain.HeartbeatResponse{
-		Status:   "ok",
-		Commands: commands,
+	// Return response with commands and the fleet-wide agent settings
+	response := protocol.HeartbeatResponse{
+		Status:          protocol.StatusOK,
+		ProtocolVersion: version,
+		Commands:        commands,
+		Config:          remote,
 	}
 
 	return c.JSON(response)
 }
+
+// ReportCommandResult receives the outcome of a command executed by an agent
+func (h *AgentHandler) ReportCommandResult(c *fiber.Ctx) error {
+	nodeID, err := nodeIDFromAuth(c, h.agentAuth)
+	if err != nil {
+		h.logger.Warnw("agent_command_result_unauthorized", "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	commandID := c.Params("id")
+	var req protocol.CommandResult
+	if err := c.BodyParser(&req); err != nil {
+		h.logger.Warnw("agent_command_result_body_parse_failed", "node_id", nodeID, "command_id", commandID, "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	cmd, err := h.taskService.CompleteCommand(nodeID, commandID, req.Success, req.Output, req.Error)
+	switch {
+	case errors.Is(err, services.ErrCommandNotFound):
+		h.logger.Warnw("agent_command_result_not_found", "node_id", nodeID, "command_id", commandID)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrCommandNodeMismatch):
+		h.logger.Warnw("agent_command_result_node_mismatch", "node_id", nodeID, "command_id", commandID)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrCommandAlreadyFinished):
+		// Duplicate report; acknowledge so the agent stops retrying
+		h.logger.Infow("agent_command_result_duplicate", "node_id", nodeID, "command_id", commandID, "status", cmd.Status)
+		return c.JSON(fiber.Map{"status": cmd.Status})
+	case err != nil:
+		h.logger.Errorw("agent_command_result_failed", "node_id", nodeID, "command_id", commandID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if req.Success && !req.DryRun && len(req.Files) > 0 {
+		if h.history != nil {
+			h.history.RecordCommand(c.Context(), nodeID, cmd, req.Files)
+		}
+		if h.drift != nil {
+			h.drift.RecordApplied(c.Context(), nodeID, cmd, req.Files)
+		}
+	}
+
+	h.logger.Infow("agent_command_result_ok", "node_id", nodeID, "command_id", commandID, "status", cmd.Status, "dry_run", req.DryRun)
+	return c.JSON(fiber.Map{"status": cmd.Status})
+}
+
+// ReportCommandOutput stores output an agent streams while a command runs
+func (h *AgentHandler) ReportCommandOutput(c *fiber.Ctx) error {
+	nodeID, err := nodeIDFromAuth(c, h.agentAuth)
+	if err != nil {
+		h.logger.Warnw("agent_command_output_unauthorized", "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	commandID := c.Params("id")
+	var req protocol.CommandOutput
+	if err := c.BodyParser(&req); err != nil {
+		h.logger.Warnw("agent_command_output_body_parse_failed", "node_id", nodeID, "command_id", commandID, "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	chunks := make([]domain.CommandOutputChunk, 0, len(req.Chunks))
+	for _, chunk := range req.Chunks {
+		if chunk.Seq < 1 || (chunk.Stream != protocol.StreamStdout && chunk.Stream != protocol.StreamStderr) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid output chunk"})
+		}
+		chunks = append(chunks, domain.CommandOutputChunk{
+			Seq:        chunk.Seq,
+			Stream:     chunk.Stream,
+			Data:       chunk.Data,
+			ProducedAt: time.Unix(chunk.Timestamp, 0),
+		})
+	}
+
+	err = h.taskService.AppendCommandOutput(nodeID, commandID, chunks)
+	switch {
+	case errors.Is(err, services.ErrCommandNotFound):
+		h.logger.Warnw("agent_command_output_not_found", "node_id", nodeID, "command_id", commandID)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrCommandNodeMismatch):
+		h.logger.Warnw("agent_command_output_node_mismatch", "node_id", nodeID, "command_id", commandID)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		h.logger.Errorw("agent_command_output_store_failed", "node_id", nodeID, "command_id", commandID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	h.logger.Debugw("agent_command_output_ok", "node_id", nodeID, "command_id", commandID, "chunks", len(chunks))
+	return c.JSON(fiber.Map{"status": "ok", "stored": len(chunks)})
+}
+
+// UploadStatsBacklog stores stats samples an agent buffered while it could
+// not reach the backend
+func (h *AgentHandler) UploadStatsBacklog(c *fiber.Ctx) error {
+	nodeID, err := nodeIDFromAuth(c, h.agentAuth)
+	if err != nil {
+		h.logger.Warnw("agent_stats_backlog_unauthorized", "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req protocol.StatsBacklog
+	if err := c.BodyParser(&req); err != nil {
+		h.logger.Warnw("agent_stats_backlog_body_parse_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	samples := make([]domain.NodeStatsSample, 0, len(req.Samples))
+	for _, st := range req.Samples {
+		samples = append(samples, statsSample(st))
+	}
+	if err := h.nodeService.RecordStatsSamples(c.Context(), nodeID, samples); err != nil {
+		h.logger.Errorw("agent_stats_backlog_store_failed", "node_id", nodeID, "count", len(samples), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	h.logger.Infow("agent_stats_backlog_ok", "node_id", nodeID, "count", len(samples))
+	return c.JSON(fiber.Map{"status": "ok", "stored": len(samples)})
+}
+
+// statsSample turns a reported sample into a history row, dated by when the
+// agent collected it
+func statsSample(stats protocol.SystemStats) domain.NodeStatsSample {
+	statsJSON, _ := json.Marshal(stats)
+	var statsMap domain.JSONB
+	json.Unmarshal(statsJSON, &statsMap)
+
+	collectedAt := time.Now()
+	if stats.CollectedAt != 0 {
+		collectedAt = time.Unix(stats.CollectedAt, 0)
+	}
+	return domain.NodeStatsSample{CollectedAt: collectedAt, Stats: statsMap}
+}
+
+// toProtocolCommand converts a queued command into its signed wire
+// representation
+func toProtocolCommand(cmd *domain.Command, keyManager *services.KeyManager) (protocol.Command, error) {
+	payload, err := json.Marshal(cmd.Payload)
+	if err != nil {
+		return protocol.Command{}, err
+	}
+	wireCmd := protocol.Command{
+		ID:        cmd.ID,
+		NodeID:    cmd.NodeID,
+		Type:      string(cmd.Type),
+		Payload:   payload,
+		Priority:  cmd.Priority,
+		CreatedAt: cmd.CreatedAt.Unix(),
+		Attempt:   cmd.Attempts,
+		Timeout:   cmd.Timeout,
+	}
+	if cmd.ExpiresAt != nil {
+		wireCmd.ExpiresAt = cmd.ExpiresAt.Unix()
+	}
+	keyManager.SignCommand(&wireCmd)
+	return wireCmd, nil
+}
+
+// nodeIDFromAuth resolves the node ID from the agent's client certificate or
+// bearer token
+func nodeIDFromAuth(c *fiber.Ctx, agentAuth *services.AgentAuthService) (uint, error) {
+	tlsState := c.Context().TLSConnectionState()
+
+	var token string
+	if authHeader := c.Get("Authorization"); authHeader != "" {
+		parts := strings.Split(authHeader, " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			return 0, errors.New("Invalid authorization header")
+		}
+		token = parts[1]
+	} else if tlsState == nil {
+		return 0, errors.New("Missing authorization header")
+	}
+
+	nodeID, err := agentAuth.AuthenticateRequest(c.Context(), tlsState, token)
+	switch {
+	case errors.Is(err, services.ErrAgentClientCertRequired), errors.Is(err, services.ErrAgentIdentityMismatch):
+		return 0, err
+	case err != nil:
+		return 0, errors.New("Invalid token")
+	}
+	return nodeID, nil
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/protocol"
+)
+
+const (
+	streamWriteWait  = 10 * time.Second
+	streamPongWait   = 60 * time.Second
+	streamPingPeriod = (streamPongWait * 9) / 10
+)
+
+var errStreamClosed = errors.New("agent stream closed")
+
+// AgentStreamHandler keeps one WebSocket per connected agent and pushes
+// queued commands over it. It implements ports.CommandPusher.
+type AgentStreamHandler struct {
+	taskService ports.TaskService
+	agentAuth   *services.AgentAuthService
+	keyManager  *services.KeyManager
+	logger      *logger.Logger
+
+	mu       sync.RWMutex
+	sessions map[uint]*agentSession
+}
+
+type agentSession struct {
+	nodeID uint
+	conn   *websocket.Conn
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewAgentStreamHandler(taskService ports.TaskService, agentAuth *services.AgentAuthService, keyManager *services.KeyManager, logger *logger.Logger) *AgentStreamHandler {
+	return &AgentStreamHandler{
+		taskService: taskService,
+		agentAuth:   agentAuth,
+		keyManager:  keyManager,
+		logger:      logger,
+		sessions:    make(map[uint]*agentSession),
+	}
+}
+
+// Upgrade authenticates the agent before the WebSocket handshake
+func (h *AgentStreamHandler) Upgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return c.SendStatus(fiber.StatusUpgradeRequired)
+	}
+
+	nodeID, err := nodeIDFromAuth(c, h.agentAuth)
+	if err != nil {
+		h.logger.Warnw("agent_stream_unauthorized", "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	peer, _ := strconv.Atoi(c.Get(protocol.ProtocolVersionHeader))
+	if _, err := protocol.Negotiate(peer); err != nil {
+		h.logger.Warnw("agent_stream_unsupported_protocol", "node_id", nodeID, "protocol_version", peer)
+		return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Locals("node_id", nodeID)
+	return c.Next()
+}
+
+// Handle serves an authenticated agent stream until it disconnects
+func (h *AgentStreamHandler) Handle(c *websocket.Conn) {
+	nodeID, _ := c.Locals("node_id").(uint)
+	session := &agentSession{nodeID: nodeID, conn: c}
+	h.register(session)
+	defer h.unregister(session)
+
+	h.logger.Infow("agent_stream_connected", "node_id", nodeID, "ip", c.IP())
+
+	// Anything queued while the agent was offline goes out right away
+	if sent, err := h.taskService.DispatchPendingCommands(nodeID); err != nil {
+		h.logger.Warnw("agent_stream_dispatch_pending_failed", "node_id", nodeID, "error", err)
+	} else if sent > 0 {
+		h.logger.Infow("agent_stream_dispatched_pending", "node_id", nodeID, "count", sent)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go h.keepAlive(session, done)
+
+	c.SetReadDeadline(time.Now().Add(streamPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(streamPongWait))
+	})
+
+	for {
+		var msg protocol.StreamMessage
+		if err := c.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				h.logger.Warnw("agent_stream_read_failed", "node_id", nodeID, "error", err)
+			}
+			break
+		}
+
+		switch msg.Type {
+		case protocol.MessageAck:
+			if err := h.taskService.AcknowledgeCommand(nodeID, msg.CommandID); err != nil {
+				h.logger.Warnw("agent_stream_ack_failed", "node_id", nodeID, "command_id", msg.CommandID, "error", err)
+				continue
+			}
+			h.logger.Infow("agent_stream_ack", "node_id", nodeID, "command_id", msg.CommandID)
+		default:
+			h.logger.Warnw("agent_stream_unknown_message", "node_id", nodeID, "type", msg.Type)
+		}
+	}
+
+	h.logger.Infow("agent_stream_disconnected", "node_id", nodeID)
+}
+
+// IsConnected reports whether the node currently holds a stream
+func (h *AgentStreamHandler) IsConnected(nodeID uint) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.sessions[nodeID]
+	return ok
+}
+
+// Push writes a command to the node's stream
+func (h *AgentStreamHandler) Push(cmd *domain.Command) error {
+	h.mu.RLock()
+	session, ok := h.sessions[cmd.NodeID]
+	h.mu.RUnlock()
+	if !ok {
+		return errStreamClosed
+	}
+
+	wireCmd, err := toProtocolCommand(cmd, h.keyManager)
+	if err != nil {
+		return err
+	}
+	return session.send(protocol.StreamMessage{Type: protocol.MessageCommand, Command: &wireCmd})
+}
+
+func (h *AgentStreamHandler) register(s *agentSession) {
+	h.mu.Lock()
+	old := h.sessions[s.nodeID]
+	h.sessions[s.nodeID] = s
+	h.mu.Unlock()
+
+	// An agent that reconnects before the old socket timed out replaces it
+	if old != nil {
+		h.logger.Infow("agent_stream_replaced", "node_id", s.nodeID)
+		old.close()
+	}
+}
+
+func (h *AgentStreamHandler) unregister(s *agentSession) {
+	h.mu.Lock()
+	if h.sessions[s.nodeID] == s {
+		delete(h.sessions, s.nodeID)
+	}
+	h.mu.Unlock()
+	s.close()
+}
+
+func (h *AgentStreamHandler) keepAlive(s *agentSession, done <-chan struct{}) {
+	ticker := time.NewTicker(streamPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.ping(); err != nil {
+				h.logger.Warnw("agent_stream_ping_failed", "node_id", s.nodeID, "error", err)
+				s.close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *agentSession) send(msg protocol.StreamMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStreamClosed
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+	return s.conn.WriteJSON(msg)
+}
+
+func (s *agentSession) ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStreamClosed
+	}
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait))
+}
+
+// close marks the session dead and closes the socket. The connection is
+// released by fiber once Handle returns, so nothing may touch it afterwards.
+func (s *agentSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.conn.Close()
+}
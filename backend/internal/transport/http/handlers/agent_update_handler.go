@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/backend/internal/transport/http/dto"
+)
+
+type AgentUpdateHandler struct {
+	service *services.AgentUpdateService
+	logger  *logger.Logger
+}
+
+func NewAgentUpdateHandler(service *services.AgentUpdateService, logger *logger.Logger) *AgentUpdateHandler {
+	return &AgentUpdateHandler{service: service, logger: logger}
+}
+
+type UpdateAgentRequest struct {
+	Version string `json:"version"`
+}
+
+// UpdateAgent queues a signed self-update for the node's agent
+func (h *AgentUpdateHandler) UpdateAgent(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	var req UpdateAgentRequest
+	if err := c.BodyParser(&req); err != nil {
+		h.logger.Warnw("agent_update_body_parse_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid request body"})
+	}
+
+	h.logger.Infow("agent_update_request", "node_id", nodeID, "version", req.Version)
+	cmd, err := h.service.QueueUpdate(c.Context(), uint(nodeID), req.Version)
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrAgentUpdateNoVersion):
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrAgentUpdateNoBinaries), errors.Is(err, services.ErrAgentUpdateNoURL):
+		return c.Status(fiber.StatusServiceUnavailable).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("agent_update_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(cmd)
+}
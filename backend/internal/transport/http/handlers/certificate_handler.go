@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/backend/internal/transport/http/dto"
+	"github.com/netly/protocol"
+)
+
+// CertificateHandler exposes the internal CA: agents renew their client
+// certificate over mTLS and admins list, issue and revoke node certificates
+type CertificateHandler struct {
+	ca     *services.CertificateAuthority
+	logger *logger.Logger
+}
+
+func NewCertificateHandler(ca *services.CertificateAuthority, logger *logger.Logger) *CertificateHandler {
+	return &CertificateHandler{ca: ca, logger: logger}
+}
+
+// Renew signs a CSR from an agent. Only the certificate being renewed can
+// authenticate this request, so a leaked token cannot mint certificates.
+func (h *CertificateHandler) Renew(c *fiber.Ctx) error {
+	nodeID, ok := h.ca.NodeIDFromTLS(c.Context().TLSConnectionState())
+	if !ok {
+		h.logger.Warnw("agent_cert_renew_unauthorized", "ip", c.IP())
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": services.ErrAgentClientCertRequired.Error()})
+	}
+
+	var req protocol.CertificateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	certPEM, notAfter, err := h.ca.SignNodeCSR(c.Context(), nodeID, req.CSR)
+	switch {
+	case errors.Is(err, services.ErrCertInvalidCSR):
+		h.logger.Warnw("agent_cert_renew_invalid_csr", "node_id", nodeID)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		h.logger.Errorw("agent_cert_renew_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	h.logger.Infow("agent_cert_renewed", "node_id", nodeID, "not_after", notAfter)
+	return c.JSON(protocol.CertificateResponse{
+		Certificate: certPEM,
+		CA:          h.ca.CACertPEM(),
+		NotAfter:    notAfter.Unix(),
+	})
+}
+
+// List returns the certificates issued to a node
+func (h *CertificateHandler) List(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	certs, err := h.ca.ListNodeCertificates(c.Context(), uint(nodeID))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.JSON(certs)
+}
+
+// Issue creates a new key pair and certificate for a node, for installing an
+// agent by hand. The private key is only returned here.
+func (h *CertificateHandler) Issue(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	certPEM, keyPEM, err := h.ca.IssueNodeCertificate(c.Context(), uint(nodeID))
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("agent_cert_issue_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"certificate": certPEM,
+		"private_key": keyPEM,
+		"ca":          h.ca.CACertPEM(),
+	})
+}
+
+// Revoke revokes every certificate issued to a node
+func (h *CertificateHandler) Revoke(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	count, err := h.ca.RevokeNode(c.Context(), uint(nodeID))
+	if err != nil {
+		h.logger.Errorw("agent_cert_revoke_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.JSON(fiber.Map{"revoked": count})
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/ports"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/domain"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/backend/internal/transport/http/dto"
+)
+
+type CommandHandler struct {
+	taskService ports.TaskService
+	logger      *logger.Logger
+}
+
+func NewCommandHandler(taskService ports.TaskService, logger *logger.Logger) *CommandHandler {
+	return &CommandHandler{taskService: taskService, logger: logger}
+}
+
+// ListCommands lists queued and historical agent commands.
+// Supports ?node_id=, ?status= and ?limit= (default 100).
+func (h *CommandHandler) ListCommands(c *fiber.Ctx) error {
+	filter := ports.CommandFilter{
+		Status: domain.CommandStatus(c.Query("status")),
+		Limit:  c.QueryInt("limit", 100),
+	}
+	if nodeIDStr := c.Query("node_id"); nodeIDStr != "" {
+		nodeID, err := strconv.ParseUint(nodeIDStr, 10, 32)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node_id"})
+		}
+		filter.NodeID = uint(nodeID)
+	}
+
+	h.logger.Infow("command_list_request", "node_id", filter.NodeID, "status", filter.Status, "limit", filter.Limit)
+	cmds, err := h.taskService.ListCommands(filter)
+	if err != nil {
+		h.logger.Errorw("command_list_failed", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	return c.JSON(cmds)
+}
+
+func (h *CommandHandler) GetCommand(c *fiber.Ctx) error {
+	id := c.Params("id")
+	cmd, err := h.taskService.GetCommand(id)
+	if err != nil {
+		h.logger.Warnw("command_get_not_found", "id", id)
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: "command not found"})
+	}
+	return c.JSON(cmd)
+}
+
+// ListNodeCommands returns the command history of a single node, newest first
+func (h *CommandHandler) ListNodeCommands(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	filter := ports.CommandFilter{
+		NodeID: uint(nodeID),
+		Status: domain.CommandStatus(c.Query("status")),
+		Limit:  c.QueryInt("limit", 100),
+	}
+
+	h.logger.Infow("node_command_history_request", "node_id", nodeID, "status", filter.Status, "limit", filter.Limit)
+	cmds, err := h.taskService.ListCommands(filter)
+	if err != nil {
+		h.logger.Errorw("node_command_history_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	return c.JSON(cmds)
+}
+
+// maxScriptTimeout bounds how long an operator's script may be allowed to run
+const maxScriptTimeout = 24 * time.Hour
+
+type RunScriptRequest struct {
+	Script      string `json:"script"`
+	Interpreter string `json:"interpreter,omitempty"`
+	// Timeout is in seconds; zero leaves it to the agent
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// RunScript queues a script on a node. It runs once, without retries, and
+// its output can be followed through GetCommandOutput while it runs.
+func (h *CommandHandler) RunScript(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	var req RunScriptRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid request body"})
+	}
+	timeout := time.Duration(req.Timeout) * time.Second
+	if req.Script == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "script is required"})
+	}
+	if timeout < 0 || timeout > maxScriptTimeout {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: fmt.Sprintf("timeout must be between 0 and %d seconds", int(maxScriptTimeout.Seconds()))})
+	}
+
+	payload := domain.JSONB{"script": req.Script}
+	if req.Interpreter != "" {
+		payload["interpreter"] = req.Interpreter
+	}
+	cmd, err := h.taskService.CreateCommand(uint(nodeID), domain.CmdExecuteScript, payload, ports.CommandOptions{
+		Timeout:     timeout,
+		MaxAttempts: 1,
+	})
+	if err != nil {
+		h.logger.Errorw("command_run_script_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	h.logger.Infow("command_run_script_queued", "node_id", nodeID, "command_id", cmd.ID, "timeout", req.Timeout)
+	return c.Status(fiber.StatusAccepted).JSON(cmd)
+}
+
+// CancelCommand stops a queued or running command
+func (h *CommandHandler) CancelCommand(c *fiber.Ctx) error {
+	id := c.Params("id")
+	cmd, err := h.taskService.CancelCommand(id)
+	switch {
+	case errors.Is(err, services.ErrCommandNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: "command not found"})
+	case errors.Is(err, services.ErrCommandAlreadyFinished), errors.Is(err, services.ErrCommandNotCancellable),
+		errors.Is(err, services.ErrCommandStatusChanged):
+		return c.Status(fiber.StatusConflict).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("command_cancel_failed", "id", id, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	h.logger.Infow("command_cancel_ok", "id", id, "status", cmd.Status)
+	return c.JSON(cmd)
+}
+
+// GetCommandOutput returns the output a command has streamed so far. Pass
+// the last seq seen as ?after= to follow it; once done is true no more
+// output will arrive. ?limit= defaults to 500.
+func (h *CommandHandler) GetCommandOutput(c *fiber.Ctx) error {
+	id := c.Params("id")
+	after := c.QueryInt("after", 0)
+	limit := c.QueryInt("limit", 500)
+	if limit <= 0 || limit > 5000 {
+		limit = 500
+	}
+
+	// Read the status first: a command seen finished has delivered all the
+	// output it is going to by the time its chunks are read
+	cmd, err := h.taskService.GetCommand(id)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: "command not found"})
+	}
+	chunks, err := h.taskService.GetCommandOutput(id, after, limit)
+	if err != nil {
+		h.logger.Errorw("command_output_failed", "id", id, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	next := after
+	if len(chunks) > 0 {
+		next = chunks[len(chunks)-1].Seq
+	}
+	return c.JSON(fiber.Map{
+		"command_id": id,
+		"status":     cmd.Status,
+		"chunks":     chunks,
+		"next_after": next,
+		"done":       cmd.Status.Finished() && len(chunks) < limit,
+	})
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/backend/internal/transport/http/dto"
+)
+
+// ConfigHistoryHandler serves the revisions agents kept of a node's managed
+// files and rolls files back to them. File paths go in the query string or
+// body since they contain slashes.
+type ConfigHistoryHandler struct {
+	service *services.ConfigHistoryService
+	logger  *logger.Logger
+}
+
+func NewConfigHistoryHandler(service *services.ConfigHistoryService, logger *logger.Logger) *ConfigHistoryHandler {
+	return &ConfigHistoryHandler{service: service, logger: logger}
+}
+
+type rollbackConfigRequest struct {
+	Path     string `json:"path"`
+	Revision string `json:"revision"`
+}
+
+// List returns the node's newest revisions, or with ?path= that file's whole
+// history with diffs
+func (h *ConfigHistoryHandler) List(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	var result interface{}
+	if path := c.Query("path"); path != "" {
+		result, err = h.service.History(c.Context(), uint(nodeID), path)
+	} else {
+		result, err = h.service.Revisions(c.Context(), uint(nodeID))
+	}
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("config_history_list_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.JSON(result)
+}
+
+// Get returns one revision with its content, chosen by ?path= and ?revision=
+func (h *ConfigHistoryHandler) Get(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+	path, revision := c.Query("path"), c.Query("revision")
+	if path == "" || revision == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "path and revision are required"})
+	}
+
+	rev, err := h.service.Revision(c.Context(), uint(nodeID), path, revision)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.JSON(rev)
+}
+
+// Rollback queues a CMD_ROLLBACK_CONFIG for the revision
+func (h *ConfigHistoryHandler) Rollback(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+	var req rollbackConfigRequest
+	if err := c.BodyParser(&req); err != nil || req.Path == "" || req.Revision == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "path and revision are required"})
+	}
+
+	cmd, err := h.service.Rollback(c.Context(), uint(nodeID), req.Path, req.Revision)
+	switch {
+	case errors.Is(err, services.ErrConfigRevisionNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("config_rollback_failed", "node_id", nodeID, "path", req.Path, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(cmd)
+}
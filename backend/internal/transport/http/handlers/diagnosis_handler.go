@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/backend/internal/transport/http/dto"
+)
+
+// DiagnosisHandler runs on-demand connectivity probes across a tunnel
+type DiagnosisHandler struct {
+	service *services.DiagnosisService
+	logger  *logger.Logger
+}
+
+func NewDiagnosisHandler(service *services.DiagnosisService, logger *logger.Logger) *DiagnosisHandler {
+	return &DiagnosisHandler{service: service, logger: logger}
+}
+
+// DiagnoseTunnel probes every hop of the tunnel from both ends and reports
+// which one is broken. It blocks until the agents answer or time runs out.
+func (h *DiagnosisHandler) DiagnoseTunnel(c *fiber.Ctx) error {
+	tunnelID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid tunnel id"})
+	}
+
+	diagnosis, err := h.service.Diagnose(c.Context(), uint(tunnelID))
+	switch {
+	case errors.Is(err, services.ErrTunnelNotFound), errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrTunnelInvalidInput):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("tunnel_diagnose_failed", "tunnel_id", tunnelID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.JSON(diagnosis)
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/backend/internal/transport/http/dto"
+)
+
+// DriftHandler shows how a node's managed files compare with what the
+// backend last wrote there and resolves drift either way
+type DriftHandler struct {
+	service *services.DriftService
+	logger  *logger.Logger
+}
+
+func NewDriftHandler(service *services.DriftService, logger *logger.Logger) *DriftHandler {
+	return &DriftHandler{service: service, logger: logger}
+}
+
+type driftFileRequest struct {
+	Path string `json:"path"`
+}
+
+// List returns the node's managed files, drifted or not
+func (h *DriftHandler) List(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	files, err := h.service.Files(c.Context(), uint(nodeID))
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("drift_list_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.JSON(files)
+}
+
+// Reapply queues the command that last wrote the file again
+func (h *DriftHandler) Reapply(c *fiber.Ctx) error {
+	nodeID, path, err := h.parse(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	cmd, err := h.service.Reapply(c.Context(), nodeID, path)
+	switch {
+	case errors.Is(err, services.ErrManagedFileNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrDriftNoIntent):
+		return c.Status(fiber.StatusConflict).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("drift_reapply_failed", "node_id", nodeID, "path", path, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(cmd)
+}
+
+// Adopt accepts the file as the node has it now
+func (h *DriftHandler) Adopt(c *fiber.Ctx) error {
+	nodeID, path, err := h.parse(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+
+	file, err := h.service.Adopt(c.Context(), nodeID, path)
+	switch {
+	case errors.Is(err, services.ErrManagedFileNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("drift_adopt_failed", "node_id", nodeID, "path", path, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.JSON(file)
+}
+
+func (h *DriftHandler) parse(c *fiber.Ctx) (uint, string, error) {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return 0, "", errors.New("invalid node id")
+	}
+	var req driftFileRequest
+	if err := c.BodyParser(&req); err != nil || req.Path == "" {
+		return 0, "", errors.New("path is required")
+	}
+	return uint(nodeID), req.Path, nil
+}
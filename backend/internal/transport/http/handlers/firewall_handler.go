@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/netly/backend/internal/core/services"
+	"github.com/netly/backend/internal/infrastructure/logger"
+	"github.com/netly/backend/internal/transport/http/dto"
+	"github.com/netly/protocol"
+)
+
+// FirewallHandler shows the ports a node's firewall is kept open for and
+// lets admins push them again, e.g. after someone flushed the node's rules
+type FirewallHandler struct {
+	service *services.FirewallService
+	logger  *logger.Logger
+}
+
+func NewFirewallHandler(service *services.FirewallService, logger *logger.Logger) *FirewallHandler {
+	return &FirewallHandler{service: service, logger: logger}
+}
+
+// Get returns the inbound ports derived from the node's tunnels and services
+func (h *FirewallHandler) Get(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	openings, err := h.service.InboundPorts(c.Context(), uint(nodeID))
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("firewall_get_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.JSON(protocol.FirewallSyncPayload{Openings: openings})
+}
+
+// Sync queues a CMD_FIREWALL_SYNC with the node's current openings
+func (h *FirewallHandler) Sync(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid node id"})
+	}
+
+	cmd, err := h.service.SyncNode(c.Context(), uint(nodeID))
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: err.Error()})
+	case err != nil:
+		h.logger.Errorw("firewall_sync_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(cmd)
+}
@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"text/template"
 
 	"github.com/gofiber/fiber/v2"
@@ -11,15 +14,24 @@ import (
 
 type InstallHandler struct {
 	settingService    *services.SystemSettingService
+	agentAuth         *services.AgentAuthService
+	ca                *services.CertificateAuthority
 	logger            *logger.Logger
 	fallbackPublicURL string
+	agentTLSURL       string
 }
 
-func NewInstallHandler(settingService *services.SystemSettingService, logger *logger.Logger, fallbackPublicURL string) *InstallHandler {
+// NewInstallHandler creates the install handler. When agentTLSURL is set the
+// install script also provisions a client certificate and points the agent at
+// the mTLS listener.
+func NewInstallHandler(settingService *services.SystemSettingService, agentAuth *services.AgentAuthService, ca *services.CertificateAuthority, logger *logger.Logger, fallbackPublicURL, agentTLSURL string) *InstallHandler {
 	return &InstallHandler{
 		settingService:    settingService,
+		agentAuth:         agentAuth,
+		ca:                ca,
 		logger:            logger,
 		fallbackPublicURL: fallbackPublicURL,
+		agentTLSURL:       agentTLSURL,
 	}
 }
 
@@ -30,6 +42,7 @@ const installScriptTemplate = `#!/bin/bash
 set -e
 
 API_URL="{{.APIURL}}"
+BACKEND_URL="{{.BackendURL}}"
 NODE_TOKEN="{{.NodeToken}}"
 
 echo "🚀 Netly Agent Installer (Fixed)"
@@ -52,13 +65,29 @@ echo "📝 Creating configuration..."
 mkdir -p /etc/netly
 
 # اصلاح مهم: تغییر نام فایل به agent.yaml و کلیدها طبق کد Go
+umask 077
 cat > /etc/netly/agent.yaml <<EOF
-backend_url: "${API_URL}"
+backend_url: "${BACKEND_URL}"
 node_token: "${NODE_TOKEN}"
 log_path: "/var/log/netly-agent.log"
 heartbeat_interval: 10s
+signing_public_key: "{{.SigningPublicKey}}"
+{{- if .AgentCert}}
+ca_file: "/etc/netly/tls/ca.pem"
+cert_file: "/etc/netly/tls/agent.pem"
+key_file: "/etc/netly/tls/agent.key"
+{{- end}}
 EOF
-
+{{if .AgentCert}}
+# mTLS identity issued by the backend's internal CA
+mkdir -p /etc/netly/tls
+cat > /etc/netly/tls/ca.pem <<'EOF'
+{{.CACert}}EOF
+cat > /etc/netly/tls/agent.pem <<'EOF'
+{{.AgentCert}}EOF
+cat > /etc/netly/tls/agent.key <<'EOF'
+{{.AgentKey}}EOF
+{{end}}
 # 2. دانلود ایجنت
 echo "📥 Downloading netly-agent..."
 BINARY_URL="${API_URL}/downloads/netly-agent-${ARCH}"
@@ -75,6 +104,7 @@ After=network.target
 [Service]
 Type=simple
 ExecStart=/usr/local/bin/netly-agent --config /etc/netly/agent.yaml
+ExecReload=/bin/kill -HUP \$MAINPID
 Restart=always
 RestartSec=5
 StandardOutput=journal
@@ -105,6 +135,12 @@ func (h *InstallHandler) GetInstallScript(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Missing token parameter")
 	}
 
+	nodeID, err := h.agentAuth.Authenticate(c.Context(), token)
+	if err != nil {
+		h.logger.Warnw("install_script_invalid_token", "error", err)
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid token")
+	}
+
 	settings, err := h.settingService.GetSettingsStruct()
 	if err != nil {
 		h.logger.Errorw("failed to get settings", "error", err)
@@ -118,6 +154,10 @@ func (h *InstallHandler) GetInstallScript(c *fiber.Ctx) error {
 	if apiURL == "" {
 		return c.Status(fiber.StatusServiceUnavailable).SendString("System Public URL not ready")
 	}
+	// Agents refuse to start without the key and cannot be sent it later
+	if settings.AgentVerifyKey == "" {
+		return c.Status(fiber.StatusServiceUnavailable).SendString("Agent signing key not ready")
+	}
 
 	tmpl, err := template.New("install").Parse(installScriptTemplate)
 	if err != nil {
@@ -126,8 +166,22 @@ func (h *InstallHandler) GetInstallScript(c *fiber.Ctx) error {
 	}
 
 	data := map[string]string{
-		"APIURL":    apiURL,
-		"NodeToken": token,
+		"APIURL":          apiURL,
+		"BackendURL":      apiURL,
+		"NodeToken":       token,
+		"SigningPublicKey": settings.AgentVerifyKey,
+	}
+
+	if h.agentTLSURL != "" {
+		certPEM, keyPEM, err := h.ca.IssueNodeCertificate(c.Context(), nodeID)
+		if err != nil {
+			h.logger.Errorw("install_script_issue_cert_failed", "node_id", nodeID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Internal server error")
+		}
+		data["BackendURL"] = h.agentTLSURL
+		data["CACert"] = h.ca.CACertPEM()
+		data["AgentCert"] = certPEM
+		data["AgentKey"] = keyPEM
 	}
 
 	c.Set("Content-Type", "text/x-shellscript")
@@ -136,27 +190,74 @@ func (h *InstallHandler) GetInstallScript(c *fiber.Ctx) error {
 	return tmpl.Execute(c.Response().BodyWriter(), data)
 }
 
+// agentTokenPlaceholder stands in for the token in commands built without one
+const agentTokenPlaceholder = "<agent-token>"
+
+// GetNodeCommand returns the install command for a node with a placeholder
+// where the token goes. Tokens are only stored hashed, and issuing one revokes
+// the token the running agent uses, so only RotateAgentToken fills it in.
 func (h *InstallHandler) GetNodeCommand(c *fiber.Ctx) error {
-	nodeID := c.Params("id")
-	if nodeID == "" {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing node ID"})
 	}
 
-	apiURL := ""
-	if settings, err := h.settingService.GetSettingsStruct(); err == nil && settings.PublicURL != "" {
-		apiURL = settings.PublicURL
-	} else if h.fallbackPublicURL != "" {
-		apiURL = h.fallbackPublicURL
-	} else {
-		apiURL = c.BaseURL()
+	issued, err := h.agentAuth.HasToken(c.Context(), uint(nodeID))
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	apiURL := h.publicURL(c)
+	return c.JSON(fiber.Map{
+		"command":      installCommand(apiURL, agentTokenPlaceholder),
+		"api_url":      apiURL,
+		"token_issued": issued,
+	})
+}
+
+// RotateAgentToken revokes a node's agent token and returns a new one along
+// with the install command that deploys it
+func (h *InstallHandler) RotateAgentToken(c *fiber.Ctx) error {
+	nodeID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing node ID"})
 	}
 
-	nodeToken := fmt.Sprintf("node-token-%s", nodeID)
-	command := fmt.Sprintf("curl -fL %s/install.sh?token=%s | sudo bash", apiURL, nodeToken)
+	nodeToken, err := h.agentAuth.IssueToken(c.Context(), uint(nodeID))
+	switch {
+	case errors.Is(err, services.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		h.logger.Errorw("agent_token_issue_failed", "node_id", nodeID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	h.logger.Infow("agent_token_rotated", "node_id", nodeID)
 
+	apiURL := h.publicURL(c)
 	return c.JSON(fiber.Map{
-		"command": command,
+		"command": installCommand(apiURL, nodeToken),
 		"api_url": apiURL,
 		"token":   nodeToken,
 	})
 }
+
+// publicURL is where nodes reach the backend to fetch the install script
+func (h *InstallHandler) publicURL(c *fiber.Ctx) string {
+	if settings, err := h.settingService.GetSettingsStruct(); err == nil && settings.PublicURL != "" {
+		return settings.PublicURL
+	}
+	if h.fallbackPublicURL != "" {
+		return h.fallbackPublicURL
+	}
+	return c.BaseURL()
+}
+
+func installCommand(apiURL, token string) string {
+	if token != agentTokenPlaceholder {
+		token = url.QueryEscape(token)
+	}
+	return fmt.Sprintf("curl -fL '%s/install.sh?token=%s' | sudo bash", apiURL, token)
+}
@@ -110,6 +110,7 @@ After=network.target
 [Service]
 Type=simple
 ExecStart=/usr/local/bin/netly-agent
+ExecReload=/bin/kill -HUP \$MAINPID
 Restart=always
 RestartSec=5
 StandardOutput=journal
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+    "errors"
     "strconv"
+    "time"
 
     "github.com/gofiber/fiber/v2"
     "github.com/netly/backend/internal/core/ports"
@@ -107,6 +109,40 @@ func (h *NodeHandler) GetNode(c *fiber.Ctx) error {
     return c.JSON(dto.NodeToResponse(node))
 }
 
+// GetStatsHistory returns the node's stats samples. since is a unix time and
+// defaults to the last 24 hours; limit defaults to 1000.
+func (h *NodeHandler) GetStatsHistory(c *fiber.Ctx) error {
+    id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+    if err != nil {
+        return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{
+            Error: "invalid node id",
+        })
+    }
+
+    since := time.Now().Add(-24 * time.Hour)
+    if v := c.Query("since"); v != "" {
+        unix, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "invalid since"})
+        }
+        since = time.Unix(unix, 0)
+    }
+    limit := c.QueryInt("limit", 1000)
+    if limit <= 0 || limit > 10000 {
+        return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{Error: "limit must be between 1 and 10000"})
+    }
+
+    samples, err := h.service.GetStatsHistory(c.Context(), uint(id), since, limit)
+    if err == services.ErrNodeNotFound {
+        return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{Error: "node not found"})
+    }
+    if err != nil {
+        h.logger.Errorw("node_stats_history_failed", "id", id, "error", err)
+        return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+    }
+    return c.JSON(samples)
+}
+
 func (h *NodeHandler) UpdateNode(c *fiber.Ctx) error {
     id, err := strconv.ParseUint(c.Params("id"), 10, 32)
     if err != nil {
@@ -214,12 +250,16 @@ func (h *NodeHandler) GetTaskStatus(c *fiber.Ctx) error {
 
     h.logger.Infow("task_status_request", "task_id", taskID)
     task, err := h.service.GetTaskStatus(taskID)
-    if err != nil {
+    if errors.Is(err, services.ErrTaskNotFound) {
         h.logger.Warnw("task_status_not_found", "task_id", taskID)
         return c.Status(fiber.StatusNotFound).JSON(dto.ErrorResponse{
             Error: "task not found",
         })
     }
+    if err != nil {
+        h.logger.Errorw("task_status_failed", "task_id", taskID, "error", err)
+        return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{Error: err.Error()})
+    }
 
     return c.JSON(task)
 }
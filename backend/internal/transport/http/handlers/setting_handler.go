@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"os"
 
 	"github.com/gofiber/fiber/v2"
@@ -90,6 +91,12 @@ func (h *SettingHandler) UpdateSettings(c *fiber.Ctx) error {
 	}
 
 	if err := h.service.UpdateSettings(c.Context(), req); err != nil {
+		if errors.Is(err, services.ErrSettingInvalid) {
+			h.logger.Warnw("settings_update_invalid", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(dto.ErrorResponse{
+				Error: err.Error(),
+			})
+		}
 		h.logger.Errorw("settings_update_failed", "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(dto.ErrorResponse{
 			Error: err.Error(),
@@ -1,6 +1,8 @@
 package http
 
 import (
+	"context"
+
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/netly/backend/internal/config"
@@ -23,13 +25,22 @@ type RouterConfig struct {
 	EnableTaskCorrelation bool
 }
 
-func SetupRoutes(app *fiber.App, cfg RouterConfig) ports.InstallerService {
+// SetupRoutes wires services and routes. It returns the installer, for the
+// binary check at startup, the agent CA, which serves the mTLS listener, and
+// the task service, whose reaper main runs for the life of the server.
+func SetupRoutes(app *fiber.App, cfg RouterConfig) (ports.InstallerService, *services.CertificateAuthority, *services.TaskService) {
 	// Initialize repositories
 	nodeRepo := db.NewNodeRepository(cfg.DB, cfg.Logger)
 	timelineRepo := db.NewTimelineRepository(cfg.DB, cfg.Logger)
 	tunnelRepo := db.NewTunnelRepository(cfg.DB, cfg.Logger)
 	serviceRepo := db.NewServiceRepository(cfg.DB, cfg.Logger)
 	settingRepo := db.NewSystemSettingRepository(cfg.DB, cfg.Logger)
+	taskRepo := db.NewTaskRepository(cfg.DB, cfg.Logger)
+	commandRepo := db.NewCommandRepository(cfg.DB, cfg.Logger)
+	certRepo := db.NewAgentCertificateRepository(cfg.DB, cfg.Logger)
+	nodeStatsRepo := db.NewNodeStatsRepository(cfg.DB, cfg.Logger)
+	managedFileRepo := db.NewManagedFileRepository(cfg.DB, cfg.Logger)
+	configRevisionRepo := db.NewConfigRevisionRepository(cfg.DB, cfg.Logger)
 
 	settingService := services.NewSystemSettingService(settingRepo, cfg.Logger, cfg.EnableLocks)
 
@@ -90,8 +101,60 @@ func SetupRoutes(app *fiber.App, cfg RouterConfig) ports.InstallerService {
 		}
 	}
 
-	installerService := services.NewInstallerService(timelineRepo, nodeRepo, cfg.Logger, cfg.EnableTaskCorrelation, cfg.Config.Security.PublicURL)
-	taskService := services.NewTaskService()
+	agentCA := services.NewCertificateAuthority(services.CertificateAuthorityConfig{
+		SettingService: settingService,
+		CertRepo:       certRepo,
+		NodeRepo:       nodeRepo,
+		Logger:         cfg.Logger,
+		CertValidity:   cfg.Config.AgentTLS.CertValidity,
+	})
+	if err := agentCA.Initialize(context.Background()); err != nil {
+		cfg.Logger.Fatalf("Failed to initialize agent CA: %v", err)
+	}
+
+	// Agents are only pointed at the mTLS listener when it is enabled
+	agentTLSURL := ""
+	if cfg.Config.AgentTLS.Enabled {
+		agentTLSURL = cfg.Config.AgentTLS.PublicURL
+	}
+
+	agentAuthService := services.NewAgentAuthService(services.AgentAuthServiceConfig{
+		NodeRepo:          nodeRepo,
+		CA:                agentCA,
+		RequireClientCert: cfg.Config.AgentTLS.Enabled && cfg.Config.AgentTLS.RequireClientCert,
+		Logger:            cfg.Logger,
+	})
+	installerService := services.NewInstallerService(timelineRepo, nodeRepo, cfg.Logger, cfg.EnableTaskCorrelation, cfg.Config.Security.PublicURL, agentAuthService, agentCA, agentTLSURL, keyManager)
+	taskService := services.NewTaskService(services.TaskServiceConfig{
+		TaskRepo:    taskRepo,
+		CommandRepo: commandRepo,
+		OutputRepo:  db.NewCommandOutputRepository(cfg.DB, cfg.Logger),
+		Logger:      cfg.Logger,
+		Config:      cfg.Config.Commands,
+	})
+	firewallService := services.NewFirewallService(services.FirewallServiceConfig{
+		NodeRepo:    nodeRepo,
+		TunnelRepo:  tunnelRepo,
+		ServiceRepo: serviceRepo,
+		TaskService: taskService,
+		Logger:      cfg.Logger,
+	})
+	agentUpdateService := services.NewAgentUpdateService(services.AgentUpdateServiceConfig{
+		NodeRepo:          nodeRepo,
+		TaskService:       taskService,
+		KeyManager:        keyManager,
+		SettingService:    settingService,
+		Logger:            cfg.Logger,
+		FallbackPublicURL: cfg.Config.Security.PublicURL,
+	})
+	agentControlService := services.NewAgentControlService(services.AgentControlServiceConfig{
+		NodeRepo:     nodeRepo,
+		TimelineRepo: timelineRepo,
+		CA:           agentCA,
+		KeyManager:   keyManager,
+		AgentPort:    cfg.Config.AgentTLS.AgentPort,
+		Logger:       cfg.Logger,
+	})
 	factoryService := factory.NewFactoryService()
 	cleanupService := services.NewCleanupService(cfg.Logger)
 	cleanupService.SetTimelineRepo(timelineRepo)
@@ -104,10 +167,12 @@ func SetupRoutes(app *fiber.App, cfg RouterConfig) ports.InstallerService {
 		FQDNAMSvc:   fqdnamService,
 		Logger:      cfg.Logger,
 		EnableLocks: cfg.EnableLocks,
+		Firewall:    firewallService,
 	})
 
 	nodeService := services.NewNodeService(services.NodeServiceConfig{
 		Repository:    nodeRepo,
+		StatsRepo:     nodeStatsRepo,
 		Installer:     installerService,
 		TaskService:   taskService,
 		Cleanup:       cleanupService,
@@ -126,6 +191,38 @@ func SetupRoutes(app *fiber.App, cfg RouterConfig) ports.InstallerService {
 		TaskService:  taskService,
 		Logger:       cfg.Logger,
 		TimelineRepo: timelineRepo,
+		Firewall:     firewallService,
+	})
+
+	healthService := services.NewHealthService(services.HealthServiceConfig{
+		NodeRepo:     nodeRepo,
+		TunnelRepo:   tunnelRepo,
+		ServiceRepo:  serviceRepo,
+		TimelineRepo: timelineRepo,
+		Logger:       cfg.Logger,
+	})
+
+	driftService := services.NewDriftService(services.DriftServiceConfig{
+		NodeRepo:     nodeRepo,
+		FileRepo:     managedFileRepo,
+		TimelineRepo: timelineRepo,
+		TaskService:  taskService,
+		Logger:       cfg.Logger,
+	})
+
+	configHistoryService := services.NewConfigHistoryService(services.ConfigHistoryServiceConfig{
+		RevisionRepo: configRevisionRepo,
+		NodeRepo:     nodeRepo,
+		TimelineRepo: timelineRepo,
+		TaskService:  taskService,
+		Logger:       cfg.Logger,
+	})
+
+	diagnosisService := services.NewDiagnosisService(services.DiagnosisServiceConfig{
+		TunnelRepo:  tunnelRepo,
+		NodeRepo:    nodeRepo,
+		TaskService: taskService,
+		Logger:      cfg.Logger,
 	})
 
 	// Initialize handlers
@@ -135,10 +232,20 @@ func SetupRoutes(app *fiber.App, cfg RouterConfig) ports.InstallerService {
 	settingHandler := handlers.NewSettingHandler(settingService, cfg.Logger, tunnelManager)
 	serviceHandler := handlers.NewServiceHandler(serviceService, cfg.Logger)
 	terminalHandler := handlers.NewTerminalHandler(nodeService, cfg.Logger)
-	agentHandler := handlers.NewAgentHandler(nodeService, taskService, cfg.Logger, keyManager)
+	agentHandler := handlers.NewAgentHandler(nodeService, taskService, cfg.Logger, keyManager, agentAuthService, healthService, settingService, driftService, configHistoryService)
+	agentStreamHandler := handlers.NewAgentStreamHandler(taskService, agentAuthService, keyManager, cfg.Logger)
+	taskService.SetPusher(agentStreamHandler)
+	commandHandler := handlers.NewCommandHandler(taskService, cfg.Logger)
+	agentUpdateHandler := handlers.NewAgentUpdateHandler(agentUpdateService, cfg.Logger)
+	agentControlHandler := handlers.NewAgentControlHandler(agentControlService, agentAuthService, cfg.Logger)
 	cleanupHandler := handlers.NewCleanupHandler(cleanupService, nodeService, cfg.Logger)
-	installHandler := handlers.NewInstallHandler(settingService, cfg.Logger, cfg.Config.Security.PublicURL)
+	installHandler := handlers.NewInstallHandler(settingService, agentAuthService, agentCA, cfg.Logger, cfg.Config.Security.PublicURL, agentTLSURL)
+	certificateHandler := handlers.NewCertificateHandler(agentCA, cfg.Logger)
 	generalSettingsHandler := handlers.NewGeneralSettingsHandler(cfg.Logger)
+	firewallHandler := handlers.NewFirewallHandler(firewallService, cfg.Logger)
+	driftHandler := handlers.NewDriftHandler(driftService, cfg.Logger)
+	configHistoryHandler := handlers.NewConfigHistoryHandler(configHistoryService, cfg.Logger)
+	diagnosisHandler := handlers.NewDiagnosisHandler(diagnosisService, cfg.Logger)
 
 	// Static file server for agent binaries
 	app.Static("/downloads", "./bin/uploads")
@@ -187,15 +294,41 @@ func SetupRoutes(app *fiber.App, cfg RouterConfig) ports.InstallerService {
 	nodes.Post("/register", nodeHandler.CreateNode)
 	nodes.Get("/", nodeHandler.GetNodes)
 	nodes.Get("/:id", nodeHandler.GetNode)
+	nodes.Get("/:id/stats", nodeHandler.GetStatsHistory)
 	nodes.Put("/:id", nodeHandler.UpdateNode)
 	nodes.Get("/:id/command", installHandler.GetNodeCommand)
+	nodes.Post("/:id/agent-token", installHandler.RotateAgentToken)
+	nodes.Get("/:id/certificates", certificateHandler.List)
+	nodes.Post("/:id/certificates", certificateHandler.Issue)
+	nodes.Delete("/:id/certificates", certificateHandler.Revoke)
+	nodes.Get("/:id/commands", commandHandler.ListNodeCommands)
+	nodes.Post("/:id/scripts", commandHandler.RunScript)
+	nodes.Get("/:id/firewall", firewallHandler.Get)
+	nodes.Post("/:id/firewall/sync", firewallHandler.Sync)
+	nodes.Get("/:id/drift", driftHandler.List)
+	nodes.Post("/:id/drift/reapply", driftHandler.Reapply)
+	nodes.Post("/:id/drift/adopt", driftHandler.Adopt)
+	nodes.Get("/:id/config-history", configHistoryHandler.List)
+	nodes.Get("/:id/config-history/revision", configHistoryHandler.Get)
+	nodes.Post("/:id/config-history/rollback", configHistoryHandler.Rollback)
 	nodes.Delete("/:id", nodeHandler.DeleteNode)
 	nodes.Post("/:id/install-agent", nodeHandler.InstallAgent)
+	nodes.Post("/:id/update-agent", agentUpdateHandler.UpdateAgent)
+	nodes.Get("/:id/agent/status", agentControlHandler.Status)
+	nodes.Get("/:id/agent/diagnostics", agentControlHandler.Diagnostics)
+	nodes.Delete("/:id/agent", agentControlHandler.SelfDestruct)
 
 	// Task routes
 	tasks := api.Group("/tasks", httpmw.AdminAuth(cfg.Config))
 	tasks.Get("/:id", nodeHandler.GetTaskStatus)
 
+	// Command queue routes
+	commands := api.Group("/commands", httpmw.AdminAuth(cfg.Config))
+	commands.Get("/", commandHandler.ListCommands)
+	commands.Get("/:id", commandHandler.GetCommand)
+	commands.Get("/:id/output", commandHandler.GetCommandOutput)
+	commands.Post("/:id/cancel", commandHandler.CancelCommand)
+
 	// Tunnel routes
 	tunnels := api.Group("/tunnels", httpmw.AdminAuth(cfg.Config))
 	tunnels.Post("/", tunnelHandler.CreateTunnel)
@@ -203,6 +336,7 @@ func SetupRoutes(app *fiber.App, cfg RouterConfig) ports.InstallerService {
 	tunnels.Get("/", tunnelHandler.GetTunnels)
 	tunnels.Get("/:id", tunnelHandler.GetTunnel)
 	tunnels.Delete("/:id", tunnelHandler.DeleteTunnel)
+	tunnels.Post("/:id/diagnose", diagnosisHandler.DiagnoseTunnel)
 
 	// Timeline routes
 	timeline := api.Group("/timeline", httpmw.AdminAuth(cfg.Config))
@@ -236,6 +370,12 @@ func SetupRoutes(app *fiber.App, cfg RouterConfig) ports.InstallerService {
 	agent := api.Group("/agent")
 	agent.Post("/register", agentHandler.RegisterNode)
 	agent.Post("/heartbeat", agentHandler.Heartbeat, httpmw.AgentAuth(cfg.Config))
-
-	return installerService
+	agent.Post("/commands/:id/result", agentHandler.ReportCommandResult)
+	agent.Post("/commands/:id/output", agentHandler.ReportCommandOutput)
+	agent.Get("/stream", agentStreamHandler.Upgrade, websocket.New(agentStreamHandler.Handle))
+	agent.Post("/certificate", certificateHandler.Renew)
+	agent.Post("/destruct", agentControlHandler.ReportDestructProgress)
+	agent.Post("/stats", agentHandler.UploadStatsBacklog)
+
+	return installerService, agentCA, taskService
 }
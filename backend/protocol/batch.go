@@ -0,0 +1,16 @@
+package protocol
+
+import "encoding/json"
+
+// BatchPayload is the payload of a CMD_BATCH command. The agent runs the
+// steps in order and, if any of them fails, rolls back every file and
+// service the batch touched before reporting a single result.
+type BatchPayload struct {
+	Steps []BatchStep `json:"steps"`
+}
+
+// BatchStep is one command inside a batch
+type BatchStep struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
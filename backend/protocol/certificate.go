@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// CertificatePath is where an agent sends a CSR to renew its client
+// certificate. The request is authenticated by the certificate being renewed.
+const CertificatePath = "/api/v1/agent/certificate"
+
+// Identity URIs carried as URI SANs in certificates issued by the internal CA
+const (
+	BackendIdentityURI = "netly://backend"
+	nodeIdentityPrefix = "netly://node/"
+)
+
+// CertificateRequest asks the backend to sign a new client certificate
+type CertificateRequest struct {
+	CSR string `json:"csr"` // PEM encoded PKCS#10
+}
+
+// CertificateResponse carries a freshly signed certificate and the CA that
+// signed it, both PEM encoded
+type CertificateResponse struct {
+	Certificate string `json:"certificate"`
+	CA          string `json:"ca"`
+	NotAfter    int64  `json:"not_after"`
+}
+
+// NodeIdentityURI returns the identity URI for a node
+func NodeIdentityURI(nodeID uint) *url.URL {
+	u, _ := url.Parse(fmt.Sprintf("%s%d", nodeIdentityPrefix, nodeID))
+	return u
+}
+
+// NodeIDFromCertificate extracts the node ID from a certificate's URI SANs
+func NodeIDFromCertificate(cert *x509.Certificate) (uint, bool) {
+	for _, u := range cert.URIs {
+		s := u.String()
+		if !strings.HasPrefix(s, nodeIdentityPrefix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(s, nodeIdentityPrefix), 10, 32)
+		if err != nil || id == 0 {
+			return 0, false
+		}
+		return uint(id), true
+	}
+	return 0, false
+}
+
+// IsBackendCertificate reports whether a certificate identifies the backend
+func IsBackendCertificate(cert *x509.Certificate) bool {
+	for _, u := range cert.URIs {
+		if u.String() == BackendIdentityURI {
+			return true
+		}
+	}
+	return false
+}
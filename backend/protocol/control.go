@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Paths served by the agent's local control API. Every request to them must
+// be signed by the backend.
+const (
+	ControlStatusPath      = "/api/v1/agent/status"
+	ControlDiagnosticsPath = "/api/v1/agent/diagnostics"
+	ControlSelfPath        = "/api/v1/agent/self"
+)
+
+// DestructProgressPath is where an agent reports the stages of a
+// self-destruct it was asked to perform
+const DestructProgressPath = "/api/v1/agent/destruct"
+
+// Headers carrying the backend's signature on a control request
+const (
+	ControlTimestampHeader = "X-Netly-Timestamp"
+	ControlNonceHeader     = "X-Netly-Nonce"
+	ControlSignatureHeader = "X-Netly-Signature"
+)
+
+// ControlMaxSkew is how far a control request's timestamp may be from the
+// agent's clock. Nonces only need to be remembered for twice this long.
+const ControlMaxSkew = time.Minute
+
+// Control request verification errors
+var (
+	ErrControlUnsigned     = errors.New("protocol: control request is not signed")
+	ErrControlBadSignature = errors.New("protocol: control request signature is invalid")
+	ErrControlStale        = errors.New("protocol: control request timestamp is outside the allowed window")
+)
+
+// ControlRequest is what the backend signs when it calls an agent
+type ControlRequest struct {
+	Method    string
+	Path      string
+	NodeID    uint
+	Timestamp int64
+	Nonce     string
+	Body      []byte
+}
+
+// SigningMessage is the exact byte string signed for a control request. The
+// node ID is part of it, so a request captured for one node cannot be sent
+// to another.
+func (r ControlRequest) SigningMessage() []byte {
+	sum := sha256.Sum256(r.Body)
+	return []byte(fmt.Sprintf("netly-control:v1\n%s\n%s\n%d\n%d\n%s\n%s",
+		r.Method, r.Path, r.NodeID, r.Timestamp, r.Nonce, hex.EncodeToString(sum[:])))
+}
+
+// VerifyControlRequest checks the signature and timestamp of a control
+// request. Replays inside the window are the caller's to reject by nonce.
+func VerifyControlRequest(pub ed25519.PublicKey, r ControlRequest, signature string, now time.Time) error {
+	if signature == "" || r.Nonce == "" || r.Timestamp == 0 {
+		return ErrControlUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, r.SigningMessage(), sig) {
+		return ErrControlBadSignature
+	}
+	skew := now.Sub(time.Unix(r.Timestamp, 0))
+	if skew > ControlMaxSkew || skew < -ControlMaxSkew {
+		return ErrControlStale
+	}
+	return nil
+}
+
+// AgentStatus is returned by the control API's status endpoint
+type AgentStatus struct {
+	NodeID          uint   `json:"node_id"`
+	Version         string `json:"version"`
+	ProtocolVersion int    `json:"protocol_version"`
+	Hostname        string `json:"hostname"`
+	StartedAt       int64  `json:"started_at"`
+	LastHeartbeat   int64  `json:"last_heartbeat,omitempty"`
+	CertNotAfter    int64  `json:"cert_not_after,omitempty"`
+	Destructing     bool   `json:"destructing,omitempty"`
+}
+
+// DiagnosticCheck is one local check run by the agent
+type DiagnosticCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// AgentDiagnostics is returned by the control API's diagnostics endpoint
+type AgentDiagnostics struct {
+	Timestamp int64             `json:"timestamp"`
+	Checks    []DiagnosticCheck `json:"checks"`
+}
+
+// Self-destruct stages, in the order the agent runs them
+const (
+	DestructAccepted        = "accepted"
+	DestructStoppingService = "stopping_services"
+	DestructCleaningNetwork = "cleaning_network"
+	DestructWipingFiles     = "wiping_files"
+	DestructRemovingAgent   = "removing_agent"
+)
+
+// DestructProgress reports one stage of a self-destruct
+type DestructProgress struct {
+	Stage     string `json:"stage"`
+	Error     string `json:"error,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
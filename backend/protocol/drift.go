@@ -0,0 +1,20 @@
+package protocol
+
+// ManagedFile is a file the agent wrote on the backend's behalf, as it is on
+// the node right now. Agents report them with heartbeats, every drift
+// interval, and with the result of the command that wrote them, so the
+// backend can tell a hand edit from its own.
+type ManagedFile struct {
+	Path string `json:"path"`
+	// Digest is the hex SHA-256 of the file's content; empty when the file
+	// is gone, e.g. after the command removed it
+	Digest string `json:"digest"`
+	// Unit is the systemd unit serving the file, if any, and UnitState its
+	// ActiveState/SubState
+	Unit      string `json:"unit,omitempty"`
+	UnitState string `json:"unit_state,omitempty"`
+	// Revision and Content are only set in command results: the revision
+	// the agent keeps of the file as the command left it, and its text
+	Revision string `json:"revision,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
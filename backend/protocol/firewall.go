@@ -0,0 +1,23 @@
+package protocol
+
+// Port protocols
+const (
+	PortTCP = "tcp"
+	PortUDP = "udp"
+)
+
+// PortOpening is an inbound port the node's firewall has to let through
+type PortOpening struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	// Owner names the tunnel or service listening on the port, e.g.
+	// "tunnel-12"
+	Owner string `json:"owner,omitempty"`
+}
+
+// FirewallSyncPayload is the payload of CMD_FIREWALL_SYNC. It lists every
+// port the node needs open; the agent allows exactly these in its own chain,
+// so ports missing from the list are closed again.
+type FirewallSyncPayload struct {
+	Openings []PortOpening `json:"openings"`
+}
@@ -0,0 +1,3 @@
+module github.com/netly/protocol
+
+go 1.22
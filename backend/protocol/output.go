@@ -0,0 +1,37 @@
+package protocol
+
+import "fmt"
+
+// CommandOutputPath is where an agent streams the output of a command while
+// it runs
+func CommandOutputPath(commandID string) string {
+	return fmt.Sprintf("/api/v1/agent/commands/%s/output", commandID)
+}
+
+// Output streams
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// OutputChunk is one piece of a running command's output. Seq starts at 1
+// and counts every chunk of the command; a gap means the agent had to drop
+// output it could not deliver.
+type OutputChunk struct {
+	Seq       int    `json:"seq"`
+	Stream    string `json:"stream"`
+	Data      string `json:"data"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// CommandOutput carries chunks in sequence order. The same chunk may be sent
+// more than once; the backend keeps the first copy.
+type CommandOutput struct {
+	Chunks []OutputChunk `json:"chunks"`
+}
+
+// CancelPayload is the payload of a CMD_CANCEL command. The agent stops the
+// target if it is running, or skips it if it has not started yet.
+type CancelPayload struct {
+	CommandID string `json:"command_id"`
+}
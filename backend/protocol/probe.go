@@ -0,0 +1,28 @@
+package protocol
+
+// ProbePayload is the payload of CMD_PROBE. The agent runs every probe once
+// and returns a ProbeReport as the command output.
+type ProbePayload struct {
+	Probes []ProbeSpec `json:"probes"`
+}
+
+// ProbeSpec is one on-demand probe
+type ProbeSpec struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Target is a host for icmp and wireguard probes, host:port for tcp
+	// and udp
+	Target string `json:"target"`
+	// Count is how many pings or attempts to make; zero leaves it to the
+	// agent
+	Count int `json:"count,omitempty"`
+	// Interface is the WireGuard interface a wireguard probe goes through
+	Interface string `json:"interface,omitempty"`
+}
+
+// ProbeReport is the output of CMD_PROBE, one result per probe in the
+// payload's order. A probe that failed is still a result; the command only
+// fails when the payload is invalid.
+type ProbeReport struct {
+	Results []ProbeResult `json:"results"`
+}
@@ -0,0 +1,274 @@
+// Package protocol defines the wire format shared by the Netly backend and
+// its agents. Both sides import these types directly, so any change here is
+// a change to the agent<->backend contract and must be reflected in the
+// golden files under testdata.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Version is the protocol version spoken by this build
+	Version = 1
+	// MinSupportedVersion is the oldest peer version this build accepts
+	MinSupportedVersion = 1
+)
+
+// Heartbeat response statuses
+const (
+	StatusOK                 = "ok"
+	StatusUnsupportedVersion = "unsupported_version"
+)
+
+var ErrUnsupportedVersion = errors.New("protocol: unsupported version")
+
+// Negotiate returns the version both sides should speak given the peer's
+// advertised version, or ErrUnsupportedVersion if the peer is too old.
+func Negotiate(peer int) (int, error) {
+	if peer < MinSupportedVersion {
+		return 0, fmt.Errorf("%w: peer speaks v%d, need at least v%d", ErrUnsupportedVersion, peer, MinSupportedVersion)
+	}
+	if peer < Version {
+		return peer, nil
+	}
+	return Version, nil
+}
+
+// Command is a unit of work delivered to an agent
+type Command struct {
+	ID        string          `json:"id"`
+	NodeID    uint            `json:"node_id,omitempty"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	Priority  int             `json:"priority"`
+	CreatedAt int64           `json:"created_at"`
+	// Attempt counts deliveries of this command; a higher attempt is a
+	// deliberate retry, the same attempt seen twice is a duplicate
+	Attempt int `json:"attempt,omitempty"`
+	// ExpiresAt is a unix timestamp after which the agent must not run the
+	// command; zero means it never expires
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// Timeout is how many seconds the command may run before the agent
+	// stops it; zero leaves it to the agent's own limits
+	Timeout int `json:"timeout,omitempty"`
+	// Signature is the base64 Ed25519 signature of CommandSigningMessage
+	Signature string `json:"signature,omitempty"`
+}
+
+// CommandResult is reported by the agent once a command has run
+type CommandResult struct {
+	Success   bool   `json:"success"`
+	Output    string `json:"output,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	// DryRun marks a result from an agent in dry-run mode. Nothing was
+	// changed on the node; Output is a DryRunReport.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Files are the managed files the command wrote or removed, as it left
+	// them
+	Files []ManagedFile `json:"files,omitempty"`
+}
+
+// Planned action kinds
+const (
+	ActionWriteFile   = "write_file"
+	ActionDeleteFile  = "delete_file"
+	ActionBackupFile  = "backup_file"
+	ActionRestoreFile = "restore_file"
+	ActionSystemctl   = "systemctl"
+	ActionScript      = "script"
+	ActionCommand     = "command"
+)
+
+// PlannedAction is one change a dry-run agent would have made
+type PlannedAction struct {
+	Kind string `json:"kind"`
+	// Target is the file path, systemd unit, script interpreter or program
+	Target string `json:"target"`
+	// Detail is the systemctl verb, the file mode or the program's arguments
+	Detail string `json:"detail,omitempty"`
+	// Content is the file content, script or the program's input
+	Content string `json:"content,omitempty"`
+}
+
+// DryRunReport is the output of a command run in dry-run mode: the actions
+// in the order they would have happened and the output the command would
+// have reported
+type DryRunReport struct {
+	Actions []PlannedAction `json:"actions"`
+	Output  string          `json:"output,omitempty"`
+}
+
+// SystemStats is the telemetry sample carried by every heartbeat
+type SystemStats struct {
+	CPUUsage    float64 `json:"cpu_usage"`
+	RAMUsage    float64 `json:"ram_usage"`
+	RAMTotal    uint64  `json:"ram_total"`
+	RAMUsed     uint64  `json:"ram_used"`
+	Uptime      uint64  `json:"uptime"`
+	NetworkRx   uint64  `json:"network_rx"`
+	NetworkTx   uint64  `json:"network_tx"`
+	Hostname    string  `json:"hostname"`
+	OS          string  `json:"os"`
+	Platform    string  `json:"platform"`
+	CollectedAt int64   `json:"collected_at"`
+
+	// NetworkRx and NetworkTx above are byte deltas since the previous
+	// sample, summed over all interfaces; the first sample after a start
+	// reports 0. The fields below break the node down further and are left
+	// out when they could not be read.
+	Load       *LoadAverage      `json:"load,omitempty"`
+	Disks      []DiskUsage       `json:"disks,omitempty"`
+	Interfaces []InterfaceStats  `json:"interfaces,omitempty"`
+	WireGuard  []WireGuardStatus `json:"wireguard,omitempty"`
+	TCP        *TCPStats         `json:"tcp,omitempty"`
+	// SingBoxRSS is the resident memory of the sing-box process in bytes
+	SingBoxRSS uint64 `json:"singbox_rss,omitempty"`
+	// Probes holds the latest result of every scheduled probe
+	Probes []ProbeResult `json:"probes,omitempty"`
+}
+
+type LoadAverage struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+type DiskUsage struct {
+	Mount       string  `json:"mount"`
+	Total       uint64  `json:"total"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// InterfaceStats carries an interface's byte counters and the rates derived
+// from the previous sample, in bytes per second
+type InterfaceStats struct {
+	Name    string `json:"name"`
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+	RxRate  uint64 `json:"rx_rate"`
+	TxRate  uint64 `json:"tx_rate"`
+}
+
+type TCPStats struct {
+	Established uint64 `json:"established"`
+	TimeWait    uint64 `json:"time_wait"`
+	InUse       uint64 `json:"in_use"`
+}
+
+type HeartbeatRequest struct {
+	ProtocolVersion int          `json:"protocol_version"`
+	AgentVersion    string       `json:"agent_version"`
+	Timestamp       int64        `json:"timestamp"`
+	Stats           *SystemStats `json:"stats"`
+	// Components is always sent, empty when the agent manages nothing, so
+	// the backend can tell it apart from an agent that does not report health
+	Components []ComponentHealth `json:"components"`
+	// Files lists every managed file. It is only sent every drift interval;
+	// heartbeats in between leave it out.
+	Files []ManagedFile `json:"files,omitempty"`
+}
+
+// Managed component kinds
+const (
+	ComponentService   = "service"
+	ComponentWireGuard = "wireguard"
+)
+
+// ComponentHealth is the state of one systemd unit the agent manages, with
+// the interface it brings up and the ports it listens on
+type ComponentHealth struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// State is the unit's ActiveState/SubState, e.g. "active/running"
+	State       string `json:"state"`
+	Active      bool   `json:"active"`
+	Interface   string `json:"interface,omitempty"`
+	InterfaceUp bool   `json:"interface_up,omitempty"`
+	ListenPorts []int  `json:"listen_ports,omitempty"`
+	// Detail is the tail of `systemctl status` when the unit is not active
+	Detail string `json:"detail,omitempty"`
+}
+
+// Healthy reports whether the unit is active and its interface, if it has
+// one, is up
+func (c ComponentHealth) Healthy() bool {
+	return c.Active && (c.Interface == "" || c.InterfaceUp)
+}
+
+// StatsBacklogPath is where an agent uploads stats samples it collected while
+// the backend was unreachable
+const StatsBacklogPath = "/api/v1/agent/stats"
+
+// StatsBacklog carries buffered samples, oldest first. They only extend the
+// node's history; the live stats come from heartbeats.
+type StatsBacklog struct {
+	Samples []SystemStats `json:"samples"`
+}
+
+type HeartbeatResponse struct {
+	Status          string        `json:"status"`
+	Message         string        `json:"message,omitempty"`
+	ProtocolVersion int           `json:"protocol_version"`
+	Commands        []Command     `json:"commands,omitempty"`
+	Config          *RemoteConfig `json:"config,omitempty"`
+}
+
+// RemoteConfig carries agent settings pushed by the backend. Unset fields
+// leave the agent's own agent.yaml value in force.
+type RemoteConfig struct {
+	// HeartbeatInterval is in seconds
+	HeartbeatInterval int `json:"heartbeat_interval,omitempty"`
+	// LogLevel is a zap level: debug, info, warn or error
+	LogLevel string `json:"log_level,omitempty"`
+	// EnabledCommands restricts the command types the agent runs
+	EnabledCommands []string        `json:"enabled_commands,omitempty"`
+	Probes          []ProbeSchedule `json:"probes,omitempty"`
+}
+
+// Probe types. An icmp probe pings a host, tcp and udp probes check a
+// host:port, and a wireguard probe pings the peer's tunnel address through an
+// interface and reads its last handshake.
+const (
+	ProbeICMP      = "icmp"
+	ProbeTCP       = "tcp"
+	ProbeUDP       = "udp"
+	ProbeWireGuard = "wireguard"
+)
+
+// ProbeSchedule asks the agent to probe a target every Interval seconds and
+// report the latest result in its stats
+type ProbeSchedule struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Target   string `json:"target"`
+	Interval int    `json:"interval"`
+}
+
+// ProbeResult is the outcome of one probe
+type ProbeResult struct {
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	Target    string  `json:"target"`
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	CheckedAt int64   `json:"checked_at"`
+
+	// Set by probes that make several attempts. LatencyMs is then the mean
+	// round trip and JitterMs the mean change between consecutive ones.
+	Sent        int     `json:"sent,omitempty"`
+	Received    int     `json:"received,omitempty"`
+	LossPercent float64 `json:"loss_percent,omitempty"`
+	JitterMs    float64 `json:"jitter_ms,omitempty"`
+	// Detail qualifies a result, e.g. a udp port that neither answered nor
+	// was refused
+	Detail string `json:"detail,omitempty"`
+	// HandshakeAge is how many seconds ago a wireguard probe's interface
+	// last completed a handshake; -1 if it never did
+	HandshakeAge int64 `json:"handshake_age,omitempty"`
+}
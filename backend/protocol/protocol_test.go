@@ -0,0 +1,462 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func TestNegotiate(t *testing.T) {
+	if v, err := Negotiate(Version); err != nil || v != Version {
+		t.Fatalf("Negotiate(%d) = %d, %v", Version, v, err)
+	}
+	if v, err := Negotiate(Version + 1); err != nil || v != Version {
+		t.Fatalf("newer peer should fall back to v%d, got %d, %v", Version, v, err)
+	}
+	if _, err := Negotiate(0); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("legacy peer should be rejected, got %v", err)
+	}
+}
+
+func TestUpdateSigningMessage(t *testing.T) {
+	got := string(UpdateSigningMessage("0.2.0", "arm64", "abc"))
+	if want := "netly-agent-update:v1:0.2.0:arm64:abc"; got != want {
+		t.Fatalf("UpdateSigningMessage = %q, want %q", got, want)
+	}
+}
+
+func TestNodeIdentity(t *testing.T) {
+	cert := &x509.Certificate{URIs: []*url.URL{NodeIdentityURI(42)}}
+	if id, ok := NodeIDFromCertificate(cert); !ok || id != 42 {
+		t.Fatalf("NodeIDFromCertificate = %d, %v", id, ok)
+	}
+	if IsBackendCertificate(cert) {
+		t.Fatal("node certificate must not identify as the backend")
+	}
+
+	backend, _ := url.Parse(BackendIdentityURI)
+	cert = &x509.Certificate{URIs: []*url.URL{backend}}
+	if _, ok := NodeIDFromCertificate(cert); ok {
+		t.Fatal("backend certificate must not carry a node ID")
+	}
+	if !IsBackendCertificate(cert) {
+		t.Fatal("backend certificate not recognised")
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	sign := func(cmd Command) Command {
+		cmd.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, CommandSigningMessage(cmd)))
+		return cmd
+	}
+
+	cmd := sign(Command{
+		ID:        "c1",
+		NodeID:    7,
+		Type:      "CMD_EXECUTE_SCRIPT",
+		Payload:   json.RawMessage(`{"script":"echo '<ok>' && true"}`),
+		CreatedAt: now.Unix(),
+		Attempt:   1,
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	})
+
+	// The signature must survive the JSON hop between backend and agent
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received Command
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCommand(pub, received, 7, now); err != nil {
+		t.Fatalf("valid command rejected: %v", err)
+	}
+
+	tampered := received
+	tampered.Payload = json.RawMessage(`{"script":"rm -rf /"}`)
+	if err := VerifyCommand(pub, tampered, 7, now); !errors.Is(err, ErrCommandBadSignature) {
+		t.Fatalf("tampered payload: got %v", err)
+	}
+
+	retimed := received
+	retimed.Timeout = 3600
+	if err := VerifyCommand(pub, retimed, 7, now); !errors.Is(err, ErrCommandBadSignature) {
+		t.Fatalf("changed timeout: got %v", err)
+	}
+
+	retargeted := received
+	retargeted.NodeID = 8
+	if err := VerifyCommand(pub, retargeted, 8, now); !errors.Is(err, ErrCommandBadSignature) {
+		t.Fatalf("retargeted command: got %v", err)
+	}
+	if err := VerifyCommand(pub, received, 8, now); !errors.Is(err, ErrCommandWrongNode) {
+		t.Fatalf("wrong node: got %v", err)
+	}
+	if err := VerifyCommand(pub, received, 7, now.Add(2*time.Hour)); !errors.Is(err, ErrCommandExpired) {
+		t.Fatalf("expired command: got %v", err)
+	}
+
+	unsigned := received
+	unsigned.Signature = ""
+	if err := VerifyCommand(pub, unsigned, 7, now); !errors.Is(err, ErrCommandUnsigned) {
+		t.Fatalf("unsigned command: got %v", err)
+	}
+}
+
+func TestNodeIDFromToken(t *testing.T) {
+	if id, ok := NodeIDFromToken("nly_42_c2VjcmV0_with_underscores"); !ok || id != 42 {
+		t.Fatalf("NodeIDFromToken = %d, %v", id, ok)
+	}
+	for _, bad := range []string{"node-token-42", "nly_42_", "nly_x_secret", "nly_0_secret"} {
+		if _, ok := NodeIDFromToken(bad); ok {
+			t.Fatalf("NodeIDFromToken(%q) accepted", bad)
+		}
+	}
+}
+
+func TestVerifyControlRequest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	req := ControlRequest{
+		Method:    "DELETE",
+		Path:      ControlSelfPath,
+		NodeID:    7,
+		Timestamp: now.Unix(),
+		Nonce:     "b64nonce",
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, req.SigningMessage()))
+
+	if err := VerifyControlRequest(pub, req, sig, now.Add(30*time.Second)); err != nil {
+		t.Fatalf("valid request rejected: %v", err)
+	}
+
+	retargeted := req
+	retargeted.NodeID = 8
+	if err := VerifyControlRequest(pub, retargeted, sig, now); !errors.Is(err, ErrControlBadSignature) {
+		t.Fatalf("retargeted request: got %v", err)
+	}
+	withBody := req
+	withBody.Body = []byte(`{}`)
+	if err := VerifyControlRequest(pub, withBody, sig, now); !errors.Is(err, ErrControlBadSignature) {
+		t.Fatalf("tampered body: got %v", err)
+	}
+	if err := VerifyControlRequest(pub, req, sig, now.Add(-2*time.Minute)); !errors.Is(err, ErrControlStale) {
+		t.Fatalf("request from the future: got %v", err)
+	}
+	if err := VerifyControlRequest(pub, req, sig, now.Add(2*time.Minute)); !errors.Is(err, ErrControlStale) {
+		t.Fatalf("stale request: got %v", err)
+	}
+	if err := VerifyControlRequest(pub, req, "", now); !errors.Is(err, ErrControlUnsigned) {
+		t.Fatalf("unsigned request: got %v", err)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	stats := &SystemStats{
+		CPUUsage:    12.5,
+		RAMUsage:    40.25,
+		RAMTotal:    2147483648,
+		RAMUsed:     864026624,
+		Uptime:      86400,
+		NetworkRx:   1024,
+		NetworkTx:   2048,
+		Hostname:    "edge-1",
+		OS:          "linux",
+		Platform:    "ubuntu",
+		CollectedAt: 1700000000,
+		Load:        &LoadAverage{Load1: 0.5, Load5: 0.25, Load15: 0.1},
+		Disks:       []DiskUsage{{Mount: "/", Total: 21474836480, Used: 5368709120, UsedPercent: 25}},
+		Interfaces: []InterfaceStats{
+			{Name: "eth0", RxBytes: 1048576, TxBytes: 2097152, RxRate: 1024, TxRate: 2048},
+		},
+		WireGuard: []WireGuardStatus{{
+			Interface: "wg0",
+			Active:    true,
+			Peers: []WireGuardPeerStatus{{
+				PublicKey:       "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+				Endpoint:        "203.0.113.10:51820",
+				LatestHandshake: 1699999990,
+				RxBytes:         4096,
+				TxBytes:         8192,
+			}},
+		}},
+		TCP:        &TCPStats{Established: 42, TimeWait: 7, InUse: 50},
+		SingBoxRSS: 33554432,
+		Probes: []ProbeResult{{
+			Name:      "exit-1",
+			Type:      ProbeTCP,
+			Target:    "203.0.113.10:443",
+			OK:        true,
+			LatencyMs: 12.5,
+			CheckedAt: 1699999995,
+		}},
+	}
+
+	cases := map[string]interface{}{
+		"heartbeat_request.json": HeartbeatRequest{
+			ProtocolVersion: 1,
+			AgentVersion:    "0.1.0",
+			Timestamp:       1700000000,
+			Stats:           stats,
+			Components: []ComponentHealth{
+				{
+					Name:        "sing-box",
+					Kind:        ComponentService,
+					State:       "active/running",
+					Active:      true,
+					ListenPorts: []int{443, 8443},
+				},
+				{
+					Name:        "wg-quick@wg0",
+					Kind:        ComponentWireGuard,
+					State:       "failed/failed",
+					Interface:   "wg0",
+					ListenPorts: []int{51820},
+					Detail:      "wg-quick@wg0.service: Failed with result 'exit-code'.",
+				},
+			},
+			Files: []ManagedFile{
+				{
+					Path:      "/etc/wireguard/wg0.conf",
+					Digest:    "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+					Unit:      "wg-quick@wg0",
+					UnitState: "failed/failed",
+				},
+			},
+		},
+		"heartbeat_response.json": HeartbeatResponse{
+			Status:          StatusOK,
+			ProtocolVersion: 1,
+			Commands: []Command{{
+				ID:        "5f0c8a4e-3f1b-4c1a-9d4e-2b7c9a1e6f10",
+				NodeID:    7,
+				Type:      "CMD_APPLY_CONFIG",
+				Payload:   json.RawMessage(`{"content":"{}","target_path":"/etc/sing-box/config.json"}`),
+				Priority:  10,
+				CreatedAt: 1700000000,
+				Attempt:   1,
+				ExpiresAt: 1700086400,
+				Signature: "c2lnbmF0dXJl",
+			}},
+			Config: &RemoteConfig{
+				HeartbeatInterval: 10,
+				LogLevel:          "info",
+				EnabledCommands:   []string{"CMD_SINGBOX_APPLY", "CMD_WG_APPLY_INTERFACE"},
+				Probes: []ProbeSchedule{
+					{Name: "exit-1", Type: ProbeTCP, Target: "203.0.113.10:443", Interval: 60},
+				},
+			},
+		},
+		"stream_command.json": StreamMessage{
+			Type: MessageCommand,
+			Command: &Command{
+				ID:        "5f0c8a4e-3f1b-4c1a-9d4e-2b7c9a1e6f10",
+				Type:      "CMD_RESTART_SERVICE",
+				Payload:   json.RawMessage(`{"name":"sing-box"}`),
+				CreatedAt: 1700000000,
+				Timeout:   60,
+			},
+		},
+		"stream_ack.json": StreamMessage{
+			Type:      MessageAck,
+			CommandID: "5f0c8a4e-3f1b-4c1a-9d4e-2b7c9a1e6f10",
+		},
+		"batch_payload.json": BatchPayload{
+			Steps: []BatchStep{
+				{
+					Type:    "CMD_EXECUTE_SCRIPT",
+					Payload: json.RawMessage(`{"interpreter":"sh","script":"sudo systemctl stop wg-quick@wg0 || true","services":["wg-quick@wg0"]}`),
+				},
+				{
+					Type:    "CMD_APPLY_CONFIG",
+					Payload: json.RawMessage(`{"content":"[Interface]","enable":true,"service_name":"wg-quick@wg0","target_path":"/etc/wireguard/wg0.conf"}`),
+				},
+			},
+		},
+		"update_agent_payload.json": UpdateAgentPayload{
+			Version: "0.2.0",
+			Artifacts: map[string]UpdateArtifact{
+				"amd64": {
+					URL:       "https://netly.example.com/downloads/netly-agent-amd64",
+					SHA256:    "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+					Signature: "c2lnbmF0dXJl",
+				},
+			},
+		},
+		"certificate_request.json": CertificateRequest{
+			CSR: "-----BEGIN CERTIFICATE REQUEST-----\nMIIB\n-----END CERTIFICATE REQUEST-----\n",
+		},
+		"certificate_response.json": CertificateResponse{
+			Certificate: "-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----\n",
+			CA:          "-----BEGIN CERTIFICATE-----\nMIID\n-----END CERTIFICATE-----\n",
+			NotAfter:    1707776000,
+		},
+		"wg_apply_payload.json": WireGuardApplyPayload{
+			Interface: "wg1",
+			Config: WireGuardConfig{
+				Interface: WireGuardInterface{
+					PrivateKey:  "YNqHbfBQKaGvzefSSBDhk0KaL8HtlxWd3mrqQhx8W1w=",
+					Address:     []string{"10.10.1.2/30"},
+					Table:       "off",
+					Forward:     true,
+					SourceRoute: &WireGuardSourceRoute{From: []string{"10.10.0.1/30"}},
+				},
+				Peers: []WireGuardPeer{{
+					PublicKey:           "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+					Endpoint:            "203.0.113.7:51820",
+					AllowedIPs:          []string{"0.0.0.0/0"},
+					PersistentKeepalive: 25,
+				}},
+			},
+		},
+		"wg_remove_payload.json": WireGuardRemovePayload{Interface: "wg0"},
+		"wg_status.json": WireGuardStatus{
+			Interface: "wg0",
+			Changed:   true,
+			Active:    true,
+			Peers: []WireGuardPeerStatus{{
+				PublicKey:       "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+				Endpoint:        "203.0.113.7:51820",
+				LatestHandshake: 1700000000,
+				RxBytes:         1024,
+				TxBytes:         2048,
+			}},
+		},
+		"singbox_apply_payload.json": SingBoxApplyPayload{
+			Key: "tunnel-12",
+			SingBoxFragment: SingBoxFragment{
+				Inbounds: []json.RawMessage{json.RawMessage(`{"type":"hysteria2","tag":"tunnel-12-in","listen":"::","listen_port":443}`)},
+			},
+		},
+		"agent_status.json": AgentStatus{
+			NodeID:          7,
+			Version:         "0.3.0",
+			ProtocolVersion: 1,
+			Hostname:        "edge-1",
+			StartedAt:       1700000000,
+			LastHeartbeat:   1700000300,
+			CertNotAfter:    1707776000,
+		},
+		"agent_diagnostics.json": AgentDiagnostics{
+			Timestamp: 1700000000,
+			Checks: []DiagnosticCheck{
+				{Name: "backend", OK: true, Detail: "last heartbeat 5s ago"},
+				{Name: "service:sing-box", OK: false, Detail: "inactive"},
+			},
+		},
+		"destruct_progress.json": DestructProgress{
+			Stage:     DestructWipingFiles,
+			Timestamp: 1700000000,
+		},
+		"stats_backlog.json": StatsBacklog{
+			Samples: []SystemStats{*stats},
+		},
+		"command_result.json": CommandResult{
+			Success:   false,
+			Output:    "partial output",
+			Error:     "exit status 1",
+			Timestamp: 1700000000,
+		},
+		"command_result_files.json": CommandResult{
+			Success:   true,
+			Output:    `{"interface":"wg0","changed":true,"active":true}`,
+			Timestamp: 1700000000,
+			Files: []ManagedFile{
+				{
+					Path:      "/etc/wireguard/wg0.conf",
+					Digest:    "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752",
+					Unit:      "wg-quick@wg0",
+					UnitState: "active/exited",
+					Revision:  "20231114T221320.000Z-60303ae2",
+					Content:   "[Interface]\nListenPort = 51820\n",
+				},
+				{Path: "/etc/wireguard/wg1.conf"},
+			},
+		},
+		"dry_run_report.json": DryRunReport{
+			Actions: []PlannedAction{
+				{Kind: ActionWriteFile, Target: "/etc/wireguard/wg0.conf", Detail: "0600", Content: "[Interface]\nListenPort = 51820\n"},
+				{Kind: ActionSystemctl, Target: "wg-quick@wg0", Detail: "enable"},
+				{Kind: ActionSystemctl, Target: "wg-quick@wg0", Detail: "restart"},
+			},
+			Output: `{"interface":"wg0","changed":true,"active":true}`,
+		},
+		"command_output.json": CommandOutput{
+			Chunks: []OutputChunk{
+				{Seq: 1, Stream: StreamStdout, Data: "Reading package lists...\n", Timestamp: 1700000000},
+				{Seq: 2, Stream: StreamStderr, Data: "W: some index files failed to download\n", Timestamp: 1700000001},
+			},
+		},
+		"cancel_payload.json": CancelPayload{CommandID: "5f0c8a4e-3f1b-4c1a-9d4e-2b7c9a1e6f10"},
+		"probe_payload.json": ProbePayload{
+			Probes: []ProbeSpec{
+				{Name: "hop1/icmp", Type: ProbeICMP, Target: "203.0.113.7", Count: 5},
+				{Name: "hop1/port", Type: ProbeUDP, Target: "203.0.113.7:51820"},
+				{Name: "hop1/tunnel", Type: ProbeWireGuard, Target: "10.8.0.1", Interface: "wg0"},
+			},
+		},
+		"probe_report.json": ProbeReport{
+			Results: []ProbeResult{
+				{Name: "hop1/icmp", Type: ProbeICMP, Target: "203.0.113.7", OK: true, LatencyMs: 41.2, CheckedAt: 1700000000, Sent: 5, Received: 5, JitterMs: 0.8},
+				{Name: "hop1/port", Type: ProbeUDP, Target: "203.0.113.7:51820", OK: true, CheckedAt: 1700000000, Detail: "no reply; open or filtered"},
+				{Name: "hop1/tunnel", Type: ProbeWireGuard, Target: "10.8.0.1", Error: "no reply", CheckedAt: 1700000000, Sent: 5, LossPercent: 100, HandshakeAge: 412},
+			},
+		},
+		"rollback_config_payload.json": RollbackConfigPayload{
+			Path:     "/etc/wireguard/wg0.conf",
+			Revision: "20231114T221320.000Z-60303ae2",
+			Service:  "wg-quick@wg0",
+		},
+		"firewall_sync_payload.json": FirewallSyncPayload{
+			Openings: []PortOpening{
+				{Port: 51820, Protocol: PortUDP, Owner: "tunnel-12"},
+				{Port: 443, Protocol: PortTCP, Owner: "service-3"},
+			},
+		},
+	}
+
+	for name, v := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			path := filepath.Join("testdata", name)
+			if *update {
+				if err := os.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("missing golden file (run with -update): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("wire format drifted from %s\n--- got\n%s\n--- want\n%s", path, got, want)
+			}
+		})
+	}
+}
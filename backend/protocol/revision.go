@@ -0,0 +1,9 @@
+package protocol
+
+// RollbackConfigPayload is the payload of CMD_ROLLBACK_CONFIG. The agent
+// writes back the revision it kept of the file and restarts Service, if any.
+type RollbackConfigPayload struct {
+	Path     string `json:"path"`
+	Revision string `json:"revision"`
+	Service  string `json:"service,omitempty"`
+}
@@ -0,0 +1,25 @@
+package protocol
+
+import "encoding/json"
+
+// SingBoxFragment is the part of the sing-box config that belongs to one
+// tunnel or service. Entries are raw sing-box JSON objects; every inbound and
+// outbound needs a tag that is unique on the node.
+type SingBoxFragment struct {
+	Inbounds  []json.RawMessage `json:"inbounds,omitempty"`
+	Outbounds []json.RawMessage `json:"outbounds,omitempty"`
+	Rules     []json.RawMessage `json:"rules,omitempty"`
+}
+
+// SingBoxApplyPayload is the payload of CMD_SINGBOX_APPLY. It replaces the
+// fragment the agent holds under Key; the agent then rebuilds the full
+// config from all fragments, checks it and reloads sing-box.
+type SingBoxApplyPayload struct {
+	Key string `json:"key"`
+	SingBoxFragment
+}
+
+// SingBoxRemovePayload is the payload of CMD_SINGBOX_REMOVE
+type SingBoxRemovePayload struct {
+	Key string `json:"key"`
+}
@@ -0,0 +1,24 @@
+package protocol
+
+// StreamPath is the WebSocket endpoint agents hold open to receive pushed
+// commands. Agents that cannot keep it open fall back to heartbeat polling.
+const StreamPath = "/api/v1/agent/stream"
+
+// ProtocolVersionHeader carries the agent's protocol version on the stream
+// upgrade request, since there is no JSON body to put it in.
+const ProtocolVersionHeader = "X-Netly-Protocol-Version"
+
+// Stream message types
+const (
+	// MessageCommand is sent by the backend to push a command to the agent
+	MessageCommand = "command"
+	// MessageAck is sent by the agent once a pushed command has been received
+	MessageAck = "ack"
+)
+
+// StreamMessage is the envelope for every frame on the agent stream
+type StreamMessage struct {
+	Type      string   `json:"type"`
+	Command   *Command `json:"command,omitempty"`
+	CommandID string   `json:"command_id,omitempty"`
+}
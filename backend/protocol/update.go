@@ -0,0 +1,25 @@
+package protocol
+
+import "fmt"
+
+// UpdateAgentPayload is the payload of a CMD_UPDATE_AGENT command. It lists
+// one artifact per architecture; the agent picks its own.
+type UpdateAgentPayload struct {
+	Version   string                    `json:"version"`
+	Artifacts map[string]UpdateArtifact `json:"artifacts"`
+}
+
+// UpdateArtifact describes a downloadable agent binary
+type UpdateArtifact struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	// Signature is the base64 Ed25519 signature of UpdateSigningMessage
+	Signature string `json:"signature"`
+}
+
+// UpdateSigningMessage is the exact byte string the backend signs for an
+// artifact, binding the checksum to its version and architecture so a valid
+// signature cannot be replayed for another build.
+func UpdateSigningMessage(version, arch, sha256Hex string) []byte {
+	return []byte(fmt.Sprintf("netly-agent-update:v1:%s:%s:%s", version, arch, sha256Hex))
+}
@@ -0,0 +1,69 @@
+package protocol
+
+// WireGuardApplyPayload is the payload of CMD_WG_APPLY_INTERFACE. The agent
+// renders the wg-quick file for Interface from Config itself, so no shell
+// travels with the command.
+type WireGuardApplyPayload struct {
+	Interface string          `json:"interface"`
+	Config    WireGuardConfig `json:"config"`
+}
+
+// WireGuardRemovePayload is the payload of CMD_WG_REMOVE_INTERFACE
+type WireGuardRemovePayload struct {
+	Interface string `json:"interface"`
+}
+
+// WireGuardConfig describes one WireGuard interface and its peers
+type WireGuardConfig struct {
+	Interface WireGuardInterface `json:"interface"`
+	Peers     []WireGuardPeer    `json:"peers"`
+}
+
+type WireGuardInterface struct {
+	PrivateKey string   `json:"private_key"`
+	Address    []string `json:"address"`
+	ListenPort int      `json:"listen_port,omitempty"`
+	MTU        int      `json:"mtu,omitempty"`
+	DNS        []string `json:"dns,omitempty"`
+
+	// Table is wg-quick's Table setting; "off" keeps AllowedIPs out of the
+	// routing table
+	Table string `json:"table,omitempty"`
+	// Forward accepts forwarded traffic arriving on the interface
+	Forward bool `json:"forward,omitempty"`
+	// Masquerade NATs forwarded traffic leaving through the default route
+	Masquerade bool `json:"masquerade,omitempty"`
+	// SourceRoute sends traffic from the given prefixes out of this
+	// interface through its own routing table
+	SourceRoute *WireGuardSourceRoute `json:"source_route,omitempty"`
+}
+
+type WireGuardSourceRoute struct {
+	From []string `json:"from"`
+}
+
+type WireGuardPeer struct {
+	PublicKey           string   `json:"public_key"`
+	PresharedKey        string   `json:"preshared_key,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+}
+
+// WireGuardStatus is the output of a WireGuard command: what the agent did
+// and the handshake state of every peer afterwards
+type WireGuardStatus struct {
+	Interface string                `json:"interface"`
+	Changed   bool                  `json:"changed"`
+	Active    bool                  `json:"active"`
+	Peers     []WireGuardPeerStatus `json:"peers,omitempty"`
+}
+
+type WireGuardPeerStatus struct {
+	PublicKey string `json:"public_key"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	// LatestHandshake is a Unix timestamp, 0 if the peer never completed one
+	LatestHandshake int64  `json:"latest_handshake"`
+	RxBytes         uint64 `json:"rx_bytes"`
+	TxBytes         uint64 `json:"tx_bytes"`
+}
@@ -10,7 +10,8 @@ interface InstallCommandModalProps {
 interface CommandResponse {
   command: string
   api_url: string
-  token: string
+  token?: string
+  token_issued?: boolean
 }
 
 export default function InstallCommandModal({ nodeId, isOpen, onClose }: InstallCommandModalProps) {
@@ -19,13 +20,17 @@ export default function InstallCommandModal({ nodeId, isOpen, onClose }: Install
   const [error, setError] = useState<string | null>(null)
   const [copied, setCopied] = useState(false)
 
-  const fetchCommand = () => {
+  // GET only previews the command; POST issues a token, which revokes the
+  // one a running agent uses, so it only happens when asked for
+  const fetchCommand = (issueToken: boolean) => {
     if (!nodeId) return
     
     setLoading(true)
     setError(null)
     
-    fetch(`http://localhost:8081/api/v1/nodes/${nodeId}/command`, {
+    const path = issueToken ? 'agent-token' : 'command'
+    fetch(`http://localhost:8081/api/v1/nodes/${nodeId}/${path}`, {
+      method: issueToken ? 'POST' : 'GET',
       headers: {
         'X-Admin-Token': 'change-me-admin'
       }
@@ -49,7 +54,7 @@ export default function InstallCommandModal({ nodeId, isOpen, onClose }: Install
 
   useEffect(() => {
     if (isOpen && nodeId) {
-      fetchCommand()
+      fetchCommand(false)
     }
   }, [isOpen, nodeId])
 
@@ -94,7 +99,7 @@ export default function InstallCommandModal({ nodeId, isOpen, onClose }: Install
           <div className="p-3 bg-red-500/20 rounded-lg border border-red-500/50 mb-4">
             <p className="text-sm text-red-200 mb-3">Error: {error}</p>
             <button 
-              onClick={fetchCommand}
+              onClick={() => fetchCommand(false)}
               className="px-3 py-1 bg-blue-500/20 border border-blue-500 text-blue-400 rounded hover:bg-blue-500/30 text-sm"
             >
               Retry
@@ -126,9 +131,25 @@ export default function InstallCommandModal({ nodeId, isOpen, onClose }: Install
                 <span className="font-medium">API URL:</span> {command.api_url}
               </div>
               <div>
-                <span className="font-medium">Token:</span> {command.token}
+                <span className="font-medium">Token:</span> {command.token ?? 'not generated'}
               </div>
             </div>
+
+            {!command.token && (
+              <div className="space-y-2">
+                {command.token_issued && (
+                  <p className="text-xs text-yellow-200">
+                    This node already has a token. Generating a new one disconnects the running agent until it is reinstalled.
+                  </p>
+                )}
+                <button
+                  onClick={() => fetchCommand(true)}
+                  className="px-3 py-1 bg-blue-500/20 border border-blue-500 text-blue-400 rounded hover:bg-blue-500/30 text-sm"
+                >
+                  Generate token
+                </button>
+              </div>
+            )}
           </div>
         )}
 
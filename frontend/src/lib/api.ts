@@ -76,8 +76,9 @@ class ApiClient {
     return this.request(`/tasks/${taskId}`)
   }
 
+  // Issues a new agent token, revoking the node's current one
   async getInstallCommand(nodeId: string) {
-    return this.request<{ command: string }>(`/nodes/${nodeId}/command`)
+    return this.request<{ command: string; token: string }>(`/nodes/${nodeId}/agent-token`, { method: 'POST' })
   }
 
   // Tunnels